@@ -3,32 +3,142 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
+	"fmt"
 	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"telemetry-agent/internal/agent"
+	"telemetry-agent/internal/filewatch"
 )
 
 func main() {
-	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo}))
-
-	cfg, err := agent.LoadConfig()
+	cfg, opts, err := agent.LoadConfig(os.Args[1:])
 	if err != nil {
-		logger.Error("load configuration", "error", err)
-		os.Exit(1)
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	// Keep standard output free for samples when it carries them.
+	logOut := os.Stdout
+	if opts.Once || cfg.Output == agent.OutputStdout {
+		logOut = os.Stderr
+	}
+	logger := slog.New(slog.NewTextHandler(logOut, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	if opts.PrintConfig {
+		if err := cfg.WriteYAML(os.Stdout); err != nil {
+			logger.Error("print configuration", "error", err)
+			os.Exit(1)
+		}
+		return
 	}
 
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
-	logger.Info("starting telemetry agent", "server", cfg.ServerAddr, "interval", cfg.Interval)
+	if opts.Once {
+		os.Exit(sampleOnce(ctx, logger, cfg, opts.Format))
+	}
+
+	logger.Info("starting telemetry agent", "output", cfg.Output, "servers", cfg.ServerAddrs, "interval", cfg.Interval, "config", opts.ConfigPath)
 
-	sampler := agent.NewSampler()
+	sampler := agent.NewSampler(cfg.Collectors)
 	runner := agent.NewRunner(cfg, logger, sampler)
 
+	if cfg.HealthAddr != "" {
+		healthServer := &http.Server{Addr: cfg.HealthAddr, Handler: agent.NewHealthHandler(runner)}
+		go func() {
+			logger.Info("health endpoint listening", "addr", cfg.HealthAddr)
+			if err := healthServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Error("health endpoint failed", "error", err)
+			}
+		}()
+		go func() {
+			<-ctx.Done()
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_ = healthServer.Shutdown(shutdownCtx)
+		}()
+	}
+
+	reload := make(chan string, 1)
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+	go func() {
+		for range hangup {
+			trigger(reload, "SIGHUP")
+		}
+	}()
+	if opts.ConfigPath != "" && opts.WatchConfig > 0 {
+		go filewatch.Watch(ctx, opts.WatchConfig, func() { trigger(reload, "file change") }, opts.ConfigPath)
+	}
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case reason := <-reload:
+				reloadConfig(ctx, logger, runner, cfg, reason)
+			}
+		}
+	}()
+
 	if err := runner.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
 		logger.Error("agent terminated", "error", err)
 	}
 }
+
+// sampleOnce prints a single sample to standard output and returns the exit status.
+func sampleOnce(ctx context.Context, logger *slog.Logger, cfg agent.Config, format string) int {
+	metric, err := agent.SampleOnce(ctx, cfg)
+	if err != nil {
+		var partial *agent.PartialSampleError
+		if !errors.As(err, &partial) {
+			logger.Error("sample metrics failed", "error", err)
+			return 1
+		}
+		logger.Warn("sample metrics incomplete", "error", partial.Err)
+	}
+	if err := agent.WriteMetric(os.Stdout, metric, format); err != nil {
+		logger.Error("print sample", "error", err)
+		return 1
+	}
+	return 0
+}
+
+func trigger(reload chan<- string, reason string) {
+	select {
+	case reload <- reason:
+	default:
+	}
+}
+
+// reloadConfig re-reads the configuration from the same flags, environment and file and
+// applies it to the running agent, keeping the current settings when anything is wrong.
+func reloadConfig(ctx context.Context, logger *slog.Logger, runner *agent.Runner, initial agent.Config, reason string) {
+	logger.Info("reloading configuration", "trigger", reason)
+
+	cfg, _, err := agent.LoadConfig(os.Args[1:])
+	if err != nil {
+		logger.Error("configuration reload rejected, keeping current settings", "error", err)
+		return
+	}
+	if err := runner.Apply(ctx, cfg); err != nil {
+		logger.Error("configuration reload rolled back", "error", err)
+		return
+	}
+	if cfg.HealthAddr != initial.HealthAddr {
+		logger.Warn("health endpoint address changes take effect after a restart", "addr", initial.HealthAddr)
+	}
+
+	logger.Info("configuration reloaded", "servers", cfg.ServerAddrs, "interval", cfg.Interval, "collectors", cfg.Collectors)
+}
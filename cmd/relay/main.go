@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+
+	"telemetry-agent/internal/relay"
+	"telemetry-agent/internal/server"
+	"telemetry-agent/pkg/api"
+)
+
+func main() {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	cfg, err := relay.LoadConfig()
+	if err != nil {
+		logger.Error("load configuration", "error", err)
+		os.Exit(1)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	spool, err := relay.OpenSpool(cfg.SpoolDir, cfg.SpoolMaxBytes, cfg.SpoolSync == 0, logger)
+	if err != nil {
+		logger.Error("open spool", "error", err)
+		os.Exit(1)
+	}
+	defer func() {
+		if err := spool.Close(); err != nil {
+			logger.Error("close spool", "error", err)
+		}
+	}()
+
+	certs, err := server.NewCertReloader(server.Config{
+		TLSCertPath:  cfg.TLSCertPath,
+		TLSKeyPath:   cfg.TLSKeyPath,
+		ClientCAPath: cfg.ClientCAPath,
+	}, logger)
+	if err != nil {
+		logger.Error("load relay credentials", "error", err)
+		os.Exit(1)
+	}
+
+	rly := relay.New(cfg, spool, logger)
+	grpcServer := grpc.NewServer(
+		grpc.Creds(credentials.NewTLS(certs.TLSConfig())),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             10 * time.Second,
+			PermitWithoutStream: true,
+		}),
+	)
+	api.RegisterTelemetryServer(grpcServer, rly)
+
+	eg, egCtx := errgroup.WithContext(ctx)
+
+	eg.Go(func() error {
+		return rly.Run(egCtx)
+	})
+
+	eg.Go(func() error {
+		certs.Watch(egCtx, 30*time.Second)
+		return nil
+	})
+
+	eg.Go(func() error {
+		listener, err := net.Listen("tcp", cfg.GRPCAddr)
+		if err != nil {
+			return err
+		}
+		logger.Info("relay listening", "addr", cfg.GRPCAddr, "upstream", cfg.UpstreamAddrs, "spooled", spool.Len())
+		return grpcServer.Serve(listener)
+	})
+
+	eg.Go(func() error {
+		<-egCtx.Done()
+		logger.Info("shutdown initiated")
+		// Agents keep their streams open, so a graceful stop would never finish; what
+		// they sent so far is spooled and they reconnect once the relay is back.
+		grpcServer.Stop()
+		return nil
+	})
+
+	if err := eg.Wait(); err != nil && !errors.Is(err, context.Canceled) {
+		logger.Error("relay terminated", "error", err)
+		os.Exit(1)
+	}
+
+	logger.Info("relay shutdown complete")
+}
@@ -29,33 +29,94 @@ func main() {
 		os.Exit(1)
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrate(cfg, os.Args[2:]))
+	}
+
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
-	pgStore, err := storage.NewPostgresStore(ctx, cfg.PostgresDSN)
+	store, err := openStore(ctx, cfg, logger)
 	if err != nil {
-		logger.Error("connect postgres", "error", err)
+		logger.Error("open storage", "backend", cfg.Storage, "error", err)
 		os.Exit(1)
 	}
-	defer pgStore.Close()
+	defer store.Close()
+	if cfg.Storage == server.StorageMemory {
+		logger.Warn("using in-memory storage; samples, policies and tokens are lost on restart", "records_per_agent", cfg.MemoryRecords)
+	}
+	// Samples without a partition pile up in the default one, so create the upcoming
+	// ones before accepting any instead of waiting for the first maintenance run.
+	if maintainer, ok := store.(storage.Maintainer); ok {
+		if err := server.PreparePartitions(ctx, maintainer, cfg.Maintenance, time.Now(), logger); err != nil {
+			logger.Error("create partitions", "error", err)
+			os.Exit(1)
+		}
+	}
 
-	creds, err := loadServerCredentials(cfg)
+	certs, err := server.NewCertReloader(cfg, logger)
 	if err != nil {
 		logger.Error("load server credentials", "error", err)
 		os.Exit(1)
 	}
-
-	grpcServer := grpc.NewServer(grpc.Creds(creds))
-	telemetrySvc := server.NewTelemetryService(pgStore, logger)
+	creds := credentials.NewTLS(certs.TLSConfig())
+
+	ingester := server.NewIngester(store, cfg.Ingest, logger)
+	telemetrySvc := server.NewTelemetryService(store, ingester, logger, server.AuthConfig{
+		Identities:   cfg.AgentIdentities,
+		RequireToken: cfg.RequireToken,
+		TokenTTL:     cfg.AgentTokenTTL,
+	}, cfg.Rates)
+	grpcOpts := append(cfg.GRPCOptions(), grpc.Creds(creds), grpc.StreamInterceptor(telemetrySvc.StreamAuthInterceptor()))
+	grpcServer := grpc.NewServer(grpcOpts...)
 	api.RegisterTelemetryServer(grpcServer, telemetrySvc)
 
+	if err := telemetrySvc.ReloadPolicies(ctx); err != nil {
+		logger.Error("load agent policies", "error", err)
+		os.Exit(1)
+	}
+
 	httpServer := &http.Server{
 		Addr:    cfg.HTTPAddr,
-		Handler: server.NewHTTPHandler(pgStore, logger),
+		Handler: server.NewHTTPHandler(store, telemetrySvc, logger),
+	}
+	var adminServer *http.Server
+	if cfg.AdminToken != "" {
+		adminServer = &http.Server{
+			Addr:      cfg.AdminAddr,
+			Handler:   server.NewAdminHandler(store, telemetrySvc, cfg.AdminToken, logger),
+			TLSConfig: certs.AdminTLSConfig(),
+		}
+	} else {
+		logger.Info("admin API disabled; set TELEMETRY_SERVER_ADMIN_TOKEN to manage tokens and policies")
 	}
 
 	eg, egCtx := errgroup.WithContext(ctx)
 
+	eg.Go(func() error {
+		ingester.Run(egCtx)
+		return nil
+	})
+
+	if pruner, ok := store.(storage.Pruner); ok {
+		eg.Go(func() error {
+			server.RunMaintenance(egCtx, pruner, cfg.Maintenance, logger)
+			return nil
+		})
+	}
+
+	eg.Go(func() error {
+		telemetrySvc.WatchPolicies(egCtx, cfg.PolicyRefresh)
+		return nil
+	})
+
+	if cfg.TLSReload > 0 {
+		eg.Go(func() error {
+			certs.Watch(egCtx, cfg.TLSReload)
+			return nil
+		})
+	}
+
 	eg.Go(func() error {
 		listener, err := net.Listen("tcp", cfg.GRPCAddr)
 		if err != nil {
@@ -73,12 +134,25 @@ func main() {
 		return nil
 	})
 
+	if adminServer != nil {
+		eg.Go(func() error {
+			logger.Info("admin server listening", "addr", cfg.AdminAddr)
+			if err := adminServer.ListenAndServeTLS("", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				return err
+			}
+			return nil
+		})
+	}
+
 	eg.Go(func() error {
 		<-egCtx.Done()
 		logger.Info("shutdown initiated")
 		grpcServer.GracefulStop()
 		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
+		if adminServer != nil {
+			adminServer.Shutdown(shutdownCtx)
+		}
 		return httpServer.Shutdown(shutdownCtx)
 	})
 
@@ -90,6 +164,39 @@ func main() {
 	logger.Info("server shutdown complete")
 }
 
-func loadServerCredentials(cfg server.Config) (credentials.TransportCredentials, error) {
-	return credentials.NewServerTLSFromFile(cfg.TLSCertPath, cfg.TLSKeyPath)
+// openStore connects the storage backend selected by cfg. PostgreSQL schema migrations
+// are applied first, or only checked when automatic migration is disabled.
+func openStore(ctx context.Context, cfg server.Config, logger *slog.Logger) (storage.Store, error) {
+	switch cfg.Storage {
+	case server.StorageMemory:
+		return storage.NewMemoryStore(cfg.MemoryRecords), nil
+	case server.StorageBolt:
+		return storage.NewBoltStore(cfg.BoltPath)
+	}
+
+	pgStore, err := storage.NewPostgresStore(ctx, cfg.PostgresDSN)
+	if err != nil {
+		return nil, err
+	}
+	if !cfg.AutoMigrate {
+		if err := pgStore.CheckSchema(ctx); err != nil {
+			pgStore.Close()
+			return nil, err
+		}
+		return pgStore, nil
+	}
+
+	latest, err := storage.LatestSchemaVersion()
+	if err == nil {
+		var ran []storage.Migration
+		ran, err = pgStore.Migrate(ctx, latest)
+		for _, m := range ran {
+			logger.Info("applied schema migration", "version", m.Version, "name", m.Name)
+		}
+	}
+	if err != nil {
+		pgStore.Close()
+		return nil, err
+	}
+	return pgStore, nil
 }
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"telemetry-agent/internal/server"
+	"telemetry-agent/internal/server/storage"
+)
+
+const migrateUsage = `usage: server migrate <command>
+
+Manages the PostgreSQL schema at TELEMETRY_SERVER_POSTGRES_DSN.
+
+commands:
+  status        list migrations and whether they are applied
+  up            apply every pending migration
+  down          revert the most recently applied migration
+  to <version>  apply or revert migrations until the schema is at version
+`
+
+// runMigrate implements the migrate subcommand and returns the process exit code.
+func runMigrate(cfg server.Config, args []string) int {
+	if len(args) == 0 || (args[0] == "to") != (len(args) == 2) || len(args) > 2 {
+		fmt.Fprint(os.Stderr, migrateUsage)
+		return 2
+	}
+	if cfg.Storage != server.StoragePostgres {
+		fmt.Fprintf(os.Stderr, "migrate: TELEMETRY_SERVER_STORAGE is %q; only %q has a versioned schema\n", cfg.Storage, server.StoragePostgres)
+		return 1
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	store, err := storage.NewPostgresStore(ctx, cfg.PostgresDSN)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migrate: %v\n", err)
+		return 1
+	}
+	defer store.Close()
+
+	if err := migrate(ctx, store, args); err != nil {
+		fmt.Fprintf(os.Stderr, "migrate: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func migrate(ctx context.Context, store *storage.PostgresStore, args []string) error {
+	states, err := store.MigrationStatus(ctx)
+	if err != nil {
+		return err
+	}
+
+	var target int
+	switch args[0] {
+	case "status":
+		printMigrationStatus(states)
+		return nil
+	case "up":
+		if target, err = storage.LatestSchemaVersion(); err != nil {
+			return err
+		}
+	case "down":
+		// Step back to the applied version below the newest one.
+		var applied []int
+		for _, state := range states {
+			if state.AppliedAt != nil {
+				applied = append(applied, state.Version)
+			}
+		}
+		if len(applied) == 0 {
+			return fmt.Errorf("no migration is applied")
+		}
+		if len(applied) > 1 {
+			target = applied[len(applied)-2]
+		}
+	case "to":
+		if target, err = strconv.Atoi(args[1]); err != nil || target < 0 {
+			return fmt.Errorf("version %q is not a non-negative integer", args[1])
+		}
+	default:
+		return fmt.Errorf("unknown command %q\n\n%s", args[0], migrateUsage)
+	}
+
+	ran, err := store.Migrate(ctx, target)
+	for _, m := range ran {
+		fmt.Printf("migrated %04d_%s\n", m.Version, m.Name)
+	}
+	if err != nil {
+		return err
+	}
+	if len(ran) == 0 {
+		fmt.Println("schema already at the requested version")
+	}
+	return nil
+}
+
+func printMigrationStatus(states []storage.MigrationState) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+	for _, state := range states {
+		name, applied := state.Name, "pending"
+		if state.Unknown {
+			name = "(unknown to this server)"
+		}
+		if state.AppliedAt != nil {
+			applied = state.AppliedAt.Local().Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%04d\t%s\t%s\n", state.Version, name, applied)
+	}
+	w.Flush()
+}
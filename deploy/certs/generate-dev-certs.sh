@@ -1,8 +1,15 @@
 #!/bin/sh
 set -euo pipefail
 
+# Usage: generate-dev-certs.sh [agent-id ...]
+#
+# Creates a development CA and server certificate, plus one client certificate per agent
+# ID (default: agent-local agent-a agent-b) for mutual TLS. Re-running with an existing CA
+# only adds the client certificates that are missing.
+
 CERT_DIR="$(cd "$(dirname "$0")" && pwd)/dev"
-mkdir -p "$CERT_DIR"
+CLIENT_DIR="$CERT_DIR/clients"
+mkdir -p "$CERT_DIR" "$CLIENT_DIR"
 
 CA_KEY="$CERT_DIR/ca-key.pem"
 CA_CERT="$CERT_DIR/ca.pem"
@@ -10,6 +17,12 @@ SERVER_KEY="$CERT_DIR/server-key.pem"
 SERVER_CSR="$CERT_DIR/server.csr"
 SERVER_CERT="$CERT_DIR/server.pem"
 
+if [ "$#" -gt 0 ]; then
+  AGENT_IDS="$*"
+else
+  AGENT_IDS="agent-local agent-a agent-b"
+fi
+
 if command -v openssl >/dev/null 2>&1; then
   :
 else
@@ -17,54 +30,98 @@ else
   exit 1
 fi
 
-if [ -f "$CA_CERT" ] || [ -f "$SERVER_CERT" ]; then
-  echo "Existing certificates detected in $CERT_DIR" >&2
+EXT_FILE=$(mktemp)
+trap 'rm -f "$EXT_FILE" "$CERT_DIR"/*.csr "$CLIENT_DIR"/*.csr "$CERT_DIR"/ca.srl' EXIT INT TERM
+
+if [ -f "$CA_CERT" ] && [ -f "$SERVER_CERT" ]; then
+  echo "Reusing existing CA and server certificate in $CERT_DIR" >&2
+elif [ -f "$CA_CERT" ] || [ -f "$SERVER_CERT" ]; then
+  echo "Incomplete certificates detected in $CERT_DIR" >&2
   echo "Move or delete them before regenerating." >&2
   exit 1
+else
+  echo "Generating development CA (for local testing only)" >&2
+  openssl req \
+    -x509 \
+    -nodes \
+    -newkey rsa:4096 \
+    -keyout "$CA_KEY" \
+    -out "$CA_CERT" \
+    -days 3650 \
+    -subj "/CN=TelemetryX Dev CA" \
+    -sha256
+
+  echo "subjectAltName = DNS:localhost,IP:127.0.0.1" > "$EXT_FILE"
+  echo "extendedKeyUsage = serverAuth" >> "$EXT_FILE"
+  echo "basicConstraints = CA:FALSE" >> "$EXT_FILE"
+  echo "subjectKeyIdentifier = hash" >> "$EXT_FILE"
+  echo "authorityKeyIdentifier = keyid,issuer" >> "$EXT_FILE"
+
+  echo "Generating server key and CSR" >&2
+  openssl req \
+    -nodes \
+    -newkey rsa:4096 \
+    -keyout "$SERVER_KEY" \
+    -out "$SERVER_CSR" \
+    -subj "/CN=telemetryx-dev" \
+    -sha256
+
+  echo "Signing server certificate using the development CA" >&2
+  openssl x509 \
+    -req \
+    -in "$SERVER_CSR" \
+    -CA "$CA_CERT" \
+    -CAkey "$CA_KEY" \
+    -CAcreateserial \
+    -out "$SERVER_CERT" \
+    -days 825 \
+    -sha256 \
+    -extfile "$EXT_FILE"
+fi
+
+if [ ! -f "$CA_KEY" ]; then
+  echo "CA key $CA_KEY not found; cannot sign client certificates" >&2
+  exit 1
 fi
 
-echo "Generating development CA (for local testing only)" >&2
-openssl req \
-  -x509 \
-  -nodes \
-  -newkey rsa:4096 \
-  -keyout "$CA_KEY" \
-  -out "$CA_CERT" \
-  -days 3650 \
-  -subj "/CN=TelemetryX Dev CA" \
-  -sha256
-
-SAN_FILE=$(mktemp)
-trap 'rm -f "$SAN_FILE" "$SERVER_CSR" "$CERT_DIR"/ca.srl' EXIT INT TERM
-
-echo "subjectAltName = DNS:localhost,IP:127.0.0.1" > "$SAN_FILE"
-echo "extendedKeyUsage = serverAuth" >> "$SAN_FILE"
-echo "basicConstraints = CA:FALSE" >> "$SAN_FILE"
-echo "subjectKeyIdentifier = hash" >> "$SAN_FILE"
-echo "authorityKeyIdentifier = keyid,issuer" >> "$SAN_FILE"
-
-echo "Generating server key and CSR" >&2
-openssl req \
-  -nodes \
-  -newkey rsa:4096 \
-  -keyout "$SERVER_KEY" \
-  -out "$SERVER_CSR" \
-  -subj "/CN=telemetryx-dev" \
-  -sha256
-
-echo "Signing server certificate using the development CA" >&2
-openssl x509 \
-  -req \
-  -in "$SERVER_CSR" \
-  -CA "$CA_CERT" \
-  -CAkey "$CA_KEY" \
-  -CAcreateserial \
-  -out "$SERVER_CERT" \
-  -days 825 \
-  -sha256 \
-  -extfile "$SAN_FILE"
-
-rm -f "$SAN_FILE" "$SERVER_CSR" "$CERT_DIR"/ca.srl
+for AGENT_ID in $AGENT_IDS; do
+  CLIENT_KEY="$CLIENT_DIR/$AGENT_ID-key.pem"
+  CLIENT_CSR="$CLIENT_DIR/$AGENT_ID.csr"
+  CLIENT_CERT="$CLIENT_DIR/$AGENT_ID.pem"
+  if [ -f "$CLIENT_CERT" ]; then
+    echo "Client certificate for $AGENT_ID already exists, skipping" >&2
+    continue
+  fi
+
+  # The agent ID is both the CN and a DNS SAN; the server binds samples to either.
+  echo "subjectAltName = DNS:$AGENT_ID" > "$EXT_FILE"
+  echo "extendedKeyUsage = clientAuth" >> "$EXT_FILE"
+  echo "basicConstraints = CA:FALSE" >> "$EXT_FILE"
+  echo "subjectKeyIdentifier = hash" >> "$EXT_FILE"
+  echo "authorityKeyIdentifier = keyid,issuer" >> "$EXT_FILE"
+
+  echo "Generating client certificate for $AGENT_ID" >&2
+  openssl req \
+    -nodes \
+    -newkey rsa:2048 \
+    -keyout "$CLIENT_KEY" \
+    -out "$CLIENT_CSR" \
+    -subj "/CN=$AGENT_ID" \
+    -sha256
+
+  openssl x509 \
+    -req \
+    -in "$CLIENT_CSR" \
+    -CA "$CA_CERT" \
+    -CAkey "$CA_KEY" \
+    -CAcreateserial \
+    -out "$CLIENT_CERT" \
+    -days 825 \
+    -sha256 \
+    -extfile "$EXT_FILE"
+done
+
+rm -f "$EXT_FILE" "$CERT_DIR"/*.csr "$CLIENT_DIR"/*.csr "$CERT_DIR"/ca.srl
 trap - EXIT INT TERM
 
 echo "Generated:" >&2
@@ -72,5 +129,6 @@ echo "  CA certificate: $CA_CERT" >&2
 echo "  CA key:         $CA_KEY" >&2
 echo "  Server cert:    $SERVER_CERT" >&2
 echo "  Server key:     $SERVER_KEY" >&2
+echo "  Client certs:   $CLIENT_DIR/<agent-id>.pem (keys: <agent-id>-key.pem)" >&2
 
 echo "Remember: never use these development certificates in production." >&2
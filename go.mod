@@ -4,10 +4,13 @@ go 1.24.0
 
 require (
 	github.com/jackc/pgx/v5 v5.5.5
+	github.com/klauspost/compress v1.18.0
 	github.com/shirou/gopsutil/v3 v3.24.5
+	go.etcd.io/bbolt v1.4.3
 	golang.org/x/sync v0.16.0
 	google.golang.org/grpc v1.76.0
 	google.golang.org/protobuf v1.36.10
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
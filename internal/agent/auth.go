@@ -0,0 +1,80 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"telemetry-agent/pkg/api"
+)
+
+// bearerCredentials attaches the agent token to every RPC.
+type bearerCredentials string
+
+func (t bearerCredentials) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(t)}, nil
+}
+
+func (bearerCredentials) RequireTransportSecurity() bool { return true }
+
+// agentToken returns the bearer token from cfg.TokenFile, enrolling with the bootstrap
+// token first when the file does not exist yet. The file is re-read on every connection
+// so a rotated token is picked up without a restart.
+func agentToken(ctx context.Context, logger *slog.Logger, client api.TelemetryClient, cfg Config) (string, error) {
+	if cfg.TokenFile == "" {
+		return "", nil
+	}
+
+	raw, err := os.ReadFile(cfg.TokenFile)
+	if err == nil {
+		if token := strings.TrimSpace(string(raw)); token != "" {
+			return token, nil
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("read token file: %w", err)
+	}
+	if cfg.BootstrapToken == "" {
+		return "", fmt.Errorf("token file %s is empty or missing and no bootstrap token is configured", cfg.TokenFile)
+	}
+
+	resp, err := client.Enroll(ctx, &api.EnrollRequest{AgentId: cfg.AgentID, BootstrapToken: cfg.BootstrapToken})
+	if err != nil {
+		return "", fmt.Errorf("enroll: %w", err)
+	}
+	if err := writeTokenFile(cfg.TokenFile, resp.GetToken()); err != nil {
+		return "", err
+	}
+
+	attrs := []any{"agent", cfg.AgentID, "token_file", cfg.TokenFile}
+	if resp.GetExpiresAt() != nil {
+		attrs = append(attrs, "expires", resp.GetExpiresAt().AsTime())
+	}
+	logger.Info("enrolled with telemetry server", attrs...)
+	return resp.GetToken(), nil
+}
+
+// writeTokenFile replaces path atomically so a crash never leaves a truncated token.
+func writeTokenFile(path, token string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".token-*")
+	if err != nil {
+		return fmt.Errorf("write token file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(token + "\n"); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write token file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write token file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("write token file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package agent
+
+import (
+	"context"
+	"sync"
+
+	"telemetry-agent/pkg/api"
+)
+
+// sampleBuffer is a bounded FIFO that keeps samples while the server is unreachable.
+// When full it drops the oldest sample so the freshest data survives an outage.
+type sampleBuffer struct {
+	mu       sync.Mutex
+	items    []*api.Metric
+	capacity int
+	notify   chan struct{}
+}
+
+func newSampleBuffer(capacity int) *sampleBuffer {
+	return &sampleBuffer{capacity: capacity, notify: make(chan struct{}, 1)}
+}
+
+// Push appends a sample and reports whether an older sample had to be dropped.
+func (b *sampleBuffer) Push(metric *api.Metric) bool {
+	b.mu.Lock()
+	dropped := false
+	if len(b.items) >= b.capacity {
+		b.items = b.items[1:]
+		dropped = true
+	}
+	b.items = append(b.items, metric)
+	b.mu.Unlock()
+
+	select {
+	case b.notify <- struct{}{}:
+	default:
+	}
+	return dropped
+}
+
+// Peek blocks until a sample is available and returns it without removing it.
+func (b *sampleBuffer) Peek(ctx context.Context) (*api.Metric, error) {
+	for {
+		b.mu.Lock()
+		if len(b.items) > 0 {
+			metric := b.items[0]
+			b.mu.Unlock()
+			return metric, nil
+		}
+		b.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-b.notify:
+		}
+	}
+}
+
+// Remove drops metric from the head of the buffer once it has been delivered. It is a
+// no-op when the sample was already evicted by Push.
+func (b *sampleBuffer) Remove(metric *api.Metric) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.items) > 0 && b.items[0] == metric {
+		b.items[0] = nil
+		b.items = b.items[1:]
+	}
+}
+
+// Resize changes the capacity, evicting the oldest samples when shrinking.
+func (b *sampleBuffer) Resize(capacity int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.capacity = capacity
+	if excess := len(b.items) - capacity; excess > 0 {
+		clear(b.items[:excess])
+		b.items = b.items[excess:]
+	}
+}
+
+// Len reports how many samples are waiting for delivery.
+func (b *sampleBuffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.items)
+}
@@ -0,0 +1,92 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"telemetry-agent/pkg/api"
+)
+
+func TestSampleBufferDropsOldestWhenFull(t *testing.T) {
+	buf := newSampleBuffer(2)
+	first, second, third := &api.Metric{AgentId: "1"}, &api.Metric{AgentId: "2"}, &api.Metric{AgentId: "3"}
+
+	if buf.Push(first) || buf.Push(second) {
+		t.Fatal("Push reported a drop before the buffer was full")
+	}
+	if !buf.Push(third) {
+		t.Fatal("Push into a full buffer did not report a drop")
+	}
+	if buf.Len() != 2 {
+		t.Fatalf("Len() = %d, want 2", buf.Len())
+	}
+
+	head, err := buf.Peek(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head != second {
+		t.Fatalf("head = %q, want the oldest surviving sample %q", head.GetAgentId(), second.GetAgentId())
+	}
+}
+
+func TestSampleBufferRemoveIgnoresEvictedSample(t *testing.T) {
+	buf := newSampleBuffer(1)
+	sent := &api.Metric{AgentId: "sent"}
+	buf.Push(sent)
+
+	head, err := buf.Peek(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A newer sample evicts the one still in flight before it is acknowledged.
+	fresh := &api.Metric{AgentId: "fresh"}
+	buf.Push(fresh)
+	buf.Remove(head)
+
+	if buf.Len() != 1 {
+		t.Fatalf("Len() = %d, want 1", buf.Len())
+	}
+	if head, _ := buf.Peek(context.Background()); head != fresh {
+		t.Fatalf("head = %q, want %q", head.GetAgentId(), fresh.GetAgentId())
+	}
+
+	buf.Remove(fresh)
+	if buf.Len() != 0 {
+		t.Fatalf("Len() = %d after delivering every sample, want 0", buf.Len())
+	}
+}
+
+func TestSampleBufferPeekWaitsForPush(t *testing.T) {
+	buf := newSampleBuffer(4)
+	want := &api.Metric{AgentId: "late"}
+	got := make(chan *api.Metric, 1)
+	go func() {
+		metric, err := buf.Peek(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+		got <- metric
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	buf.Push(want)
+	select {
+	case metric := <-got:
+		if metric != want {
+			t.Fatalf("Peek() = %q, want %q", metric.GetAgentId(), want.GetAgentId())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Peek did not return after Push")
+	}
+}
+
+func TestSampleBufferPeekHonoursCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := newSampleBuffer(1).Peek(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Peek() error = %v, want context.Canceled", err)
+	}
+}
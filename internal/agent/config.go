@@ -1,103 +1,847 @@
 package agent
 
 import (
+	"bytes"
+	"cmp"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"math"
 	"net"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"telemetry-agent/internal/transport"
 )
 
 // Config captures runtime settings for the agent process.
 type Config struct {
-	ServerAddr  string
-	AgentID     string
-	Interval    time.Duration
-	CACertPath  string
-	ServerName  string
-	DialTimeout time.Duration
+	// ServerAddrs lists the servers the agent streams to as host:port or "srv:<name>"
+	// entries; ServerSelection decides the order they are tried in (SelectOrdered or
+	// SelectRandom). The agent stays on a server once connected and fails over when it
+	// rejects the stream or stalls it for longer than StallTimeout.
+	ServerAddrs     []string
+	ServerSelection string
+	StallTimeout    time.Duration
+	AgentID         string
+	Interval        time.Duration
+	CACertPath      string
+	ServerName      string
+	DialTimeout     time.Duration
+	// ClientCertPath and ClientKeyPath hold the certificate presented to servers that
+	// require mutual TLS. Both or neither must be set.
+	ClientCertPath string
+	ClientKeyPath  string
+	// TokenFile holds the bearer token presented to servers that require one. When it is
+	// missing, BootstrapToken is exchanged for a token which is then written to TokenFile.
+	TokenFile      string
+	BootstrapToken string
+
+	// Labels are static key/value pairs attached to every sample.
+	Labels map[string]string
+	// LabelsFromEnv maps a label key to the environment variable holding its value.
+	LabelsFromEnv map[string]string
+	// LabelsFromFile maps a label key to a file whose trimmed contents become its value.
+	LabelsFromFile map[string]string
+
+	// Align stamps samples with interval boundaries instead of the wall clock at which
+	// they were taken; Jitter delays each agent by a stable offset below it.
+	Align  bool
+	Jitter time.Duration
+
+	// Collectors lists the enabled collectors (see KnownCollectors).
+	Collectors []string
+	// ProbeTargets are host:port endpoints checked by the probe collector.
+	ProbeTargets []string
+
+	// HealthAddr is the listen address of the local /healthz, /readyz and /metrics
+	// endpoints; empty disables the listener.
+	HealthAddr string
+	// StreamSelfMetrics adds the agent's own counters to every sample under
+	// SelfMetricPrefix.
+	StreamSelfMetrics bool
+
+	// Output selects where samples go (OutputGRPC, OutputStdout or OutputFile).
+	Output string
+	// OutputPath is the file written by OutputFile.
+	OutputPath string
+
+	// Sinks are further destinations that receive every sample next to the one above.
+	// They can only be configured in the file.
+	Sinks []SinkConfig
+
+	// BufferSize bounds how many samples are held while the server is unreachable.
+	BufferSize int
+	// RetryBackoff is the initial delay between reconnect attempts; it doubles up to
+	// MaxRetryBackoff.
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+
+	// Compression is the gRPC compressor used for the metrics stream (transport.Compressions).
+	Compression string
+	// KeepaliveTime is how long the connection may sit idle before the agent pings the
+	// server, zero to never ping; KeepaliveTimeout bounds the wait for the reply.
+	KeepaliveTime    time.Duration
+	KeepaliveTimeout time.Duration
+	// MaxMessageBytes caps a single message in either direction.
+	MaxMessageBytes int
+	// InitialWindowSize and InitialConnWindowSize are the HTTP/2 flow-control windows per
+	// stream and per connection in bytes; zero keeps gRPC's dynamic sizing.
+	InitialWindowSize     int
+	InitialConnWindowSize int
 }
 
-// LoadConfig reads configuration strictly from environment variables with sensible defaults.
-//
-//	TELEMETRY_SERVER_ADDR       gRPC server host:port (default "127.0.0.1:50051")
-//	TELEMETRY_AGENT_ID          unique identifier for this agent (defaults to hostname)
-//	TELEMETRY_SCRAPE_INTERVAL   sampling cadence (default "2s")
-//	TELEMETRY_SERVER_CA_CERT    CA bundle for verifying the server (default dev cert)
-//	TELEMETRY_SERVER_NAME       expected TLS server name (derived from addr when omitted)
-//	TELEMETRY_DIAL_TIMEOUT      timeout for establishing the gRPC session (default "5s")
-func LoadConfig() (Config, error) {
-	defaultAddr := getenv("TELEMETRY_SERVER_ADDR", "127.0.0.1:50051")
-	intervalStr := getenv("TELEMETRY_SCRAPE_INTERVAL", "2s")
-	dialTimeoutStr := getenv("TELEMETRY_DIAL_TIMEOUT", "5s")
-
-	interval, err := time.ParseDuration(intervalStr)
-	if err != nil {
-		return Config{}, fmt.Errorf("parse TELEMETRY_SCRAPE_INTERVAL: %w", err)
-	}
+// SinkConfig describes an additional destination. Each sink has its own buffer, reconnect
+// state and credentials, so a slow or failing sink never holds up the others. An empty
+// Output means OutputGRPC; empty ServerSelection, CACertPath, client certificate and
+// BufferSize are inherited from the primary destination. Server name and tokens are not
+// inherited because they belong to one cluster.
+type SinkConfig struct {
+	Name            string
+	Output          string
+	OutputPath      string
+	ServerAddrs     []string
+	ServerSelection string
+	ServerName      string
+	CACertPath      string
+	ClientCertPath  string
+	ClientKeyPath   string
+	TokenFile       string
+	BootstrapToken  string
+	BufferSize      int
+}
 
-	dialTimeout, err := time.ParseDuration(dialTimeoutStr)
-	if err != nil {
-		return Config{}, fmt.Errorf("parse TELEMETRY_DIAL_TIMEOUT: %w", err)
+// PrimarySink names the destination configured by the top-level output and server
+// settings.
+const PrimarySink = "default"
+
+// sinkSpec is the effective configuration of one destination.
+type sinkSpec struct {
+	name string
+	cfg  Config
+}
+
+// sinkSpecs returns every destination, the primary one first, with inherited settings
+// filled in. The configurations of additional sinks carry no sinks of their own.
+func (c Config) sinkSpecs() []sinkSpec {
+	primary := c
+	primary.Sinks = nil
+	specs := []sinkSpec{{name: PrimarySink, cfg: primary}}
+	for _, sc := range c.Sinks {
+		cfg := primary
+		cfg.Output = cmp.Or(sc.Output, OutputGRPC)
+		cfg.OutputPath = sc.OutputPath
+		cfg.ServerAddrs = sc.ServerAddrs
+		cfg.ServerSelection = cmp.Or(sc.ServerSelection, c.ServerSelection)
+		cfg.ServerName = sc.ServerName
+		cfg.CACertPath = cmp.Or(sc.CACertPath, c.CACertPath)
+		if sc.ClientCertPath != "" || sc.ClientKeyPath != "" {
+			cfg.ClientCertPath, cfg.ClientKeyPath = sc.ClientCertPath, sc.ClientKeyPath
+		}
+		cfg.TokenFile = sc.TokenFile
+		cfg.BootstrapToken = sc.BootstrapToken
+		cfg.BufferSize = cmp.Or(sc.BufferSize, c.BufferSize)
+		specs = append(specs, sinkSpec{name: sc.Name, cfg: cfg})
 	}
+	return specs
+}
 
+// Output destinations for samples.
+const (
+	OutputGRPC   = "grpc"   // stream to the telemetry server
+	OutputStdout = "stdout" // JSON lines on standard output
+	OutputFile   = "file"   // JSON lines appended to Config.OutputPath
+)
+
+// Options are command-line switches that steer the process rather than the agent itself.
+type Options struct {
+	// ConfigPath is the configuration file in use, empty when none was given.
+	ConfigPath string
+	// PrintConfig asks the process to dump the effective configuration and exit.
+	PrintConfig bool
+	// Once samples a single time, prints it in Format and exits.
+	Once   bool
+	Format string
+	// WatchConfig is the polling period for reloading ConfigPath on change; zero disables
+	// watching and leaves SIGHUP as the only reload trigger.
+	WatchConfig time.Duration
+}
+
+// setting binds one configuration knob to its file key, command-line flag and
+// environment variable.
+type setting struct {
+	key   string
+	flag  string
+	env   string
+	usage string
+	apply func(cfg *Config, raw string) error
+}
+
+var settings = []setting{
+	{"output.type", "output", "TELEMETRY_OUTPUT", "where samples go: grpc, stdout or file", setString(func(c *Config) *string { return &c.Output })},
+	{"output.path", "output-file", "TELEMETRY_OUTPUT_FILE", "file receiving JSON lines when -output=file", setString(func(c *Config) *string { return &c.OutputPath })},
+	{"server.addr", "server-addr", "TELEMETRY_SERVER_ADDR", `comma-separated gRPC servers as host:port or "srv:<name>"`, setList(func(c *Config) *[]string { return &c.ServerAddrs })},
+	{"server.selection", "server-selection", "TELEMETRY_SERVER_SELECTION", "order servers are tried in: ordered or random", setString(func(c *Config) *string { return &c.ServerSelection })},
+	{"server.stallTimeout", "stall-timeout", "TELEMETRY_STALL_TIMEOUT", "fail over when a send blocks this long, 0 to disable", setDuration(func(c *Config) *time.Duration { return &c.StallTimeout })},
+	{"server.name", "server-name", "TELEMETRY_SERVER_NAME", "expected TLS server name (derived from each address when omitted)", setString(func(c *Config) *string { return &c.ServerName })},
+	{"server.caCert", "ca-cert", "TELEMETRY_SERVER_CA_CERT", "CA bundle for verifying the server", setString(func(c *Config) *string { return &c.CACertPath })},
+	{"server.clientCert", "client-cert", "TELEMETRY_CLIENT_CERT", "client certificate for mutual TLS", setString(func(c *Config) *string { return &c.ClientCertPath })},
+	{"server.clientKey", "client-key", "TELEMETRY_CLIENT_KEY", "private key of the client certificate", setString(func(c *Config) *string { return &c.ClientKeyPath })},
+	{"server.tokenFile", "token-file", "TELEMETRY_AGENT_TOKEN_FILE", "file holding the agent's bearer token", setString(func(c *Config) *string { return &c.TokenFile })},
+	{"server.bootstrapToken", "bootstrap-token", "TELEMETRY_BOOTSTRAP_TOKEN", "one-time token exchanged for a bearer token when the token file is missing", setString(func(c *Config) *string { return &c.BootstrapToken })},
+	{"server.dialTimeout", "dial-timeout", "TELEMETRY_DIAL_TIMEOUT", "timeout for establishing the gRPC session", setDuration(func(c *Config) *time.Duration { return &c.DialTimeout })},
+	{"agent.id", "agent-id", "TELEMETRY_AGENT_ID", "unique identifier for this agent (defaults to hostname)", setString(func(c *Config) *string { return &c.AgentID })},
+	{"agent.interval", "interval", "TELEMETRY_SCRAPE_INTERVAL", "sampling cadence", setDuration(func(c *Config) *time.Duration { return &c.Interval })},
+	{"agent.align", "align", "TELEMETRY_ALIGN_SAMPLES", "align sample timestamps to interval boundaries", setBool(func(c *Config) *bool { return &c.Align })},
+	{"agent.jitter", "jitter", "TELEMETRY_SCRAPE_JITTER", "upper bound of the per-agent sampling offset", setDuration(func(c *Config) *time.Duration { return &c.Jitter })},
+	{"collectors", "collectors", "TELEMETRY_COLLECTORS", "comma-separated collectors to enable", setList(func(c *Config) *[]string { return &c.Collectors })},
+	{"probe.targets", "probe-targets", "TELEMETRY_PROBE_TARGETS", "comma-separated host:port targets for the probe collector", setList(func(c *Config) *[]string { return &c.ProbeTargets })},
+	{"labels.static", "labels", "TELEMETRY_LABELS", `static labels as "key=value,key2=value2"`, setLabels(func(c *Config) *map[string]string { return &c.Labels })},
+	{"labels.fromEnv", "labels-from-env", "TELEMETRY_LABELS_FROM_ENV", `dynamic labels as "key=ENV_VAR,..."`, setLabels(func(c *Config) *map[string]string { return &c.LabelsFromEnv })},
+	{"labels.fromFile", "labels-from-file", "TELEMETRY_LABELS_FROM_FILE", `dynamic labels as "key=/path/to/file,..."`, setLabels(func(c *Config) *map[string]string { return &c.LabelsFromFile })},
+	{"self.listen", "health-addr", "TELEMETRY_HEALTH_ADDR", "listen address for /healthz, /readyz and /metrics (empty disables)", setString(func(c *Config) *string { return &c.HealthAddr })},
+	{"self.stream", "self-metrics", "TELEMETRY_SELF_METRICS", "stream the agent's own counters with every sample", setBool(func(c *Config) *bool { return &c.StreamSelfMetrics })},
+	{"buffer.size", "buffer-size", "TELEMETRY_BUFFER_SIZE", "samples held while the server is unreachable", setInt(func(c *Config) *int { return &c.BufferSize })},
+	{"buffer.retryBackoff", "retry-backoff", "TELEMETRY_RETRY_BACKOFF", "initial delay between reconnect attempts", setDuration(func(c *Config) *time.Duration { return &c.RetryBackoff })},
+	{"buffer.maxRetryBackoff", "max-retry-backoff", "TELEMETRY_MAX_RETRY_BACKOFF", "upper bound for the reconnect delay", setDuration(func(c *Config) *time.Duration { return &c.MaxRetryBackoff })},
+	{"transport.compression", "compression", "TELEMETRY_COMPRESSION", "stream compression: none, gzip or zstd", setString(func(c *Config) *string { return &c.Compression })},
+	{"transport.keepaliveTime", "keepalive-time", "TELEMETRY_KEEPALIVE_TIME", "idle time before pinging the server, 0 to disable", setDuration(func(c *Config) *time.Duration { return &c.KeepaliveTime })},
+	{"transport.keepaliveTimeout", "keepalive-timeout", "TELEMETRY_KEEPALIVE_TIMEOUT", "wait for a keepalive reply before dropping the connection", setDuration(func(c *Config) *time.Duration { return &c.KeepaliveTimeout })},
+	{"transport.maxMessageBytes", "max-message-bytes", "TELEMETRY_MAX_MESSAGE_BYTES", "largest message sent or received", setInt(func(c *Config) *int { return &c.MaxMessageBytes })},
+	{"transport.initialWindowSize", "initial-window-size", "TELEMETRY_INITIAL_WINDOW_SIZE", "HTTP/2 stream flow-control window in bytes, 0 for dynamic", setInt(func(c *Config) *int { return &c.InitialWindowSize })},
+	{"transport.initialConnWindowSize", "initial-conn-window-size", "TELEMETRY_INITIAL_CONN_WINDOW_SIZE", "HTTP/2 connection flow-control window in bytes, 0 for dynamic", setInt(func(c *Config) *int { return &c.InitialConnWindowSize })},
+}
+
+// DefaultConfig returns the settings used when neither file, environment nor flags
+// override them.
+func DefaultConfig() Config {
 	hostname, err := os.Hostname()
 	if err != nil {
 		hostname = "unknown-agent"
 	}
 
-	cfg := Config{
-		ServerAddr:  defaultAddr,
-		AgentID:     getenv("TELEMETRY_AGENT_ID", hostname),
-		Interval:    interval,
-		CACertPath:  getenv("TELEMETRY_SERVER_CA_CERT", "deploy/certs/dev/ca.pem"),
-		ServerName:  getenv("TELEMETRY_SERVER_NAME", hostFromAddr(defaultAddr)),
-		DialTimeout: dialTimeout,
+	return Config{
+		Output:            OutputGRPC,
+		ServerAddrs:       []string{"127.0.0.1:50051"},
+		ServerSelection:   SelectOrdered,
+		StallTimeout:      30 * time.Second,
+		AgentID:           hostname,
+		Interval:          2 * time.Second,
+		CACertPath:        "deploy/certs/dev/ca.pem",
+		DialTimeout:       5 * time.Second,
+		Labels:            map[string]string{},
+		LabelsFromEnv:     map[string]string{},
+		LabelsFromFile:    map[string]string{},
+		Collectors:        slices.Clone(KnownCollectors),
+		StreamSelfMetrics: true,
+		BufferSize:        1000,
+		RetryBackoff:      time.Second,
+		MaxRetryBackoff:   30 * time.Second,
+		Compression:       transport.CompressionNone,
+		KeepaliveTimeout:  20 * time.Second,
+		MaxMessageBytes:   4 << 20,
 	}
+}
 
-	if cfg.ServerAddr == "" {
-		return Config{}, fmt.Errorf("server address must be provided")
+// LoadConfig assembles the configuration from defaults, an optional YAML file, environment
+// variables and command-line args, in increasing order of precedence:
+//
+//	flag > env > file > default
+//
+// The file path comes from -config or TELEMETRY_AGENT_CONFIG. Every knob is available in
+// all three layers; run with -h for the flag list. The merged result is validated as a
+// whole and every problem is reported.
+func LoadConfig(args []string) (Config, Options, error) {
+	var opts Options
+	flagValues := make(map[string]string)
+
+	fs := flag.NewFlagSet("agent", flag.ContinueOnError)
+	fs.StringVar(&opts.ConfigPath, "config", getenv("TELEMETRY_AGENT_CONFIG", ""), "YAML configuration file (env TELEMETRY_AGENT_CONFIG)")
+	fs.BoolVar(&opts.PrintConfig, "print-config", false, "print the effective configuration as YAML and exit")
+	fs.BoolVar(&opts.Once, "once", false, "take a single sample, print it and exit")
+	fs.StringVar(&opts.Format, "format", FormatJSON, "output format for -once: json, prom or table")
+	fs.Func("watch-config", "poll the config file at this period and reload on change (env TELEMETRY_AGENT_CONFIG_WATCH)", func(raw string) error {
+		parsed, err := time.ParseDuration(raw)
+		opts.WatchConfig = parsed
+		return err
+	})
+	if raw := getenv("TELEMETRY_AGENT_CONFIG_WATCH", ""); raw != "" {
+		parsed, err := time.ParseDuration(raw)
+		if err != nil {
+			return Config{}, opts, fmt.Errorf("parse TELEMETRY_AGENT_CONFIG_WATCH: %w", err)
+		}
+		opts.WatchConfig = parsed
+	}
+	for _, s := range settings {
+		name := s.flag
+		fs.Func(name, fmt.Sprintf("%s (env %s)", s.usage, s.env), func(raw string) error {
+			flagValues[name] = raw
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return Config{}, opts, err
 	}
-	if cfg.Interval <= 0 {
-		return Config{}, fmt.Errorf("interval must be positive")
+	if opts.WatchConfig < 0 {
+		return Config{}, opts, fmt.Errorf("-watch-config must not be negative, got %s", opts.WatchConfig)
 	}
-	if cfg.DialTimeout <= 0 {
-		return Config{}, fmt.Errorf("dial timeout must be positive")
+	if !slices.Contains(Formats, opts.Format) {
+		return Config{}, opts, fmt.Errorf("-format must be one of %s, got %q", strings.Join(Formats, ", "), opts.Format)
 	}
-	if cfg.CACertPath == "" {
-		return Config{}, fmt.Errorf("CA certificate path must be provided")
+	if fs.NArg() > 0 {
+		return Config{}, opts, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
 	}
-	if cfg.ServerName == "" {
-		cfg.ServerName = hostFromAddr(cfg.ServerAddr)
-		if cfg.ServerName == "" {
-			cfg.ServerName = "localhost"
+
+	cfg := DefaultConfig()
+
+	if opts.ConfigPath != "" {
+		raw, err := os.ReadFile(opts.ConfigPath)
+		if err != nil {
+			return Config{}, opts, fmt.Errorf("read config file: %w", err)
+		}
+		if cfg, err = decodeConfigFile(raw, cfg); err != nil {
+			return Config{}, opts, fmt.Errorf("config file %s: %w", opts.ConfigPath, err)
 		}
 	}
 
-	return cfg, nil
+	for _, s := range settings {
+		if raw, ok := os.LookupEnv(s.env); ok {
+			if err := s.apply(&cfg, raw); err != nil {
+				return Config{}, opts, fmt.Errorf("parse %s: %w", s.env, err)
+			}
+		}
+	}
+
+	for _, s := range settings {
+		if raw, ok := flagValues[s.flag]; ok {
+			if err := s.apply(&cfg, raw); err != nil {
+				return Config{}, opts, fmt.Errorf("parse -%s: %w", s.flag, err)
+			}
+		}
+	}
+
+	// -once never connects anywhere, so server and output settings are not checked.
+	// -print-config only renders the settings, so the files they name need not exist yet.
+	check := cfg
+	if opts.Once {
+		check.Output = OutputStdout
+		check.Sinks = nil
+	}
+	if err := check.validate(!opts.PrintConfig); err != nil {
+		return Config{}, opts, err
+	}
+
+	return cfg, opts, nil
 }
 
-func getenv(key, fallback string) string {
-	if val, ok := os.LookupEnv(key); ok {
-		return val
+// Validate checks the configuration and reports every invalid setting at once.
+func (c Config) Validate() error {
+	return c.validate(true)
+}
+
+// validate is Validate; checkFiles controls whether the certificate files are opened.
+func (c Config) validate(checkFiles bool) error {
+	var errs []error
+	invalid := func(key, format string, args ...any) {
+		errs = append(errs, fieldError(key, fmt.Sprintf(format, args...)))
 	}
-	return fallback
+
+	c.validateOutput("", checkFiles, invalid)
+	tokenFiles := make(map[string]string)
+	if c.Output == OutputGRPC && c.TokenFile != "" {
+		tokenFiles[c.TokenFile] = PrimarySink
+	}
+	specs := c.sinkSpecs()
+	for i, sc := range c.Sinks {
+		prefix := fmt.Sprintf("sinks[%d].", i)
+		switch {
+		case sc.Name == "":
+			invalid(prefix+"name", "must be provided")
+		case sc.Name == PrimarySink:
+			invalid(prefix+"name", "%q is reserved for the primary destination", PrimarySink)
+		case slices.IndexFunc(c.Sinks, func(o SinkConfig) bool { return o.Name == sc.Name }) != i:
+			invalid(prefix+"name", "sink %q listed more than once", sc.Name)
+		}
+		sink := specs[i+1].cfg
+		sink.validateOutput(prefix, checkFiles, invalid)
+		if sink.Output == OutputGRPC && sc.TokenFile != "" {
+			if other, ok := tokenFiles[sc.TokenFile]; ok {
+				invalid(prefix+"server.tokenFile", "%s is already used by sink %q", sc.TokenFile, other)
+			}
+			tokenFiles[sc.TokenFile] = sc.Name
+		}
+		if sc.BufferSize < 0 {
+			invalid(prefix+"buffer.size", "must not be negative, got %d", sc.BufferSize)
+		}
+	}
+	if strings.TrimSpace(c.AgentID) == "" {
+		invalid("agent.id", "must be provided")
+	} else if strings.ContainsFunc(c.AgentID, isSpace) {
+		invalid("agent.id", "%q must not contain whitespace", c.AgentID)
+	}
+	if c.Interval <= 0 {
+		invalid("agent.interval", "must be positive, got %s", c.Interval)
+	}
+	if c.Jitter < 0 {
+		invalid("agent.jitter", "must not be negative, got %s", c.Jitter)
+	} else if c.Interval > 0 && c.Jitter >= c.Interval {
+		invalid("agent.jitter", "must be shorter than agent.interval (%s), got %s", c.Interval, c.Jitter)
+	}
+	if len(c.Collectors) == 0 {
+		invalid("collectors", "at least one collector must be enabled (known: %s)", strings.Join(KnownCollectors, ", "))
+	}
+	for i, name := range c.Collectors {
+		if !slices.Contains(KnownCollectors, name) {
+			invalid("collectors", "unknown collector %q (known: %s)", name, strings.Join(KnownCollectors, ", "))
+		} else if slices.Index(c.Collectors, name) != i {
+			invalid("collectors", "collector %q listed more than once", name)
+		}
+	}
+	for _, target := range c.ProbeTargets {
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			invalid("probe.targets", "%q is not host:port: %v", target, err)
+		}
+	}
+	if err := validateLabels(c); err != nil {
+		errs = append(errs, err)
+	}
+	if c.HealthAddr != "" {
+		if _, _, err := net.SplitHostPort(c.HealthAddr); err != nil {
+			invalid("self.listen", "%q is not host:port: %v", c.HealthAddr, err)
+		}
+	}
+	if c.BufferSize <= 0 {
+		invalid("buffer.size", "must be at least 1, got %d", c.BufferSize)
+	}
+	if c.RetryBackoff <= 0 {
+		invalid("buffer.retryBackoff", "must be positive, got %s", c.RetryBackoff)
+	}
+	if c.MaxRetryBackoff < c.RetryBackoff {
+		invalid("buffer.maxRetryBackoff", "must not be shorter than buffer.retryBackoff (%s), got %s", c.RetryBackoff, c.MaxRetryBackoff)
+	}
+	if !slices.Contains(transport.Compressions, c.Compression) {
+		invalid("transport.compression", "must be one of %s, got %q", strings.Join(transport.Compressions, ", "), c.Compression)
+	}
+	// gRPC raises shorter keepalive periods to 10s anyway.
+	if c.KeepaliveTime != 0 && c.KeepaliveTime < 10*time.Second {
+		invalid("transport.keepaliveTime", "must be 0 or at least 10s, got %s", c.KeepaliveTime)
+	}
+	if c.KeepaliveTimeout <= 0 {
+		invalid("transport.keepaliveTimeout", "must be positive, got %s", c.KeepaliveTimeout)
+	}
+	if c.MaxMessageBytes <= 0 {
+		invalid("transport.maxMessageBytes", "must be positive, got %d", c.MaxMessageBytes)
+	}
+	for _, window := range []struct {
+		key  string
+		size int
+	}{
+		{"transport.initialWindowSize", c.InitialWindowSize},
+		{"transport.initialConnWindowSize", c.InitialConnWindowSize},
+	} {
+		if window.size != 0 && (window.size < 64<<10 || window.size > math.MaxInt32) {
+			invalid(window.key, "must be 0 or between 64KiB and 2GiB, got %d", window.size)
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n%w", errors.Join(errs...))
+	}
+	return nil
 }
 
-func hostFromAddr(addr string) string {
-	trimmed := strings.TrimSpace(addr)
-	if host, _, err := net.SplitHostPort(trimmed); err == nil {
-		if host != "" {
-			return host
+// validateOutput checks the destination settings of c, reporting them under prefix. The
+// certificate files are only opened when checkFiles is set.
+func (c Config) validateOutput(prefix string, checkFiles bool, invalid func(key, format string, args ...any)) {
+	switch c.Output {
+	case OutputGRPC:
+		if len(c.ServerAddrs) == 0 {
+			invalid(prefix+"server.addr", "at least one server must be provided")
+		}
+		for i, addr := range c.ServerAddrs {
+			if name, ok := strings.CutPrefix(addr, srvPrefix); ok {
+				if name == "" {
+					invalid(prefix+"server.addr", "%q names no SRV record", addr)
+				}
+			} else if _, _, err := net.SplitHostPort(addr); err != nil {
+				invalid(prefix+"server.addr", "%q is not host:port: %v", addr, err)
+			}
+			if slices.Index(c.ServerAddrs, addr) != i {
+				invalid(prefix+"server.addr", "server %q listed more than once", addr)
+			}
+		}
+		if c.ServerSelection != SelectOrdered && c.ServerSelection != SelectRandom {
+			invalid(prefix+"server.selection", "must be %q or %q, got %q", SelectOrdered, SelectRandom, c.ServerSelection)
+		}
+		if c.StallTimeout < 0 {
+			invalid(prefix+"server.stallTimeout", "must not be negative, got %s", c.StallTimeout)
+		}
+		if c.CACertPath == "" {
+			invalid(prefix+"server.caCert", "must be provided")
+		} else if checkFiles {
+			if _, err := os.Stat(c.CACertPath); err != nil {
+				invalid(prefix+"server.caCert", "%v", err)
+			}
+		}
+		switch {
+		case c.ClientCertPath == "" && c.ClientKeyPath != "":
+			invalid(prefix+"server.clientCert", "must be provided together with server.clientKey")
+		case c.ClientCertPath != "" && c.ClientKeyPath == "":
+			invalid(prefix+"server.clientKey", "must be provided together with server.clientCert")
+		case c.ClientCertPath != "" && checkFiles:
+			if _, err := tls.LoadX509KeyPair(c.ClientCertPath, c.ClientKeyPath); err != nil {
+				invalid(prefix+"server.clientCert", "%v", err)
+			}
+		}
+		if c.BootstrapToken != "" && c.TokenFile == "" {
+			invalid(prefix+"server.bootstrapToken", "requires server.tokenFile to store the enrolled token")
 		}
-		return "localhost"
+		if c.DialTimeout <= 0 {
+			invalid(prefix+"server.dialTimeout", "must be positive, got %s", c.DialTimeout)
+		}
+	case OutputStdout:
+	case OutputFile:
+		if c.OutputPath == "" {
+			invalid(prefix+"output.path", "must be provided when output.type is %q", OutputFile)
+		}
+	default:
+		invalid(prefix+"output.type", "unknown output %q (known: %s, %s, %s)", c.Output, OutputGRPC, OutputStdout, OutputFile)
 	}
+}
 
-	if trimmed == "" {
-		return ""
+// WriteYAML renders the configuration in the config file format.
+func (c Config) WriteYAML(w io.Writer) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(toFileConfig(c)); err != nil {
+		return fmt.Errorf("encode config: %w", err)
 	}
-	if strings.HasPrefix(trimmed, ":") {
-		return "localhost"
+	return enc.Close()
+}
+
+// fieldError names a setting by file key, flag and environment variable so the message
+// points at whichever layer the operator used.
+func fieldError(key, msg string) error {
+	for _, s := range settings {
+		if s.key == key {
+			return fmt.Errorf("  %s (-%s, %s): %s", key, s.flag, s.env, msg)
+		}
 	}
-	return trimmed
+	return fmt.Errorf("  %s: %s", key, msg)
+}
+
+// fileConfig mirrors Config in the nested layout used by the YAML file.
+type fileConfig struct {
+	Output struct {
+		Type string `yaml:"type"`
+		Path string `yaml:"path,omitempty"`
+	} `yaml:"output"`
+	Server struct {
+		Addr         addrList `yaml:"addr"`
+		Selection    string   `yaml:"selection"`
+		StallTimeout duration `yaml:"stallTimeout"`
+		Name         string   `yaml:"name,omitempty"`
+		CACert       string   `yaml:"caCert"`
+		ClientCert   string   `yaml:"clientCert,omitempty"`
+		ClientKey    string   `yaml:"clientKey,omitempty"`
+		TokenFile    string   `yaml:"tokenFile,omitempty"`
+		Bootstrap    string   `yaml:"bootstrapToken,omitempty"`
+		DialTimeout  duration `yaml:"dialTimeout"`
+	} `yaml:"server"`
+	Agent struct {
+		ID       string   `yaml:"id"`
+		Interval duration `yaml:"interval"`
+		Align    bool     `yaml:"align"`
+		Jitter   duration `yaml:"jitter"`
+	} `yaml:"agent"`
+	Collectors []string `yaml:"collectors,flow"`
+	Probe      struct {
+		Targets []string `yaml:"targets"`
+	} `yaml:"probe"`
+	Labels struct {
+		Static   map[string]string `yaml:"static"`
+		FromEnv  map[string]string `yaml:"fromEnv"`
+		FromFile map[string]string `yaml:"fromFile"`
+	} `yaml:"labels"`
+	Self struct {
+		Listen string `yaml:"listen"`
+		Stream bool   `yaml:"stream"`
+	} `yaml:"self"`
+	Buffer struct {
+		Size            int      `yaml:"size"`
+		RetryBackoff    duration `yaml:"retryBackoff"`
+		MaxRetryBackoff duration `yaml:"maxRetryBackoff"`
+	} `yaml:"buffer"`
+	Transport struct {
+		Compression           string   `yaml:"compression"`
+		KeepaliveTime         duration `yaml:"keepaliveTime"`
+		KeepaliveTimeout      duration `yaml:"keepaliveTimeout"`
+		MaxMessageBytes       int      `yaml:"maxMessageBytes"`
+		InitialWindowSize     int      `yaml:"initialWindowSize"`
+		InitialConnWindowSize int      `yaml:"initialConnWindowSize"`
+	} `yaml:"transport"`
+	Sinks []fileSink `yaml:"sinks,omitempty"`
+}
+
+// fileSink is the YAML layout of a SinkConfig, using the same keys as the primary
+// destination.
+type fileSink struct {
+	Name   string `yaml:"name"`
+	Output struct {
+		Type string `yaml:"type,omitempty"`
+		Path string `yaml:"path,omitempty"`
+	} `yaml:"output,omitempty"`
+	Server struct {
+		Addr       addrList `yaml:"addr,omitempty"`
+		Selection  string   `yaml:"selection,omitempty"`
+		Name       string   `yaml:"name,omitempty"`
+		CACert     string   `yaml:"caCert,omitempty"`
+		ClientCert string   `yaml:"clientCert,omitempty"`
+		ClientKey  string   `yaml:"clientKey,omitempty"`
+		TokenFile  string   `yaml:"tokenFile,omitempty"`
+		Bootstrap  string   `yaml:"bootstrapToken,omitempty"`
+	} `yaml:"server,omitempty"`
+	Buffer struct {
+		Size int `yaml:"size,omitempty"`
+	} `yaml:"buffer,omitempty"`
+}
+
+func decodeConfigFile(raw []byte, base Config) (Config, error) {
+	fc := toFileConfig(base)
+	dec := yaml.NewDecoder(bytes.NewReader(raw))
+	dec.KnownFields(true)
+	if err := dec.Decode(&fc); err != nil && !errors.Is(err, io.EOF) {
+		return Config{}, err
+	}
+	return fc.toConfig(), nil
+}
+
+func toFileConfig(c Config) fileConfig {
+	var fc fileConfig
+	fc.Output.Type = c.Output
+	fc.Output.Path = c.OutputPath
+	fc.Server.Addr = c.ServerAddrs
+	fc.Server.Selection = c.ServerSelection
+	fc.Server.StallTimeout = duration(c.StallTimeout)
+	fc.Server.Name = c.ServerName
+	fc.Server.CACert = c.CACertPath
+	fc.Server.ClientCert = c.ClientCertPath
+	fc.Server.ClientKey = c.ClientKeyPath
+	fc.Server.TokenFile = c.TokenFile
+	fc.Server.Bootstrap = c.BootstrapToken
+	fc.Server.DialTimeout = duration(c.DialTimeout)
+	fc.Agent.ID = c.AgentID
+	fc.Agent.Interval = duration(c.Interval)
+	fc.Agent.Align = c.Align
+	fc.Agent.Jitter = duration(c.Jitter)
+	fc.Collectors = c.Collectors
+	fc.Probe.Targets = c.ProbeTargets
+	fc.Labels.Static = c.Labels
+	fc.Labels.FromEnv = c.LabelsFromEnv
+	fc.Labels.FromFile = c.LabelsFromFile
+	fc.Self.Listen = c.HealthAddr
+	fc.Self.Stream = c.StreamSelfMetrics
+	fc.Buffer.Size = c.BufferSize
+	fc.Buffer.RetryBackoff = duration(c.RetryBackoff)
+	fc.Buffer.MaxRetryBackoff = duration(c.MaxRetryBackoff)
+	fc.Transport.Compression = c.Compression
+	fc.Transport.KeepaliveTime = duration(c.KeepaliveTime)
+	fc.Transport.KeepaliveTimeout = duration(c.KeepaliveTimeout)
+	fc.Transport.MaxMessageBytes = c.MaxMessageBytes
+	fc.Transport.InitialWindowSize = c.InitialWindowSize
+	fc.Transport.InitialConnWindowSize = c.InitialConnWindowSize
+	for _, sc := range c.Sinks {
+		var fs fileSink
+		fs.Name = sc.Name
+		fs.Output.Type = sc.Output
+		fs.Output.Path = sc.OutputPath
+		fs.Server.Addr = sc.ServerAddrs
+		fs.Server.Selection = sc.ServerSelection
+		fs.Server.Name = sc.ServerName
+		fs.Server.CACert = sc.CACertPath
+		fs.Server.ClientCert = sc.ClientCertPath
+		fs.Server.ClientKey = sc.ClientKeyPath
+		fs.Server.TokenFile = sc.TokenFile
+		fs.Server.Bootstrap = sc.BootstrapToken
+		fs.Buffer.Size = sc.BufferSize
+		fc.Sinks = append(fc.Sinks, fs)
+	}
+	return fc
+}
+
+func (fc fileConfig) toConfig() Config {
+	var sinks []SinkConfig
+	for _, fs := range fc.Sinks {
+		sinks = append(sinks, SinkConfig{
+			Name:            fs.Name,
+			Output:          fs.Output.Type,
+			OutputPath:      fs.Output.Path,
+			ServerAddrs:     fs.Server.Addr,
+			ServerSelection: fs.Server.Selection,
+			ServerName:      fs.Server.Name,
+			CACertPath:      fs.Server.CACert,
+			ClientCertPath:  fs.Server.ClientCert,
+			ClientKeyPath:   fs.Server.ClientKey,
+			TokenFile:       fs.Server.TokenFile,
+			BootstrapToken:  fs.Server.Bootstrap,
+			BufferSize:      fs.Buffer.Size,
+		})
+	}
+	return Config{
+		Output:                fc.Output.Type,
+		OutputPath:            fc.Output.Path,
+		ServerAddrs:           fc.Server.Addr,
+		ServerSelection:       fc.Server.Selection,
+		StallTimeout:          time.Duration(fc.Server.StallTimeout),
+		ServerName:            fc.Server.Name,
+		CACertPath:            fc.Server.CACert,
+		ClientCertPath:        fc.Server.ClientCert,
+		ClientKeyPath:         fc.Server.ClientKey,
+		TokenFile:             fc.Server.TokenFile,
+		BootstrapToken:        fc.Server.Bootstrap,
+		DialTimeout:           time.Duration(fc.Server.DialTimeout),
+		AgentID:               fc.Agent.ID,
+		Interval:              time.Duration(fc.Agent.Interval),
+		Align:                 fc.Agent.Align,
+		Jitter:                time.Duration(fc.Agent.Jitter),
+		Collectors:            fc.Collectors,
+		ProbeTargets:          fc.Probe.Targets,
+		Labels:                fc.Labels.Static,
+		LabelsFromEnv:         fc.Labels.FromEnv,
+		LabelsFromFile:        fc.Labels.FromFile,
+		HealthAddr:            fc.Self.Listen,
+		StreamSelfMetrics:     fc.Self.Stream,
+		BufferSize:            fc.Buffer.Size,
+		RetryBackoff:          time.Duration(fc.Buffer.RetryBackoff),
+		MaxRetryBackoff:       time.Duration(fc.Buffer.MaxRetryBackoff),
+		Compression:           fc.Transport.Compression,
+		KeepaliveTime:         time.Duration(fc.Transport.KeepaliveTime),
+		KeepaliveTimeout:      time.Duration(fc.Transport.KeepaliveTimeout),
+		MaxMessageBytes:       fc.Transport.MaxMessageBytes,
+		InitialWindowSize:     fc.Transport.InitialWindowSize,
+		InitialConnWindowSize: fc.Transport.InitialConnWindowSize,
+		Sinks:                 sinks,
+	}
+}
+
+// duration lets YAML files spell durations as "2s" or "1m30s".
+type duration time.Duration
+
+func (d *duration) UnmarshalYAML(node *yaml.Node) error {
+	parsed, err := time.ParseDuration(node.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", node.Line, err)
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+func (d duration) MarshalYAML() (any, error) {
+	return time.Duration(d).String(), nil
+}
+
+// addrList accepts a single server address or a sequence of them, so files written for a
+// single server keep working.
+type addrList []string
+
+func (a *addrList) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*a = addrList{node.Value}
+		return nil
+	}
+	var addrs []string
+	if err := node.Decode(&addrs); err != nil {
+		return err
+	}
+	*a = addrs
+	return nil
+}
+
+func (a addrList) MarshalYAML() (any, error) {
+	if len(a) == 1 {
+		return a[0], nil
+	}
+	return []string(a), nil
+}
+
+func setString(field func(*Config) *string) func(*Config, string) error {
+	return func(c *Config, raw string) error {
+		*field(c) = strings.TrimSpace(raw)
+		return nil
+	}
+}
+
+func setDuration(field func(*Config) *time.Duration) func(*Config, string) error {
+	return func(c *Config, raw string) error {
+		parsed, err := time.ParseDuration(strings.TrimSpace(raw))
+		if err != nil {
+			return err
+		}
+		*field(c) = parsed
+		return nil
+	}
+}
+
+func setBool(field func(*Config) *bool) func(*Config, string) error {
+	return func(c *Config, raw string) error {
+		parsed, err := strconv.ParseBool(strings.TrimSpace(raw))
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", raw)
+		}
+		*field(c) = parsed
+		return nil
+	}
+}
+
+func setInt(field func(*Config) *int) func(*Config, string) error {
+	return func(c *Config, raw string) error {
+		parsed, err := strconv.Atoi(strings.TrimSpace(raw))
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", raw)
+		}
+		*field(c) = parsed
+		return nil
+	}
+}
+
+func setList(field func(*Config) *[]string) func(*Config, string) error {
+	return func(c *Config, raw string) error {
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		*field(c) = items
+		return nil
+	}
+}
+
+func setLabels(field func(*Config) *map[string]string) func(*Config, string) error {
+	return func(c *Config, raw string) error {
+		labels, err := parseLabelList(raw)
+		if err != nil {
+			return err
+		}
+		*field(c) = labels
+		return nil
+	}
+}
+
+func isSpace(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\n' || r == '\r'
+}
+
+func getenv(key, fallback string) string {
+	if val, ok := os.LookupEnv(key); ok {
+		return val
+	}
+	return fallback
 }
@@ -0,0 +1,228 @@
+package agent
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clearEnv unsets every agent variable for the duration of the test.
+func clearEnv(t *testing.T) {
+	t.Helper()
+	for _, env := range []string{"TELEMETRY_AGENT_CONFIG", "TELEMETRY_AGENT_CONFIG_WATCH"} {
+		t.Setenv(env, "")
+		os.Unsetenv(env)
+	}
+	for _, s := range settings {
+		t.Setenv(s.env, "")
+		os.Unsetenv(s.env)
+	}
+}
+
+func writeConfigFile(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "agent.yaml")
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `
+output:
+  type: stdout
+agent:
+  id: from-file
+  interval: 3s
+transport:
+  compression: gzip
+`)
+	tests := []struct {
+		name         string
+		env          map[string]string
+		args         []string
+		wantID       string
+		wantInterval time.Duration
+		wantCompress string
+	}{
+		{
+			name:         "file over default",
+			wantID:       "from-file",
+			wantInterval: 3 * time.Second,
+			wantCompress: "gzip",
+		},
+		{
+			name:         "env over file",
+			env:          map[string]string{"TELEMETRY_AGENT_ID": "from-env", "TELEMETRY_SCRAPE_INTERVAL": "4s"},
+			wantID:       "from-env",
+			wantInterval: 4 * time.Second,
+			wantCompress: "gzip",
+		},
+		{
+			name:         "flag over env",
+			env:          map[string]string{"TELEMETRY_AGENT_ID": "from-env", "TELEMETRY_SCRAPE_INTERVAL": "4s"},
+			args:         []string{"-interval", "5s", "-compression", "zstd"},
+			wantID:       "from-env",
+			wantInterval: 5 * time.Second,
+			wantCompress: "zstd",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv(t)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			cfg, opts, err := LoadConfig(append([]string{"-config", path}, tt.args...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if opts.ConfigPath != path {
+				t.Errorf("ConfigPath = %q, want %q", opts.ConfigPath, path)
+			}
+			if cfg.AgentID != tt.wantID || cfg.Interval != tt.wantInterval || cfg.Compression != tt.wantCompress {
+				t.Fatalf("got id=%q interval=%s compression=%q, want id=%q interval=%s compression=%q",
+					cfg.AgentID, cfg.Interval, cfg.Compression, tt.wantID, tt.wantInterval, tt.wantCompress)
+			}
+		})
+	}
+}
+
+func TestLoadConfigParseErrorsNameTheLayer(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		args []string
+		want string
+	}{
+		{"env", map[string]string{"TELEMETRY_SCRAPE_INTERVAL": "soon"}, nil, "parse TELEMETRY_SCRAPE_INTERVAL"},
+		{"flag", nil, []string{"-interval", "soon"}, "parse -interval"},
+		{"unknown file key", nil, []string{"-config", writeConfigFile(t, "agent:\n  period: 1s\n")}, "field period not found"},
+		{"stray argument", nil, []string{"extra"}, "unexpected arguments: extra"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv(t)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			_, _, err := LoadConfig(tt.args)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("error = %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigPrintConfigSkipsFileChecks(t *testing.T) {
+	clearEnv(t)
+	missing := filepath.Join(t.TempDir(), "missing.pem")
+	args := []string{"-ca-cert", missing, "-client-cert", missing, "-client-key", missing}
+
+	if _, _, err := LoadConfig(args); err == nil || !strings.Contains(err.Error(), "server.caCert") {
+		t.Fatalf("without -print-config: error = %v, want server.caCert", err)
+	}
+	cfg, opts, err := LoadConfig(append(args, "-print-config"))
+	if err != nil {
+		t.Fatalf("with -print-config: %v", err)
+	}
+	if !opts.PrintConfig || cfg.CACertPath != missing {
+		t.Fatalf("PrintConfig = %t, CACertPath = %q", opts.PrintConfig, cfg.CACertPath)
+	}
+	if _, _, err := LoadConfig(append(args, "-print-config", "-interval", "0s")); err == nil {
+		t.Fatal("with -print-config: invalid interval was accepted")
+	}
+}
+
+func TestSettingsTable(t *testing.T) {
+	keys, flags, envs := map[string]bool{}, map[string]bool{}, map[string]bool{}
+	for _, s := range settings {
+		if keys[s.key] || flags[s.flag] || envs[s.env] {
+			t.Errorf("setting %s (-%s, %s) is declared more than once", s.key, s.flag, s.env)
+		}
+		keys[s.key], flags[s.flag], envs[s.env] = true, true, true
+		if !strings.HasPrefix(s.env, "TELEMETRY_") {
+			t.Errorf("setting %s: env %s lacks the TELEMETRY_ prefix", s.key, s.env)
+		}
+		if got := fieldError(s.key, "bad").Error(); !strings.Contains(got, "-"+s.flag) || !strings.Contains(got, s.env) {
+			t.Errorf("fieldError(%s) = %q, want flag and env named", s.key, got)
+		}
+	}
+}
+
+func TestConfigFileRoundTrip(t *testing.T) {
+	want := DefaultConfig()
+	want.ServerAddrs = []string{"a:1", "srv:_telemetry._tcp.example.com"}
+	want.Labels = map[string]string{"env": "prod"}
+	want.Jitter = 250 * time.Millisecond
+	want.ProbeTargets = []string{"db:5432"}
+	want.Sinks = []SinkConfig{{Name: "archive", Output: OutputFile, OutputPath: "/var/lib/agent.jsonl"}}
+
+	var buf bytes.Buffer
+	if err := want.WriteYAML(&buf); err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeConfigFile(buf.Bytes(), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("round trip changed the configuration:\n got %+v\nwant %+v\nyaml:\n%s", got, want, buf.String())
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := func(mutate func(*Config)) Config {
+		cfg := DefaultConfig()
+		cfg.Output = OutputStdout
+		mutate(&cfg)
+		return cfg
+	}
+	tests := []struct {
+		name string
+		cfg  Config
+		want []string
+	}{
+		{"defaults", valid(func(*Config) {}), nil},
+		{"blank agent id", valid(func(c *Config) { c.AgentID = " " }), []string{"agent.id"}},
+		{"agent id with space", valid(func(c *Config) { c.AgentID = "a b" }), []string{"agent.id"}},
+		{"zero interval", valid(func(c *Config) { c.Interval = 0 }), []string{"agent.interval"}},
+		{"jitter not below interval", valid(func(c *Config) { c.Jitter = c.Interval }), []string{"agent.jitter"}},
+		{"no collectors", valid(func(c *Config) { c.Collectors = nil }), []string{"collectors"}},
+		{"unknown collector", valid(func(c *Config) { c.Collectors = []string{"gpu"} }), []string{"collectors"}},
+		{"bad probe target", valid(func(c *Config) { c.ProbeTargets = []string{"db"} }), []string{"probe.targets"}},
+		{"bad health addr", valid(func(c *Config) { c.HealthAddr = "8080" }), []string{"self.listen"}},
+		{"empty buffer", valid(func(c *Config) { c.BufferSize = 0 }), []string{"buffer.size"}},
+		{"max backoff below initial", valid(func(c *Config) { c.MaxRetryBackoff = time.Millisecond }), []string{"buffer.maxRetryBackoff"}},
+		{"unknown compression", valid(func(c *Config) { c.Compression = "lz4" }), []string{"transport.compression"}},
+		{"short keepalive", valid(func(c *Config) { c.KeepaliveTime = time.Second }), []string{"transport.keepaliveTime"}},
+		{"small window", valid(func(c *Config) { c.InitialWindowSize = 1024 }), []string{"transport.initialWindowSize"}},
+		{"sink without name", valid(func(c *Config) { c.Sinks = []SinkConfig{{Output: OutputStdout}} }), []string{"sinks[0].name"}},
+		{"reserved sink name", valid(func(c *Config) { c.Sinks = []SinkConfig{{Name: PrimarySink, Output: OutputStdout}} }), []string{"sinks[0].name"}},
+		{"every problem reported", valid(func(c *Config) { c.Interval = 0; c.Compression = "lz4" }), []string{"agent.interval", "transport.compression"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.Validate()
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("accepted, want errors for %v", tt.want)
+			}
+			for _, key := range tt.want {
+				if !strings.Contains(err.Error(), "  "+key+" ") && !strings.Contains(err.Error(), "  "+key+":") {
+					t.Errorf("error does not name %s:\n%v", key, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package agent
+
+import (
+	"context"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server selection modes.
+const (
+	SelectOrdered = "ordered" // prefer servers in the order they are listed
+	SelectRandom  = "random"  // spread agents across servers
+)
+
+// srvPrefix marks a server address resolved through DNS SRV records, as in
+// "srv:_telemetry._tcp.example.com".
+const srvPrefix = "srv:"
+
+// endpoint is one server the agent can dial.
+type endpoint struct {
+	addr       string // host:port to dial
+	serverName string // name expected in the server certificate
+}
+
+// resolver is the part of net.Resolver endpoint resolution uses.
+type resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// resolveEndpoints expands the configured server addresses into dialable endpoints. SRV
+// names yield their targets in priority and weight order; host names resolving to several
+// addresses (round-robin DNS) yield one endpoint per address that still verifies the
+// certificate against the host name. A host lookup failure keeps the host name as the
+// address so the dial reports the error. An SRV name that fails to resolve has nothing
+// to dial and contributes no endpoint, leaving the other servers to be tried.
+func resolveEndpoints(ctx context.Context, cfg Config, r resolver) []endpoint {
+	var endpoints []endpoint
+	add := func(addr, host string) {
+		name := cfg.ServerName
+		if name == "" {
+			name = host
+		}
+		if !slices.ContainsFunc(endpoints, func(e endpoint) bool { return e.addr == addr }) {
+			endpoints = append(endpoints, endpoint{addr: addr, serverName: name})
+		}
+	}
+	expand := func(host, port string) {
+		if host == "" {
+			host = "localhost"
+		}
+		if net.ParseIP(host) != nil {
+			add(net.JoinHostPort(host, port), host)
+			return
+		}
+		ips, err := r.LookupHost(ctx, host)
+		if err != nil || len(ips) == 0 {
+			add(net.JoinHostPort(host, port), host)
+			return
+		}
+		for _, ip := range ips {
+			add(net.JoinHostPort(ip, port), host)
+		}
+	}
+
+	for _, raw := range cfg.ServerAddrs {
+		if name, ok := strings.CutPrefix(raw, srvPrefix); ok {
+			_, records, err := r.LookupSRV(ctx, "", "", name)
+			if err != nil {
+				continue
+			}
+			for _, rec := range records {
+				expand(strings.TrimSuffix(rec.Target, "."), strconv.Itoa(int(rec.Port)))
+			}
+			continue
+		}
+		host, port, err := net.SplitHostPort(raw)
+		if err != nil {
+			continue
+		}
+		expand(host, port)
+	}
+	return endpoints
+}
+
+// endpointPicker orders endpoints for the next connection attempt. It sticks to the
+// server it last streamed to and moves servers that recently failed or stalled to the
+// back, so they are only retried when nothing else works.
+type endpointPicker struct {
+	mu      sync.Mutex
+	current string
+	failed  map[string]time.Time // address -> end of its cool-down
+}
+
+func newEndpointPicker() *endpointPicker {
+	return &endpointPicker{failed: make(map[string]time.Time)}
+}
+
+func (p *endpointPicker) order(endpoints []endpoint, mode string, now time.Time) []endpoint {
+	ordered := slices.Clone(endpoints)
+	if mode == SelectRandom {
+		rand.Shuffle(len(ordered), func(i, j int) { ordered[i], ordered[j] = ordered[j], ordered[i] })
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	rank := func(e endpoint) int {
+		switch {
+		case now.Before(p.failed[e.addr]):
+			return 2
+		case e.addr == p.current:
+			return 0
+		default:
+			return 1
+		}
+	}
+	slices.SortStableFunc(ordered, func(a, b endpoint) int { return rank(a) - rank(b) })
+	return ordered
+}
+
+// connected records a stream to e and reports whether the agent moved to a different
+// server than the one it streamed to before.
+func (p *endpointPicker) connected(e endpoint) (switched bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switched = p.current != "" && p.current != e.addr
+	p.current = e.addr
+	delete(p.failed, e.addr)
+	return switched
+}
+
+// fail puts e into cool-down; while it lasts other servers are tried first.
+func (p *endpointPicker) fail(e endpoint, coolDown time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.failed[e.addr] = time.Now().Add(coolDown)
+}
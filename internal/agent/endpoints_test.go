@@ -0,0 +1,108 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+// fakeResolver answers lookups from fixed tables; names missing from them fail.
+type fakeResolver struct {
+	hosts map[string][]string
+	srv   map[string][]*net.SRV
+}
+
+func (r fakeResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	if ips, ok := r.hosts[host]; ok {
+		return ips, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+func (r fakeResolver) LookupSRV(_ context.Context, _, _, name string) (string, []*net.SRV, error) {
+	if records, ok := r.srv[name]; ok {
+		return "", records, nil
+	}
+	return "", nil, errors.New("no such host")
+}
+
+func TestResolveEndpoints(t *testing.T) {
+	r := fakeResolver{
+		hosts: map[string][]string{
+			"rr.example.com": {"10.0.0.1", "10.0.0.2"},
+			"a.example.com":  {"10.0.1.1"},
+			"b.example.com":  {"10.0.1.2"},
+		},
+		srv: map[string][]*net.SRV{
+			"_telemetry._tcp.example.com": {
+				{Target: "a.example.com.", Port: 50051},
+				{Target: "b.example.com.", Port: 50052},
+			},
+		},
+	}
+	tests := []struct {
+		name       string
+		addrs      []string
+		serverName string
+		want       []endpoint
+	}{
+		{"ip", []string{"192.0.2.1:50051"}, "", []endpoint{{"192.0.2.1:50051", "192.0.2.1"}}},
+		{"round robin", []string{"rr.example.com:50051"}, "", []endpoint{
+			{"10.0.0.1:50051", "rr.example.com"}, {"10.0.0.2:50051", "rr.example.com"},
+		}},
+		{"srv in record order", []string{"srv:_telemetry._tcp.example.com"}, "", []endpoint{
+			{"10.0.1.1:50051", "a.example.com"}, {"10.0.1.2:50052", "b.example.com"},
+		}},
+		{"failed host lookup kept", []string{"gone.example.com:50051"}, "", []endpoint{{"gone.example.com:50051", "gone.example.com"}}},
+		{"failed srv lookup dropped", []string{"srv:_missing._tcp.example.com", "a.example.com:1"}, "", []endpoint{{"10.0.1.1:1", "a.example.com"}}},
+		{"duplicates merged", []string{"a.example.com:1", "10.0.1.1:1"}, "", []endpoint{{"10.0.1.1:1", "a.example.com"}}},
+		{"server name override", []string{"a.example.com:1"}, "telemetry.internal", []endpoint{{"10.0.1.1:1", "telemetry.internal"}}},
+		{"empty host is localhost", []string{":50051"}, "", []endpoint{{"localhost:50051", "localhost"}}},
+		{"malformed skipped", []string{"no-port"}, "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := resolveEndpoints(context.Background(), Config{ServerAddrs: tt.addrs, ServerName: tt.serverName}, r)
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEndpointPickerFailover(t *testing.T) {
+	a, b, c := endpoint{addr: "a:1"}, endpoint{addr: "b:1"}, endpoint{addr: "c:1"}
+	all := []endpoint{a, b, c}
+	now := time.Now()
+	p := newEndpointPicker()
+
+	if got := p.order(all, SelectOrdered, now); !slices.Equal(got, all) {
+		t.Fatalf("initial order = %v", got)
+	}
+	if p.connected(b) {
+		t.Fatal("first connection reported as a switch")
+	}
+	if got := p.order(all, SelectOrdered, now); !slices.Equal(got, []endpoint{b, a, c}) {
+		t.Fatalf("order after streaming to b = %v, want b first", got)
+	}
+
+	p.fail(b, time.Minute)
+	p.fail(a, time.Minute)
+	if got := p.order(all, SelectOrdered, now); !slices.Equal(got, []endpoint{c, a, b}) {
+		t.Fatalf("order with a and b cooling down = %v, want c first", got)
+	}
+	if got := p.order(all, SelectOrdered, now.Add(2*time.Minute)); !slices.Equal(got, []endpoint{b, a, c}) {
+		t.Fatalf("order after the cool-down = %v, want b first again", got)
+	}
+	if !p.connected(c) {
+		t.Fatal("moving from b to c not reported as a switch")
+	}
+
+	random := p.order(all, SelectRandom, now)
+	if random[0] != c || !slices.ContainsFunc(random, func(e endpoint) bool { return e == a }) {
+		t.Fatalf("random order = %v, want the current server first", random)
+	}
+}
@@ -0,0 +1,45 @@
+package agent
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// NewHealthHandler exposes the agent's liveness, readiness and self-metrics:
+//
+//	/healthz  200 while the sampling loop keeps running
+//	/readyz   200 while a metrics stream to the server is open
+//	/metrics  self-telemetry in the Prometheus text format
+func NewHealthHandler(r *Runner) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		snap := r.SelfSnapshot()
+		last := snap.LastCollect
+		if last.IsZero() {
+			last = r.stats.started
+		}
+		// Allow for an aligned first sample plus one missed interval.
+		if stale := time.Since(last); stale > 3*r.config().Interval {
+			http.Error(w, fmt.Sprintf("no sample collected for %s", stale.Round(time.Second)), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, _ *http.Request) {
+		if !r.primary().stats.connected.Load() {
+			http.Error(w, "not connected to server", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_ = r.SelfSnapshot().WritePrometheus(w)
+	})
+
+	return mux
+}
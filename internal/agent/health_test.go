@@ -0,0 +1,155 @@
+package agent
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"telemetry-agent/pkg/api"
+)
+
+// writeTestCert writes a self-signed certificate for name expiring at notAfter, with its
+// key, into dir and returns both paths.
+func writeTestCert(t *testing.T, dir, name string, notAfter time.Time) (certPath, keyPath string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawKey, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath, keyPath = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: rawKey}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+func newTestRunner(t *testing.T, cfg Config) *Runner {
+	t.Helper()
+	return NewRunner(cfg, slog.New(slog.NewTextHandler(io.Discard, nil)), NewSampler(nil))
+}
+
+func getHealth(t *testing.T, h http.Handler, path string) (int, string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	return rec.Code, rec.Body.String()
+}
+
+func TestHealthzReportsStalledSampling(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Interval = time.Second
+	r := newTestRunner(t, cfg)
+	h := NewHealthHandler(r)
+
+	if code, body := getHealth(t, h, "/healthz"); code != http.StatusOK {
+		t.Fatalf("/healthz right after start = %d %q, want 200", code, body)
+	}
+	r.stats.started = time.Now().Add(-time.Minute)
+	if code, _ := getHealth(t, h, "/healthz"); code != http.StatusServiceUnavailable {
+		t.Fatalf("/healthz with no sample for a minute = %d, want 503", code)
+	}
+	r.stats.lastCollectNs.Store(time.Now().UnixNano())
+	if code, body := getHealth(t, h, "/healthz"); code != http.StatusOK {
+		t.Fatalf("/healthz after a fresh sample = %d %q, want 200", code, body)
+	}
+}
+
+func TestReadyzFollowsPrimaryStream(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Sinks = []SinkConfig{{Name: "archive", Output: OutputStdout}}
+	r := newTestRunner(t, cfg)
+	h := NewHealthHandler(r)
+
+	r.sinkList()[1].stats.connected.Store(true)
+	if code, _ := getHealth(t, h, "/readyz"); code != http.StatusServiceUnavailable {
+		t.Fatalf("/readyz without a primary stream = %d, want 503", code)
+	}
+	r.primary().stats.connected.Store(true)
+	if code, body := getHealth(t, h, "/readyz"); code != http.StatusOK {
+		t.Fatalf("/readyz with the primary stream open = %d %q, want 200", code, body)
+	}
+}
+
+func TestSelfSnapshotReportsSinksAndTLS(t *testing.T) {
+	dir := t.TempDir()
+	caExpiry := time.Now().Add(30 * 24 * time.Hour).Truncate(time.Second)
+	certExpiry := time.Now().Add(7 * 24 * time.Hour).Truncate(time.Second)
+	cfg := DefaultConfig()
+	cfg.BufferSize = 2
+	cfg.CACertPath, _ = writeTestCert(t, dir, "ca", caExpiry)
+	cfg.ClientCertPath, cfg.ClientKeyPath = writeTestCert(t, dir, "client", certExpiry)
+	cfg.Sinks = []SinkConfig{{Name: "archive", Output: OutputStdout, BufferSize: 5}}
+	r := newTestRunner(t, cfg)
+
+	sinks := r.sinkList()
+	if err := sinks[0].tls.refresh(sinks[0].config()); err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		pushSample(sinks, &api.Metric{AgentId: "a"})
+	}
+	sinks[0].stats.dropped.Store(1)
+	sinks[0].stats.connected.Store(true)
+
+	snap := r.SelfSnapshot()
+	if snap.BufferDepth != 2 || snap.SamplesDropped != 1 || !snap.Connected {
+		t.Fatalf("primary depth %d, dropped %d, connected %t; want 2, 1, true", snap.BufferDepth, snap.SamplesDropped, snap.Connected)
+	}
+	if len(snap.Sinks) != 2 || snap.Sinks[1].Name != "archive" || snap.Sinks[1].BufferDepth != 3 || snap.Sinks[1].Connected {
+		t.Fatalf("sinks = %+v, want archive holding 3 samples, disconnected", snap.Sinks)
+	}
+	if !snap.CACertExpiry.Equal(caExpiry) || !snap.ClientCertExpiry.Equal(certExpiry) {
+		t.Fatalf("tls expiry = %s, %s; want %s, %s", snap.CACertExpiry, snap.ClientCertExpiry, caExpiry, certExpiry)
+	}
+
+	_, body := getHealth(t, NewHealthHandler(r), "/metrics")
+	for _, line := range []string{
+		"telemetryx_agent_buffer_depth 2",
+		"telemetryx_agent_samples_dropped_total 1",
+		"telemetryx_agent_connected 1",
+		`telemetryx_agent_sink_buffer_depth{sink="archive"} 3`,
+		`telemetryx_agent_sink_connected{sink="archive"} 0`,
+		fmt.Sprintf("telemetryx_agent_tls_ca_expiry_timestamp_seconds %g", float64(caExpiry.Unix())),
+		fmt.Sprintf("telemetryx_agent_tls_client_cert_expiry_timestamp_seconds %g", float64(certExpiry.Unix())),
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("/metrics lacks %q", line)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// labelRefreshInterval bounds how often dynamic label sources are re-read.
+const labelRefreshInterval = time.Minute
+
+var labelKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Labeler resolves the key/value labels attached to every sample. Static labels come
+// straight from configuration; dynamic labels are read from environment variables or
+// files (for example cloud metadata stubs) and refreshed periodically.
+type Labeler struct {
+	static   map[string]string
+	fromEnv  map[string]string
+	fromFile map[string]string
+
+	mu       sync.Mutex
+	resolved map[string]string
+	expires  time.Time
+}
+
+// NewLabeler builds a resolver for the label sources declared in cfg.
+func NewLabeler(cfg Config) *Labeler {
+	return &Labeler{
+		static:   maps.Clone(cfg.Labels),
+		fromEnv:  maps.Clone(cfg.LabelsFromEnv),
+		fromFile: maps.Clone(cfg.LabelsFromFile),
+	}
+}
+
+// Labels returns the current label set. Dynamic sources that are unset or unreadable are
+// skipped so a missing metadata file never blocks sampling.
+func (l *Labeler) Labels() map[string]string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if l.resolved != nil && now.Before(l.expires) {
+		return l.resolved
+	}
+
+	labels := make(map[string]string, len(l.static)+len(l.fromEnv)+len(l.fromFile))
+	maps.Copy(labels, l.static)
+	for key, env := range l.fromEnv {
+		if val := strings.TrimSpace(os.Getenv(env)); val != "" {
+			labels[key] = val
+		}
+	}
+	for key, path := range l.fromFile {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		if val := strings.TrimSpace(string(raw)); val != "" {
+			labels[key] = val
+		}
+	}
+
+	l.resolved = labels
+	l.expires = now.Add(labelRefreshInterval)
+	return labels
+}
+
+// parseLabelList decodes "key=value,key2=value2" into a map.
+func parseLabelList(raw string) (map[string]string, error) {
+	out := make(map[string]string)
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		key, val, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("label %q must use key=value form", part)
+		}
+		out[strings.TrimSpace(key)] = strings.TrimSpace(val)
+	}
+	return out, nil
+}
+
+// validateLabels checks label keys and makes sure no key is declared by more than one source.
+func validateLabels(cfg Config) error {
+	var errs []error
+	seen := make(map[string]string)
+	sources := []struct {
+		key    string
+		labels map[string]string
+	}{
+		{"labels.static", cfg.Labels},
+		{"labels.fromEnv", cfg.LabelsFromEnv},
+		{"labels.fromFile", cfg.LabelsFromFile},
+	}
+
+	for _, src := range sources {
+		keys := make([]string, 0, len(src.labels))
+		for key := range src.labels {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if !labelKeyPattern.MatchString(key) {
+				errs = append(errs, fieldError(src.key, fmt.Sprintf("label key %q must match %s", key, labelKeyPattern)))
+				continue
+			}
+			if src.labels[key] == "" {
+				errs = append(errs, fieldError(src.key, fmt.Sprintf("label %q has an empty value", key)))
+			}
+			if prev, dup := seen[key]; dup {
+				errs = append(errs, fieldError(src.key, fmt.Sprintf("label %q is already declared in %s", key, prev)))
+			}
+			seen[key] = src.key
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -2,7 +2,10 @@ package agent
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"runtime"
+	"sync"
 	"time"
 
 	"github.com/shirou/gopsutil/v3/cpu"
@@ -15,17 +18,147 @@ import (
 	"telemetry-agent/pkg/api"
 )
 
+// KnownCollectors lists the collectors a sampler can run, in sampling order.
+var KnownCollectors = []string{"memory", "cpu", "network", "disk", "load", "probe"}
+
+// collector fills its part of a metric. Failures of a required collector abort the
+// sample; optional collectors only record the error.
+type collector struct {
+	name     string
+	required bool
+	collect  func(s *Sampler, ctx context.Context, metric *api.Metric) error
+}
+
+var collectors = []collector{
+	{"memory", true, (*Sampler).collectMemory},
+	{"cpu", true, (*Sampler).collectCPU},
+	{"network", true, (*Sampler).collectNetwork},
+	{"disk", false, (*Sampler).collectDisk},
+	{"load", false, (*Sampler).collectLoad},
+	{"probe", false, (*Sampler).collectProbe},
+}
+
+// CollectorStats describes the most recent runs of one collector.
+type CollectorStats struct {
+	LastDuration time.Duration
+	Runs         uint64
+	Errors       uint64
+}
+
 // Sampler gathers system metrics in a threadsafe manner.
-type Sampler struct{}
+type Sampler struct {
+	mu      sync.RWMutex
+	enabled map[string]bool
+	targets []string
 
-// NewSampler returns a ready-to-use sampler instance.
-func NewSampler() *Sampler { return &Sampler{} }
+	// sampleMu serialises Sample so CPU deltas are taken between consecutive calls.
+	sampleMu sync.Mutex
+	prevCPU  *cpu.TimesStat
+
+	statsMu sync.Mutex
+	stats   map[string]CollectorStats
+}
+
+// NewSampler returns a sampler running the named collectors.
+func NewSampler(collectors []string) *Sampler {
+	s := &Sampler{stats: make(map[string]CollectorStats)}
+	s.SetCollectors(collectors)
+	return s
+}
+
+// SetCollectors replaces the set of enabled collectors.
+func (s *Sampler) SetCollectors(collectors []string) {
+	enabled := make(map[string]bool, len(collectors))
+	for _, name := range collectors {
+		enabled[name] = true
+	}
+
+	s.mu.Lock()
+	s.enabled = enabled
+	s.mu.Unlock()
+}
+
+// SetProbeTargets replaces the host:port targets checked by the probe collector.
+func (s *Sampler) SetProbeTargets(targets []string) {
+	s.mu.Lock()
+	s.targets = targets
+	s.mu.Unlock()
+}
 
-// Sample queries the host for CPU, memory, and network utilisation.
+// Stats returns a snapshot of per-collector timings and error counts.
+func (s *Sampler) Stats() map[string]CollectorStats {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+
+	out := make(map[string]CollectorStats, len(s.stats))
+	for name, st := range s.stats {
+		out[name] = st
+	}
+	return out
+}
+
+// Sample runs every enabled collector once. CollectedAt is the moment sampling started;
+// CPU utilisation is the average since the previous call, so no collector blocks.
 func (s *Sampler) Sample(ctx context.Context, agentID string) (*api.Metric, error) {
+	s.sampleMu.Lock()
+	defer s.sampleMu.Unlock()
+
+	s.mu.RLock()
+	enabled := s.enabled
+	s.mu.RUnlock()
+
+	metric := &api.Metric{AgentId: agentID, CollectedAt: timestamppb.Now()}
+
+	var errs []error
+	for _, c := range collectors {
+		if !enabled[c.name] {
+			continue
+		}
+
+		start := time.Now()
+		err := c.collect(s, ctx, metric)
+		s.record(c.name, time.Since(start), err)
+
+		if err != nil {
+			if c.required {
+				return nil, err
+			}
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return metric, &PartialSampleError{Err: errors.Join(errs...)}
+	}
+	return metric, nil
+}
+
+// PartialSampleError reports optional collectors that failed; the accompanying metric
+// is still usable.
+type PartialSampleError struct {
+	Err error
+}
+
+func (e *PartialSampleError) Error() string { return "partial sample: " + e.Err.Error() }
+func (e *PartialSampleError) Unwrap() error { return e.Err }
+
+func (s *Sampler) record(name string, elapsed time.Duration, err error) {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+
+	st := s.stats[name]
+	st.LastDuration = elapsed
+	st.Runs++
+	if err != nil {
+		st.Errors++
+	}
+	s.stats[name] = st
+}
+
+func (s *Sampler) collectMemory(ctx context.Context, metric *api.Metric) error {
 	vm, err := mem.VirtualMemoryWithContext(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("collect virtual memory metrics: %w", err)
+		return fmt.Errorf("collect virtual memory metrics: %w", err)
 	}
 
 	usedBytes := vm.Used
@@ -40,52 +173,99 @@ func (s *Sampler) Sample(ctx context.Context, agentID string) (*api.Metric, erro
 		memPercent = (float64(usedBytes) / float64(vm.Total)) * 100
 	}
 
-	cpuPercent, err := cpu.PercentWithContext(ctx, 200*time.Millisecond, false)
+	metric.MemoryUsage = usedBytes
+	metric.MemoryPercent = memPercent
+	return nil
+}
+
+// collectCPU reports utilisation between this call and the previous one. The first call
+// falls back to the average since boot.
+func (s *Sampler) collectCPU(ctx context.Context, metric *api.Metric) error {
+	times, err := cpu.TimesWithContext(ctx, false)
 	if err != nil {
-		return nil, fmt.Errorf("collect cpu metrics: %w", err)
+		return fmt.Errorf("collect cpu metrics: %w", err)
+	}
+	if len(times) == 0 {
+		return fmt.Errorf("collect cpu metrics: no cpu times reported")
 	}
 
-	netCounters, err := gnet.IOCountersWithContext(ctx, false)
-	if err != nil {
-		return nil, fmt.Errorf("collect network metrics: %w", err)
+	current := times[0]
+	var prev cpu.TimesStat
+	if s.prevCPU != nil {
+		prev = *s.prevCPU
 	}
+	s.prevCPU = &current
 
-	diskCounters, _ := disk.IOCountersWithContext(ctx)
-	loadAvg, _ := load.AvgWithContext(ctx)
+	metric.CpuUsage = busyPercent(prev, current)
+	return nil
+}
 
-	var totalSent, totalRecv uint64
+func (s *Sampler) collectNetwork(ctx context.Context, metric *api.Metric) error {
+	netCounters, err := gnet.IOCountersWithContext(ctx, false)
+	if err != nil {
+		return fmt.Errorf("collect network metrics: %w", err)
+	}
 	if len(netCounters) > 0 {
-		totalSent = netCounters[0].BytesSent
-		totalRecv = netCounters[0].BytesRecv
+		metric.NetworkTxBytes = netCounters[0].BytesSent
+		metric.NetworkRxBytes = netCounters[0].BytesRecv
 	}
+	return nil
+}
 
-	var totalDiskRead, totalDiskWrite uint64
+func (s *Sampler) collectDisk(ctx context.Context, metric *api.Metric) error {
+	diskCounters, err := disk.IOCountersWithContext(ctx)
+	if err != nil {
+		return fmt.Errorf("collect disk metrics: %w", err)
+	}
 	for _, counter := range diskCounters {
-		totalDiskRead += counter.ReadBytes
-		totalDiskWrite += counter.WriteBytes
+		metric.DiskReadBytes += counter.ReadBytes
+		metric.DiskWriteBytes += counter.WriteBytes
 	}
+	return nil
+}
 
-	metric := &api.Metric{
-		CpuUsage:       firstOrZero(cpuPercent),
-		MemoryUsage:    usedBytes,
-		MemoryPercent:  memPercent,
-		NetworkTxBytes: totalSent,
-		NetworkRxBytes: totalRecv,
-		DiskReadBytes:  totalDiskRead,
-		DiskWriteBytes: totalDiskWrite,
-		LoadAvg_1:      loadAvg.Load1,
-		LoadAvg_5:      loadAvg.Load5,
-		LoadAvg_15:     loadAvg.Load15,
-		AgentId:        agentID,
-		CollectedAt:    timestamppb.Now(),
+func (s *Sampler) collectLoad(ctx context.Context, metric *api.Metric) error {
+	loadAvg, err := load.AvgWithContext(ctx)
+	if err != nil {
+		return fmt.Errorf("collect load metrics: %w", err)
 	}
+	metric.LoadAvg_1 = loadAvg.Load1
+	metric.LoadAvg_5 = loadAvg.Load5
+	metric.LoadAvg_15 = loadAvg.Load15
+	return nil
+}
 
-	return metric, nil
+func (s *Sampler) collectProbe(ctx context.Context, metric *api.Metric) error {
+	s.mu.RLock()
+	targets := s.targets
+	s.mu.RUnlock()
+
+	if len(targets) > 0 {
+		metric.Values = probeTargets(ctx, targets)
+	}
+	return nil
 }
 
-func firstOrZero(values []float64) float64 {
-	if len(values) == 0 {
+// busyPercent computes CPU utilisation between two cumulative readings the same way
+// gopsutil does for its blocking variant.
+func busyPercent(prev, cur cpu.TimesStat) float64 {
+	prevAll, prevBusy := cpuBusy(prev)
+	curAll, curBusy := cpuBusy(cur)
+
+	if curBusy <= prevBusy {
 		return 0
 	}
-	return values[0]
+	if curAll <= prevAll {
+		return 100
+	}
+	return min(100, max(0, (curBusy-prevBusy)/(curAll-prevAll)*100))
+}
+
+func cpuBusy(t cpu.TimesStat) (total, busy float64) {
+	total = t.User + t.System + t.Idle + t.Nice + t.Iowait + t.Irq + t.Softirq + t.Steal
+	if runtime.GOOS != "linux" {
+		// Linux already accounts guest time inside user and nice.
+		total += t.Guest + t.GuestNice
+	}
+	return total, total - t.Idle - t.Iowait
 }
@@ -0,0 +1,190 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+
+	"telemetry-agent/pkg/api"
+)
+
+// Formats accepted by WriteMetric.
+const (
+	FormatJSON  = "json"
+	FormatProm  = "prom"
+	FormatTable = "table"
+)
+
+// Formats lists the names accepted by -format.
+var Formats = []string{FormatJSON, FormatProm, FormatTable}
+
+// onceWindow is how long SampleOnce waits between its two CPU readings, so the reported
+// utilisation reflects the present rather than the average since boot.
+const onceWindow = 500 * time.Millisecond
+
+// SampleOnce takes a single labelled sample with cfg without a server connection. A
+// failing optional collector is reported as a *PartialSampleError next to the metric.
+func SampleOnce(ctx context.Context, cfg Config) (*api.Metric, error) {
+	sampler := NewSampler(cfg.Collectors)
+	sampler.SetProbeTargets(cfg.ProbeTargets)
+
+	if slices.Contains(cfg.Collectors, "cpu") {
+		if err := sampler.collectCPU(ctx, &api.Metric{}); err != nil {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(onceWindow):
+		}
+	}
+
+	metric, err := sampler.Sample(ctx, cfg.AgentID)
+	if metric != nil {
+		metric.Labels = NewLabeler(cfg).Labels()
+	}
+	return metric, err
+}
+
+// WriteMetric renders metric in one of Formats.
+func WriteMetric(w io.Writer, metric *api.Metric, format string) error {
+	switch format {
+	case FormatJSON:
+		data, err := protojson.MarshalOptions{Multiline: true, Indent: "  "}.Marshal(metric)
+		if err != nil {
+			return fmt.Errorf("encode metric: %w", err)
+		}
+		_, err = fmt.Fprintf(w, "%s\n", data)
+		return err
+	case FormatProm:
+		return writeMetricPrometheus(w, metric)
+	case FormatTable:
+		return writeMetricTable(w, metric)
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+}
+
+func writeMetricPrometheus(w io.Writer, metric *api.Metric) error {
+	labels := []string{promLabel("agent_id", metric.GetAgentId())}
+	for _, key := range slices.Sorted(maps.Keys(metric.GetLabels())) {
+		labels = append(labels, promLabel(key, metric.GetLabels()[key]))
+	}
+	base := strings.Join(labels, ",")
+	stamp := metric.GetCollectedAt().AsTime().UnixMilli()
+
+	var err error
+	write := func(name, help, kind string, value float64) {
+		if err != nil {
+			return
+		}
+		_, err = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s{%s} %g %d\n", name, help, name, kind, name, base, value, stamp)
+	}
+
+	write("telemetryx_cpu_usage_percent", "CPU utilisation since the previous sample.", "gauge", metric.GetCpuUsage())
+	write("telemetryx_memory_usage_bytes", "Memory in use.", "gauge", float64(metric.GetMemoryUsage()))
+	write("telemetryx_memory_usage_percent", "Memory in use as a share of the total.", "gauge", metric.GetMemoryPercent())
+	write("telemetryx_network_tx_bytes_total", "Bytes sent on all interfaces.", "counter", float64(metric.GetNetworkTxBytes()))
+	write("telemetryx_network_rx_bytes_total", "Bytes received on all interfaces.", "counter", float64(metric.GetNetworkRxBytes()))
+	write("telemetryx_disk_read_bytes_total", "Bytes read from all disks.", "counter", float64(metric.GetDiskReadBytes()))
+	write("telemetryx_disk_write_bytes_total", "Bytes written to all disks.", "counter", float64(metric.GetDiskWriteBytes()))
+	write("telemetryx_load_average_1m", "One-minute load average.", "gauge", metric.GetLoadAvg_1())
+	write("telemetryx_load_average_5m", "Five-minute load average.", "gauge", metric.GetLoadAvg_5())
+	write("telemetryx_load_average_15m", "Fifteen-minute load average.", "gauge", metric.GetLoadAvg_15())
+	if err != nil || len(metric.GetValues()) == 0 {
+		return err
+	}
+
+	if _, err := fmt.Fprint(w, "# HELP telemetryx_value Named values reported by collectors.\n# TYPE telemetryx_value gauge\n"); err != nil {
+		return err
+	}
+	for _, name := range slices.Sorted(maps.Keys(metric.GetValues())) {
+		if _, err := fmt.Fprintf(w, "telemetryx_value{%s,%s} %g %d\n", base, promLabel("name", name), metric.GetValues()[name], stamp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// promEscaper escapes label values as the Prometheus text format specifies: only
+// backslash, double quote and line feed. Everything else, including non-ASCII, is
+// written verbatim.
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// promLabel formats one name="value" label pair.
+func promLabel(name, value string) string {
+	return name + `="` + promEscaper.Replace(value) + `"`
+}
+
+func writeMetricTable(w io.Writer, metric *api.Metric) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	row := func(name, value string) { fmt.Fprintf(tw, "%s\t%s\n", name, value) }
+
+	row("agent", metric.GetAgentId())
+	row("collected at", metric.GetCollectedAt().AsTime().Format(time.RFC3339Nano))
+	for _, key := range slices.Sorted(maps.Keys(metric.GetLabels())) {
+		row("label "+key, metric.GetLabels()[key])
+	}
+	row("cpu", fmt.Sprintf("%.1f%%", metric.GetCpuUsage()))
+	row("memory", fmt.Sprintf("%d bytes (%.1f%%)", metric.GetMemoryUsage(), metric.GetMemoryPercent()))
+	row("network tx/rx", fmt.Sprintf("%d / %d bytes", metric.GetNetworkTxBytes(), metric.GetNetworkRxBytes()))
+	row("disk read/write", fmt.Sprintf("%d / %d bytes", metric.GetDiskReadBytes(), metric.GetDiskWriteBytes()))
+	row("load 1m/5m/15m", fmt.Sprintf("%.2f / %.2f / %.2f", metric.GetLoadAvg_1(), metric.GetLoadAvg_5(), metric.GetLoadAvg_15()))
+	for _, name := range slices.Sorted(maps.Keys(metric.GetValues())) {
+		row(name, fmt.Sprintf("%g", metric.GetValues()[name]))
+	}
+	return tw.Flush()
+}
+
+// writeLines drains the buffer of sink s as JSON lines into standard output or
+// cfg.OutputPath instead of a server stream. It returns when ctx is cancelled or a write
+// fails.
+func writeLines(ctx context.Context, s *sink, cfg Config) (connected bool, err error) {
+	out := io.Writer(os.Stdout)
+	if cfg.Output == OutputFile {
+		f, err := os.OpenFile(cfg.OutputPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return false, fmt.Errorf("open output file: %w", err)
+		}
+		defer func() {
+			if cerr := f.Close(); cerr != nil {
+				s.logger.Warn("closing output file", "error", cerr)
+			}
+		}()
+		out = f
+	}
+
+	s.logger.Info("writing samples as JSON lines", "output", cfg.Output, "path", cfg.OutputPath, "buffered", s.buffer.Len())
+	s.stats.streams.Add(1)
+	s.stats.connected.Store(true)
+	defer s.stats.connected.Store(false)
+
+	for {
+		metric, err := s.buffer.Peek(ctx)
+		if err != nil {
+			return true, context.Cause(ctx)
+		}
+		line, err := protojson.Marshal(metric)
+		if err != nil {
+			// A sample that cannot be encoded would block the buffer forever.
+			s.buffer.Remove(metric)
+			s.logger.Error("encode metric", "error", err)
+			continue
+		}
+		line = append(line, '\n')
+		if _, err := out.Write(line); err != nil {
+			return true, fmt.Errorf("write metric: %w", err)
+		}
+		s.buffer.Remove(metric)
+		s.stats.sent.Add(1)
+		s.stats.lastSendNs.Store(time.Now().UnixNano())
+	}
+}
@@ -0,0 +1,28 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"telemetry-agent/pkg/api"
+)
+
+func TestWriteMetricPrometheusEscapesLabels(t *testing.T) {
+	metric := &api.Metric{
+		AgentId:     "host-é",
+		CollectedAt: timestamppb.New(time.Unix(1700000000, 0)),
+		Labels:      map[string]string{"path": `C:\data "x"` + "\nnext"},
+		Values:      map[string]float64{"probe.ok": 1},
+	}
+	var out strings.Builder
+	if err := WriteMetric(&out, metric, FormatProm); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	want := `telemetryx_value{agent_id="host-é",path="C:\\data \"x\"\nnext",name="probe.ok"} 1 1700000000000`
+	if !strings.Contains(out.String(), want+"\n") {
+		t.Fatalf("output lacks %s:\n%s", want, out.String())
+	}
+}
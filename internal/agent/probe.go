@@ -0,0 +1,50 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// probeTimeout caps how long a single TCP probe may take.
+const probeTimeout = 2 * time.Second
+
+// probeTargets dials every host:port target concurrently and reports reachability and
+// connect latency as "probe.<target>.up" (1 or 0) and "probe.<target>.latency_seconds".
+func probeTargets(ctx context.Context, targets []string) map[string]float64 {
+	values := make(map[string]float64, 2*len(targets))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for _, target := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			dialCtx, cancel := context.WithTimeout(ctx, probeTimeout)
+			defer cancel()
+
+			start := time.Now()
+			var d net.Dialer
+			conn, err := d.DialContext(dialCtx, "tcp", target)
+			elapsed := time.Since(start)
+
+			up := 0.0
+			if err == nil {
+				up = 1
+				conn.Close()
+			}
+
+			mu.Lock()
+			values["probe."+target+".up"] = up
+			if err == nil {
+				values["probe."+target+".latency_seconds"] = elapsed.Seconds()
+			}
+			mu.Unlock()
+		}()
+	}
+
+	wg.Wait()
+	return values
+}
@@ -0,0 +1,91 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"telemetry-agent/pkg/api"
+)
+
+// receive consumes server messages until the stream ends, applying pushed configuration
+// when applyConfig is set and cancelling the stream when the server goes away.
+func (r *Runner) receive(stream api.Telemetry_StreamMetricsClient, cancel func(error), applyConfig bool) {
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = errors.New("server closed the stream")
+			}
+			cancel(fmt.Errorf("receive: %w", err))
+			return
+		}
+		if cfg := msg.GetConfig(); cfg != nil && applyConfig && r.addressed(msg) {
+			r.applyRemote(cfg)
+		}
+	}
+}
+
+// addressed reports whether msg is meant for this agent. Messages without an agent ID
+// come from servers that predate multiplexed streams.
+func (r *Runner) addressed(msg *api.ServerMessage) bool {
+	return msg.GetAgentId() == "" || msg.GetAgentId() == r.config().AgentID
+}
+
+// applyRemote layers a server-pushed configuration over the local one. A rejected
+// configuration leaves the current settings untouched; either way the outcome is
+// acknowledged on the next sample.
+func (r *Runner) applyRemote(remote *api.AgentConfig) {
+	r.mu.Lock()
+	local, acked := r.local, r.ackVersion
+	r.mu.Unlock()
+
+	version := remote.GetVersion()
+	if version == acked {
+		return
+	}
+
+	if version == 0 {
+		r.mu.Lock()
+		r.remote, r.ackVersion, r.ackErr = nil, 0, ""
+		r.mu.Unlock()
+		r.activate(local, local)
+		r.logger.Info("remote configuration withdrawn, using local settings")
+		return
+	}
+
+	merged, err := mergeRemote(local, remote)
+	if err != nil {
+		r.mu.Lock()
+		r.ackVersion, r.ackErr = version, err.Error()
+		r.mu.Unlock()
+		r.logger.Error("remote configuration rejected", "version", version, "error", err)
+		return
+	}
+
+	r.mu.Lock()
+	r.remote, r.ackVersion, r.ackErr = remote, version, ""
+	r.mu.Unlock()
+	r.activate(local, merged)
+	r.logger.Info("remote configuration applied", "version", version, "interval", merged.Interval, "collectors", merged.Collectors, "probe_targets", merged.ProbeTargets)
+}
+
+// mergeRemote overlays the fields set in remote onto local and validates the result.
+func mergeRemote(local Config, remote *api.AgentConfig) (Config, error) {
+	merged := local
+	if remote.GetInterval() != nil {
+		merged.Interval = remote.GetInterval().AsDuration()
+	}
+	if len(remote.GetCollectors()) > 0 {
+		merged.Collectors = slices.Clone(remote.GetCollectors())
+	}
+	if remote.GetProbeTargets() != nil {
+		merged.ProbeTargets = slices.Clone(remote.GetProbeTargets())
+	}
+
+	if err := merged.Validate(); err != nil {
+		return Config{}, err
+	}
+	return merged, nil
+}
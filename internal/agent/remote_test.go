@@ -0,0 +1,101 @@
+package agent
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"telemetry-agent/pkg/api"
+)
+
+func TestMergeRemote(t *testing.T) {
+	local := DefaultConfig()
+	local.Output = OutputStdout
+	local.Interval = 10 * time.Second
+	local.Collectors = []string{"cpu", "memory"}
+	local.ProbeTargets = []string{"db:5432"}
+
+	tests := []struct {
+		name           string
+		remote         *api.AgentConfig
+		wantInterval   time.Duration
+		wantCollectors []string
+		wantTargets    []string
+		wantErr        string
+	}{
+		{
+			name:           "empty keeps local",
+			remote:         &api.AgentConfig{Version: 1},
+			wantInterval:   10 * time.Second,
+			wantCollectors: []string{"cpu", "memory"},
+			wantTargets:    []string{"db:5432"},
+		},
+		{
+			name:           "remote overrides every field",
+			remote:         &api.AgentConfig{Version: 2, Interval: durationpb.New(30 * time.Second), Collectors: []string{"load"}, ProbeTargets: []string{"cache:6379"}},
+			wantInterval:   30 * time.Second,
+			wantCollectors: []string{"load"},
+			wantTargets:    []string{"cache:6379"},
+		},
+		{
+			name:           "empty target list clears targets",
+			remote:         &api.AgentConfig{Version: 3, ProbeTargets: []string{}},
+			wantInterval:   10 * time.Second,
+			wantCollectors: []string{"cpu", "memory"},
+			wantTargets:    []string{},
+		},
+		{
+			name:    "invalid interval rejected",
+			remote:  &api.AgentConfig{Version: 4, Interval: durationpb.New(0)},
+			wantErr: "agent.interval",
+		},
+		{
+			name:    "unknown collector rejected",
+			remote:  &api.AgentConfig{Version: 5, Collectors: []string{"gpu"}},
+			wantErr: "collectors",
+		},
+		{
+			name:    "bad probe target rejected",
+			remote:  &api.AgentConfig{Version: 6, ProbeTargets: []string{"db"}},
+			wantErr: "probe.targets",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			merged, err := mergeRemote(local, tt.remote)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want it to name %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if merged.Interval != tt.wantInterval || !slices.Equal(merged.Collectors, tt.wantCollectors) || !slices.Equal(merged.ProbeTargets, tt.wantTargets) {
+				t.Fatalf("merged interval=%s collectors=%v targets=%v, want %s %v %v",
+					merged.Interval, merged.Collectors, merged.ProbeTargets, tt.wantInterval, tt.wantCollectors, tt.wantTargets)
+			}
+			if merged.AgentID != local.AgentID || merged.Output != local.Output {
+				t.Fatal("settings the server does not manage changed")
+			}
+		})
+	}
+}
+
+func TestMergeRemoteDoesNotAliasRemote(t *testing.T) {
+	local := DefaultConfig()
+	local.Output = OutputStdout
+	remote := &api.AgentConfig{Version: 1, Collectors: []string{"cpu"}}
+	merged, err := mergeRemote(local, remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote.Collectors[0] = "gpu"
+	if merged.Collectors[0] != "cpu" {
+		t.Fatal("merged configuration shares the collectors slice of the message")
+	}
+}
@@ -0,0 +1,41 @@
+package agent
+
+import (
+	"hash/fnv"
+	"time"
+)
+
+// jitterOffset spreads agents across [0, maxJitter) with a stable per-agent offset so a
+// fleet sharing the same interval does not hit the server on the same instant.
+func jitterOffset(agentID string, maxJitter time.Duration) time.Duration {
+	if maxJitter <= 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write([]byte(agentID))
+	return time.Duration(h.Sum64() % uint64(maxJitter))
+}
+
+// nextSample returns when the next sample should be taken and the timestamp it should
+// carry. Aligned samples fire on the first interval boundary (plus the agent's jitter
+// offset) after now and are stamped with the boundary itself; unaligned samples fire one
+// interval after the previous one and are stamped when they fire.
+func nextSample(now, prev time.Time, cfg Config) (fireAt, stamp time.Time) {
+	if !cfg.Align {
+		if prev.IsZero() {
+			return now, now
+		}
+		fireAt = prev.Add(cfg.Interval)
+		if fireAt.Before(now) {
+			fireAt = now
+		}
+		return fireAt, fireAt
+	}
+
+	offset := jitterOffset(cfg.AgentID, cfg.Jitter)
+	boundary := now.Truncate(cfg.Interval)
+	if !boundary.Add(offset).After(now) {
+		boundary = boundary.Add(cfg.Interval)
+	}
+	return boundary.Add(offset), boundary
+}
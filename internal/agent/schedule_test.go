@@ -0,0 +1,95 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/cpu"
+)
+
+func TestNextSampleUnaligned(t *testing.T) {
+	cfg := Config{AgentID: "a", Interval: 10 * time.Second}
+	now := time.Date(2024, 5, 1, 10, 0, 3, 0, time.UTC)
+
+	if fireAt, stamp := nextSample(now, time.Time{}, cfg); !fireAt.Equal(now) || !stamp.Equal(now) {
+		t.Fatalf("first sample at %v stamped %v, want now", fireAt, stamp)
+	}
+	prev := now.Add(-4 * time.Second)
+	if fireAt, stamp := nextSample(now, prev, cfg); !fireAt.Equal(prev.Add(cfg.Interval)) || !stamp.Equal(fireAt) {
+		t.Fatalf("next sample at %v stamped %v, want one interval after the previous", fireAt, stamp)
+	}
+	// A sample overdue after a stall fires at once instead of catching up.
+	late := now.Add(-time.Minute)
+	if fireAt, _ := nextSample(now, late, cfg); !fireAt.Equal(now) {
+		t.Fatalf("overdue sample at %v, want now", fireAt)
+	}
+}
+
+func TestNextSampleAligned(t *testing.T) {
+	boundary := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	cfg := Config{AgentID: "a", Interval: 10 * time.Second, Align: true}
+	tests := []struct {
+		now, fireAt, stamp time.Time
+	}{
+		{boundary.Add(3 * time.Second), boundary.Add(10 * time.Second), boundary.Add(10 * time.Second)},
+		{boundary, boundary.Add(10 * time.Second), boundary.Add(10 * time.Second)},
+		{boundary.Add(-time.Nanosecond), boundary, boundary},
+	}
+	for _, tt := range tests {
+		fireAt, stamp := nextSample(tt.now, tt.now.Add(-cfg.Interval), cfg)
+		if !fireAt.Equal(tt.fireAt) || !stamp.Equal(tt.stamp) {
+			t.Errorf("now %v: fire at %v stamped %v, want %v stamped %v", tt.now.Format(time.TimeOnly), fireAt, stamp, tt.fireAt, tt.stamp)
+		}
+	}
+
+	cfg.Jitter = 5 * time.Second
+	offset := jitterOffset(cfg.AgentID, cfg.Jitter)
+	// Within the offset after a boundary the sample for that boundary is still due.
+	fireAt, stamp := nextSample(boundary.Add(offset/2), time.Time{}, cfg)
+	if !fireAt.Equal(boundary.Add(offset)) || !stamp.Equal(boundary) {
+		t.Fatalf("jittered sample at %v stamped %v, want %v stamped %v", fireAt, stamp, boundary.Add(offset), boundary)
+	}
+	fireAt, stamp = nextSample(boundary.Add(offset), time.Time{}, cfg)
+	if want := boundary.Add(cfg.Interval); !fireAt.Equal(want.Add(offset)) || !stamp.Equal(want) {
+		t.Fatalf("jittered sample at %v stamped %v, want the next boundary", fireAt, stamp)
+	}
+}
+
+func TestJitterOffset(t *testing.T) {
+	if got := jitterOffset("a", 0); got != 0 {
+		t.Fatalf("offset without jitter = %v", got)
+	}
+	seen := make(map[time.Duration]bool)
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		offset := jitterOffset(id, time.Second)
+		if offset < 0 || offset >= time.Second {
+			t.Fatalf("offset of %s = %v, outside [0, 1s)", id, offset)
+		}
+		if again := jitterOffset(id, time.Second); again != offset {
+			t.Fatalf("offset of %s changed from %v to %v", id, offset, again)
+		}
+		seen[offset] = true
+	}
+	if len(seen) < 2 {
+		t.Fatal("every agent got the same offset")
+	}
+}
+
+func TestBusyPercent(t *testing.T) {
+	prev := cpu.TimesStat{User: 100, System: 50, Idle: 800, Iowait: 50}
+	tests := []struct {
+		name string
+		cur  cpu.TimesStat
+		want float64
+	}{
+		{"quarter busy", cpu.TimesStat{User: 120, System: 55, Idle: 870, Iowait: 55}, 25},
+		{"idle", cpu.TimesStat{User: 100, System: 50, Idle: 900, Iowait: 50}, 0},
+		{"fully busy", cpu.TimesStat{User: 200, System: 50, Idle: 800, Iowait: 50}, 100},
+		{"counters went backwards", cpu.TimesStat{User: 10, System: 5, Idle: 80, Iowait: 5}, 0},
+	}
+	for _, tt := range tests {
+		if got := busyPercent(prev, tt.cur); got != tt.want {
+			t.Errorf("%s: busyPercent = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
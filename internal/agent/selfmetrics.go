@@ -0,0 +1,206 @@
+package agent
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// SelfMetricPrefix is the namespace reserved for the agent's own metrics in
+// Metric.values; collectors must not emit names starting with it.
+const SelfMetricPrefix = "agent."
+
+// runnerStats counts what the runner does so operators can judge agent health.
+type runnerStats struct {
+	started       time.Time
+	collected     atomic.Uint64
+	sampleErrors  atomic.Uint64
+	lastCollectNs atomic.Int64
+}
+
+// SelfSnapshot is a point-in-time copy of the agent's own counters. The delivery fields
+// describe the primary destination; Sinks has them for every destination.
+type SelfSnapshot struct {
+	Uptime           time.Duration
+	SamplesCollected uint64
+	SamplesSent      uint64
+	SamplesDropped   uint64
+	SampleErrors     uint64
+	BufferDepth      int
+	Reconnects       uint64
+	Failovers        uint64
+	Connected        bool
+	LastCollect      time.Time
+	LastSend         time.Time
+	CACertExpiry     time.Time
+	ClientCertExpiry time.Time
+	Collectors       map[string]CollectorStats
+	Sinks            []SinkSnapshot
+}
+
+// SinkSnapshot is the delivery state of one destination.
+type SinkSnapshot struct {
+	Name           string
+	SamplesSent    uint64
+	SamplesDropped uint64
+	BufferDepth    int
+	Reconnects     uint64
+	Failovers      uint64
+	Connected      bool
+	LastSend       time.Time
+}
+
+func (s *sink) snapshot() SinkSnapshot {
+	snap := SinkSnapshot{
+		Name:           s.name,
+		SamplesSent:    s.stats.sent.Load(),
+		SamplesDropped: s.stats.dropped.Load(),
+		BufferDepth:    s.buffer.Len(),
+		Reconnects:     max(s.stats.streams.Load(), 1) - 1,
+		Failovers:      s.stats.failovers.Load(),
+		Connected:      s.stats.connected.Load(),
+	}
+	if ns := s.stats.lastSendNs.Load(); ns > 0 {
+		snap.LastSend = time.Unix(0, ns)
+	}
+	return snap
+}
+
+// SelfSnapshot returns the agent's current self-telemetry.
+func (r *Runner) SelfSnapshot() SelfSnapshot {
+	sinks := r.sinkList()
+	snap := SelfSnapshot{
+		Uptime:           time.Since(r.stats.started),
+		SamplesCollected: r.stats.collected.Load(),
+		SampleErrors:     r.stats.sampleErrors.Load(),
+		Collectors:       r.sampler.Stats(),
+	}
+	for _, s := range sinks {
+		snap.Sinks = append(snap.Sinks, s.snapshot())
+	}
+	primary := snap.Sinks[0]
+	snap.SamplesSent, snap.SamplesDropped, snap.BufferDepth = primary.SamplesSent, primary.SamplesDropped, primary.BufferDepth
+	snap.Reconnects, snap.Failovers, snap.Connected, snap.LastSend = primary.Reconnects, primary.Failovers, primary.Connected, primary.LastSend
+	if ns := r.stats.lastCollectNs.Load(); ns > 0 {
+		snap.LastCollect = time.Unix(0, ns)
+	}
+	snap.CACertExpiry, snap.ClientCertExpiry = sinks[0].tls.expiry()
+	return snap
+}
+
+// Values flattens the snapshot into Metric.values entries under SelfMetricPrefix.
+func (s SelfSnapshot) Values() map[string]float64 {
+	values := map[string]float64{
+		SelfMetricPrefix + "uptime_seconds":          s.Uptime.Seconds(),
+		SelfMetricPrefix + "samples_collected_total": float64(s.SamplesCollected),
+		SelfMetricPrefix + "samples_sent_total":      float64(s.SamplesSent),
+		SelfMetricPrefix + "samples_dropped_total":   float64(s.SamplesDropped),
+		SelfMetricPrefix + "sample_errors_total":     float64(s.SampleErrors),
+		SelfMetricPrefix + "buffer_depth":            float64(s.BufferDepth),
+		SelfMetricPrefix + "reconnects_total":        float64(s.Reconnects),
+		SelfMetricPrefix + "failovers_total":         float64(s.Failovers),
+		SelfMetricPrefix + "connected":               boolValue(s.Connected),
+	}
+	if !s.LastSend.IsZero() {
+		values[SelfMetricPrefix+"last_send_timestamp_seconds"] = float64(s.LastSend.UnixNano()) / 1e9
+	}
+	if !s.CACertExpiry.IsZero() {
+		values[SelfMetricPrefix+"tls.ca_expiry_timestamp_seconds"] = float64(s.CACertExpiry.Unix())
+	}
+	if !s.ClientCertExpiry.IsZero() {
+		values[SelfMetricPrefix+"tls.client_cert_expiry_timestamp_seconds"] = float64(s.ClientCertExpiry.Unix())
+	}
+	for _, sink := range s.Sinks[min(1, len(s.Sinks)):] {
+		prefix := SelfMetricPrefix + "sink." + sink.Name + "."
+		values[prefix+"samples_sent_total"] = float64(sink.SamplesSent)
+		values[prefix+"samples_dropped_total"] = float64(sink.SamplesDropped)
+		values[prefix+"buffer_depth"] = float64(sink.BufferDepth)
+		values[prefix+"connected"] = boolValue(sink.Connected)
+	}
+	for name, st := range s.Collectors {
+		values[SelfMetricPrefix+"collector."+name+".duration_seconds"] = st.LastDuration.Seconds()
+		values[SelfMetricPrefix+"collector."+name+".errors_total"] = float64(st.Errors)
+	}
+	return values
+}
+
+// WritePrometheus renders the snapshot in the Prometheus text exposition format.
+func (s SelfSnapshot) WritePrometheus(w io.Writer) error {
+	var err error
+	write := func(name, help, kind string, value float64) {
+		if err != nil {
+			return
+		}
+		_, err = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", name, help, name, kind, name, value)
+	}
+
+	write("telemetryx_agent_uptime_seconds", "Seconds since the agent started.", "gauge", s.Uptime.Seconds())
+	write("telemetryx_agent_samples_collected_total", "Samples taken by the collectors.", "counter", float64(s.SamplesCollected))
+	write("telemetryx_agent_samples_sent_total", "Samples written to the server stream.", "counter", float64(s.SamplesSent))
+	write("telemetryx_agent_samples_dropped_total", "Samples evicted from a full buffer.", "counter", float64(s.SamplesDropped))
+	write("telemetryx_agent_sample_errors_total", "Sampling attempts that failed.", "counter", float64(s.SampleErrors))
+	write("telemetryx_agent_buffer_depth", "Samples waiting for delivery.", "gauge", float64(s.BufferDepth))
+	write("telemetryx_agent_reconnects_total", "Streams re-established after the first.", "counter", float64(s.Reconnects))
+	write("telemetryx_agent_failovers_total", "Streams opened to a different server than the previous one.", "counter", float64(s.Failovers))
+	write("telemetryx_agent_connected", "Whether a metrics stream is open (1) or not (0).", "gauge", boolValue(s.Connected))
+	if !s.LastSend.IsZero() {
+		write("telemetryx_agent_last_send_timestamp_seconds", "Unix time of the last successful send.", "gauge", float64(s.LastSend.UnixNano())/1e9)
+	}
+	if !s.CACertExpiry.IsZero() {
+		write("telemetryx_agent_tls_ca_expiry_timestamp_seconds", "Unix time the earliest certificate in the CA bundle expires.", "gauge", float64(s.CACertExpiry.Unix()))
+	}
+	if !s.ClientCertExpiry.IsZero() {
+		write("telemetryx_agent_tls_client_cert_expiry_timestamp_seconds", "Unix time the client certificate expires.", "gauge", float64(s.ClientCertExpiry.Unix()))
+	}
+	if err != nil {
+		return err
+	}
+
+	names := slices.Sorted(maps.Keys(s.Collectors))
+	if _, err := fmt.Fprint(w, "# HELP telemetryx_agent_collector_duration_seconds Duration of the last collector run.\n# TYPE telemetryx_agent_collector_duration_seconds gauge\n"); err != nil {
+		return err
+	}
+	for _, name := range names {
+		if _, err := fmt.Fprintf(w, "telemetryx_agent_collector_duration_seconds{%s} %g\n", promLabel("collector", name), s.Collectors[name].LastDuration.Seconds()); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprint(w, "# HELP telemetryx_agent_collector_errors_total Failed collector runs.\n# TYPE telemetryx_agent_collector_errors_total counter\n"); err != nil {
+		return err
+	}
+	for _, name := range names {
+		if _, err := fmt.Fprintf(w, "telemetryx_agent_collector_errors_total{%s} %d\n", promLabel("collector", name), s.Collectors[name].Errors); err != nil {
+			return err
+		}
+	}
+
+	for _, family := range []struct {
+		name, help, kind string
+		value            func(SinkSnapshot) float64
+	}{
+		{"telemetryx_agent_sink_samples_sent_total", "Samples delivered to the destination.", "counter", func(s SinkSnapshot) float64 { return float64(s.SamplesSent) }},
+		{"telemetryx_agent_sink_samples_dropped_total", "Samples evicted from the destination's full buffer.", "counter", func(s SinkSnapshot) float64 { return float64(s.SamplesDropped) }},
+		{"telemetryx_agent_sink_buffer_depth", "Samples waiting for delivery to the destination.", "gauge", func(s SinkSnapshot) float64 { return float64(s.BufferDepth) }},
+		{"telemetryx_agent_sink_connected", "Whether the destination's stream is open (1) or not (0).", "gauge", func(s SinkSnapshot) float64 { return boolValue(s.Connected) }},
+	} {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", family.name, family.help, family.name, family.kind); err != nil {
+			return err
+		}
+		for _, sink := range s.Sinks {
+			if _, err := fmt.Fprintf(w, "%s{%s} %g\n", family.name, promLabel("sink", sink.Name), family.value(sink)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,128 @@
+package agent
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// sink delivers samples to one destination. Every sink has its own buffer, reconnect
+// loop, server preferences and TLS material, so a destination that is slow or down only
+// fills its own buffer.
+type sink struct {
+	name    string
+	logger  *slog.Logger
+	buffer  *sampleBuffer
+	tls     *tlsFiles
+	servers *endpointPicker
+	stop    context.CancelFunc // ends the delivery loop; nil until started
+
+	mu           sync.Mutex
+	cfg          Config
+	cancelStream context.CancelCauseFunc
+
+	stats sinkStats
+}
+
+// sinkStats counts what one sink delivered.
+type sinkStats struct {
+	sent       atomic.Uint64
+	dropped    atomic.Uint64
+	streams    atomic.Uint64
+	failovers  atomic.Uint64
+	connected  atomic.Bool
+	lastSendNs atomic.Int64
+}
+
+func newSink(spec sinkSpec, logger *slog.Logger) *sink {
+	logger = logger.With("sink", spec.name)
+	return &sink{
+		name:    spec.name,
+		logger:  logger,
+		cfg:     spec.cfg,
+		buffer:  newSampleBuffer(spec.cfg.BufferSize),
+		tls:     newTLSFiles(logger),
+		servers: newEndpointPicker(),
+	}
+}
+
+func (s *sink) config() Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cfg
+}
+
+// update installs cfg and tears down the open stream when its connection settings
+// changed, so the delivery loop reconnects with them.
+func (s *sink) update(cfg Config) {
+	s.mu.Lock()
+	current := s.cfg
+	s.cfg = cfg
+	cancel := s.cancelStream
+	s.mu.Unlock()
+
+	s.buffer.Resize(cfg.BufferSize)
+	if connectionChanged(current, cfg) && cancel != nil {
+		cancel(errReconfigured)
+	}
+}
+
+// startSink runs the delivery loop of s until Run returns or the sink is removed. r.mu
+// must be held and Run must be active.
+func (r *Runner) startSink(s *sink) {
+	ctx, stop := context.WithCancel(r.runCtx)
+	s.stop = stop
+	r.sinkWG.Add(1)
+	go func() {
+		defer r.sinkWG.Done()
+		r.deliver(ctx, s)
+	}()
+}
+
+// updateSinks reconciles the sinks with cfg: existing sinks pick up their new settings,
+// new ones are started and removed ones are stopped. Samples still buffered for a
+// removed sink are discarded.
+func (r *Runner) updateSinks(cfg Config) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var sinks []*sink
+	for _, spec := range cfg.sinkSpecs() {
+		if i := slices.IndexFunc(r.sinks, func(s *sink) bool { return s.name == spec.name }); i >= 0 {
+			r.sinks[i].update(spec.cfg)
+			sinks = append(sinks, r.sinks[i])
+			continue
+		}
+		s := newSink(spec, r.logger)
+		if r.runCtx != nil {
+			r.startSink(s)
+		}
+		sinks = append(sinks, s)
+		r.logger.Info("sink added", "sink", spec.name, "output", spec.cfg.Output)
+	}
+	for _, s := range r.sinks {
+		if slices.Contains(sinks, s) {
+			continue
+		}
+		if s.stop != nil {
+			s.stop()
+		}
+		r.logger.Info("sink removed", "sink", s.name, "discarded", s.buffer.Len())
+	}
+	r.sinks = sinks
+}
+
+// primary returns the sink configured by the top-level output settings.
+func (r *Runner) primary() *sink {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sinks[0]
+}
+
+func (r *Runner) sinkList() []*sink {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.sinks)
+}
@@ -0,0 +1,144 @@
+package agent
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"telemetry-agent/pkg/api"
+)
+
+func TestPushSampleAcksConfigOnlyToPrimary(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cfg := DefaultConfig()
+	cfg.Sinks = []SinkConfig{{Name: "archive", Output: OutputStdout}}
+	var sinks []*sink
+	for _, spec := range cfg.sinkSpecs() {
+		sinks = append(sinks, newSink(spec, logger))
+	}
+
+	pushSample(sinks, &api.Metric{AgentId: "a", ConfigVersion: 7, ConfigError: "bad interval"})
+
+	primary, err := sinks[0].buffer.Peek(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if primary.GetConfigVersion() != 7 || primary.GetConfigError() != "bad interval" {
+		t.Fatalf("primary sample acks %d %q, want 7 %q", primary.GetConfigVersion(), primary.GetConfigError(), "bad interval")
+	}
+	secondary, err := sinks[1].buffer.Peek(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secondary.GetConfigVersion() != 0 || secondary.GetConfigError() != "" || secondary.GetAgentId() != "a" {
+		t.Fatalf("secondary sample = %v, want the sample without config ack", secondary)
+	}
+}
+
+func TestSinkSpecsInheritance(t *testing.T) {
+	base := DefaultConfig()
+	base.ServerSelection = SelectRandom
+	base.ServerName = "primary.example.com"
+	base.CACertPath = "primary-ca.pem"
+	base.ClientCertPath, base.ClientKeyPath = "primary.pem", "primary-key.pem"
+	base.TokenFile = "primary.token"
+	base.BufferSize = 50
+
+	tests := []struct {
+		name  string
+		sink  SinkConfig
+		check func(t *testing.T, cfg Config)
+	}{
+		{"inherits", SinkConfig{Name: "s", ServerAddrs: []string{"b:1"}}, func(t *testing.T, cfg Config) {
+			if cfg.Output != OutputGRPC || cfg.ServerSelection != SelectRandom || cfg.CACertPath != "primary-ca.pem" ||
+				cfg.ClientCertPath != "primary.pem" || cfg.ClientKeyPath != "primary-key.pem" || cfg.BufferSize != 50 {
+				t.Fatalf("inherited settings missing: %+v", cfg)
+			}
+		}},
+		{"does not inherit cluster identity", SinkConfig{Name: "s", ServerAddrs: []string{"b:1"}}, func(t *testing.T, cfg Config) {
+			if cfg.ServerName != "" || cfg.TokenFile != "" || !slices.Equal(cfg.ServerAddrs, []string{"b:1"}) {
+				t.Fatalf("server name %q, token file %q, servers %v leaked from the primary", cfg.ServerName, cfg.TokenFile, cfg.ServerAddrs)
+			}
+		}},
+		{"overrides", SinkConfig{Name: "s", ServerAddrs: []string{"b:1"}, ServerSelection: SelectOrdered, CACertPath: "b-ca.pem", BufferSize: 5, TokenFile: "b.token"}, func(t *testing.T, cfg Config) {
+			if cfg.ServerSelection != SelectOrdered || cfg.CACertPath != "b-ca.pem" || cfg.BufferSize != 5 || cfg.TokenFile != "b.token" {
+				t.Fatalf("overrides ignored: %+v", cfg)
+			}
+		}},
+		{"client certificate replaced as a pair", SinkConfig{Name: "s", ClientCertPath: "b.pem"}, func(t *testing.T, cfg Config) {
+			if cfg.ClientCertPath != "b.pem" || cfg.ClientKeyPath != "" {
+				t.Fatalf("client cert %q key %q, want b.pem and no key", cfg.ClientCertPath, cfg.ClientKeyPath)
+			}
+		}},
+		{"local output", SinkConfig{Name: "s", Output: OutputFile, OutputPath: "out.jsonl"}, func(t *testing.T, cfg Config) {
+			if cfg.Output != OutputFile || cfg.OutputPath != "out.jsonl" {
+				t.Fatalf("output %q %q", cfg.Output, cfg.OutputPath)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := base
+			cfg.Sinks = []SinkConfig{tt.sink}
+			specs := cfg.sinkSpecs()
+			if len(specs) != 2 || specs[0].name != PrimarySink || specs[1].name != tt.sink.Name {
+				t.Fatalf("specs = %v", specs)
+			}
+			if specs[0].cfg.Sinks != nil || specs[1].cfg.Sinks != nil {
+				t.Fatal("sink configurations carry sinks of their own")
+			}
+			tt.check(t, specs[1].cfg)
+		})
+	}
+}
+
+func TestValidateOutput(t *testing.T) {
+	dir := t.TempDir()
+	ca := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(ca, []byte("unused"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	grpc := func(edit func(*Config)) Config {
+		cfg := DefaultConfig()
+		cfg.ServerAddrs = []string{"a:1"}
+		cfg.CACertPath = ca
+		edit(&cfg)
+		return cfg
+	}
+	tests := []struct {
+		name string
+		cfg  Config
+		want []string // keys reported, empty when valid
+	}{
+		{"valid grpc", grpc(func(*Config) {}), nil},
+		{"srv address", grpc(func(c *Config) { c.ServerAddrs = []string{"srv:_t._tcp.example.com"} }), nil},
+		{"no servers", grpc(func(c *Config) { c.ServerAddrs = nil }), []string{"server.addr"}},
+		{"empty srv name", grpc(func(c *Config) { c.ServerAddrs = []string{"srv:"} }), []string{"server.addr"}},
+		{"missing port", grpc(func(c *Config) { c.ServerAddrs = []string{"a"} }), []string{"server.addr"}},
+		{"duplicate server", grpc(func(c *Config) { c.ServerAddrs = []string{"a:1", "a:1"} }), []string{"server.addr"}},
+		{"bad selection", grpc(func(c *Config) { c.ServerSelection = "nearest" }), []string{"server.selection"}},
+		{"missing ca", grpc(func(c *Config) { c.CACertPath = filepath.Join(dir, "missing.pem") }), []string{"server.caCert"}},
+		{"key without cert", grpc(func(c *Config) { c.ClientKeyPath = "key.pem" }), []string{"server.clientCert"}},
+		{"bootstrap without token file", grpc(func(c *Config) { c.BootstrapToken = "secret" }), []string{"server.bootstrapToken"}},
+		{"no dial timeout", grpc(func(c *Config) { c.DialTimeout = 0 }), []string{"server.dialTimeout"}},
+		{"stdout", Config{Output: OutputStdout}, nil},
+		{"file without path", Config{Output: OutputFile}, []string{"output.path"}},
+		{"unknown output", Config{Output: "kafka"}, []string{"output.type"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			tt.cfg.validateOutput("sinks[0].", true, func(key, format string, args ...any) {
+				got = append(got, strings.TrimPrefix(key, "sinks[0]."))
+			})
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("reported %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,67 +2,374 @@ package agent
 
 import (
 	"context"
-	"crypto/x509"
 	"errors"
 	"fmt"
 	"log/slog"
-	"os"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
+	"telemetry-agent/internal/transport"
 	"telemetry-agent/pkg/api"
 )
 
+// errReconfigured is the cancellation cause used to tear down a stream whose connection
+// settings were replaced by Apply.
+var errReconfigured = errors.New("connection settings changed")
+
+// errStalled is the cancellation cause used when a send blocks for longer than the
+// configured stall timeout.
+var errStalled = errors.New("server stalled the stream")
+
 // Runner encapsulates the lifecycle of the agent streaming loop.
 type Runner struct {
-	cfg     Config
 	logger  *slog.Logger
 	sampler *Sampler
+
+	mu         sync.Mutex
+	local      Config           // configuration from flags, environment and file
+	cfg        Config           // local configuration with remote overrides applied
+	remote     *api.AgentConfig // last remote configuration applied
+	ackVersion uint64           // last remote version received, reported with samples
+	ackErr     string           // why ackVersion was rejected, if it was
+	labeler    *Labeler
+	sinks      []*sink         // destinations, the primary one first
+	runCtx     context.Context // context of an active Run, in which sinks are started
+	retick     chan struct{}
+
+	sinkWG sync.WaitGroup
+	stats  runnerStats
 }
 
 // NewRunner creates a configured telemetry runner.
 func NewRunner(cfg Config, logger *slog.Logger, sampler *Sampler) *Runner {
-	return &Runner{cfg: cfg, logger: logger, sampler: sampler}
+	sampler.SetCollectors(cfg.Collectors)
+	sampler.SetProbeTargets(cfg.ProbeTargets)
+
+	r := &Runner{
+		local:   cfg,
+		cfg:     cfg,
+		logger:  logger,
+		sampler: sampler,
+		labeler: NewLabeler(cfg),
+		retick:  make(chan struct{}, 1),
+	}
+	for _, spec := range cfg.sinkSpecs() {
+		r.sinks = append(r.sinks, newSink(spec, logger))
+	}
+	r.stats.started = time.Now()
+	return r
 }
 
-// Run connects to the telemetry server and begins streaming metrics until ctx is cancelled.
+// Run samples metrics on every interval and streams them to every sink until ctx is
+// cancelled. Each sink buffers samples while its destination is unreachable and
+// re-establishes its stream with exponential backoff.
 func (r *Runner) Run(ctx context.Context) error {
-	creds, err := r.clientCredentials()
-	if err != nil {
+	eg, egCtx := errgroup.WithContext(ctx)
+
+	r.mu.Lock()
+	r.runCtx = egCtx
+	for _, s := range r.sinks {
+		r.startSink(s)
+	}
+	r.mu.Unlock()
+
+	eg.Go(func() error { return r.collect(egCtx) })
+	eg.Go(func() error { return r.watchTLS(egCtx) })
+	err := eg.Wait()
+
+	r.mu.Lock()
+	r.runCtx = nil
+	r.mu.Unlock()
+	r.sinkWG.Wait()
+	return err
+}
+
+// Apply switches a running agent to cfg without dropping buffered samples. When the
+// connection settings change the new servers are probed first; if the configuration is
+// invalid or the probe fails, the current configuration stays in place and the error is
+// returned. Remote overrides pushed by the server stay in effect on top of cfg.
+func (r *Runner) Apply(ctx context.Context, cfg Config) error {
+	if err := cfg.Validate(); err != nil {
 		return err
 	}
 
-	dialCtx, cancel := context.WithTimeout(ctx, r.cfg.DialTimeout)
-	defer cancel()
+	r.mu.Lock()
+	current, remote := r.cfg, r.remote
+	r.mu.Unlock()
+
+	effective := cfg
+	if remote != nil {
+		merged, err := mergeRemote(cfg, remote)
+		if err != nil {
+			return fmt.Errorf("remote configuration v%d conflicts with new settings: %w", remote.GetVersion(), err)
+		}
+		effective = merged
+	}
+
+	currentSinks := current.sinkSpecs()
+	for _, spec := range effective.sinkSpecs() {
+		i := slices.IndexFunc(currentSinks, func(c sinkSpec) bool { return c.name == spec.name })
+		if spec.cfg.Output != OutputGRPC || (i >= 0 && !connectionChanged(currentSinks[i].cfg, spec.cfg)) {
+			continue
+		}
+		if err := r.probe(ctx, spec.cfg); err != nil {
+			return fmt.Errorf("probe sink %s (%s): %w", spec.name, strings.Join(spec.cfg.ServerAddrs, ","), err)
+		}
+	}
+
+	r.activate(cfg, effective)
+	return nil
+}
+
+// activate installs a new local and effective configuration.
+func (r *Runner) activate(local, effective Config) {
+	r.mu.Lock()
+	current := r.cfg
+	r.local = local
+	r.cfg = effective
+	r.labeler = NewLabeler(effective)
+	r.mu.Unlock()
+
+	r.sampler.SetCollectors(effective.Collectors)
+	r.sampler.SetProbeTargets(effective.ProbeTargets)
+	r.updateSinks(effective)
+
+	if effective.Interval != current.Interval || effective.Jitter != current.Jitter ||
+		effective.Align != current.Align || effective.AgentID != current.AgentID {
+		r.reschedule()
+	}
+}
+
+func (r *Runner) config() Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cfg
+}
 
-	conn, err := grpc.DialContext(dialCtx, r.cfg.ServerAddr, grpc.WithTransportCredentials(creds), grpc.WithBlock())
+// reschedule recomputes the sampling schedule after the interval or jitter changed.
+func (r *Runner) reschedule() {
+	select {
+	case r.retick <- struct{}{}:
+	default:
+	}
+}
+
+func (r *Runner) collect(ctx context.Context) error {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	<-timer.C
+
+	var prev time.Time
+	for {
+		fireAt, stamp := nextSample(time.Now(), prev, r.config())
+		timer.Reset(time.Until(fireAt))
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-r.retick:
+			timer.Stop()
+		case <-timer.C:
+			prev = fireAt
+			r.collectSample(ctx, stamp)
+		}
+	}
+}
+
+func (r *Runner) collectSample(ctx context.Context, stamp time.Time) {
+	r.mu.Lock()
+	agentID, labeler, streamSelf := r.cfg.AgentID, r.labeler, r.cfg.StreamSelfMetrics
+	configVersion, configErr := r.ackVersion, r.ackErr
+	sinks := slices.Clone(r.sinks)
+	r.mu.Unlock()
+
+	r.stats.lastCollectNs.Store(time.Now().UnixNano())
+	metric, err := r.sampler.Sample(ctx, agentID)
 	if err != nil {
-		return fmt.Errorf("dial telemetry server: %w", err)
+		if ctx.Err() != nil {
+			return
+		}
+		r.stats.sampleErrors.Add(1)
+		var partial *PartialSampleError
+		if !errors.As(err, &partial) {
+			r.logger.Error("sample metrics failed", "error", err)
+			return
+		}
+		r.logger.Warn("sample metrics incomplete", "error", partial.Err)
 	}
+	r.stats.collected.Add(1)
+
+	metric.CollectedAt = timestamppb.New(stamp)
+	metric.Labels = labeler.Labels()
+	metric.ConfigVersion = configVersion
+	metric.ConfigError = configErr
+	if streamSelf {
+		if metric.Values == nil {
+			metric.Values = make(map[string]float64)
+		}
+		maps.Copy(metric.Values, r.SelfSnapshot().Values())
+	}
+
+	pushSample(sinks, metric)
+}
+
+// pushSample buffers metric for every sink. Sinks share the sample; it is not modified
+// once buffered. The configuration version belongs to the primary destination's
+// cluster, so the other sinks get a copy without it.
+func pushSample(sinks []*sink, metric *api.Metric) {
+	var secondary *api.Metric
+	if len(sinks) > 1 {
+		secondary = proto.Clone(metric).(*api.Metric)
+		secondary.ConfigVersion, secondary.ConfigError = 0, ""
+	}
+	for _, s := range sinks {
+		sample := metric
+		if s.name != PrimarySink {
+			sample = secondary
+		}
+		if dropped := s.buffer.Push(sample); dropped {
+			s.stats.dropped.Add(1)
+			s.logger.Warn("sample buffer full, dropped oldest sample", "capacity", s.config().BufferSize)
+		}
+	}
+}
+
+// deliver keeps the stream of sink s open until ctx is cancelled, reconnecting with
+// exponential backoff.
+func (r *Runner) deliver(ctx context.Context, s *sink) {
+	backoff := s.config().RetryBackoff
+	for {
+		connected, err := r.stream(ctx, s)
+		if ctx.Err() != nil {
+			return
+		}
+		cfg := s.config()
+		if errors.Is(err, errReconfigured) {
+			s.logger.Info("reconnecting with new connection settings", "servers", cfg.ServerAddrs)
+			backoff = cfg.RetryBackoff
+			continue
+		}
+		if connected {
+			backoff = cfg.RetryBackoff
+		}
+
+		s.logger.Warn("telemetry stream interrupted", "error", err, "retry_in", backoff, "buffered", s.buffer.Len())
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, cfg.MaxRetryBackoff)
+	}
+}
+
+// stream dials the server of sink s, or opens its local output, and drains the sink's
+// buffer into it until sending fails, ctx is cancelled or Apply replaces the connection
+// settings. connected reports whether the stream was established.
+func (r *Runner) stream(ctx context.Context, s *sink) (connected bool, err error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	s.mu.Lock()
+	cfg := s.cfg
+	s.cancelStream = cancel
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.cancelStream = nil
+		s.mu.Unlock()
+	}()
+
+	if cfg.Output != OutputGRPC {
+		return writeLines(ctx, s, cfg)
+	}
+
+	conn, server, err := s.connect(ctx, cfg)
+	if err != nil {
+		return false, causeOr(ctx, err)
+	}
+	// A server that rejects or drops the stream is tried last for a while, so the next
+	// attempt fails over to another one.
+	defer func() {
+		if err != nil && !errors.Is(err, errReconfigured) && context.Cause(ctx) != context.Canceled {
+			s.servers.fail(server, cfg.MaxRetryBackoff)
+		}
+	}()
 	defer func() {
 		if cerr := conn.Close(); cerr != nil {
-			r.logger.Warn("closing grpc connection", "error", cerr)
+			s.logger.Warn("closing grpc connection", "error", cerr)
 		}
 	}()
 
 	client := api.NewTelemetryClient(conn)
-	stream, err := client.StreamMetrics(ctx)
+	var opts []grpc.CallOption
+	if cfg.Compression != transport.CompressionNone {
+		opts = append(opts, grpc.UseCompressor(cfg.Compression))
+	}
+	token, err := agentToken(ctx, s.logger, client, cfg)
+	if err != nil {
+		return false, causeOr(ctx, err)
+	}
+	if token != "" {
+		opts = append(opts, grpc.PerRPCCredentials(bearerCredentials(token)))
+	}
+	stream, err := client.StreamMetrics(ctx, opts...)
 	if err != nil {
-		return fmt.Errorf("open metrics stream: %w", err)
+		return false, causeOr(ctx, fmt.Errorf("open metrics stream: %w", err))
 	}
 	defer func() {
 		if cerr := stream.CloseSend(); cerr != nil && !errors.Is(cerr, context.Canceled) {
-			r.logger.Warn("closing metric stream", "error", cerr)
+			s.logger.Warn("closing metric stream", "error", cerr)
 		}
 	}()
 
-	if err := r.publishSample(ctx, stream); err != nil {
-		return err
+	s.logger.Info("metrics stream established", "server", server.addr, "buffered", s.buffer.Len())
+	s.stats.streams.Add(1)
+	if s.servers.connected(server) {
+		s.stats.failovers.Add(1)
+	}
+	s.stats.connected.Store(true)
+	defer s.stats.connected.Store(false)
+	// Only the primary destination may reconfigure the agent.
+	go r.receive(stream, cancel, s.name == PrimarySink)
+
+	var sending atomic.Int64 // start of the send in flight, zero when idle
+	if cfg.StallTimeout > 0 {
+		go watchStall(ctx, &sending, cfg.StallTimeout, cancel)
+	}
+
+	for {
+		metric, err := s.buffer.Peek(ctx)
+		if err != nil {
+			return true, context.Cause(ctx)
+		}
+		sending.Store(time.Now().UnixNano())
+		err = stream.Send(metric)
+		sending.Store(0)
+		if err != nil {
+			return true, causeOr(ctx, fmt.Errorf("send metric: %w", err))
+		}
+		s.buffer.Remove(metric)
+		s.stats.sent.Add(1)
+		s.stats.lastSendNs.Store(time.Now().UnixNano())
 	}
+}
 
-	ticker := time.NewTicker(r.cfg.Interval)
+// watchTLS picks up rotated CA bundles and client certificates between dials.
+func (r *Runner) watchTLS(ctx context.Context) error {
+	ticker := time.NewTicker(tlsCheckInterval)
 	defer ticker.Stop()
 
 	for {
@@ -70,43 +377,147 @@ func (r *Runner) Run(ctx context.Context) error {
 		case <-ctx.Done():
 			return nil
 		case <-ticker.C:
-			if err := r.publishSample(ctx, stream); err != nil {
-				if errors.Is(err, context.Canceled) {
-					return nil
+			for _, s := range r.sinkList() {
+				if cfg := s.config(); cfg.Output == OutputGRPC {
+					if err := s.tls.refresh(cfg); err != nil {
+						s.logger.Warn("check tls files", "error", err)
+					}
 				}
-				return err
 			}
 		}
 	}
 }
 
-func (r *Runner) clientCredentials() (credentials.TransportCredentials, error) {
-	pem, err := os.ReadFile(r.cfg.CACertPath)
-	if err != nil {
-		return nil, fmt.Errorf("read ca certificate: %w", err)
+// watchStall cancels the stream with errStalled once a send has been blocked, typically
+// on flow control of a server that stopped reading, for longer than timeout.
+func watchStall(ctx context.Context, sending *atomic.Int64, timeout time.Duration, cancel context.CancelCauseFunc) {
+	ticker := time.NewTicker(max(timeout/4, 100*time.Millisecond))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if start := sending.Load(); start != 0 && time.Since(time.Unix(0, start)) > timeout {
+				cancel(errStalled)
+				return
+			}
+		}
 	}
+}
 
-	pool := x509.NewCertPool()
-	if ok := pool.AppendCertsFromPEM(pem); !ok {
-		return nil, fmt.Errorf("append ca certificate: not a valid PEM block")
+// connect dials the configured servers in preference order and returns the first
+// connection that succeeds. Servers that cannot be reached are put into cool-down.
+func (s *sink) connect(ctx context.Context, cfg Config) (*grpc.ClientConn, endpoint, error) {
+	endpoints := resolveEndpoints(ctx, cfg, net.DefaultResolver)
+	if len(endpoints) == 0 {
+		return nil, endpoint{}, fmt.Errorf("no server address resolved from %s", strings.Join(cfg.ServerAddrs, ","))
 	}
 
-	return credentials.NewClientTLSFromCert(pool, r.cfg.ServerName), nil
+	var errs []error
+	for _, server := range s.servers.order(endpoints, cfg.ServerSelection, time.Now()) {
+		conn, err := dial(ctx, s.tls, cfg, server)
+		if err == nil {
+			return conn, server, nil
+		}
+		if ctx.Err() != nil {
+			return nil, endpoint{}, err
+		}
+		s.logger.Warn("telemetry server unreachable", "server", server.addr, "error", err)
+		s.servers.fail(server, cfg.MaxRetryBackoff)
+		errs = append(errs, err)
+	}
+	return nil, endpoint{}, errors.Join(errs...)
 }
 
-func (r *Runner) publishSample(ctx context.Context, stream api.Telemetry_StreamMetricsClient) error {
-	metric, err := r.sampler.Sample(ctx, r.cfg.AgentID)
+func dial(ctx context.Context, files *tlsFiles, cfg Config, server endpoint) (*grpc.ClientConn, error) {
+	creds, err := files.credentials(cfg, server.serverName)
 	if err != nil {
-		r.logger.Error("sample metrics failed", "error", err)
-		return nil
+		return nil, err
 	}
 
-	if err := stream.Send(metric); err != nil {
-		if errors.Is(err, context.Canceled) {
-			return err
+	dialCtx, cancel := context.WithTimeout(ctx, cfg.DialTimeout)
+	defer cancel()
+
+	conn, err := grpc.DialContext(dialCtx, server.addr, dialOptions(cfg, creds)...)
+	if err != nil {
+		return nil, fmt.Errorf("dial telemetry server %s: %w", server.addr, err)
+	}
+	return conn, nil
+}
+
+// dialOptions translates the transport settings of cfg into gRPC dial options.
+func dialOptions(cfg Config, creds credentials.TransportCredentials) []grpc.DialOption {
+	opts := []grpc.DialOption{
+		grpc.WithTransportCredentials(creds),
+		grpc.WithBlock(),
+		grpc.WithDefaultCallOptions(
+			grpc.MaxCallSendMsgSize(cfg.MaxMessageBytes),
+			grpc.MaxCallRecvMsgSize(cfg.MaxMessageBytes),
+		),
+	}
+	if cfg.KeepaliveTime > 0 {
+		opts = append(opts, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:    cfg.KeepaliveTime,
+			Timeout: cfg.KeepaliveTimeout,
+		}))
+	}
+	if cfg.InitialWindowSize > 0 {
+		opts = append(opts, grpc.WithInitialWindowSize(int32(cfg.InitialWindowSize)))
+	}
+	if cfg.InitialConnWindowSize > 0 {
+		opts = append(opts, grpc.WithInitialConnWindowSize(int32(cfg.InitialConnWindowSize)))
+	}
+	return opts
+}
+
+// probe checks that at least one server described by cfg is reachable before switching
+// to it. It leaves the server preferences and TLS material of running sinks alone.
+func (r *Runner) probe(ctx context.Context, cfg Config) error {
+	files := newTLSFiles(r.logger)
+	endpoints := resolveEndpoints(ctx, cfg, net.DefaultResolver)
+	if len(endpoints) == 0 {
+		return errors.New("no server address resolved")
+	}
+
+	var errs []error
+	for _, server := range endpoints {
+		conn, err := dial(ctx, files, cfg, server)
+		if err == nil {
+			return conn.Close()
 		}
-		return fmt.Errorf("send metric: %w", err)
+		errs = append(errs, err)
 	}
+	return errors.Join(errs...)
+}
 
-	return nil
+// causeOr prefers the cancellation cause of ctx over err so callers can tell a deliberate
+// teardown from a transport failure.
+func causeOr(ctx context.Context, err error) error {
+	if cause := context.Cause(ctx); cause != nil {
+		return cause
+	}
+	return err
+}
+
+func connectionChanged(a, b Config) bool {
+	return a.Output != b.Output ||
+		a.OutputPath != b.OutputPath ||
+		!slices.Equal(a.ServerAddrs, b.ServerAddrs) ||
+		a.ServerSelection != b.ServerSelection ||
+		a.StallTimeout != b.StallTimeout ||
+		a.ServerName != b.ServerName ||
+		a.CACertPath != b.CACertPath ||
+		a.ClientCertPath != b.ClientCertPath ||
+		a.ClientKeyPath != b.ClientKeyPath ||
+		a.TokenFile != b.TokenFile ||
+		a.BootstrapToken != b.BootstrapToken ||
+		a.DialTimeout != b.DialTimeout ||
+		a.Compression != b.Compression ||
+		a.KeepaliveTime != b.KeepaliveTime ||
+		a.KeepaliveTimeout != b.KeepaliveTimeout ||
+		a.MaxMessageBytes != b.MaxMessageBytes ||
+		a.InitialWindowSize != b.InitialWindowSize ||
+		a.InitialConnWindowSize != b.InitialConnWindowSize
 }
@@ -0,0 +1,154 @@
+package agent
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/credentials"
+
+	"telemetry-agent/internal/filewatch"
+)
+
+// tlsCheckInterval is how often the CA bundle and client certificate are checked for
+// changes between dials, which keeps the reported expiry current.
+const tlsCheckInterval = 30 * time.Second
+
+// tlsFiles caches the CA bundle and client certificate the agent dials with and re-reads
+// them whenever the files change, so rotated material is used from the next connection
+// on. A rotation that cannot be loaded is logged and the last good material is kept.
+type tlsFiles struct {
+	logger *slog.Logger
+
+	mu     sync.Mutex
+	paths  [3]string // CA bundle, client certificate, client key
+	stamps filewatch.Stamp
+
+	pool       *x509.CertPool
+	cert       *tls.Certificate
+	caExpiry   time.Time // earliest expiry in the CA bundle
+	certExpiry time.Time
+}
+
+func newTLSFiles(logger *slog.Logger) *tlsFiles {
+	return &tlsFiles{logger: logger}
+}
+
+// credentials returns transport credentials for cfg built from the current files that
+// expect the server to present a certificate for serverName.
+func (t *tlsFiles) credentials(cfg Config, serverName string) (credentials.TransportCredentials, error) {
+	if err := t.refresh(cfg); err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tlsCfg := &tls.Config{RootCAs: t.pool, ServerName: serverName}
+	if t.cert != nil {
+		tlsCfg.Certificates = []tls.Certificate{*t.cert}
+	}
+	return credentials.NewTLS(tlsCfg), nil
+}
+
+// refresh reloads the files named by cfg when they differ from the cached ones. An error
+// is only returned when there is no usable material for cfg at all.
+func (t *tlsFiles) refresh(cfg Config) error {
+	paths := [3]string{cfg.CACertPath, cfg.ClientCertPath, cfg.ClientKeyPath}
+	stamps := filewatch.Snapshot(paths[:]...)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if paths == t.paths && stamps.Equal(t.stamps) && t.pool != nil {
+		return nil
+	}
+	rotated := paths == t.paths && t.pool != nil
+
+	pool, caExpiry, err := loadCABundle(cfg.CACertPath)
+	var cert *tls.Certificate
+	var certExpiry time.Time
+	if err == nil && cfg.ClientCertPath != "" {
+		cert, certExpiry, err = loadClientCert(cfg.ClientCertPath, cfg.ClientKeyPath)
+	}
+	if err != nil {
+		if rotated {
+			t.logger.Error("tls files changed but cannot be loaded, keeping current material", "error", err)
+			t.stamps = stamps
+			return nil
+		}
+		return err
+	}
+
+	t.paths, t.stamps = paths, stamps
+	t.pool, t.caExpiry = pool, caExpiry
+	t.cert, t.certExpiry = cert, certExpiry
+	if rotated {
+		attrs := []any{"ca", cfg.CACertPath, "ca_expires", caExpiry}
+		if cert != nil {
+			attrs = append(attrs, "client_cert", cfg.ClientCertPath, "client_cert_expires", certExpiry)
+		}
+		t.logger.Info("reloaded tls files", attrs...)
+	}
+	return nil
+}
+
+// expiry reports when the CA bundle and client certificate expire; zero when unknown or
+// not configured.
+func (t *tlsFiles) expiry() (ca, cert time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.caExpiry, t.certExpiry
+}
+
+func loadCABundle(path string) (*x509.CertPool, time.Time, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("read ca certificate: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	var earliest time.Time
+	for rest := raw; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("parse ca certificate: %w", err)
+		}
+		pool.AddCert(cert)
+		if earliest.IsZero() || cert.NotAfter.Before(earliest) {
+			earliest = cert.NotAfter
+		}
+	}
+	if earliest.IsZero() {
+		return nil, time.Time{}, errors.New("append ca certificate: not a valid PEM block")
+	}
+	return pool, earliest, nil
+}
+
+func loadClientCert(certPath, keyPath string) (*tls.Certificate, time.Time, error) {
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("load client certificate: %w", err)
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, time.Time{}, fmt.Errorf("parse client certificate: %w", err)
+		}
+	}
+	return &cert, leaf.NotAfter, nil
+}
@@ -0,0 +1,122 @@
+package agent
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// touch gives path a modification time of its own, so a rewrite within the same clock
+// tick still looks like a change.
+func touch(t *testing.T, path string, age time.Duration) {
+	t.Helper()
+	at := time.Now().Add(age)
+	if err := os.Chtimes(path, at, at); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLSFilesReloadRotatedMaterial(t *testing.T) {
+	dir := t.TempDir()
+	first := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	cfg := DefaultConfig()
+	cfg.CACertPath, _ = writeTestCert(t, dir, "ca", first)
+	cfg.ClientCertPath, cfg.ClientKeyPath = writeTestCert(t, dir, "client", first)
+	files := newTLSFiles(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	if err := files.refresh(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if ca, cert := files.expiry(); !ca.Equal(first) || !cert.Equal(first) {
+		t.Fatalf("expiry = %s, %s; want %s for both", ca, cert, first)
+	}
+	loaded := files.cert
+	if err := files.refresh(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if files.cert != loaded {
+		t.Fatal("unchanged files were loaded again")
+	}
+
+	// cert-manager style rotation: both files are replaced with a renewed certificate.
+	second := first.Add(30 * 24 * time.Hour)
+	writeTestCert(t, dir, "client", second)
+	touch(t, cfg.ClientCertPath, time.Minute)
+	touch(t, cfg.ClientKeyPath, time.Minute)
+	if err := files.refresh(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if ca, cert := files.expiry(); !ca.Equal(first) || !cert.Equal(second) {
+		t.Fatalf("expiry after rotation = %s, %s; want %s, %s", ca, cert, first, second)
+	}
+	if files.cert == loaded {
+		t.Fatal("rotated client certificate was not loaded")
+	}
+	if _, err := files.credentials(cfg, "server"); err != nil {
+		t.Fatalf("credentials after rotation: %v", err)
+	}
+}
+
+func TestTLSFilesKeepMaterialWhenRotationIsBroken(t *testing.T) {
+	dir := t.TempDir()
+	expiry := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	cfg := DefaultConfig()
+	cfg.CACertPath, _ = writeTestCert(t, dir, "ca", expiry)
+	files := newTLSFiles(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err := files.refresh(cfg); err != nil {
+		t.Fatal(err)
+	}
+	pool := files.pool
+
+	// A half-written bundle must not take the agent offline.
+	if err := os.WriteFile(cfg.CACertPath, []byte("-----BEGIN CERT"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	touch(t, cfg.CACertPath, time.Minute)
+	if err := files.refresh(cfg); err != nil {
+		t.Fatalf("refresh with a broken rotation = %v, want the current material kept", err)
+	}
+	if files.pool != pool {
+		t.Fatal("CA pool replaced by a broken rotation")
+	}
+	if ca, _ := files.expiry(); !ca.Equal(expiry) {
+		t.Fatalf("CA expiry = %s, want %s", ca, expiry)
+	}
+
+	// Once the rotation completes, the new bundle is picked up.
+	renewed := expiry.Add(24 * time.Hour)
+	writeTestCert(t, dir, "ca", renewed)
+	touch(t, cfg.CACertPath, 2*time.Minute)
+	if err := files.refresh(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if ca, _ := files.expiry(); !ca.Equal(renewed) {
+		t.Fatalf("CA expiry after the fixed rotation = %s, want %s", ca, renewed)
+	}
+}
+
+func TestTLSFilesRejectUnusableMaterial(t *testing.T) {
+	dir := t.TempDir()
+	files := newTLSFiles(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	cfg := DefaultConfig()
+	cfg.CACertPath = filepath.Join(dir, "missing.crt")
+	if err := files.refresh(cfg); err == nil {
+		t.Fatal("refresh without a CA bundle succeeded")
+	}
+
+	// Pointing at other files is not a rotation: nothing was loaded from them yet.
+	cfg.CACertPath, _ = writeTestCert(t, dir, "ca", time.Now().Add(time.Hour))
+	if err := files.refresh(cfg); err != nil {
+		t.Fatal(err)
+	}
+	cfg.CACertPath = filepath.Join(dir, "other.crt")
+	if err := os.WriteFile(cfg.CACertPath, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := files.credentials(cfg, "server"); err == nil {
+		t.Fatal("credentials from an invalid CA bundle succeeded")
+	}
+}
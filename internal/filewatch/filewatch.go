@@ -0,0 +1,79 @@
+// Package filewatch detects changes to files by polling their size and modification
+// time, which works the same for edits, atomic renames and Kubernetes secret updates.
+package filewatch
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// Stamp identifies the version of a set of files seen by Snapshot.
+type Stamp []state
+
+type state struct {
+	exists  bool
+	modTime time.Time
+	size    int64
+}
+
+// Snapshot stats paths in order. Empty paths and files that cannot be stat'ed are
+// recorded as missing.
+func Snapshot(paths ...string) Stamp {
+	stamp := make(Stamp, len(paths))
+	for i, path := range paths {
+		if path == "" {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil {
+			stamp[i] = state{exists: true, modTime: info.ModTime(), size: info.Size()}
+		}
+	}
+	return stamp
+}
+
+// Equal reports whether s and o saw the same files in the same state.
+func (s Stamp) Equal(o Stamp) bool {
+	if len(s) != len(o) {
+		return false
+	}
+	for i := range s {
+		if s[i].exists != o[i].exists || !s[i].modTime.Equal(o[i].modTime) || s[i].size != o[i].size {
+			return false
+		}
+	}
+	return true
+}
+
+// missing reports whether a file present in prev is gone from s.
+func (s Stamp) missing(prev Stamp) bool {
+	for i := range s {
+		if i < len(prev) && prev[i].exists && !s[i].exists {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch polls paths every period and calls onChange after any of them changed, until
+// ctx is cancelled. A file that temporarily disappears, for example during an atomic
+// replace, is not reported until it is back.
+func Watch(ctx context.Context, period time.Duration, onChange func(), paths ...string) {
+	last := Snapshot(paths...)
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		stamp := Snapshot(paths...)
+		if stamp.Equal(last) || stamp.missing(last) {
+			continue
+		}
+		last = stamp
+		onChange()
+	}
+}
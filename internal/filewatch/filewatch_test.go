@@ -0,0 +1,69 @@
+package filewatch
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchReportsChangesButNotRemovals(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "cert.pem")
+	write := func(data string, modTime time.Time) {
+		t.Helper()
+		// Replace atomically so no poll sees the file between write and Chtimes.
+		tmp := filepath.Join(dir, "cert.tmp")
+		if err := os.WriteFile(tmp, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(tmp, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now().Add(-time.Hour)
+	write("one", start)
+
+	if !Snapshot(path, "").Equal(Snapshot(path, "")) {
+		t.Fatal("unchanged files compare unequal")
+	}
+	before := Snapshot(path)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := make(chan struct{}, 10)
+	go Watch(ctx, 5*time.Millisecond, func() { changes <- struct{}{} }, path)
+	expect := func(want bool, what string) {
+		t.Helper()
+		select {
+		case <-changes:
+			if !want {
+				t.Fatalf("%s reported as a change", what)
+			}
+		case <-time.After(100 * time.Millisecond):
+			if want {
+				t.Fatalf("%s not reported", what)
+			}
+		}
+	}
+
+	expect(false, "an untouched file")
+	write("three", start)
+	expect(true, "a size change")
+	if Snapshot(path).Equal(before) {
+		t.Fatal("snapshot did not change with the file")
+	}
+	write("three", start.Add(time.Minute))
+	expect(true, "a new modification time")
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	expect(false, "a removal")
+	write("four", start.Add(2*time.Minute))
+	expect(true, "the file coming back")
+}
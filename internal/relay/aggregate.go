@@ -0,0 +1,111 @@
+package relay
+
+import (
+	"strings"
+	"time"
+
+	"telemetry-agent/pkg/api"
+)
+
+// AggregatedSamplesValue counts the agent samples combined into a pre-aggregated one.
+const AggregatedSamplesValue = "relay.aggregated_samples"
+
+// aggregate combines the samples each agent collected within the same window into one,
+// keeping the order in which the windows were first seen. Gauges (CPU, memory and load)
+// are averaged; byte counters, labels, the timestamp and the configuration
+// acknowledgement come from the newest sample. Named values are averaged unless their
+// name marks a counter or timestamp ("_total" or "_timestamp_seconds" suffix), which
+// keep the newest value.
+func aggregate(metrics []*api.Metric, size time.Duration) []*api.Metric {
+	type key struct {
+		agentID string
+		start   time.Time
+	}
+	windows := make(map[key]*window)
+	var order []key
+	for _, metric := range metrics {
+		k := key{metric.GetAgentId(), windowStart(metric, size)}
+		w, ok := windows[k]
+		if !ok {
+			w = &window{values: make(map[string]float64), counts: make(map[string]int)}
+			windows[k] = w
+			order = append(order, k)
+		}
+		w.add(metric)
+	}
+
+	combined := make([]*api.Metric, 0, len(order))
+	for _, k := range order {
+		combined = append(combined, windows[k].combine())
+	}
+	return combined
+}
+
+// windowStart returns the start of the window metric was collected in.
+func windowStart(metric *api.Metric, size time.Duration) time.Time {
+	return metric.GetCollectedAt().AsTime().Truncate(size)
+}
+
+type window struct {
+	samples int
+	newest  *api.Metric
+	cpu     float64
+	memory  float64
+	percent float64
+	load1   float64
+	load5   float64
+	load15  float64
+	values  map[string]float64
+	counts  map[string]int
+}
+
+func (w *window) add(metric *api.Metric) {
+	w.samples++
+	if w.newest == nil || !metric.GetCollectedAt().AsTime().Before(w.newest.GetCollectedAt().AsTime()) {
+		w.newest = metric
+	}
+	w.cpu += metric.GetCpuUsage()
+	w.memory += float64(metric.GetMemoryUsage())
+	w.percent += metric.GetMemoryPercent()
+	w.load1 += metric.GetLoadAvg_1()
+	w.load5 += metric.GetLoadAvg_5()
+	w.load15 += metric.GetLoadAvg_15()
+	for name, value := range metric.GetValues() {
+		w.values[name] += value
+		w.counts[name]++
+	}
+}
+
+func (w *window) combine() *api.Metric {
+	n := float64(w.samples)
+	newest := w.newest
+	combined := &api.Metric{
+		AgentId:        newest.GetAgentId(),
+		CollectedAt:    newest.GetCollectedAt(),
+		CpuUsage:       w.cpu / n,
+		MemoryUsage:    uint64(w.memory / n),
+		MemoryPercent:  w.percent / n,
+		LoadAvg_1:      w.load1 / n,
+		LoadAvg_5:      w.load5 / n,
+		LoadAvg_15:     w.load15 / n,
+		NetworkTxBytes: newest.GetNetworkTxBytes(),
+		NetworkRxBytes: newest.GetNetworkRxBytes(),
+		DiskReadBytes:  newest.GetDiskReadBytes(),
+		DiskWriteBytes: newest.GetDiskWriteBytes(),
+		Labels:         newest.GetLabels(),
+		ConfigVersion:  newest.GetConfigVersion(),
+		ConfigError:    newest.GetConfigError(),
+		Values:         make(map[string]float64, len(w.values)+1),
+	}
+	for name, sum := range w.values {
+		if strings.HasSuffix(name, "_total") || strings.HasSuffix(name, "_timestamp_seconds") {
+			if value, ok := newest.GetValues()[name]; ok {
+				combined.Values[name] = value
+				continue
+			}
+		}
+		combined.Values[name] = sum / float64(w.counts[name])
+	}
+	combined.Values[AggregatedSamplesValue] = n
+	return combined
+}
@@ -0,0 +1,58 @@
+package relay
+
+import (
+	"testing"
+	"time"
+
+	"telemetry-agent/pkg/api"
+)
+
+func TestAggregate(t *testing.T) {
+	gauge := func(agentID string, offset time.Duration, cpu, total float64, tx uint64) *api.Metric {
+		metric := sample(agentID, offset, 0)
+		metric.CpuUsage = cpu
+		metric.NetworkTxBytes = tx
+		metric.Values = map[string]float64{"queue_depth": cpu, "requests_total": total}
+		return metric
+	}
+	metrics := []*api.Metric{
+		gauge("web-1", 0, 10, 100, 1000),
+		gauge("web-2", 5*time.Second, 50, 7, 70),
+		// Out of order within the window: the newest sample is still the last collected.
+		gauge("web-1", 20*time.Second, 30, 300, 3000),
+		gauge("web-1", 10*time.Second, 20, 200, 2000),
+		gauge("web-1", 30*time.Second, 90, 900, 9000),
+	}
+
+	got := aggregate(metrics, 30*time.Second)
+	want := []struct {
+		agentID string
+		at      time.Duration
+		samples float64
+		cpu     float64
+		total   float64
+		tx      uint64
+	}{
+		{"web-1", 20 * time.Second, 3, 20, 300, 3000},
+		{"web-2", 5 * time.Second, 1, 50, 7, 70},
+		{"web-1", 30 * time.Second, 1, 90, 900, 9000},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("aggregate returned %d samples, want %d", len(got), len(want))
+	}
+	for i, w := range want {
+		m := got[i]
+		if m.GetAgentId() != w.agentID || !m.GetCollectedAt().AsTime().Equal(testEpoch.Add(w.at)) {
+			t.Fatalf("sample %d is %s at %s, want %s at %s", i, m.GetAgentId(), m.GetCollectedAt().AsTime(), w.agentID, testEpoch.Add(w.at))
+		}
+		if m.GetValues()[AggregatedSamplesValue] != w.samples {
+			t.Fatalf("sample %d combines %v samples, want %v", i, m.GetValues()[AggregatedSamplesValue], w.samples)
+		}
+		if m.GetCpuUsage() != w.cpu || m.GetValues()["queue_depth"] != w.cpu {
+			t.Fatalf("sample %d gauges = %v / %v, want the average %v", i, m.GetCpuUsage(), m.GetValues()["queue_depth"], w.cpu)
+		}
+		if m.GetValues()["requests_total"] != w.total || m.GetNetworkTxBytes() != w.tx {
+			t.Fatalf("sample %d counters = %v / %d, want the newest %v / %d", i, m.GetValues()["requests_total"], m.GetNetworkTxBytes(), w.total, w.tx)
+		}
+	}
+}
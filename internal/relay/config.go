@@ -0,0 +1,157 @@
+// Package relay implements an edge relay that accepts metric streams from local agents,
+// spools them on disk and forwards them upstream over a single connection.
+package relay
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"telemetry-agent/internal/server"
+	"telemetry-agent/internal/transport"
+)
+
+// Config stores runtime parameters for the relay.
+type Config struct {
+	// GRPCAddr is where local agents connect; they authenticate the relay with
+	// TLSCertPath and present a certificate issued by ClientCAPath themselves.
+	GRPCAddr     string
+	TLSCertPath  string
+	TLSKeyPath   string
+	ClientCAPath string
+	// AgentIdentities lets a certificate report as agent IDs other than its own name,
+	// such as a chained relay reporting for the agents behind it.
+	AgentIdentities server.IdentityMap
+
+	// UpstreamAddrs are the telemetry servers samples are forwarded to, tried in order.
+	UpstreamAddrs []string
+	// UpstreamServerName overrides the name expected in the upstream certificate, which
+	// otherwise is the host of the address dialled.
+	UpstreamServerName string
+	UpstreamCACertPath string
+	// UpstreamClientCertPath and UpstreamClientKeyPath identify the relay to servers that
+	// require mutual TLS; UpstreamTokenFile holds its bearer token. The server must allow
+	// that identity to report as every agent behind the relay.
+	UpstreamClientCertPath string
+	UpstreamClientKeyPath  string
+	UpstreamTokenFile      string
+	Compression            string
+	DialTimeout            time.Duration
+	RetryBackoff           time.Duration
+	MaxRetryBackoff        time.Duration
+
+	// SpoolDir holds samples not yet forwarded. SpoolMaxBytes bounds its size, dropping
+	// the oldest samples beyond it; SpoolSync is how often appended samples are flushed
+	// to stable storage, zero to flush every sample.
+	SpoolDir      string
+	SpoolMaxBytes int64
+	SpoolSync     time.Duration
+
+	// Aggregate combines the spooled samples each agent collected within a window of this
+	// size into one as they are forwarded; zero forwards every sample.
+	Aggregate time.Duration
+}
+
+// LoadConfig reads configuration from environment variables.
+func LoadConfig() (Config, error) {
+	cfg := Config{
+		GRPCAddr:               getenv("TELEMETRY_RELAY_GRPC_ADDR", ":50051"),
+		TLSCertPath:            getenv("TELEMETRY_RELAY_TLS_CERT", "deploy/certs/dev/server.pem"),
+		TLSKeyPath:             getenv("TELEMETRY_RELAY_TLS_KEY", "deploy/certs/dev/server-key.pem"),
+		ClientCAPath:           getenv("TELEMETRY_RELAY_CLIENT_CA", ""),
+		UpstreamServerName:     getenv("TELEMETRY_RELAY_UPSTREAM_SERVER_NAME", ""),
+		UpstreamCACertPath:     getenv("TELEMETRY_RELAY_UPSTREAM_CA_CERT", "deploy/certs/dev/ca.pem"),
+		UpstreamClientCertPath: getenv("TELEMETRY_RELAY_UPSTREAM_CLIENT_CERT", ""),
+		UpstreamClientKeyPath:  getenv("TELEMETRY_RELAY_UPSTREAM_CLIENT_KEY", ""),
+		UpstreamTokenFile:      getenv("TELEMETRY_RELAY_UPSTREAM_TOKEN_FILE", ""),
+		Compression:            getenv("TELEMETRY_RELAY_UPSTREAM_COMPRESSION", transport.CompressionZstd),
+		SpoolDir:               getenv("TELEMETRY_RELAY_SPOOL_DIR", "relay-spool"),
+	}
+	for _, addr := range strings.Split(getenv("TELEMETRY_RELAY_UPSTREAM_ADDR", ""), ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			cfg.UpstreamAddrs = append(cfg.UpstreamAddrs, addr)
+		}
+	}
+
+	identities, err := server.ParseIdentityMap(getenv("TELEMETRY_RELAY_AGENT_IDENTITIES", ""))
+	if err != nil {
+		return Config{}, fmt.Errorf("parse TELEMETRY_RELAY_AGENT_IDENTITIES: %w", err)
+	}
+	cfg.AgentIdentities = identities
+
+	if cfg.DialTimeout, err = time.ParseDuration(getenv("TELEMETRY_RELAY_DIAL_TIMEOUT", "5s")); err != nil {
+		return Config{}, fmt.Errorf("parse TELEMETRY_RELAY_DIAL_TIMEOUT: %w", err)
+	}
+	if cfg.RetryBackoff, err = time.ParseDuration(getenv("TELEMETRY_RELAY_RETRY_BACKOFF", "1s")); err != nil {
+		return Config{}, fmt.Errorf("parse TELEMETRY_RELAY_RETRY_BACKOFF: %w", err)
+	}
+	if cfg.MaxRetryBackoff, err = time.ParseDuration(getenv("TELEMETRY_RELAY_MAX_RETRY_BACKOFF", "30s")); err != nil {
+		return Config{}, fmt.Errorf("parse TELEMETRY_RELAY_MAX_RETRY_BACKOFF: %w", err)
+	}
+	if cfg.SpoolMaxBytes, err = strconv.ParseInt(getenv("TELEMETRY_RELAY_SPOOL_MAX_BYTES", "1073741824"), 10, 64); err != nil {
+		return Config{}, fmt.Errorf("parse TELEMETRY_RELAY_SPOOL_MAX_BYTES: %w", err)
+	}
+	if cfg.SpoolSync, err = time.ParseDuration(getenv("TELEMETRY_RELAY_SPOOL_SYNC", "1s")); err != nil {
+		return Config{}, fmt.Errorf("parse TELEMETRY_RELAY_SPOOL_SYNC: %w", err)
+	}
+	if cfg.Aggregate, err = time.ParseDuration(getenv("TELEMETRY_RELAY_AGGREGATE", "0s")); err != nil {
+		return Config{}, fmt.Errorf("parse TELEMETRY_RELAY_AGGREGATE: %w", err)
+	}
+
+	if cfg.GRPCAddr == "" {
+		return Config{}, fmt.Errorf("TELEMETRY_RELAY_GRPC_ADDR must be set")
+	}
+	if cfg.TLSCertPath == "" || cfg.TLSKeyPath == "" {
+		return Config{}, fmt.Errorf("TELEMETRY_RELAY_TLS_CERT and TELEMETRY_RELAY_TLS_KEY must be provided")
+	}
+	// Samples are forwarded under the server identity of the relay, so the relay must
+	// know which agent sent them.
+	if cfg.ClientCAPath == "" {
+		return Config{}, fmt.Errorf("TELEMETRY_RELAY_CLIENT_CA must be provided; agents authenticate to the relay with client certificates")
+	}
+	if len(cfg.UpstreamAddrs) == 0 {
+		return Config{}, fmt.Errorf("TELEMETRY_RELAY_UPSTREAM_ADDR must be provided")
+	}
+	for _, addr := range cfg.UpstreamAddrs {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return Config{}, fmt.Errorf("TELEMETRY_RELAY_UPSTREAM_ADDR: %q is not host:port", addr)
+		}
+	}
+	if cfg.UpstreamCACertPath == "" {
+		return Config{}, fmt.Errorf("TELEMETRY_RELAY_UPSTREAM_CA_CERT must be provided")
+	}
+	if (cfg.UpstreamClientCertPath == "") != (cfg.UpstreamClientKeyPath == "") {
+		return Config{}, fmt.Errorf("TELEMETRY_RELAY_UPSTREAM_CLIENT_CERT and TELEMETRY_RELAY_UPSTREAM_CLIENT_KEY must be provided together")
+	}
+	if !slices.Contains(transport.Compressions, cfg.Compression) {
+		return Config{}, fmt.Errorf("TELEMETRY_RELAY_UPSTREAM_COMPRESSION must be one of %s", strings.Join(transport.Compressions, ", "))
+	}
+	if cfg.DialTimeout <= 0 || cfg.RetryBackoff <= 0 || cfg.MaxRetryBackoff < cfg.RetryBackoff {
+		return Config{}, fmt.Errorf("TELEMETRY_RELAY_DIAL_TIMEOUT and _RETRY_BACKOFF must be positive and _MAX_RETRY_BACKOFF at least _RETRY_BACKOFF")
+	}
+	if cfg.SpoolDir == "" {
+		return Config{}, fmt.Errorf("TELEMETRY_RELAY_SPOOL_DIR must be provided")
+	}
+	if cfg.SpoolMaxBytes < 2*segmentBytes {
+		return Config{}, fmt.Errorf("TELEMETRY_RELAY_SPOOL_MAX_BYTES must be at least %d", 2*segmentBytes)
+	}
+	if cfg.SpoolSync < 0 {
+		return Config{}, fmt.Errorf("TELEMETRY_RELAY_SPOOL_SYNC must not be negative")
+	}
+	if cfg.Aggregate < 0 {
+		return Config{}, fmt.Errorf("TELEMETRY_RELAY_AGGREGATE must not be negative")
+	}
+
+	return cfg, nil
+}
+
+func getenv(key, fallback string) string {
+	if val, ok := os.LookupEnv(key); ok {
+		return val
+	}
+	return fallback
+}
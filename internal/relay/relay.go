@@ -0,0 +1,449 @@
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
+
+	"telemetry-agent/internal/server"
+	"telemetry-agent/internal/transport"
+	"telemetry-agent/pkg/api"
+)
+
+// statusInterval is how often the relay logs its spool and connection state.
+const statusInterval = time.Minute
+
+// aggregateBatch bounds how many spooled samples are combined at a time.
+const aggregateBatch = 4096
+
+// Relay accepts metric streams from local agents, spools the samples on disk and
+// forwards them upstream over a single stream that carries every agent. Configuration
+// pushed by the server for an agent is routed back to that agent's stream.
+type Relay struct {
+	api.UnimplementedTelemetryServer
+
+	cfg    Config
+	logger *slog.Logger
+	spool  *Spool
+
+	mu       sync.Mutex
+	agents   map[string]*downstream      // local streams by the agents they carry
+	configs  map[string]*api.AgentConfig // last configuration the server pushed per agent
+	upstream api.TelemetryClient         // nil while disconnected
+}
+
+// downstream is the stream of a local agent, or of a chained relay carrying several.
+type downstream struct {
+	mu      sync.Mutex
+	pending map[string]*api.AgentConfig
+	notify  chan struct{}
+}
+
+func newDownstream() *downstream {
+	return &downstream{pending: make(map[string]*api.AgentConfig), notify: make(chan struct{}, 1)}
+}
+
+// offer queues cfg for agentID, replacing any configuration for it not yet sent.
+func (d *downstream) offer(agentID string, cfg *api.AgentConfig) {
+	d.mu.Lock()
+	d.pending[agentID] = cfg
+	d.mu.Unlock()
+	select {
+	case d.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (d *downstream) take() map[string]*api.AgentConfig {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	pending := d.pending
+	d.pending = make(map[string]*api.AgentConfig)
+	return pending
+}
+
+// New creates a relay spooling into spool.
+func New(cfg Config, spool *Spool, logger *slog.Logger) *Relay {
+	r := &Relay{
+		cfg:     cfg,
+		logger:  logger,
+		spool:   spool,
+		agents:  make(map[string]*downstream),
+		configs: make(map[string]*api.AgentConfig),
+	}
+	return r
+}
+
+// StreamMetrics accepts samples from local agents. A sample is acknowledged to the agent
+// only by the stream staying open; when the spool cannot take it the stream fails so the
+// agent keeps it buffered. Agents may only report as the identities of their client
+// certificate, since the server sees every sample as coming from the relay.
+func (r *Relay) StreamMetrics(stream api.Telemetry_StreamMetricsServer) error {
+	identities, ok := server.PeerIdentities(stream.Context())
+	if !ok {
+		return status.Error(codes.Unauthenticated, "client certificate required")
+	}
+	d := newDownstream()
+	var agents []string
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			case <-d.notify:
+			}
+			for agentID, cfg := range d.take() {
+				if err := stream.Send(&api.ServerMessage{Config: cfg, AgentId: agentID}); err != nil {
+					r.logger.Warn("push configuration", "agent", agentID, "error", err)
+					return
+				}
+			}
+		}
+	}()
+
+	defer func() {
+		close(done)
+		wg.Wait()
+		r.mu.Lock()
+		for _, agentID := range agents {
+			if r.agents[agentID] == d {
+				delete(r.agents, agentID)
+			}
+		}
+		r.mu.Unlock()
+	}()
+
+	for {
+		metric, err := stream.Recv()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		agentID := metric.GetAgentId()
+		if agentID == "" {
+			r.logger.Warn("discarding metric", "error", "missing agent id")
+			continue
+		}
+
+		if !contains(agents, agentID) {
+			if !r.cfg.AgentIdentities.Allows(identities, agentID) {
+				r.logger.Warn("rejecting metric stream", "agent", agentID, "identities", identities)
+				return status.Errorf(codes.PermissionDenied, "client certificate for %s may not report as agent %q", strings.Join(identities, ", "), agentID)
+			}
+			agents = append(agents, agentID)
+			r.mu.Lock()
+			r.agents[agentID] = d
+			cfg, ok := r.configs[agentID]
+			r.mu.Unlock()
+			// The server pushes configuration once per agent on the upstream stream, so
+			// agents reconnecting to the relay get the last one from here.
+			if ok && cfg.GetVersion() != metric.GetConfigVersion() {
+				d.offer(agentID, cfg)
+			}
+			r.logger.Info("agent connected", "agent", agentID)
+		}
+
+		if err := r.spool.Append(metric); err != nil {
+			r.logger.Error("spool metric", "agent", agentID, "error", err)
+			return status.Error(codes.Unavailable, "relay spool unavailable")
+		}
+	}
+}
+
+// Enroll passes enrollment through to the upstream server.
+func (r *Relay) Enroll(ctx context.Context, req *api.EnrollRequest) (*api.EnrollResponse, error) {
+	r.mu.Lock()
+	client := r.upstream
+	r.mu.Unlock()
+	if client == nil {
+		return nil, status.Error(codes.Unavailable, "relay is not connected upstream")
+	}
+	return client.Enroll(ctx, req)
+}
+
+// Run forwards spooled samples upstream until ctx is cancelled, reconnecting with
+// exponential backoff, and flushes the spool in the background.
+func (r *Relay) Run(ctx context.Context) error {
+	eg, egCtx := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		r.forward(egCtx)
+		return nil
+	})
+	eg.Go(func() error {
+		r.flushSpool(egCtx)
+		return nil
+	})
+	return eg.Wait()
+}
+
+func (r *Relay) forward(ctx context.Context) {
+	backoff := r.cfg.RetryBackoff
+	for {
+		connected, err := r.stream(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if connected {
+			backoff = r.cfg.RetryBackoff
+		}
+
+		r.logger.Warn("upstream stream interrupted", "error", err, "retry_in", backoff, "spooled", r.spool.Len())
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, r.cfg.MaxRetryBackoff)
+	}
+}
+
+// stream opens the upstream stream and drains the spool into it until sending fails or
+// ctx is cancelled. connected reports whether the stream was established.
+func (r *Relay) stream(ctx context.Context) (connected bool, err error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	conn, addr, err := r.dial(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	client := api.NewTelemetryClient(conn)
+	var opts []grpc.CallOption
+	if r.cfg.Compression != transport.CompressionNone {
+		opts = append(opts, grpc.UseCompressor(r.cfg.Compression))
+	}
+	if r.cfg.UpstreamTokenFile != "" {
+		raw, err := os.ReadFile(r.cfg.UpstreamTokenFile)
+		if err != nil {
+			return false, fmt.Errorf("read token file: %w", err)
+		}
+		opts = append(opts, grpc.PerRPCCredentials(bearerCredentials(strings.TrimSpace(string(raw)))))
+	}
+	stream, err := client.StreamMetrics(ctx, opts...)
+	if err != nil {
+		return false, fmt.Errorf("open metrics stream: %w", err)
+	}
+	defer stream.CloseSend()
+
+	r.mu.Lock()
+	r.upstream = client
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		r.upstream = nil
+		r.mu.Unlock()
+	}()
+
+	r.logger.Info("upstream stream established", "server", addr, "spooled", r.spool.Len())
+	go r.receive(stream, cancel)
+
+	if r.cfg.Aggregate > 0 {
+		return true, causeOr(ctx, r.sendWindows(ctx, stream))
+	}
+	for {
+		metric, err := r.spool.Peek(ctx)
+		if err != nil {
+			return true, causeOr(ctx, err)
+		}
+		if err := stream.Send(metric); err != nil {
+			return true, causeOr(ctx, fmt.Errorf("send metric: %w", err))
+		}
+		r.spool.Remove()
+	}
+}
+
+// sendWindows forwards the spooled samples of every finished window combined into one
+// sample per agent. Samples stay spooled until their combined sample is sent, so after a
+// restart or a lost connection they are combined and sent again.
+func (r *Relay) sendWindows(ctx context.Context, stream api.Telemetry_StreamMetricsClient) error {
+	size := r.cfg.Aggregate
+	for {
+		batch, err := r.spool.PeekN(ctx, aggregateBatch)
+		if err != nil {
+			return err
+		}
+		// Combine in spool order up to the first sample whose window is still open.
+		now := time.Now()
+		ready := 0
+		for ready < len(batch) && !windowStart(batch[ready], size).Add(size).After(now) {
+			ready++
+		}
+		if ready == 0 {
+			wait := min(windowStart(batch[0], size).Add(size).Sub(now), size)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(wait):
+			}
+			continue
+		}
+
+		for _, metric := range aggregate(batch[:ready], size) {
+			if err := stream.Send(metric); err != nil {
+				return fmt.Errorf("send metric: %w", err)
+			}
+		}
+		r.spool.RemoveN(ready)
+	}
+}
+
+// receive routes configuration pushed by the server to the agents it is meant for.
+func (r *Relay) receive(stream api.Telemetry_StreamMetricsClient, cancel context.CancelCauseFunc) {
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = errors.New("server closed the stream")
+			}
+			cancel(fmt.Errorf("receive: %w", err))
+			return
+		}
+		agentID := msg.GetAgentId()
+		if msg.GetConfig() == nil || agentID == "" {
+			continue
+		}
+
+		r.mu.Lock()
+		r.configs[agentID] = msg.GetConfig()
+		d := r.agents[agentID]
+		r.mu.Unlock()
+		if d != nil {
+			d.offer(agentID, msg.GetConfig())
+		}
+	}
+}
+
+// dial connects to the first reachable upstream server.
+func (r *Relay) dial(ctx context.Context) (*grpc.ClientConn, string, error) {
+	var errs []error
+	for _, addr := range r.cfg.UpstreamAddrs {
+		creds, err := r.upstreamCredentials(addr)
+		if err != nil {
+			return nil, "", err
+		}
+		dialCtx, cancel := context.WithTimeout(ctx, r.cfg.DialTimeout)
+		conn, err := grpc.DialContext(dialCtx, addr,
+			grpc.WithTransportCredentials(creds),
+			grpc.WithBlock(),
+			// Keep the uplink's NAT mapping alive and notice a dead link without traffic.
+			grpc.WithKeepaliveParams(keepalive.ClientParameters{Time: 30 * time.Second, Timeout: 20 * time.Second}),
+		)
+		cancel()
+		if err == nil {
+			return conn, addr, nil
+		}
+		if ctx.Err() != nil {
+			return nil, "", ctx.Err()
+		}
+		errs = append(errs, fmt.Errorf("dial upstream %s: %w", addr, err))
+	}
+	return nil, "", errors.Join(errs...)
+}
+
+// upstreamCredentials reads the upstream CA bundle and client certificate on every dial
+// so rotated files are picked up on the next connection.
+func (r *Relay) upstreamCredentials(addr string) (credentials.TransportCredentials, error) {
+	pem, err := os.ReadFile(r.cfg.UpstreamCACertPath)
+	if err != nil {
+		return nil, fmt.Errorf("read upstream ca certificate: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("append upstream ca certificate: not a valid PEM block")
+	}
+
+	serverName := r.cfg.UpstreamServerName
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(addr)
+	}
+	tlsCfg := &tls.Config{RootCAs: pool, ServerName: serverName}
+	if r.cfg.UpstreamClientCertPath != "" {
+		cert, err := tls.LoadX509KeyPair(r.cfg.UpstreamClientCertPath, r.cfg.UpstreamClientKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("load upstream client certificate: %w", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	return credentials.NewTLS(tlsCfg), nil
+}
+
+// flushSpool persists the spool every SpoolSync (or second, when every append is already
+// synced) and periodically logs the relay's state.
+func (r *Relay) flushSpool(ctx context.Context) {
+	period := r.cfg.SpoolSync
+	if period == 0 {
+		period = time.Second
+	}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	lastStatus := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := r.spool.Flush(); err != nil {
+			r.logger.Error("flush spool", "error", err)
+		}
+		if time.Since(lastStatus) >= statusInterval {
+			lastStatus = time.Now()
+			r.mu.Lock()
+			agents, connected := len(r.agents), r.upstream != nil
+			r.mu.Unlock()
+			r.logger.Info("relay status", "agents", agents, "upstream_connected", connected, "spooled", r.spool.Len(), "spool_bytes", r.spool.Bytes())
+		}
+	}
+}
+
+// bearerCredentials attaches the relay's token to the upstream stream.
+type bearerCredentials string
+
+func (t bearerCredentials) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(t)}, nil
+}
+
+func (bearerCredentials) RequireTransportSecurity() bool { return true }
+
+// causeOr prefers the cancellation cause of ctx over err.
+func causeOr(ctx context.Context, err error) error {
+	if cause := context.Cause(ctx); cause != nil {
+		return cause
+	}
+	return err
+}
+
+func contains(ids []string, id string) bool {
+	for _, candidate := range ids {
+		if candidate == id {
+			return true
+		}
+	}
+	return false
+}
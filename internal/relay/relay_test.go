@@ -0,0 +1,179 @@
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"telemetry-agent/internal/server"
+	"telemetry-agent/pkg/api"
+)
+
+// agentStream is the relay's end of a stream opened by a local agent that sends
+// metrics and then closes.
+type agentStream struct {
+	grpc.ServerStream
+	ctx     context.Context
+	metrics []*api.Metric
+}
+
+func (s *agentStream) Context() context.Context { return s.ctx }
+
+func (s *agentStream) Recv() (*api.Metric, error) {
+	if len(s.metrics) == 0 {
+		return nil, io.EOF
+	}
+	metric := s.metrics[0]
+	s.metrics = s.metrics[1:]
+	return metric, nil
+}
+
+func (s *agentStream) Send(*api.ServerMessage) error { return nil }
+
+// upstreamStream is the relay's end of the upstream stream, recording what is sent.
+type upstreamStream struct {
+	grpc.ClientStream
+	sent chan *api.Metric
+	err  error
+}
+
+func (s *upstreamStream) Send(metric *api.Metric) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.sent <- metric
+	return nil
+}
+
+func (s *upstreamStream) Recv() (*api.ServerMessage, error) { return nil, io.EOF }
+
+// certContext returns a context carrying a verified client certificate for names, the
+// first as common name and all as DNS SANs.
+func certContext(names ...string) context.Context {
+	leaf := &x509.Certificate{Subject: pkix.Name{CommonName: names[0]}, DNSNames: names}
+	return peer.NewContext(context.Background(), &peer.Peer{
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{leaf}}}},
+	})
+}
+
+func TestStreamMetricsChecksAgentIdentity(t *testing.T) {
+	identities, err := server.ParseIdentityMap("relay-b=branch-b-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		agents  []string
+		want    codes.Code
+		spooled int
+	}{
+		{"no certificate", context.Background(), []string{"web-1"}, codes.Unauthenticated, 0},
+		{"own name", certContext("web-1"), []string{"web-1", "web-1"}, codes.OK, 2},
+		{"DNS SAN", certContext("web-1", "web-1.example.com"), []string{"web-1.example.com"}, codes.OK, 1},
+		{"another agent", certContext("web-1"), []string{"web-1", "db-1"}, codes.PermissionDenied, 1},
+		{"mapped identity", certContext("relay-b"), []string{"branch-b-1", "branch-b-2"}, codes.OK, 2},
+		{"outside the mapping", certContext("relay-b"), []string{"branch-c-1"}, codes.PermissionDenied, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spool := openTestSpool(t, t.TempDir(), 1<<30)
+			defer spool.Close()
+			r := New(Config{AgentIdentities: identities}, spool, testLogger)
+
+			stream := &agentStream{ctx: tt.ctx}
+			for i, agentID := range tt.agents {
+				stream.metrics = append(stream.metrics, sample(agentID, time.Duration(i)*time.Second, i))
+			}
+			if err := r.StreamMetrics(stream); status.Code(err) != tt.want {
+				t.Fatalf("StreamMetrics = %v, want %s", err, tt.want)
+			}
+			if spool.Len() != tt.spooled {
+				t.Fatalf("spooled %d samples, want %d", spool.Len(), tt.spooled)
+			}
+		})
+	}
+}
+
+func TestSendWindows(t *testing.T) {
+	const size = time.Minute
+	spool := openTestSpool(t, t.TempDir(), 1<<30)
+	defer spool.Close()
+	r := New(Config{Aggregate: size}, spool, testLogger)
+
+	// Two finished windows of web-1, one of web-2 and a sample in the open window.
+	for i, offset := range []time.Duration{0, 30 * time.Second, 70 * time.Second} {
+		if err := spool.Append(sample("web-1", offset, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := spool.Append(sample("web-2", 10*time.Second, 3)); err != nil {
+		t.Fatal(err)
+	}
+	open := sample("web-1", 0, 4)
+	open.CollectedAt = timestamppb.New(time.Now().Add(size))
+	if err := spool.Append(open); err != nil {
+		t.Fatal(err)
+	}
+	if err := spool.Append(sample("web-2", 20*time.Second, 5)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A failing upstream keeps every sample spooled.
+	failing := &upstreamStream{err: errors.New("connection reset")}
+	if err := r.sendWindows(context.Background(), failing); err == nil {
+		t.Fatal("sendWindows succeeded on a failing stream")
+	}
+	if spool.Len() != 6 {
+		t.Fatalf("spooled %d samples after a failed send, want 6", spool.Len())
+	}
+
+	upstream := &upstreamStream{sent: make(chan *api.Metric, 10)}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- r.sendWindows(ctx, upstream) }()
+
+	want := []struct {
+		agentID string
+		samples float64
+	}{
+		{"web-1", 2},
+		{"web-1", 1},
+		{"web-2", 1},
+	}
+	for i, w := range want {
+		select {
+		case m := <-upstream.sent:
+			if m.GetAgentId() != w.agentID || m.GetValues()[AggregatedSamplesValue] != w.samples {
+				t.Fatalf("sent %d: %s combining %v samples, want %s combining %v", i, m.GetAgentId(), m.GetValues()[AggregatedSamplesValue], w.agentID, w.samples)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("window %d not sent", i)
+		}
+	}
+	// The open window holds back the samples spooled after it.
+	select {
+	case m := <-upstream.sent:
+		t.Fatalf("sent %s from an open window", m.GetAgentId())
+	case <-time.After(50 * time.Millisecond):
+	}
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("sendWindows = %v, want context.Canceled", err)
+	}
+	if spool.Len() != 2 {
+		t.Fatalf("spooled %d samples, want the open window and the one after it", spool.Len())
+	}
+}
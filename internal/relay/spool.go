@@ -0,0 +1,484 @@
+package relay
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+
+	"telemetry-agent/pkg/api"
+)
+
+// segmentBytes is the size at which the spool starts a new segment file. Delivered
+// samples are reclaimed a whole segment at a time.
+const segmentBytes = 8 << 20
+
+// recordHeader is the length and CRC-32C of the payload that follows it.
+const recordHeader = 8
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Spool is a durable FIFO of samples backed by append-only segment files. Samples are
+// delivered at least once: the read position is persisted by Flush, so samples removed
+// after the last flush are delivered again after a crash. A record torn by a crash is
+// detected by its checksum and discarded when the spool is opened.
+type Spool struct {
+	dir      string
+	maxBytes int64
+	syncEach bool
+	logger   *slog.Logger
+	notify   chan struct{}
+
+	mu       sync.Mutex
+	segments []*segment // oldest first; reading happens in segments[0], writing in the last
+	bytes    int64
+	pending  int
+	writer   *os.File
+	reader   *os.File
+	readOff  int64
+	readSeen int // records of segments[0] before readOff
+	peeked   []*api.Metric
+	peekEnds []int64 // offset in segments[0] after each peeked record
+}
+
+type segment struct {
+	seq     uint64
+	size    int64
+	records int
+}
+
+// OpenSpool opens or creates the spool in dir. With syncEach every Append is flushed to
+// stable storage before it returns; otherwise Flush must be called periodically.
+func OpenSpool(dir string, maxBytes int64, syncEach bool, logger *slog.Logger) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("create spool dir: %w", err)
+	}
+	s := &Spool{
+		dir:      dir,
+		maxBytes: maxBytes,
+		syncEach: syncEach,
+		logger:   logger,
+		notify:   make(chan struct{}, 1),
+	}
+
+	seqs, err := s.segmentSeqs()
+	if err != nil {
+		return nil, err
+	}
+	cursorSeq, cursorOff, err := s.readCursor()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, seq := range seqs {
+		if seq < cursorSeq {
+			if err := os.Remove(s.segmentPath(seq)); err != nil {
+				return nil, fmt.Errorf("remove delivered segment: %w", err)
+			}
+			continue
+		}
+		seg, err := s.recover(seq, i == len(seqs)-1)
+		if err != nil {
+			return nil, err
+		}
+		if len(s.segments) == 0 && seq == cursorSeq {
+			s.readOff, s.readSeen = s.skipTo(seg, cursorOff)
+		}
+		s.segments = append(s.segments, seg)
+		s.bytes += seg.size
+		s.pending += seg.records
+	}
+	s.pending -= s.readSeen
+
+	if len(s.segments) == 0 {
+		s.segments = []*segment{{seq: max(cursorSeq, 1)}}
+		s.readOff, s.readSeen = 0, 0
+	}
+	last := s.segments[len(s.segments)-1]
+	if s.writer, err = os.OpenFile(s.segmentPath(last.seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640); err != nil {
+		return nil, fmt.Errorf("open spool segment: %w", err)
+	}
+	if s.pending > 0 {
+		logger.Info("spool recovered", "dir", dir, "pending", s.pending, "bytes", s.bytes)
+	}
+	return s, nil
+}
+
+// Append adds metric to the tail of the spool, dropping the oldest segment when the
+// spool outgrows its size limit.
+func (s *Spool) Append(metric *api.Metric) error {
+	payload, err := proto.Marshal(metric)
+	if err != nil {
+		return fmt.Errorf("encode metric: %w", err)
+	}
+	record := make([]byte, recordHeader+len(payload))
+	binary.LittleEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[4:8], crc32.Checksum(payload, crcTable))
+	copy(record[recordHeader:], payload)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.writer.Write(record); err != nil {
+		return fmt.Errorf("append to spool: %w", err)
+	}
+	if s.syncEach {
+		if err := s.writer.Sync(); err != nil {
+			return fmt.Errorf("sync spool: %w", err)
+		}
+	}
+	last := s.segments[len(s.segments)-1]
+	last.size += int64(len(record))
+	last.records++
+	s.bytes += int64(len(record))
+	s.pending++
+
+	if last.size >= segmentBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	for s.bytes > s.maxBytes && len(s.segments) > 1 {
+		if err := s.dropOldest(); err != nil {
+			return err
+		}
+	}
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Peek blocks until a sample is available and returns the oldest one without removing
+// it. Only one goroutine may consume the spool.
+func (s *Spool) Peek(ctx context.Context) (*api.Metric, error) {
+	metrics, err := s.PeekN(ctx, 1)
+	if err != nil {
+		return nil, err
+	}
+	return metrics[0], nil
+}
+
+// PeekN is Peek for up to n of the oldest samples. It returns fewer when no more are
+// spooled or the next ones are in another segment file.
+func (s *Spool) PeekN(ctx context.Context, n int) ([]*api.Metric, error) {
+	for {
+		s.mu.Lock()
+		metrics, err := s.peekLocked(n)
+		s.mu.Unlock()
+		if len(metrics) > 0 || err != nil {
+			return metrics, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-s.notify:
+		}
+	}
+}
+
+// Remove drops the sample last returned by Peek once it has been delivered. It is a
+// no-op when that sample was already evicted by the size limit.
+func (s *Spool) Remove() {
+	s.RemoveN(1)
+}
+
+// RemoveN drops the first n samples last returned by PeekN once they have been
+// delivered, skipping those already evicted by the size limit.
+func (s *Spool) RemoveN(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n = min(n, len(s.peeked))
+	if n <= 0 {
+		return
+	}
+	s.readOff = s.peekEnds[n-1]
+	s.readSeen += n
+	s.pending -= n
+	s.peeked, s.peekEnds = s.peeked[n:], s.peekEnds[n:]
+}
+
+// Len returns the number of samples not yet removed.
+func (s *Spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pending
+}
+
+// Bytes returns the size of the spool on disk.
+func (s *Spool) Bytes() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bytes
+}
+
+// Flush writes appended samples to stable storage and persists the read position.
+func (s *Spool) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flushLocked()
+}
+
+// Close flushes the spool and releases its files.
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.flushLocked()
+	if cerr := s.writer.Close(); err == nil {
+		err = cerr
+	}
+	if s.reader != nil {
+		s.reader.Close()
+	}
+	return err
+}
+
+func (s *Spool) flushLocked() error {
+	if err := s.writer.Sync(); err != nil {
+		return fmt.Errorf("sync spool: %w", err)
+	}
+	return s.writeCursor(s.segments[0].seq, s.readOff)
+}
+
+// peekLocked reads up to n records from the read position on, moving past finished
+// segments while nothing is peeked.
+func (s *Spool) peekLocked(n int) ([]*api.Metric, error) {
+	for len(s.peeked) < n {
+		seg := s.segments[0]
+		off := s.readOff
+		if len(s.peeked) > 0 {
+			off = s.peekEnds[len(s.peekEnds)-1]
+		}
+		if off >= seg.size {
+			if len(s.peeked) > 0 || len(s.segments) == 1 {
+				break
+			}
+			if err := s.releaseOldest(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if s.reader == nil {
+			f, err := os.Open(s.segmentPath(seg.seq))
+			if err != nil {
+				return nil, fmt.Errorf("open spool segment: %w", err)
+			}
+			s.reader = f
+		}
+		payload, err := readRecord(s.reader, off)
+		if err != nil {
+			// Segments are validated when the spool is opened, so this is a disk failure.
+			return nil, fmt.Errorf("read spool segment %d: %w", seg.seq, err)
+		}
+		metric := &api.Metric{}
+		if err := proto.Unmarshal(payload, metric); err != nil {
+			if len(s.peeked) > 0 {
+				// Discarded once the samples before it are removed.
+				break
+			}
+			s.logger.Error("discarding undecodable spooled sample", "segment", seg.seq, "offset", off, "error", err)
+			s.readOff += recordHeader + int64(len(payload))
+			s.readSeen++
+			s.pending--
+			continue
+		}
+		s.peeked = append(s.peeked, metric)
+		s.peekEnds = append(s.peekEnds, off+recordHeader+int64(len(payload)))
+	}
+	return s.peeked[:min(n, len(s.peeked))], nil
+}
+
+// rotate starts a new segment for writing.
+func (s *Spool) rotate() error {
+	if err := s.writer.Sync(); err != nil {
+		return fmt.Errorf("sync spool: %w", err)
+	}
+	if err := s.writer.Close(); err != nil {
+		return fmt.Errorf("close spool segment: %w", err)
+	}
+	next := &segment{seq: s.segments[len(s.segments)-1].seq + 1}
+	f, err := os.OpenFile(s.segmentPath(next.seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return fmt.Errorf("open spool segment: %w", err)
+	}
+	s.writer = f
+	s.segments = append(s.segments, next)
+	return nil
+}
+
+// dropOldest discards the oldest segment, delivered or not, to stay within maxBytes.
+func (s *Spool) dropOldest() error {
+	seg := s.segments[0]
+	lost := seg.records - s.readSeen
+	s.pending -= lost
+	s.logger.Warn("spool full, dropped oldest samples", "samples", lost, "bytes", seg.size, "limit", s.maxBytes)
+	return s.releaseOldest()
+}
+
+// releaseOldest deletes the segment being read and moves reading to the next one.
+func (s *Spool) releaseOldest() error {
+	seg := s.segments[0]
+	if s.reader != nil {
+		s.reader.Close()
+		s.reader = nil
+	}
+	s.segments = s.segments[1:]
+	s.bytes -= seg.size
+	s.readOff, s.readSeen = 0, 0
+	s.peeked, s.peekEnds = nil, nil
+	if err := os.Remove(s.segmentPath(seg.seq)); err != nil {
+		return fmt.Errorf("remove spool segment: %w", err)
+	}
+	// Persist the move so the deleted segment is not looked for after a restart.
+	return s.writeCursor(s.segments[0].seq, 0)
+}
+
+// recover validates a segment file and returns its valid prefix. A torn record at the
+// end of the newest segment is truncated so appends continue after the last good one.
+func (s *Spool) recover(seq uint64, newest bool) (*segment, error) {
+	path := s.segmentPath(seq)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open spool segment: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("stat spool segment: %w", err)
+	}
+
+	seg := &segment{seq: seq}
+	for seg.size < info.Size() {
+		payload, err := readRecord(f, seg.size)
+		if err != nil {
+			s.logger.Warn("spool segment ends in a damaged record", "segment", seq, "offset", seg.size, "discarded_bytes", info.Size()-seg.size, "error", err)
+			break
+		}
+		seg.size += recordHeader + int64(len(payload))
+		seg.records++
+	}
+	if newest && seg.size < info.Size() {
+		if err := os.Truncate(path, seg.size); err != nil {
+			return nil, fmt.Errorf("truncate spool segment: %w", err)
+		}
+	}
+	return seg, nil
+}
+
+// skipTo returns the record boundary at or before off in seg and how many records
+// precede it.
+func (s *Spool) skipTo(seg *segment, off int64) (int64, int) {
+	f, err := os.Open(s.segmentPath(seg.seq))
+	if err != nil {
+		return 0, 0
+	}
+	defer f.Close()
+
+	var pos int64
+	var seen int
+	var header [recordHeader]byte
+	for pos < off && pos < seg.size {
+		if _, err := f.ReadAt(header[:], pos); err != nil {
+			break
+		}
+		next := pos + recordHeader + int64(binary.LittleEndian.Uint32(header[0:4]))
+		if next > off {
+			break
+		}
+		pos = next
+		seen++
+	}
+	return pos, seen
+}
+
+func readRecord(f *os.File, off int64) ([]byte, error) {
+	var header [recordHeader]byte
+	if _, err := f.ReadAt(header[:], off); err != nil {
+		return nil, fmt.Errorf("read record header: %w", err)
+	}
+	length := binary.LittleEndian.Uint32(header[0:4])
+	if length > segmentBytes {
+		return nil, fmt.Errorf("record length %d out of range", length)
+	}
+	payload := make([]byte, length)
+	if _, err := f.ReadAt(payload, off+recordHeader); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("read record: %w", err)
+	}
+	if crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(header[4:8]) {
+		return nil, errors.New("record checksum mismatch")
+	}
+	return payload, nil
+}
+
+func (s *Spool) segmentPath(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d.seg", seq))
+}
+
+func (s *Spool) segmentSeqs() ([]uint64, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("read spool dir: %w", err)
+	}
+	var seqs []uint64
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".seg")
+		if !ok {
+			continue
+		}
+		if seq, err := strconv.ParseUint(name, 10, 64); err == nil {
+			seqs = append(seqs, seq)
+		}
+	}
+	slices.Sort(seqs)
+	return seqs, nil
+}
+
+// readCursor returns the persisted read position, zero when there is none yet.
+func (s *Spool) readCursor() (uint64, int64, error) {
+	raw, err := os.ReadFile(filepath.Join(s.dir, "cursor"))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("read spool cursor: %w", err)
+	}
+	var seq uint64
+	var off int64
+	if _, err := fmt.Sscan(string(raw), &seq, &off); err != nil {
+		s.logger.Warn("ignoring unreadable spool cursor", "error", err)
+		return 0, 0, nil
+	}
+	return seq, off, nil
+}
+
+// writeCursor replaces the cursor file atomically.
+func (s *Spool) writeCursor(seq uint64, off int64) error {
+	path := filepath.Join(s.dir, "cursor")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(fmt.Sprintf("%d %d\n", seq, off)), 0o640); err != nil {
+		return fmt.Errorf("write spool cursor: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("write spool cursor: %w", err)
+	}
+	return nil
+}
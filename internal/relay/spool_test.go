@@ -0,0 +1,240 @@
+package relay
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"telemetry-agent/pkg/api"
+)
+
+var testLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// testEpoch is a window boundary for every window size the tests use.
+var testEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// sample returns a sample of agentID collected offset after testEpoch whose "seq" value
+// identifies it.
+func sample(agentID string, offset time.Duration, seq int) *api.Metric {
+	return &api.Metric{
+		AgentId:     agentID,
+		CollectedAt: timestamppb.New(testEpoch.Add(offset)),
+		Values:      map[string]float64{"seq": float64(seq)},
+	}
+}
+
+func openTestSpool(t *testing.T, dir string, maxBytes int64) *Spool {
+	t.Helper()
+	s, err := OpenSpool(dir, maxBytes, false, testLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func appendSamples(t *testing.T, s *Spool, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		if err := s.Append(sample("web-1", time.Duration(i)*time.Second, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// peekSeq returns the "seq" value of the oldest spooled sample.
+func peekSeq(t *testing.T, s *Spool) int {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	metric, err := s.Peek(ctx)
+	if err != nil {
+		t.Fatalf("peek: %v", err)
+	}
+	return int(metric.GetValues()["seq"])
+}
+
+func TestSpoolReplaysAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestSpool(t, dir, 1<<30)
+	appendSamples(t, s, 0, 5)
+	for i := 0; i < 2; i++ {
+		if seq := peekSeq(t, s); seq != i {
+			t.Fatalf("peeked %d, want %d", seq, i)
+		}
+		s.Remove()
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openTestSpool(t, dir, 1<<30)
+	defer s.Close()
+	if s.Len() != 3 {
+		t.Fatalf("Len = %d after restart, want 3", s.Len())
+	}
+	if seq := peekSeq(t, s); seq != 2 {
+		t.Fatalf("first sample after restart = %d, want 2", seq)
+	}
+}
+
+func TestSpoolCursorPersistedByFlush(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestSpool(t, dir, 1<<30)
+	appendSamples(t, s, 0, 4)
+	peekSeq(t, s)
+	s.Remove()
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// Removed after the last flush and then crashed: delivered again.
+	peekSeq(t, s)
+	s.Remove()
+
+	crashed := openTestSpool(t, dir, 1<<30)
+	defer crashed.Close()
+	if crashed.Len() != 3 {
+		t.Fatalf("Len = %d after crash, want 3", crashed.Len())
+	}
+	if seq := peekSeq(t, crashed); seq != 1 {
+		t.Fatalf("first sample after crash = %d, want 1", seq)
+	}
+	s.Close()
+}
+
+func TestSpoolDiscardsDamagedTail(t *testing.T) {
+	tests := []struct {
+		name   string
+		damage func(t *testing.T, path string)
+		want   int
+	}{
+		{
+			name: "torn record",
+			damage: func(t *testing.T, path string) {
+				f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer f.Close()
+				// A header announcing more payload than was written.
+				if _, err := f.Write([]byte{64, 0, 0, 0, 1, 2, 3, 4, 5}); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: 3,
+		},
+		{
+			name: "checksum mismatch",
+			damage: func(t *testing.T, path string) {
+				raw, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				raw[len(raw)-1] ^= 0xff
+				if err := os.WriteFile(path, raw, 0o640); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := openTestSpool(t, dir, 1<<30)
+			appendSamples(t, s, 0, 3)
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+			tt.damage(t, s.segmentPath(1))
+
+			s = openTestSpool(t, dir, 1<<30)
+			defer s.Close()
+			if s.Len() != tt.want {
+				t.Fatalf("Len = %d, want %d", s.Len(), tt.want)
+			}
+			// Appends continue after the last good record.
+			appendSamples(t, s, 10, 11)
+			for i := 0; i < tt.want; i++ {
+				if seq := peekSeq(t, s); seq != i {
+					t.Fatalf("sample %d = %d", i, seq)
+				}
+				s.Remove()
+			}
+			if seq := peekSeq(t, s); seq != 10 {
+				t.Fatalf("sample appended after recovery = %d, want 10", seq)
+			}
+		})
+	}
+}
+
+func TestSpoolEvictsOldestSegment(t *testing.T) {
+	dir := t.TempDir()
+	const limit = segmentBytes + segmentBytes/2
+	s := openTestSpool(t, dir, limit)
+	defer s.Close()
+
+	padding := strings.Repeat("x", 64<<10)
+	perSegment := 0
+	for i := 0; s.segments[0].seq == 1; i++ {
+		metric := sample("web-1", time.Duration(i)*time.Second, i)
+		metric.Labels = map[string]string{"padding": padding}
+		if err := s.Append(metric); err != nil {
+			t.Fatal(err)
+		}
+		if len(s.segments) == 1 && s.segments[0].seq == 1 {
+			perSegment = i + 2
+		}
+		if i > 4*segmentBytes/len(padding) {
+			t.Fatal("spool never reached its size limit")
+		}
+	}
+	if s.Bytes() > limit {
+		t.Fatalf("spool holds %d bytes, limit %d", s.Bytes(), limit)
+	}
+	if seq := peekSeq(t, s); seq != perSegment {
+		t.Fatalf("oldest sample = %d, want %d, the first of the second segment", seq, perSegment)
+	}
+	if _, err := os.Stat(s.segmentPath(1)); !os.IsNotExist(err) {
+		t.Fatalf("evicted segment still on disk: %v", err)
+	}
+	if entries, _ := filepath.Glob(filepath.Join(dir, "*.seg")); len(entries) != len(s.segments) {
+		t.Fatalf("%d segment files for %d segments", len(entries), len(s.segments))
+	}
+}
+
+func TestSpoolPeekN(t *testing.T) {
+	s := openTestSpool(t, t.TempDir(), 1<<30)
+	defer s.Close()
+	appendSamples(t, s, 0, 5)
+	ctx := context.Background()
+
+	batch, err := s.PeekN(ctx, 3)
+	if err != nil || len(batch) != 3 {
+		t.Fatalf("PeekN = %d samples, %v", len(batch), err)
+	}
+	s.RemoveN(2)
+	if s.Len() != 3 {
+		t.Fatalf("Len = %d, want 3", s.Len())
+	}
+	batch, err = s.PeekN(ctx, 10)
+	if err != nil || len(batch) != 3 || batch[0].GetValues()["seq"] != 2 {
+		t.Fatalf("PeekN after RemoveN = %v, %v", batch, err)
+	}
+	s.RemoveN(10)
+	if s.Len() != 0 {
+		t.Fatalf("Len = %d, want 0", s.Len())
+	}
+
+	short, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := s.PeekN(short, 1); err == nil {
+		t.Fatal("PeekN on an empty spool returned without blocking")
+	}
+}
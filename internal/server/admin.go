@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"telemetry-agent/internal/server/storage"
+)
+
+// NewAdminHandler wires the routes that change what agents may do: issuing and revoking
+// agent tokens and editing remote configuration policies. Every request must carry
+// "Authorization: Bearer <token>"; the handler is meant for its own listener, never for
+// the address the dashboard proxies.
+func NewAdminHandler(store storage.Store, svc *TelemetryService, token string, logger *slog.Logger) http.Handler {
+	h := &httpAPI{store: store, svc: svc, logger: logger}
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /api/policies", h.handleListPolicies)
+	mux.HandleFunc("PUT /api/policies/{name}", h.handlePutPolicy)
+	mux.HandleFunc("DELETE /api/policies/{name}", h.handleDeletePolicy)
+	mux.HandleFunc("GET /api/tokens", h.handleListTokens)
+	mux.HandleFunc("POST /api/tokens", h.handleCreateToken)
+	mux.HandleFunc("DELETE /api/tokens/{id}", h.handleRevokeToken)
+
+	return h.requireAdmin(token, mux)
+}
+
+// requireAdmin rejects requests whose bearer token is not token. An empty token rejects
+// everything.
+func (h *httpAPI) requireAdmin(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		presented, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" || subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="telemetry-admin"`)
+			h.writeError(w, http.StatusUnauthorized, fmt.Errorf("admin token required"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (h *httpAPI) handlePutPolicy(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var policy storage.Policy
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&policy); err != nil {
+		h.writeError(w, http.StatusBadRequest, fmt.Errorf("decode policy: %w", err))
+		return
+	}
+	policy.Name = r.PathValue("name")
+	if err := policy.Validate(); err != nil {
+		h.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	saved, err := h.store.SavePolicy(ctx, policy)
+	if err != nil {
+		h.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	h.reloadPolicies(ctx)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(saved); err != nil {
+		h.logger.Warn("write policy response", "policy", saved.Name, "error", err)
+	}
+}
+
+func (h *httpAPI) handleDeletePolicy(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	name := r.PathValue("name")
+
+	found, err := h.store.DeletePolicy(ctx, name)
+	if err != nil {
+		h.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !found {
+		h.writeError(w, http.StatusNotFound, fmt.Errorf("policy %q not found", name))
+		return
+	}
+	h.reloadPolicies(ctx)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *httpAPI) handleListTokens(w http.ResponseWriter, r *http.Request) {
+	tokens, err := h.store.Tokens(r.Context())
+	if err != nil {
+		h.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]any{"tokens": tokens}); err != nil {
+		h.logger.Warn("write tokens response", "error", err)
+	}
+}
+
+// tokenRequest describes a token to issue; TTL is a Go duration, empty for no expiry.
+type tokenRequest struct {
+	Kind        string `json:"kind"`
+	AgentID     string `json:"agentId"`
+	Description string `json:"description"`
+	TTL         string `json:"ttl"`
+}
+
+func (h *httpAPI) handleCreateToken(w http.ResponseWriter, r *http.Request) {
+	var req tokenRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		h.writeError(w, http.StatusBadRequest, fmt.Errorf("decode token request: %w", err))
+		return
+	}
+
+	var ttl time.Duration
+	if req.TTL != "" {
+		parsed, err := time.ParseDuration(req.TTL)
+		if err != nil || parsed <= 0 {
+			h.writeError(w, http.StatusBadRequest, fmt.Errorf("ttl must be a positive duration, got %q", req.TTL))
+			return
+		}
+		ttl = parsed
+	}
+	token := storage.Token{Kind: req.Kind, AgentID: req.AgentID, Description: req.Description}
+	if err := token.Validate(); err != nil {
+		h.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	issued, secret, err := h.svc.IssueToken(r.Context(), token, ttl)
+	if err != nil {
+		h.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(map[string]any{"token": issued, "secret": secret}); err != nil {
+		h.logger.Warn("write token response", "token", issued.ID, "error", err)
+	}
+}
+
+func (h *httpAPI) handleRevokeToken(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	found, err := h.store.RevokeToken(r.Context(), id)
+	if err != nil {
+		h.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !found {
+		h.writeError(w, http.StatusNotFound, fmt.Errorf("token %q not found", id))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *httpAPI) reloadPolicies(ctx context.Context) {
+	if err := h.svc.ReloadPolicies(ctx); err != nil {
+		h.logger.Error("reload policies after edit", "error", err)
+	}
+}
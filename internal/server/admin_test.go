@@ -0,0 +1,184 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"telemetry-agent/internal/server/storage"
+)
+
+const testAdminToken = "admin-secret-0123456789"
+
+// adminRequest performs an authenticated admin request and decodes a successful JSON
+// response into out, if given.
+func adminRequest(t *testing.T, h http.Handler, method, target, body string, out any) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if out != nil && rec.Code < 300 {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: decode %q: %v", method, target, rec.Body.String(), err)
+		}
+	}
+	return rec
+}
+
+func TestAdminHandlerRequiresToken(t *testing.T) {
+	svc, store, _ := newTestService(t, AuthConfig{})
+	tests := []struct {
+		name   string
+		token  string
+		header string
+		want   int
+	}{
+		{"no header", testAdminToken, "", http.StatusUnauthorized},
+		{"wrong token", testAdminToken, "Bearer nope", http.StatusUnauthorized},
+		{"not a bearer token", testAdminToken, "Basic " + testAdminToken, http.StatusUnauthorized},
+		{"empty configured token", "", "Bearer ", http.StatusUnauthorized},
+		{"valid", testAdminToken, "Bearer " + testAdminToken, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewAdminHandler(store, svc, tt.token, testLogger)
+			req := httptest.NewRequest(http.MethodGet, "/api/tokens", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+		})
+	}
+}
+
+func TestPublicHandlerRejectsChanges(t *testing.T) {
+	h, _, _ := newTestHandler(t)
+	tests := []struct {
+		method, target, body string
+	}{
+		{http.MethodGet, "/api/tokens", ""},
+		{http.MethodPost, "/api/tokens", `{"kind":"agent","agentId":"*"}`},
+		{http.MethodDelete, "/api/tokens/abc", ""},
+		{http.MethodPut, "/api/policies/prod", `{"interval":"5s"}`},
+		{http.MethodDelete, "/api/policies/prod", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.target, func(t *testing.T) {
+			rec := serve(t, h, tt.method, tt.target, tt.body, nil)
+			if rec.Code != http.StatusNotFound && rec.Code != http.StatusMethodNotAllowed {
+				t.Fatalf("status = %d, want the route to be absent", rec.Code)
+			}
+		})
+	}
+}
+
+func TestAdminTokenLifecycle(t *testing.T) {
+	svc, store, _ := newTestService(t, AuthConfig{})
+	h := NewAdminHandler(store, svc, testAdminToken, testLogger)
+
+	var created struct {
+		Token  storage.Token `json:"token"`
+		Secret string        `json:"secret"`
+	}
+	rec := adminRequest(t, h, http.MethodPost, "/api/tokens", `{"kind":"agent","agentId":"web-*","description":"web tier","ttl":"24h"}`, &created)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: status = %d: %s", rec.Code, rec.Body)
+	}
+	if created.Secret == "" || created.Token.ID == "" || created.Token.ExpiresAt == nil {
+		t.Fatalf("create returned %+v", created)
+	}
+	stored, ok, err := store.TokenByHash(context.Background(), hashToken(created.Secret))
+	if err != nil || !ok || stored.ID != created.Token.ID {
+		t.Fatalf("secret does not resolve to the issued token: %+v, %v, %v", stored, ok, err)
+	}
+
+	var listed struct {
+		Tokens []storage.Token `json:"tokens"`
+	}
+	rec = adminRequest(t, h, http.MethodGet, "/api/tokens", "", &listed)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("list: status = %d: %s", rec.Code, rec.Body)
+	}
+	if len(listed.Tokens) != 1 || listed.Tokens[0].ID != created.Token.ID || listed.Tokens[0].RevokedAt != nil {
+		t.Fatalf("list = %+v", listed.Tokens)
+	}
+	if strings.Contains(rec.Body.String(), created.Secret) {
+		t.Fatal("list exposed the token secret")
+	}
+
+	if rec := adminRequest(t, h, http.MethodDelete, "/api/tokens/"+created.Token.ID, "", nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("revoke: status = %d: %s", rec.Code, rec.Body)
+	}
+	adminRequest(t, h, http.MethodGet, "/api/tokens", "", &listed)
+	if len(listed.Tokens) != 1 || listed.Tokens[0].RevokedAt == nil {
+		t.Fatalf("token not revoked: %+v", listed.Tokens)
+	}
+	if rec := adminRequest(t, h, http.MethodDelete, "/api/tokens/unknown", "", nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("revoke unknown: status = %d, want 404", rec.Code)
+	}
+}
+
+func TestAdminCreateTokenValidation(t *testing.T) {
+	svc, store, _ := newTestService(t, AuthConfig{})
+	h := NewAdminHandler(store, svc, testAdminToken, testLogger)
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"unknown kind", `{"kind":"admin","agentId":"a"}`},
+		{"missing agent", `{"kind":"agent"}`},
+		{"bad pattern", `{"kind":"agent","agentId":"web-["}`},
+		{"bad ttl", `{"kind":"agent","agentId":"a","ttl":"soon"}`},
+		{"negative ttl", `{"kind":"agent","agentId":"a","ttl":"-1h"}`},
+		{"unknown field", `{"kind":"agent","agentId":"a","scope":"all"}`},
+		{"not json", `kind=agent`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := adminRequest(t, h, http.MethodPost, "/api/tokens", tt.body, nil); rec.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want 400: %s", rec.Code, rec.Body)
+			}
+		})
+	}
+	if tokens, _ := store.Tokens(context.Background()); len(tokens) != 0 {
+		t.Fatalf("rejected requests stored tokens: %+v", tokens)
+	}
+}
+
+func TestAdminPolicyEdits(t *testing.T) {
+	svc, store, _ := newTestService(t, AuthConfig{})
+	h := NewAdminHandler(store, svc, testAdminToken, testLogger)
+
+	var saved storage.Policy
+	rec := adminRequest(t, h, http.MethodPut, "/api/policies/prod", `{"selector":{"env":"prod"},"interval":"30s"}`, &saved)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("put: status = %d: %s", rec.Code, rec.Body)
+	}
+	if saved.Name != "prod" || saved.Version == 0 {
+		t.Fatalf("put returned %+v", saved)
+	}
+	if policy, ok := resolvePolicy(svc.policies, "web-1", storage.Labels{"env": "prod"}); !ok || policy.Name != "prod" {
+		t.Fatalf("service did not reload the edited policy: %+v, %t", policy, ok)
+	}
+
+	if rec := adminRequest(t, h, http.MethodPut, "/api/policies/bad", `{"interval":"often"}`, nil); rec.Code != http.StatusBadRequest {
+		t.Fatalf("put invalid: status = %d, want 400", rec.Code)
+	}
+	if rec := adminRequest(t, h, http.MethodDelete, "/api/policies/prod", "", nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete: status = %d: %s", rec.Code, rec.Body)
+	}
+	if rec := adminRequest(t, h, http.MethodDelete, "/api/policies/prod", "", nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("delete again: status = %d, want 404", rec.Code)
+	}
+	if _, ok := resolvePolicy(svc.policies, "web-1", storage.Labels{"env": "prod"}); ok {
+		t.Fatal("deleted policy still applies")
+	}
+}
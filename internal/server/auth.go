@@ -0,0 +1,190 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"telemetry-agent/internal/server/storage"
+	"telemetry-agent/pkg/api"
+)
+
+// tokenRecheck is how often an open stream re-reads its token so revocation and expiry
+// also end streams that are already running.
+const tokenRecheck = time.Minute
+
+// AuthConfig controls how agents are authenticated on the metrics stream.
+type AuthConfig struct {
+	// Identities extends which agent IDs a client certificate may report as when mutual
+	// TLS is enabled.
+	Identities IdentityMap
+	// RequireToken makes StreamMetrics reject callers without a valid agent token.
+	RequireToken bool
+	// TokenTTL bounds the lifetime of credentials issued by Enroll; zero means they do
+	// not expire.
+	TokenTTL time.Duration
+}
+
+type tokenContextKey struct{}
+
+// streamToken is the agent token a stream was opened with.
+type streamToken struct {
+	storage.Token
+	hash []byte
+}
+
+// StreamAuthInterceptor rejects streams that do not carry a valid agent bearer token in
+// their "authorization" metadata. It is a no-op unless AuthConfig.RequireToken is set.
+func (s *TelemetryService) StreamAuthInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if !s.auth.RequireToken {
+			return handler(srv, ss)
+		}
+
+		ctx := ss.Context()
+		secret, err := bearerToken(ctx)
+		if err != nil {
+			return err
+		}
+		hash := hashToken(secret)
+		token, err := s.checkToken(ctx, hash)
+		if err != nil {
+			return err
+		}
+
+		ctx = context.WithValue(ctx, tokenContextKey{}, streamToken{Token: token, hash: hash})
+		return handler(srv, &authenticatedStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// checkToken loads the agent token hashing to hash and verifies it is still accepted.
+func (s *TelemetryService) checkToken(ctx context.Context, hash []byte) (storage.Token, error) {
+	token, ok, err := s.store.TokenByHash(ctx, hash)
+	if err != nil {
+		s.logger.Error("look up agent token", "error", err)
+		return storage.Token{}, status.Error(codes.Unavailable, "token lookup failed")
+	}
+	if !ok || token.Kind != storage.TokenAgent || !token.Active(time.Now()) {
+		return storage.Token{}, status.Error(codes.Unauthenticated, "invalid, expired or revoked token")
+	}
+	return token, nil
+}
+
+// authorizeToken rejects samples from agents the stream's token is not scoped to.
+func authorizeToken(token streamToken, agentID string) error {
+	if token.Allows(agentID) {
+		return nil
+	}
+	return status.Errorf(codes.PermissionDenied, "token %s may not report as agent %q", token.ID, agentID)
+}
+
+// Enroll exchanges a one-time bootstrap token for a long-lived credential scoped to the
+// requesting agent.
+func (s *TelemetryService) Enroll(ctx context.Context, req *api.EnrollRequest) (*api.EnrollResponse, error) {
+	agentID := req.GetAgentId()
+	if agentID == "" || req.GetBootstrapToken() == "" {
+		return nil, status.Error(codes.InvalidArgument, "agent_id and bootstrap_token are required")
+	}
+	if identities, ok := PeerIdentities(ctx); ok {
+		if err := s.authorizeAgent(identities, agentID); err != nil {
+			return nil, err
+		}
+	}
+
+	credential := storage.Token{
+		Kind:        storage.TokenAgent,
+		AgentID:     agentID,
+		Description: "issued by enrollment",
+	}
+	if s.auth.TokenTTL > 0 {
+		expires := time.Now().Add(s.auth.TokenTTL)
+		credential.ExpiresAt = &expires
+	}
+	secret, err := newTokenSecret(&credential)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	issued, err := s.store.EnrollAgent(ctx, hashToken(req.GetBootstrapToken()), agentID, credential, hashToken(secret))
+	if errors.Is(err, storage.ErrTokenRejected) {
+		s.logger.Warn("enrollment rejected", "agent", agentID)
+		return nil, status.Error(codes.PermissionDenied, "bootstrap token rejected")
+	}
+	if err != nil {
+		s.logger.Error("enroll agent", "agent", agentID, "error", err)
+		return nil, status.Error(codes.Unavailable, "enrollment failed")
+	}
+	s.logger.Info("agent enrolled", "agent", agentID, "token", issued.ID)
+
+	resp := &api.EnrollResponse{Token: secret}
+	if issued.ExpiresAt != nil {
+		resp.ExpiresAt = timestamppb.New(*issued.ExpiresAt)
+	}
+	return resp, nil
+}
+
+// IssueToken stores a new token valid for ttl (zero for no expiry) and returns it with
+// its secret, which is not retrievable afterwards.
+func (s *TelemetryService) IssueToken(ctx context.Context, token storage.Token, ttl time.Duration) (storage.Token, string, error) {
+	if ttl > 0 {
+		expires := time.Now().Add(ttl)
+		token.ExpiresAt = &expires
+	}
+	secret, err := newTokenSecret(&token)
+	if err != nil {
+		return storage.Token{}, "", err
+	}
+	issued, err := s.store.CreateToken(ctx, token, hashToken(secret))
+	if err != nil {
+		return storage.Token{}, "", err
+	}
+	return issued, secret, nil
+}
+
+// newTokenSecret assigns token a random ID and returns a fresh secret for it.
+func newTokenSecret(token *storage.Token) (string, error) {
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("generate token id: %w", err)
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("generate token secret: %w", err)
+	}
+	token.ID = hex.EncodeToString(id)
+	return "tx_" + base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+func hashToken(secret string) []byte {
+	sum := sha256.Sum256([]byte(secret))
+	return sum[:]
+}
+
+func bearerToken(ctx context.Context) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		if token, ok := strings.CutPrefix(value, "Bearer "); ok && token != "" {
+			return token, nil
+		}
+	}
+	return "", status.Error(codes.Unauthenticated, "missing bearer token")
+}
+
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context { return s.ctx }
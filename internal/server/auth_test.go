@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"telemetry-agent/internal/server/storage"
+)
+
+// interceptStream runs the stream auth interceptor for a stream opened with the given
+// authorization header value and reports the token the handler saw.
+func interceptStream(svc *TelemetryService, authorization string) (streamToken, bool, error) {
+	ctx := context.Background()
+	if authorization != "" {
+		ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", authorization))
+	}
+	var seen streamToken
+	var called bool
+	err := svc.StreamAuthInterceptor()(nil, newFakeStream(ctx), &grpc.StreamServerInfo{}, func(srv any, ss grpc.ServerStream) error {
+		seen, called = ss.Context().Value(tokenContextKey{}).(streamToken)
+		return nil
+	})
+	return seen, called, err
+}
+
+func TestStreamAuthInterceptor(t *testing.T) {
+	svc, store, _ := newTestService(t, AuthConfig{RequireToken: true})
+	ctx := context.Background()
+
+	issue := func(token storage.Token) string {
+		t.Helper()
+		secret, err := newTokenSecret(&token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.CreateToken(ctx, token, hashToken(secret)); err != nil {
+			t.Fatal(err)
+		}
+		return secret
+	}
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Hour)
+
+	valid := issue(storage.Token{Kind: storage.TokenAgent, AgentID: "web-*"})
+	expiring := issue(storage.Token{Kind: storage.TokenAgent, AgentID: "web-1", ExpiresAt: &future})
+	expired := issue(storage.Token{Kind: storage.TokenAgent, AgentID: "web-1", ExpiresAt: &past})
+	bootstrap := issue(storage.Token{Kind: storage.TokenBootstrap, AgentID: "web-1"})
+	revokedToken := storage.Token{Kind: storage.TokenAgent, AgentID: "web-1"}
+	revoked, err := newTokenSecret(&revokedToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.CreateToken(ctx, revokedToken, hashToken(revoked)); err != nil {
+		t.Fatal(err)
+	}
+	if found, err := store.RevokeToken(ctx, revokedToken.ID); err != nil || !found {
+		t.Fatalf("revoke: %t, %v", found, err)
+	}
+
+	tests := []struct {
+		name          string
+		authorization string
+		want          codes.Code
+		wantAgent     string
+	}{
+		{"valid", "Bearer " + valid, codes.OK, "web-*"},
+		{"not yet expired", "Bearer " + expiring, codes.OK, "web-1"},
+		{"missing", "", codes.Unauthenticated, ""},
+		{"not bearer", "Basic " + valid, codes.Unauthenticated, ""},
+		{"unknown", "Bearer tx_unknown", codes.Unauthenticated, ""},
+		{"expired", "Bearer " + expired, codes.Unauthenticated, ""},
+		{"revoked", "Bearer " + revoked, codes.Unauthenticated, ""},
+		{"bootstrap token", "Bearer " + bootstrap, codes.Unauthenticated, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, called, err := interceptStream(svc, tt.authorization)
+			if status.Code(err) != tt.want {
+				t.Fatalf("interceptor = %v, want %s", err, tt.want)
+			}
+			if called != (tt.want == codes.OK) {
+				t.Fatalf("handler called = %t", called)
+			}
+			if called && token.AgentID != tt.wantAgent {
+				t.Fatalf("stream token scoped to %q, want %q", token.AgentID, tt.wantAgent)
+			}
+		})
+	}
+}
+
+func TestStreamAuthInterceptorDisabled(t *testing.T) {
+	svc, _, _ := newTestService(t, AuthConfig{})
+	_, called, err := interceptStream(svc, "")
+	if err != nil {
+		t.Fatalf("interceptor = %v", err)
+	}
+	if called {
+		t.Fatal("a token was attached although none is required")
+	}
+}
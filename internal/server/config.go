@@ -2,48 +2,289 @@ package server
 
 import (
 	"fmt"
+	"math"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"telemetry-agent/internal/server/storage"
 )
 
 // Config stores runtime parameters for the telemetry server.
 type Config struct {
-	GRPCAddr    string
-	HTTPAddr    string
+	GRPCAddr string
+	// HTTPAddr serves the read-only API the dashboard uses.
+	HTTPAddr string
+	// AdminAddr serves token and policy management over TLS to callers presenting
+	// AdminToken; the admin API is disabled while AdminToken is empty.
+	AdminAddr   string
+	AdminToken  string
 	TLSCertPath string
 	TLSKeyPath  string
+	// ClientCAPath enables mutual TLS: agents must present a certificate signed by this CA
+	// and may only report under an agent ID bound to it.
+	ClientCAPath string
+	// TLSReload is how often the certificate, key and client CA files are checked for
+	// changes; zero disables reloading.
+	TLSReload time.Duration
+	// AgentIdentities lets a certificate report as agent IDs other than its own name.
+	AgentIdentities IdentityMap
+	// RequireToken makes agents authenticate with a bearer token; AgentTokenTTL bounds the
+	// lifetime of tokens issued by enrollment (zero for no expiry).
+	RequireToken  bool
+	AgentTokenTTL time.Duration
+	// Storage selects the backend: StoragePostgres persists to PostgresDSN, StorageBolt to
+	// the embedded database file at BoltPath, and StorageMemory keeps the newest
+	// MemoryRecords samples per agent in process and loses everything on restart.
+	Storage     string
 	PostgresDSN string
+	// AutoMigrate applies pending PostgreSQL schema migrations on start; without it the
+	// server refuses to start until "server migrate up" has run.
+	AutoMigrate   bool
+	BoltPath      string
+	MemoryRecords int
+	// PolicyRefresh is how often agent policies are re-read so edits made through another
+	// server instance reach the agents connected to this one.
+	PolicyRefresh time.Duration
+	// Rates tunes how counter rates are derived from consecutive samples.
+	Rates RateConfig
+	// Ingest tunes the queue and writer pool samples pass through on their way to storage.
+	Ingest IngestConfig
+	// Maintenance schedules partitioning and rollups of PostgreSQL storage and retention
+	// of PostgreSQL and Bolt storage.
+	Maintenance MaintenanceConfig
+
+	// KeepaliveTime and KeepaliveTimeout control server pings on idle connections;
+	// KeepaliveMinTime is the shortest ping interval tolerated from agents.
+	KeepaliveTime    time.Duration
+	KeepaliveTimeout time.Duration
+	KeepaliveMinTime time.Duration
+	// MaxMessageBytes caps a single message in either direction.
+	MaxMessageBytes int
+	// InitialWindowSize and InitialConnWindowSize are the HTTP/2 flow-control windows per
+	// stream and per connection in bytes; zero keeps gRPC's dynamic sizing.
+	InitialWindowSize     int
+	InitialConnWindowSize int
 }
 
+// minAdminToken is the shortest admin token accepted, to keep it out of guessing range.
+const minAdminToken = 16
+
+// Storage backends.
+const (
+	StoragePostgres = "postgres"
+	StorageBolt     = "bolt"
+	StorageMemory   = "memory"
+)
+
 // LoadConfig reads configuration solely from environment variables, keeping only the
 // knobs required for the minimal deployment.
 func LoadConfig() (Config, error) {
 	cfg := Config{
-		GRPCAddr:    getenv("TELEMETRY_SERVER_GRPC_ADDR", ":50051"),
-		HTTPAddr:    getenv("TELEMETRY_SERVER_HTTP_ADDR", ":8080"),
-		TLSCertPath: getenv("TELEMETRY_SERVER_TLS_CERT", "deploy/certs/dev/server.pem"),
-		TLSKeyPath:  getenv("TELEMETRY_SERVER_TLS_KEY", "deploy/certs/dev/server-key.pem"),
-		PostgresDSN: getenv("TELEMETRY_SERVER_POSTGRES_DSN", ""),
+		GRPCAddr:     getenv("TELEMETRY_SERVER_GRPC_ADDR", ":50051"),
+		HTTPAddr:     getenv("TELEMETRY_SERVER_HTTP_ADDR", ":8080"),
+		AdminAddr:    getenv("TELEMETRY_SERVER_ADMIN_ADDR", "127.0.0.1:8081"),
+		AdminToken:   getenv("TELEMETRY_SERVER_ADMIN_TOKEN", ""),
+		TLSCertPath:  getenv("TELEMETRY_SERVER_TLS_CERT", "deploy/certs/dev/server.pem"),
+		TLSKeyPath:   getenv("TELEMETRY_SERVER_TLS_KEY", "deploy/certs/dev/server-key.pem"),
+		ClientCAPath: getenv("TELEMETRY_SERVER_CLIENT_CA", ""),
+		Storage:      getenv("TELEMETRY_SERVER_STORAGE", StoragePostgres),
+		PostgresDSN:  getenv("TELEMETRY_SERVER_POSTGRES_DSN", ""),
+		BoltPath:     getenv("TELEMETRY_SERVER_BOLT_PATH", "telemetry.db"),
+		Ingest:       IngestConfig{Overflow: getenv("TELEMETRY_SERVER_INGEST_OVERFLOW", OverflowBlock)},
+	}
+
+	identities, err := ParseIdentityMap(getenv("TELEMETRY_SERVER_AGENT_IDENTITIES", ""))
+	if err != nil {
+		return Config{}, fmt.Errorf("parse TELEMETRY_SERVER_AGENT_IDENTITIES: %w", err)
+	}
+	cfg.AgentIdentities = identities
+
+	if cfg.RequireToken, err = strconv.ParseBool(getenv("TELEMETRY_SERVER_REQUIRE_TOKEN", "false")); err != nil {
+		return Config{}, fmt.Errorf("parse TELEMETRY_SERVER_REQUIRE_TOKEN: %w", err)
+	}
+	if cfg.AgentTokenTTL, err = time.ParseDuration(getenv("TELEMETRY_SERVER_AGENT_TOKEN_TTL", "0s")); err != nil {
+		return Config{}, fmt.Errorf("parse TELEMETRY_SERVER_AGENT_TOKEN_TTL: %w", err)
+	}
+
+	if cfg.AutoMigrate, err = strconv.ParseBool(getenv("TELEMETRY_SERVER_AUTO_MIGRATE", "true")); err != nil {
+		return Config{}, fmt.Errorf("parse TELEMETRY_SERVER_AUTO_MIGRATE: %w", err)
+	}
+	if cfg.MemoryRecords, err = strconv.Atoi(getenv("TELEMETRY_SERVER_MEMORY_RECORDS", "10000")); err != nil {
+		return Config{}, fmt.Errorf("parse TELEMETRY_SERVER_MEMORY_RECORDS: %w", err)
+	}
+	if cfg.Rates.GapIntervals, err = strconv.Atoi(getenv("TELEMETRY_SERVER_RATE_GAP_INTERVALS", "3")); err != nil {
+		return Config{}, fmt.Errorf("parse TELEMETRY_SERVER_RATE_GAP_INTERVALS: %w", err)
+	}
+
+	if cfg.Ingest.QueueSize, err = strconv.Atoi(getenv("TELEMETRY_SERVER_INGEST_QUEUE", "10000")); err != nil {
+		return Config{}, fmt.Errorf("parse TELEMETRY_SERVER_INGEST_QUEUE: %w", err)
+	}
+	if cfg.Ingest.BatchSize, err = strconv.Atoi(getenv("TELEMETRY_SERVER_INGEST_BATCH", "500")); err != nil {
+		return Config{}, fmt.Errorf("parse TELEMETRY_SERVER_INGEST_BATCH: %w", err)
+	}
+	if cfg.Ingest.FlushInterval, err = time.ParseDuration(getenv("TELEMETRY_SERVER_INGEST_FLUSH_INTERVAL", "1s")); err != nil {
+		return Config{}, fmt.Errorf("parse TELEMETRY_SERVER_INGEST_FLUSH_INTERVAL: %w", err)
+	}
+	if cfg.Ingest.Writers, err = strconv.Atoi(getenv("TELEMETRY_SERVER_INGEST_WRITERS", "2")); err != nil {
+		return Config{}, fmt.Errorf("parse TELEMETRY_SERVER_INGEST_WRITERS: %w", err)
+	}
+
+	cfg.Maintenance.Retention.Tiers = make(map[string]time.Duration)
+	if cfg.Maintenance.Interval, err = time.ParseDuration(getenv("TELEMETRY_SERVER_MAINTENANCE_INTERVAL", "1m")); err != nil {
+		return Config{}, fmt.Errorf("parse TELEMETRY_SERVER_MAINTENANCE_INTERVAL: %w", err)
+	}
+	if cfg.Maintenance.PartitionInterval, err = time.ParseDuration(getenv("TELEMETRY_SERVER_PARTITION_INTERVAL", "24h")); err != nil {
+		return Config{}, fmt.Errorf("parse TELEMETRY_SERVER_PARTITION_INTERVAL: %w", err)
+	}
+	if cfg.Maintenance.PartitionAhead, err = time.ParseDuration(getenv("TELEMETRY_SERVER_PARTITION_AHEAD", "72h")); err != nil {
+		return Config{}, fmt.Errorf("parse TELEMETRY_SERVER_PARTITION_AHEAD: %w", err)
+	}
+	if cfg.Maintenance.Rollup, err = strconv.ParseBool(getenv("TELEMETRY_SERVER_ROLLUP", "true")); err != nil {
+		return Config{}, fmt.Errorf("parse TELEMETRY_SERVER_ROLLUP: %w", err)
+	}
+	if cfg.Maintenance.RollupDelay, err = time.ParseDuration(getenv("TELEMETRY_SERVER_ROLLUP_DELAY", "2m")); err != nil {
+		return Config{}, fmt.Errorf("parse TELEMETRY_SERVER_ROLLUP_DELAY: %w", err)
+	}
+	if cfg.Maintenance.Retention.Raw, err = time.ParseDuration(getenv("TELEMETRY_SERVER_RETENTION_RAW", "0s")); err != nil {
+		return Config{}, fmt.Errorf("parse TELEMETRY_SERVER_RETENTION_RAW: %w", err)
+	}
+	for _, tier := range storage.Tiers {
+		key := "TELEMETRY_SERVER_RETENTION_" + strings.ToUpper(tier.Name)
+		keep, err := time.ParseDuration(getenv(key, "0s"))
+		if err != nil {
+			return Config{}, fmt.Errorf("parse %s: %w", key, err)
+		}
+		cfg.Maintenance.Retention.Tiers[tier.Name] = keep
+	}
+	if cfg.Maintenance.PruneBatch, err = strconv.Atoi(getenv("TELEMETRY_SERVER_PRUNE_BATCH", "5000")); err != nil {
+		return Config{}, fmt.Errorf("parse TELEMETRY_SERVER_PRUNE_BATCH: %w", err)
+	}
+
+	if cfg.TLSReload, err = time.ParseDuration(getenv("TELEMETRY_SERVER_TLS_RELOAD", "10s")); err != nil {
+		return Config{}, fmt.Errorf("parse TELEMETRY_SERVER_TLS_RELOAD: %w", err)
 	}
 
+	if cfg.KeepaliveTime, err = time.ParseDuration(getenv("TELEMETRY_SERVER_KEEPALIVE_TIME", "2h")); err != nil {
+		return Config{}, fmt.Errorf("parse TELEMETRY_SERVER_KEEPALIVE_TIME: %w", err)
+	}
+	if cfg.KeepaliveTimeout, err = time.ParseDuration(getenv("TELEMETRY_SERVER_KEEPALIVE_TIMEOUT", "20s")); err != nil {
+		return Config{}, fmt.Errorf("parse TELEMETRY_SERVER_KEEPALIVE_TIMEOUT: %w", err)
+	}
+	if cfg.KeepaliveMinTime, err = time.ParseDuration(getenv("TELEMETRY_SERVER_KEEPALIVE_MIN_TIME", "10s")); err != nil {
+		return Config{}, fmt.Errorf("parse TELEMETRY_SERVER_KEEPALIVE_MIN_TIME: %w", err)
+	}
+	if cfg.MaxMessageBytes, err = strconv.Atoi(getenv("TELEMETRY_SERVER_MAX_MESSAGE_BYTES", "4194304")); err != nil {
+		return Config{}, fmt.Errorf("parse TELEMETRY_SERVER_MAX_MESSAGE_BYTES: %w", err)
+	}
+	if cfg.InitialWindowSize, err = strconv.Atoi(getenv("TELEMETRY_SERVER_INITIAL_WINDOW_SIZE", "0")); err != nil {
+		return Config{}, fmt.Errorf("parse TELEMETRY_SERVER_INITIAL_WINDOW_SIZE: %w", err)
+	}
+	if cfg.InitialConnWindowSize, err = strconv.Atoi(getenv("TELEMETRY_SERVER_INITIAL_CONN_WINDOW_SIZE", "0")); err != nil {
+		return Config{}, fmt.Errorf("parse TELEMETRY_SERVER_INITIAL_CONN_WINDOW_SIZE: %w", err)
+	}
+
+	policyRefresh, err := time.ParseDuration(getenv("TELEMETRY_SERVER_POLICY_REFRESH", "30s"))
+	if err != nil {
+		return Config{}, fmt.Errorf("parse TELEMETRY_SERVER_POLICY_REFRESH: %w", err)
+	}
+	cfg.PolicyRefresh = policyRefresh
+
 	if cfg.GRPCAddr == "" {
 		return Config{}, fmt.Errorf("TELEMETRY_SERVER_GRPC_ADDR must be set")
 	}
 	if cfg.HTTPAddr == "" {
 		return Config{}, fmt.Errorf("TELEMETRY_SERVER_HTTP_ADDR must be set")
 	}
+	if cfg.AdminToken != "" && cfg.AdminAddr == "" {
+		return Config{}, fmt.Errorf("TELEMETRY_SERVER_ADMIN_ADDR must be set when TELEMETRY_SERVER_ADMIN_TOKEN is")
+	}
+	if cfg.AdminToken != "" && len(cfg.AdminToken) < minAdminToken {
+		return Config{}, fmt.Errorf("TELEMETRY_SERVER_ADMIN_TOKEN must be at least %d characters", minAdminToken)
+	}
 	if cfg.TLSCertPath == "" {
 		return Config{}, fmt.Errorf("TELEMETRY_SERVER_TLS_CERT must be provided")
 	}
 	if cfg.TLSKeyPath == "" {
 		return Config{}, fmt.Errorf("TELEMETRY_SERVER_TLS_KEY must be provided")
 	}
-	if cfg.PostgresDSN == "" {
-		return Config{}, fmt.Errorf("TELEMETRY_SERVER_POSTGRES_DSN must be provided")
+	if len(cfg.AgentIdentities) > 0 && cfg.ClientCAPath == "" {
+		return Config{}, fmt.Errorf("TELEMETRY_SERVER_AGENT_IDENTITIES requires TELEMETRY_SERVER_CLIENT_CA")
+	}
+	if cfg.TLSReload < 0 {
+		return Config{}, fmt.Errorf("TELEMETRY_SERVER_TLS_RELOAD must not be negative")
+	}
+	if cfg.AgentTokenTTL < 0 {
+		return Config{}, fmt.Errorf("TELEMETRY_SERVER_AGENT_TOKEN_TTL must not be negative")
+	}
+	switch cfg.Storage {
+	case StoragePostgres:
+		if cfg.PostgresDSN == "" {
+			return Config{}, fmt.Errorf("TELEMETRY_SERVER_POSTGRES_DSN must be provided")
+		}
+	case StorageBolt:
+		if cfg.BoltPath == "" {
+			return Config{}, fmt.Errorf("TELEMETRY_SERVER_BOLT_PATH must be provided")
+		}
+	case StorageMemory:
+		if cfg.MemoryRecords <= 0 {
+			return Config{}, fmt.Errorf("TELEMETRY_SERVER_MEMORY_RECORDS must be positive")
+		}
+	default:
+		return Config{}, fmt.Errorf("TELEMETRY_SERVER_STORAGE must be %q, %q or %q, got %q", StoragePostgres, StorageBolt, StorageMemory, cfg.Storage)
+	}
+	if cfg.PolicyRefresh <= 0 {
+		return Config{}, fmt.Errorf("TELEMETRY_SERVER_POLICY_REFRESH must be positive")
+	}
+	if cfg.Rates.GapIntervals < 0 {
+		return Config{}, fmt.Errorf("TELEMETRY_SERVER_RATE_GAP_INTERVALS must not be negative")
+	}
+	if cfg.Ingest.QueueSize <= 0 || cfg.Ingest.BatchSize <= 0 || cfg.Ingest.Writers <= 0 || cfg.Ingest.FlushInterval <= 0 {
+		return Config{}, fmt.Errorf("TELEMETRY_SERVER_INGEST_QUEUE, _BATCH, _WRITERS and _FLUSH_INTERVAL must be positive")
+	}
+	if cfg.Ingest.Overflow != OverflowBlock && cfg.Ingest.Overflow != OverflowDrop {
+		return Config{}, fmt.Errorf("TELEMETRY_SERVER_INGEST_OVERFLOW must be %q or %q, got %q", OverflowBlock, OverflowDrop, cfg.Ingest.Overflow)
+	}
+	if cfg.Maintenance.Interval <= 0 || cfg.Maintenance.PruneBatch <= 0 {
+		return Config{}, fmt.Errorf("TELEMETRY_SERVER_MAINTENANCE_INTERVAL and TELEMETRY_SERVER_PRUNE_BATCH must be positive")
+	}
+	if !slices.Contains(storage.PartitionIntervals, cfg.Maintenance.PartitionInterval) {
+		return Config{}, fmt.Errorf("TELEMETRY_SERVER_PARTITION_INTERVAL must be 24h or 168h, got %s", cfg.Maintenance.PartitionInterval)
+	}
+	if cfg.Maintenance.PartitionAhead < cfg.Maintenance.Interval {
+		return Config{}, fmt.Errorf("TELEMETRY_SERVER_PARTITION_AHEAD must be at least TELEMETRY_SERVER_MAINTENANCE_INTERVAL")
+	}
+	if cfg.Maintenance.RollupDelay < 0 || cfg.Maintenance.Retention.Raw < 0 {
+		return Config{}, fmt.Errorf("TELEMETRY_SERVER_ROLLUP_DELAY and TELEMETRY_SERVER_RETENTION_RAW must not be negative")
+	}
+	for tier, keep := range cfg.Maintenance.Retention.Tiers {
+		if keep < 0 {
+			return Config{}, fmt.Errorf("TELEMETRY_SERVER_RETENTION_%s must not be negative", strings.ToUpper(tier))
+		}
+	}
+	if cfg.KeepaliveTime <= 0 || cfg.KeepaliveTimeout <= 0 || cfg.KeepaliveMinTime <= 0 {
+		return Config{}, fmt.Errorf("TELEMETRY_SERVER_KEEPALIVE_TIME, _TIMEOUT and _MIN_TIME must be positive")
+	}
+	if cfg.MaxMessageBytes <= 0 {
+		return Config{}, fmt.Errorf("TELEMETRY_SERVER_MAX_MESSAGE_BYTES must be positive")
+	}
+	if !validWindow(cfg.InitialWindowSize) {
+		return Config{}, fmt.Errorf("TELEMETRY_SERVER_INITIAL_WINDOW_SIZE must be 0 or between 64KiB and 2GiB")
+	}
+	if !validWindow(cfg.InitialConnWindowSize) {
+		return Config{}, fmt.Errorf("TELEMETRY_SERVER_INITIAL_CONN_WINDOW_SIZE must be 0 or between 64KiB and 2GiB")
 	}
 
 	return cfg, nil
 }
 
+// validWindow accepts 0 (dynamic) or a flow-control window gRPC will honour.
+func validWindow(size int) bool {
+	return size == 0 || (size >= 64<<10 && size <= math.MaxInt32)
+}
+
 func getenv(key, fallback string) string {
 	if val, ok := os.LookupEnv(key); ok {
 		return val
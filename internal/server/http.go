@@ -6,24 +6,34 @@ import (
 	"log/slog"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"telemetry-agent/internal/server/storage"
 )
 
+// maxHistoryLimit caps the records returned by one /api/metrics page.
+const maxHistoryLimit = 10000
+
 type httpAPI struct {
-	store  *storage.PostgresStore
+	store  storage.Store
+	svc    *TelemetryService
 	logger *slog.Logger
 }
 
-// NewHTTPHandler wires HTTP routes that expose telemetry data to the dashboard.
-func NewHTTPHandler(store *storage.PostgresStore, logger *slog.Logger) http.Handler {
-	h := &httpAPI{store: store, logger: logger}
+// NewHTTPHandler wires the read-only HTTP routes that expose telemetry data and policy
+// state to the dashboard. Changes go through NewAdminHandler.
+func NewHTTPHandler(store storage.Store, svc *TelemetryService, logger *slog.Logger) http.Handler {
+	h := &httpAPI{store: store, svc: svc, logger: logger}
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/api/metrics", h.handleMetrics)
 	mux.HandleFunc("/api/metrics/stream", h.handleStream)
+	mux.HandleFunc("GET /api/query_range", h.handleQueryRange)
 	mux.HandleFunc("/api/agents", h.handleAgents)
+	mux.HandleFunc("GET /api/policies", h.handleListPolicies)
+	mux.HandleFunc("GET /api/policies/status", h.handlePolicyStatus)
+	mux.HandleFunc("GET /metrics", h.handlePrometheus)
 
 	return mux
 }
@@ -31,42 +41,50 @@ func NewHTTPHandler(store *storage.PostgresStore, logger *slog.Logger) http.Hand
 func (h *httpAPI) handleMetrics(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	agentID := r.URL.Query().Get("agent_id")
-	limitParam := r.URL.Query().Get("limit")
-
-	limit := 60
-	if limitParam != "" {
-		if parsed, err := strconv.Atoi(limitParam); err == nil && parsed > 0 {
-			limit = parsed
-		}
+	selector, err := labelSelector(r)
+	if err != nil {
+		h.writeError(w, http.StatusBadRequest, err)
+		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-
 	if agentID != "" {
-		records, err := h.store.List(ctx, agentID, limit)
+		query, err := recordQuery(r)
+		if err != nil {
+			h.writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		query.Selector = selector
+		page, err := h.store.List(ctx, agentID, query)
 		if err != nil {
 			h.writeError(w, http.StatusInternalServerError, err)
 			return
 		}
 
-		if err := json.NewEncoder(w).Encode(map[string]any{
+		w.Header().Set("Content-Type", "application/json")
+		response := map[string]any{
 			"agentId": agentID,
-			"records": records,
-		}); err != nil {
+			"records": page.Records,
+		}
+		if page.Next != "" {
+			response["next"] = page.Next
+		}
+		if err := json.NewEncoder(w).Encode(response); err != nil {
 			h.logger.Warn("write metrics response", "agent", agentID, "error", err)
 		}
 		return
 	}
 
-	agents, err := h.store.Agents(ctx)
+	agents, err := h.store.Agents(ctx, selector)
 	if err != nil {
 		h.writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+
 	summaries := make([]map[string]any, 0, len(agents))
 	for _, id := range agents {
-		record, ok, err := h.store.Latest(ctx, id)
+		record, ok, err := h.store.Latest(ctx, id, selector)
 		if err != nil {
 			h.logger.Error("load latest metric", "agent", id, "error", err)
 			continue
@@ -98,6 +116,11 @@ func (h *httpAPI) handleStream(w http.ResponseWriter, r *http.Request) {
 		h.writeError(w, http.StatusBadRequest, fmt.Errorf("agent_id is required"))
 		return
 	}
+	selector, err := labelSelector(r)
+	if err != nil {
+		h.writeError(w, http.StatusBadRequest, err)
+		return
+	}
 
 	ctx := r.Context()
 
@@ -107,7 +130,7 @@ func (h *httpAPI) handleStream(w http.ResponseWriter, r *http.Request) {
 
 	lastSent := time.Time{}
 
-	if latest, ok, err := h.store.Latest(ctx, agentID); err == nil && ok {
+	if latest, ok, err := h.store.Latest(ctx, agentID, selector); err == nil && ok {
 		if payload, err := json.Marshal(latest); err == nil {
 			if _, err := fmt.Fprintf(w, "data: %s\n\n", payload); err != nil {
 				h.logger.Warn("write initial sse", "agent", agentID, "error", err)
@@ -131,7 +154,7 @@ func (h *httpAPI) handleStream(w http.ResponseWriter, r *http.Request) {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			record, ok, err := h.store.Latest(ctx, agentID)
+			record, ok, err := h.store.Latest(ctx, agentID, selector)
 			if err != nil {
 				h.logger.Warn("poll latest metric", "agent", agentID, "error", err)
 				continue
@@ -155,8 +178,81 @@ func (h *httpAPI) handleStream(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleQueryRange resamples one metric of an agent into fixed steps. to defaults to now,
+// from to an hour before to, step to one minute and agg to avg.
+func (h *httpAPI) handleQueryRange(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	agentID := params.Get("agent_id")
+	if agentID == "" {
+		h.writeError(w, http.StatusBadRequest, fmt.Errorf("agent_id must be provided"))
+		return
+	}
+	selector, err := labelSelector(r)
+	if err != nil {
+		h.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	query := storage.RangeQuery{
+		Metric:   params.Get("metric"),
+		To:       time.Now(),
+		Step:     time.Minute,
+		Agg:      storage.AggAvg,
+		Selector: selector,
+	}
+	if raw := params.Get("to"); raw != "" {
+		if query.To, err = time.Parse(time.RFC3339Nano, raw); err != nil {
+			h.writeError(w, http.StatusBadRequest, fmt.Errorf("to must be an RFC 3339 time: %w", err))
+			return
+		}
+	}
+	query.From = query.To.Add(-time.Hour)
+	if raw := params.Get("from"); raw != "" {
+		if query.From, err = time.Parse(time.RFC3339Nano, raw); err != nil {
+			h.writeError(w, http.StatusBadRequest, fmt.Errorf("from must be an RFC 3339 time: %w", err))
+			return
+		}
+	}
+	if raw := params.Get("step"); raw != "" {
+		if query.Step, err = time.ParseDuration(raw); err != nil {
+			h.writeError(w, http.StatusBadRequest, fmt.Errorf("parse step: %w", err))
+			return
+		}
+	}
+	if raw := params.Get("agg"); raw != "" {
+		query.Agg = storage.Aggregation(raw)
+	}
+	if err := query.Validate(); err != nil {
+		h.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	points, err := h.store.QueryRange(r.Context(), agentID, query)
+	if err != nil {
+		h.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]any{
+		"agentId": agentID,
+		"metric":  query.Metric,
+		"agg":     query.Agg,
+		"step":    query.Step.String(),
+		"points":  points,
+	}); err != nil {
+		h.logger.Warn("write range response", "agent", agentID, "error", err)
+	}
+}
+
 func (h *httpAPI) handleAgents(w http.ResponseWriter, r *http.Request) {
-	agents, err := h.store.Agents(r.Context())
+	selector, err := labelSelector(r)
+	if err != nil {
+		h.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	agents, err := h.store.Agents(r.Context(), selector)
 	if err != nil {
 		h.writeError(w, http.StatusInternalServerError, err)
 		return
@@ -168,6 +264,96 @@ func (h *httpAPI) handleAgents(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (h *httpAPI) handleListPolicies(w http.ResponseWriter, r *http.Request) {
+	policies, err := h.store.Policies(r.Context())
+	if err != nil {
+		h.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]any{"policies": policies}); err != nil {
+		h.logger.Warn("write policies response", "error", err)
+	}
+}
+
+func (h *httpAPI) handlePolicyStatus(w http.ResponseWriter, r *http.Request) {
+	acks, err := h.store.ConfigAcks(r.Context())
+	if err != nil {
+		h.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]any{
+		"connected": h.svc.PolicyStatuses(),
+		"acks":      acks,
+	}); err != nil {
+		h.logger.Warn("write policy status response", "error", err)
+	}
+}
+
+// handlePrometheus exposes the server's own metrics in the Prometheus text format.
+func (h *httpAPI) handlePrometheus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := h.svc.ingest.WritePrometheus(w); err != nil {
+		h.logger.Debug("write metrics", "error", err)
+	}
+}
+
+// recordQuery parses the history parameters of /api/metrics: from and to (RFC 3339),
+// order (desc by default, so the newest samples come first), limit and cursor.
+func recordQuery(r *http.Request) (storage.RecordQuery, error) {
+	params := r.URL.Query()
+	query := storage.RecordQuery{
+		Order:  storage.Order(params.Get("order")),
+		Limit:  60,
+		Cursor: params.Get("cursor"),
+	}
+	if raw := params.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit <= 0 || limit > maxHistoryLimit {
+			return storage.RecordQuery{}, fmt.Errorf("limit must be between 1 and %d", maxHistoryLimit)
+		}
+		query.Limit = limit
+	}
+	for name, dest := range map[string]*time.Time{"from": &query.From, "to": &query.To} {
+		if raw := params.Get(name); raw != "" {
+			parsed, err := time.Parse(time.RFC3339Nano, raw)
+			if err != nil {
+				return storage.RecordQuery{}, fmt.Errorf("%s must be an RFC 3339 time: %w", name, err)
+			}
+			*dest = parsed
+		}
+	}
+	if err := query.Validate(); err != nil {
+		return storage.RecordQuery{}, err
+	}
+	return query, nil
+}
+
+// labelSelector collects "label.<key>=<value>" query parameters into a selector.
+func labelSelector(r *http.Request) (storage.Labels, error) {
+	var selector storage.Labels
+	for param, values := range r.URL.Query() {
+		key, ok := strings.CutPrefix(param, "label.")
+		if !ok {
+			continue
+		}
+		if key == "" {
+			return nil, fmt.Errorf("label selector %q is missing a key", param)
+		}
+		if len(values) != 1 || values[0] == "" {
+			return nil, fmt.Errorf("label selector %q needs exactly one non-empty value", param)
+		}
+		if selector == nil {
+			selector = make(storage.Labels)
+		}
+		selector[key] = values[0]
+	}
+	return selector, nil
+}
+
 func (h *httpAPI) writeError(w http.ResponseWriter, status int, err error) {
 	h.logger.Error("http error", "status", status, "error", err)
 	w.Header().Set("Content-Type", "application/json")
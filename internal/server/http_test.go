@@ -0,0 +1,248 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"telemetry-agent/internal/server/storage"
+)
+
+// newTestHandler returns the public HTTP API over a MemoryStore holding records.
+func newTestHandler(t *testing.T, records ...storage.Record) (http.Handler, *TelemetryService, *storage.MemoryStore) {
+	t.Helper()
+	svc, store, _ := newTestService(t, AuthConfig{})
+	for _, record := range records {
+		if err := store.Save(context.Background(), record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return NewHTTPHandler(store, svc, testLogger), svc, store
+}
+
+// serve performs a request against h and decodes the JSON response into out, if given.
+func serve(t *testing.T, h http.Handler, method, target, body string, out any) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if out != nil && rec.Code < 300 {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: decode %q: %v", method, target, rec.Body.String(), err)
+		}
+	}
+	return rec
+}
+
+func historyRecords() []storage.Record {
+	var records []storage.Record
+	for i := range 5 {
+		records = append(records, storage.Record{
+			AgentID:     "a",
+			CollectedAt: rateEpoch.Add(time.Duration(i) * time.Minute),
+			CPUUsage:    float64(i),
+			Labels:      storage.Labels{"env": "prod"},
+		})
+	}
+	// Delivered late, after newer samples.
+	records = append(records, storage.Record{AgentID: "b", CollectedAt: rateEpoch.Add(time.Minute), CPUUsage: 10, Labels: storage.Labels{"env": "dev"}})
+	records = append(records, storage.Record{AgentID: "b", CollectedAt: rateEpoch, CPUUsage: 9, Labels: storage.Labels{"env": "dev"}})
+	return records
+}
+
+func TestHandleMetricsHistory(t *testing.T) {
+	h, _, _ := newTestHandler(t, historyRecords()...)
+
+	type page struct {
+		AgentID string           `json:"agentId"`
+		Records []storage.Record `json:"records"`
+		Next    string           `json:"next"`
+	}
+	tests := []struct {
+		name     string
+		target   string
+		wantCode int
+		wantCPU  []float64
+		wantNext bool
+	}{
+		{"newest first by default", "/api/metrics?agent_id=a&limit=2", http.StatusOK, []float64{4, 3}, true},
+		{"ascending", "/api/metrics?agent_id=a&order=asc&limit=10", http.StatusOK, []float64{0, 1, 2, 3, 4}, false},
+		{"time window", "/api/metrics?agent_id=a&order=asc&from=2026-01-01T00:01:00Z&to=2026-01-01T00:03:00Z", http.StatusOK, []float64{1, 2}, false},
+		{"label selector", "/api/metrics?agent_id=a&label.env=dev", http.StatusOK, []float64{}, false},
+		{"unknown agent", "/api/metrics?agent_id=zz", http.StatusOK, []float64{}, false},
+		{"bad limit", "/api/metrics?agent_id=a&limit=0", http.StatusBadRequest, nil, false},
+		{"bad time", "/api/metrics?agent_id=a&from=yesterday", http.StatusBadRequest, nil, false},
+		{"bad order", "/api/metrics?agent_id=a&order=up", http.StatusBadRequest, nil, false},
+		{"empty selector", "/api/metrics?agent_id=a&label.env=", http.StatusBadRequest, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got page
+			rec := serve(t, h, http.MethodGet, tt.target, "", &got)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			cpu := []float64{}
+			for _, record := range got.Records {
+				cpu = append(cpu, record.CPUUsage)
+			}
+			if !slices.Equal(cpu, tt.wantCPU) {
+				t.Errorf("cpu = %v, want %v", cpu, tt.wantCPU)
+			}
+			if (got.Next != "") != tt.wantNext {
+				t.Errorf("next = %q, want present %t", got.Next, tt.wantNext)
+			}
+		})
+	}
+}
+
+func TestHandleMetricsHistoryPaging(t *testing.T) {
+	h, _, _ := newTestHandler(t, historyRecords()...)
+
+	var cpu []float64
+	target := "/api/metrics?agent_id=a&order=asc&limit=2"
+	for range 5 {
+		var got struct {
+			Records []storage.Record `json:"records"`
+			Next    string           `json:"next"`
+		}
+		if rec := serve(t, h, http.MethodGet, target, "", &got); rec.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+		}
+		for _, record := range got.Records {
+			cpu = append(cpu, record.CPUUsage)
+		}
+		if got.Next == "" {
+			break
+		}
+		target = "/api/metrics?agent_id=a&order=asc&limit=2&cursor=" + got.Next
+	}
+	if !slices.Equal(cpu, []float64{0, 1, 2, 3, 4}) {
+		t.Fatalf("paged cpu = %v, want [0 1 2 3 4]", cpu)
+	}
+}
+
+func TestHandleMetricsSummary(t *testing.T) {
+	h, _, _ := newTestHandler(t, historyRecords()...)
+
+	tests := []struct {
+		name   string
+		target string
+		want   map[string]float64 // agent -> latest cpu
+	}{
+		{"every agent", "/api/metrics", map[string]float64{"a": 4, "b": 10}},
+		{"latest by collection time", "/api/metrics?label.env=dev", map[string]float64{"b": 10}},
+		{"no match", "/api/metrics?label.env=qa", map[string]float64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got struct {
+				Agents []struct {
+					AgentID string         `json:"agentId"`
+					Latest  storage.Record `json:"latest"`
+				} `json:"agents"`
+			}
+			if rec := serve(t, h, http.MethodGet, tt.target, "", &got); rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+			}
+			latest := map[string]float64{}
+			for _, agent := range got.Agents {
+				latest[agent.AgentID] = agent.Latest.CPUUsage
+			}
+			if len(latest) != len(tt.want) {
+				t.Fatalf("summary = %v, want %v", latest, tt.want)
+			}
+			for id, cpu := range tt.want {
+				if latest[id] != cpu {
+					t.Errorf("agent %s latest cpu = %v, want %v", id, latest[id], cpu)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleAgents(t *testing.T) {
+	h, _, _ := newTestHandler(t, historyRecords()...)
+
+	var got struct {
+		Agents []string `json:"agents"`
+	}
+	if rec := serve(t, h, http.MethodGet, "/api/agents?label.env=prod", "", &got); rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	if !slices.Equal(got.Agents, []string{"a"}) {
+		t.Fatalf("agents = %v, want [a]", got.Agents)
+	}
+}
+
+func TestHandleQueryRange(t *testing.T) {
+	h, _, _ := newTestHandler(t, historyRecords()...)
+
+	tests := []struct {
+		name      string
+		target    string
+		wantCode  int
+		wantSteps int
+	}{
+		{"two minute steps", "/api/query_range?agent_id=a&metric=cpuUsage&from=2026-01-01T00:00:00Z&to=2026-01-01T00:05:00Z&step=2m&agg=max", http.StatusOK, 3},
+		{"missing agent", "/api/query_range?metric=cpuUsage", http.StatusBadRequest, 0},
+		{"bad step", "/api/query_range?agent_id=a&metric=cpuUsage&step=often", http.StatusBadRequest, 0},
+		{"unknown aggregation", "/api/query_range?agent_id=a&metric=cpuUsage&agg=median", http.StatusBadRequest, 0},
+		{"missing metric", "/api/query_range?agent_id=a", http.StatusBadRequest, 0},
+		{"value without samples", "/api/query_range?agent_id=a&metric=nope&from=2026-01-01T00:00:00Z&to=2026-01-01T00:05:00Z", http.StatusOK, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got struct {
+				Points []storage.Point `json:"points"`
+			}
+			rec := serve(t, h, http.MethodGet, tt.target, "", &got)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+			if tt.wantCode == http.StatusOK && len(got.Points) != tt.wantSteps {
+				t.Fatalf("points = %v, want %d", got.Points, tt.wantSteps)
+			}
+		})
+	}
+}
+
+func TestHandleStreamSendsLatest(t *testing.T) {
+	h, _, _ := newTestHandler(t, historyRecords()...)
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/api/metrics/stream?agent_id=b", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	buf := make([]byte, 4096)
+	n, err := resp.Body.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, ok := strings.CutPrefix(string(buf[:n]), "data: ")
+	if !ok {
+		t.Fatalf("event = %q, want a data line", buf[:n])
+	}
+	var record storage.Record
+	if err := json.Unmarshal([]byte(strings.TrimSpace(event)), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.CPUUsage != 10 {
+		t.Fatalf("first event cpu = %v, want the latest collected sample (10)", record.CPUUsage)
+	}
+}
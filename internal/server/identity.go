@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// IdentityMap lists, per client certificate identity (common name or DNS SAN), the agent
+// ID patterns that identity may report as. Without an entry an identity may only report
+// as itself.
+type IdentityMap map[string][]string
+
+// ParseIdentityMap reads comma-separated identity=pattern pairs such as
+// "gateway=edge-*,ops=agent-a". Patterns use path.Match syntax and an identity may
+// appear more than once.
+func ParseIdentityMap(raw string) (IdentityMap, error) {
+	m := make(IdentityMap)
+	for _, pair := range strings.Split(raw, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		identity, pattern, ok := strings.Cut(pair, "=")
+		identity, pattern = strings.TrimSpace(identity), strings.TrimSpace(pattern)
+		if !ok || identity == "" || pattern == "" {
+			return nil, fmt.Errorf("%q is not identity=pattern", pair)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("pattern %q: %w", pattern, err)
+		}
+		m[identity] = append(m[identity], pattern)
+	}
+	return m, nil
+}
+
+// Allows reports whether a client holding a certificate for identities may report
+// samples as agentID.
+func (m IdentityMap) Allows(identities []string, agentID string) bool {
+	if slices.Contains(identities, agentID) {
+		return true
+	}
+	for _, identity := range identities {
+		for _, pattern := range m[identity] {
+			if ok, _ := path.Match(pattern, agentID); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// PeerIdentities returns the common name and DNS SANs of the verified client certificate
+// on ctx. ok is false when the peer did not authenticate with a certificate, which only
+// happens when mutual TLS is disabled.
+func PeerIdentities(ctx context.Context) (identities []string, ok bool) {
+	p, found := peer.FromContext(ctx)
+	if !found {
+		return nil, false
+	}
+	info, isTLS := p.AuthInfo.(credentials.TLSInfo)
+	if !isTLS || len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+		return nil, false
+	}
+
+	leaf := info.State.VerifiedChains[0][0]
+	if leaf.Subject.CommonName != "" {
+		identities = append(identities, leaf.Subject.CommonName)
+	}
+	for _, name := range leaf.DNSNames {
+		if !slices.Contains(identities, name) {
+			identities = append(identities, name)
+		}
+	}
+	return identities, true
+}
+
+// authorizeAgent rejects samples whose agent ID is not bound to the client certificate
+// the stream was opened with.
+func (s *TelemetryService) authorizeAgent(identities []string, agentID string) error {
+	if s.auth.Identities.Allows(identities, agentID) {
+		return nil
+	}
+	return status.Errorf(codes.PermissionDenied, "client certificate for %s may not report as agent %q", strings.Join(identities, ", "), agentID)
+}
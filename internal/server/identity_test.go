@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"slices"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// certContext returns a context carrying a verified client certificate with common name
+// cn and the given DNS SANs.
+func certContext(cn string, dnsNames ...string) context.Context {
+	leaf := &x509.Certificate{Subject: pkix.Name{CommonName: cn}, DNSNames: dnsNames}
+	return peer.NewContext(context.Background(), &peer.Peer{
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{leaf}}}},
+	})
+}
+
+func TestParseIdentityMap(t *testing.T) {
+	m, err := ParseIdentityMap(" gateway=edge-* , ops=agent-a,gateway=core-?,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(m["gateway"], []string{"edge-*", "core-?"}) || !slices.Equal(m["ops"], []string{"agent-a"}) {
+		t.Fatalf("map = %v", m)
+	}
+
+	for _, raw := range []string{"gateway", "=edge-*", "gateway=", "gateway=edge-["} {
+		if _, err := ParseIdentityMap(raw); err == nil {
+			t.Errorf("ParseIdentityMap(%q) succeeded", raw)
+		}
+	}
+}
+
+func TestIdentityMapAllows(t *testing.T) {
+	m := IdentityMap{"gateway": {"edge-*"}, "ops": {"agent-a"}}
+	tests := []struct {
+		identities []string
+		agent      string
+		want       bool
+	}{
+		{[]string{"web-1"}, "web-1", true},
+		{[]string{"web-1", "web-1.example.com"}, "web-1.example.com", true},
+		{[]string{"web-1"}, "web-2", false},
+		{[]string{"gateway"}, "edge-7", true},
+		{[]string{"gateway"}, "core-1", false},
+		{[]string{"web-1", "ops"}, "agent-a", true},
+		{[]string{"ops"}, "agent-b", false},
+		{nil, "web-1", false},
+	}
+	for _, tt := range tests {
+		if got := m.Allows(tt.identities, tt.agent); got != tt.want {
+			t.Errorf("Allows(%v, %q) = %t, want %t", tt.identities, tt.agent, got, tt.want)
+		}
+	}
+}
+
+func TestPeerIdentities(t *testing.T) {
+	if _, ok := PeerIdentities(context.Background()); ok {
+		t.Error("identities found without a peer")
+	}
+	plain := peer.NewContext(context.Background(), &peer.Peer{})
+	if _, ok := PeerIdentities(plain); ok {
+		t.Error("identities found on a connection without TLS")
+	}
+	unverified := peer.NewContext(context.Background(), &peer.Peer{AuthInfo: credentials.TLSInfo{}})
+	if _, ok := PeerIdentities(unverified); ok {
+		t.Error("identities found without a verified client certificate")
+	}
+
+	identities, ok := PeerIdentities(certContext("web-1", "web-1", "web-1.example.com"))
+	if !ok || !slices.Equal(identities, []string{"web-1", "web-1.example.com"}) {
+		t.Fatalf("identities = %v, %t; want the common name and the other SAN", identities, ok)
+	}
+}
+
+func TestStreamMetricsBindsAgentToCertificate(t *testing.T) {
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		agents []string
+		want   codes.Code
+		stored []string
+	}{
+		{"own name", certContext("web-1"), []string{"web-1"}, codes.OK, []string{"web-1"}},
+		{"another agent", certContext("web-1"), []string{"web-1", "web-2"}, codes.PermissionDenied, []string{"web-1"}},
+		{"mapped identity", certContext("gateway"), []string{"edge-1", "edge-2"}, codes.OK, []string{"edge-1", "edge-2"}},
+		{"outside the mapping", certContext("gateway"), []string{"core-1"}, codes.PermissionDenied, nil},
+		{"without mutual TLS", context.Background(), []string{"web-2"}, codes.OK, []string{"web-2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, store, stop := newTestService(t, AuthConfig{Identities: IdentityMap{"gateway": {"edge-*"}}})
+			stream := newFakeStream(tt.ctx)
+			for i, agent := range tt.agents {
+				stream.recv <- testMetric(agent, time.Duration(i)*time.Second, 0)
+			}
+			close(stream.recv)
+
+			if err := svc.StreamMetrics(stream); status.Code(err) != tt.want {
+				t.Fatalf("StreamMetrics = %v, want %s", err, tt.want)
+			}
+			stop()
+			agents, err := store.Agents(context.Background(), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(agents, tt.stored) {
+				t.Fatalf("stored samples of %v, want %v", agents, tt.stored)
+			}
+		})
+	}
+}
@@ -0,0 +1,337 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"telemetry-agent/internal/server/storage"
+)
+
+// Overflow policies applied when the ingestion queue is full.
+const (
+	// OverflowBlock holds the agent stream until the queue has room, so back-pressure
+	// reaches the agent, which keeps samples in its own buffer.
+	OverflowBlock = "block"
+	// OverflowDrop discards the sample and counts it, keeping streams flowing.
+	OverflowDrop = "drop"
+)
+
+// errIngestStopped is returned by Enqueue once the writers have shut down.
+var errIngestStopped = errors.New("ingestion stopped")
+
+const (
+	// ingestDrainTimeout bounds how long queued samples are written after shutdown starts.
+	ingestDrainTimeout = 10 * time.Second
+	ingestRetryBackoff = 100 * time.Millisecond
+	ingestMaxBackoff   = 5 * time.Second
+	// shedLogInterval limits how often shedding is logged while the queue stays full.
+	shedLogInterval = 10 * time.Second
+)
+
+// flushBuckets are the upper bounds, in seconds, of the flush latency histogram.
+var flushBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// IngestConfig tunes the ingestion pipeline.
+type IngestConfig struct {
+	// QueueSize bounds the samples waiting to be written.
+	QueueSize int
+	// Writers flush batches concurrently; each writes once it holds BatchSize samples or
+	// FlushInterval after the first sample of the batch arrived.
+	Writers       int
+	BatchSize     int
+	FlushInterval time.Duration
+	// Overflow is OverflowBlock or OverflowDrop.
+	Overflow string
+}
+
+// Ingester decouples agent streams from storage: samples are queued and written in
+// batches by a pool of writers. Transient storage errors are retried until the write
+// succeeds or shutdown; a batch failing otherwise is retried record by record so one bad
+// sample does not take the rest with it.
+type Ingester struct {
+	store  storage.RecordStore
+	logger *slog.Logger
+	cfg    IngestConfig
+
+	queue   chan storage.Record
+	stopped chan struct{}
+	// mu orders Enqueue against shutdown: senders hold it shared, and Run sets closed
+	// under the exclusive lock, so no record reaches the queue after the drain starts.
+	mu     sync.RWMutex
+	closed bool
+
+	stats ingestStats
+}
+
+type ingestStats struct {
+	enqueued    atomic.Uint64
+	dropped     atomic.Uint64
+	written     atomic.Uint64
+	failed      atomic.Uint64
+	retries     atomic.Uint64
+	lastShedLog atomic.Int64
+
+	mu          sync.Mutex
+	flushCounts []uint64 // per flushBuckets entry, plus +Inf
+	flushSum    float64
+	flushCount  uint64
+}
+
+// NewIngester creates an ingester writing to store. Run starts its writers.
+func NewIngester(store storage.RecordStore, cfg IngestConfig, logger *slog.Logger) *Ingester {
+	i := &Ingester{
+		store:   store,
+		logger:  logger,
+		cfg:     cfg,
+		queue:   make(chan storage.Record, cfg.QueueSize),
+		stopped: make(chan struct{}),
+	}
+	i.stats.flushCounts = make([]uint64, len(flushBuckets)+1)
+	return i
+}
+
+// Enqueue hands record to the writers. When the queue is full it waits for room under
+// OverflowBlock, returning ctx's error if the stream ends first, and discards the record
+// under OverflowDrop.
+func (i *Ingester) Enqueue(ctx context.Context, record storage.Record) error {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	// Once stopped the queue may have room again, but nothing would write the record.
+	if i.closed {
+		return errIngestStopped
+	}
+	select {
+	case i.queue <- record:
+		i.stats.enqueued.Add(1)
+		return nil
+	case <-i.stopped:
+		return errIngestStopped
+	default:
+	}
+
+	if i.cfg.Overflow == OverflowDrop {
+		dropped := i.stats.dropped.Add(1)
+		now := time.Now().UnixNano()
+		if last := i.stats.lastShedLog.Load(); now-last >= int64(shedLogInterval) && i.stats.lastShedLog.CompareAndSwap(last, now) {
+			i.logger.Warn("ingest queue full, shedding samples", "queue", i.cfg.QueueSize, "dropped_total", dropped)
+		}
+		return nil
+	}
+
+	select {
+	case i.queue <- record:
+		i.stats.enqueued.Add(1)
+		return nil
+	case <-i.stopped:
+		return errIngestStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Run writes queued samples until ctx is cancelled, then drains the queue for up to
+// ingestDrainTimeout.
+func (i *Ingester) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for range i.cfg.Writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			i.write(ctx)
+		}()
+	}
+	<-ctx.Done()
+	// Closing stopped releases blocked senders; taking the lock then waits for any send
+	// already in progress, which lands in the queue before the drain reads it.
+	close(i.stopped)
+	i.mu.Lock()
+	i.closed = true
+	i.mu.Unlock()
+	wg.Wait()
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), ingestDrainTimeout)
+	defer cancel()
+	batch := make([]storage.Record, 0, i.cfg.BatchSize)
+	for {
+		select {
+		case record := <-i.queue:
+			batch = append(batch, record)
+			if len(batch) < i.cfg.BatchSize {
+				continue
+			}
+		default:
+		}
+		if len(batch) == 0 {
+			return
+		}
+		if err := i.flush(drainCtx, batch); err != nil {
+			lost := len(batch) + len(i.queue)
+			i.stats.failed.Add(uint64(lost))
+			i.logger.Error("ingest drain timed out, samples lost", "samples", lost, "error", err)
+			return
+		}
+		batch = batch[:0]
+	}
+}
+
+// write is one writer of the pool.
+func (i *Ingester) write(ctx context.Context) {
+	batch := make([]storage.Record, 0, i.cfg.BatchSize)
+	timer := time.NewTimer(i.cfg.FlushInterval)
+	timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			i.requeue(batch)
+			return
+		case record := <-i.queue:
+			if len(batch) == 0 {
+				timer.Reset(i.cfg.FlushInterval)
+			}
+			batch = append(batch, record)
+			if len(batch) < i.cfg.BatchSize {
+				continue
+			}
+			timer.Stop()
+		case <-timer.C:
+		}
+
+		if err := i.flush(ctx, batch); err != nil {
+			i.requeue(batch)
+			return
+		}
+		batch = batch[:0]
+	}
+}
+
+// requeue hands the unwritten batch of a stopping writer back for the drain. The queue
+// has room for it unless agents refilled it, in which case the rest is written right away.
+func (i *Ingester) requeue(batch []storage.Record) {
+	for n, record := range batch {
+		select {
+		case i.queue <- record:
+		default:
+			ctx, cancel := context.WithTimeout(context.Background(), ingestDrainTimeout)
+			defer cancel()
+			if err := i.flush(ctx, batch[n:]); err != nil {
+				i.stats.failed.Add(uint64(len(batch) - n))
+				i.logger.Error("write samples", "samples", len(batch)-n, "error", err)
+			}
+			return
+		}
+	}
+}
+
+// flush writes batch, retrying transient errors with backoff. It returns an error, with
+// nothing written, only when ctx ends before a retry succeeds; records rejected otherwise
+// are counted as failed.
+func (i *Ingester) flush(ctx context.Context, batch []storage.Record) error {
+	start := time.Now()
+	backoff := ingestRetryBackoff
+	for {
+		err := i.store.SaveBatch(ctx, batch)
+		if err == nil {
+			i.stats.written.Add(uint64(len(batch)))
+			i.observeFlush(time.Since(start))
+			return nil
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		if !storage.Transient(err) {
+			i.saveEach(ctx, batch, err)
+			i.observeFlush(time.Since(start))
+			return nil
+		}
+
+		i.stats.retries.Add(1)
+		i.logger.Warn("write samples failed, retrying", "samples", len(batch), "retry_in", backoff, "error", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, ingestMaxBackoff)
+	}
+}
+
+// saveEach writes the records of a batch that failed permanently one at a time.
+func (i *Ingester) saveEach(ctx context.Context, batch []storage.Record, batchErr error) {
+	var failed int
+	for _, record := range batch {
+		if err := i.store.Save(ctx, record); err != nil {
+			failed++
+			i.logger.Error("save metric", "agent", record.AgentID, "error", err)
+			continue
+		}
+		i.stats.written.Add(1)
+	}
+	i.stats.failed.Add(uint64(failed))
+	if failed == 0 {
+		i.logger.Warn("batch write failed, records saved individually", "samples", len(batch), "error", batchErr)
+	}
+}
+
+func (i *Ingester) observeFlush(d time.Duration) {
+	seconds := d.Seconds()
+	i.stats.mu.Lock()
+	defer i.stats.mu.Unlock()
+	bucket := len(flushBuckets)
+	for n, bound := range flushBuckets {
+		if seconds <= bound {
+			bucket = n
+			break
+		}
+	}
+	i.stats.flushCounts[bucket]++
+	i.stats.flushSum += seconds
+	i.stats.flushCount++
+}
+
+// WritePrometheus renders the pipeline's metrics in the Prometheus text exposition format.
+func (i *Ingester) WritePrometheus(w io.Writer) error {
+	var err error
+	write := func(name, help, kind string, value float64) {
+		if err != nil {
+			return
+		}
+		_, err = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", name, help, name, kind, name, value)
+	}
+
+	write("telemetryx_server_ingest_queue_depth", "Samples waiting to be written.", "gauge", float64(len(i.queue)))
+	write("telemetryx_server_ingest_queue_capacity", "Samples the ingestion queue holds.", "gauge", float64(cap(i.queue)))
+	write("telemetryx_server_ingest_samples_enqueued_total", "Samples accepted into the ingestion queue.", "counter", float64(i.stats.enqueued.Load()))
+	write("telemetryx_server_ingest_samples_dropped_total", "Samples shed because the ingestion queue was full.", "counter", float64(i.stats.dropped.Load()))
+	write("telemetryx_server_ingest_samples_written_total", "Samples written to storage.", "counter", float64(i.stats.written.Load()))
+	write("telemetryx_server_ingest_samples_failed_total", "Samples that could not be written.", "counter", float64(i.stats.failed.Load()))
+	write("telemetryx_server_ingest_retries_total", "Batch writes retried after a transient storage error.", "counter", float64(i.stats.retries.Load()))
+	if err != nil {
+		return err
+	}
+
+	i.stats.mu.Lock()
+	counts := append([]uint64(nil), i.stats.flushCounts...)
+	sum, count := i.stats.flushSum, i.stats.flushCount
+	i.stats.mu.Unlock()
+
+	const name = "telemetryx_server_ingest_flush_duration_seconds"
+	if _, err := fmt.Fprintf(w, "# HELP %s Time to write one batch, including retries.\n# TYPE %s histogram\n", name, name); err != nil {
+		return err
+	}
+	var cumulative uint64
+	for n, bound := range flushBuckets {
+		cumulative += counts[n]
+		if _, err := fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound, cumulative); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n%s_sum %g\n%s_count %d\n", name, count, name, sum, name, count)
+	return err
+}
@@ -0,0 +1,313 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"telemetry-agent/internal/server/storage"
+)
+
+// recordingStore records the batches and single records written to it. fail, when set,
+// decides whether a write of records fails.
+type recordingStore struct {
+	storage.RecordStore
+
+	mu      sync.Mutex
+	batches []int
+	saved   []storage.Record
+	fail    func(records []storage.Record) error
+}
+
+func (s *recordingStore) SaveBatch(ctx context.Context, records []storage.Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail != nil {
+		if err := s.fail(records); err != nil {
+			return err
+		}
+	}
+	s.batches = append(s.batches, len(records))
+	s.saved = append(s.saved, records...)
+	return nil
+}
+
+func (s *recordingStore) Save(ctx context.Context, record storage.Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail != nil {
+		if err := s.fail([]storage.Record{record}); err != nil {
+			return err
+		}
+	}
+	s.saved = append(s.saved, record)
+	return nil
+}
+
+func (s *recordingStore) written() (batches []int, saved []storage.Record) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]int(nil), s.batches...), append([]storage.Record(nil), s.saved...)
+}
+
+// runIngester starts i and returns a function stopping it and waiting for the drain.
+func runIngester(i *Ingester) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		i.Run(ctx)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func enqueueN(t *testing.T, i *Ingester, n int) {
+	t.Helper()
+	for k := range n {
+		if err := i.Enqueue(context.Background(), storage.Record{AgentID: "web-1", CPUUsage: float64(k)}); err != nil {
+			t.Fatalf("enqueue %d: %v", k, err)
+		}
+	}
+}
+
+// eventually fails the test unless cond holds within a second.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// ingestMetric returns the value of an unlabelled metric i exposes.
+func ingestMetric(t *testing.T, i *Ingester, name string) float64 {
+	t.Helper()
+	var out strings.Builder
+	if err := i.WritePrometheus(&out); err != nil {
+		t.Fatal(err)
+	}
+	scanner := bufio.NewScanner(strings.NewReader(out.String()))
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), name+" "); ok {
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return v
+		}
+	}
+	t.Fatalf("metric %s not exposed", name)
+	return 0
+}
+
+func TestIngesterFlushesFullBatches(t *testing.T) {
+	store := &recordingStore{}
+	i := NewIngester(store, IngestConfig{QueueSize: 10, Writers: 1, BatchSize: 3, FlushInterval: time.Hour, Overflow: OverflowBlock}, testLogger)
+	stop := runIngester(i)
+	defer stop()
+
+	enqueueN(t, i, 7)
+	eventually(t, "two full batches", func() bool {
+		batches, _ := store.written()
+		return len(batches) == 2
+	})
+	if batches, _ := store.written(); batches[0] != 3 || batches[1] != 3 {
+		t.Fatalf("batches = %v, want [3 3]", batches)
+	}
+}
+
+func TestIngesterFlushesAfterInterval(t *testing.T) {
+	store := &recordingStore{}
+	i := NewIngester(store, IngestConfig{QueueSize: 10, Writers: 1, BatchSize: 100, FlushInterval: 20 * time.Millisecond, Overflow: OverflowBlock}, testLogger)
+	stop := runIngester(i)
+	defer stop()
+
+	start := time.Now()
+	enqueueN(t, i, 2)
+	eventually(t, "the partial batch", func() bool {
+		batches, _ := store.written()
+		return len(batches) == 1
+	})
+	if batches, _ := store.written(); batches[0] != 2 {
+		t.Fatalf("batches = %v, want [2]", batches)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Fatalf("partial batch written after %s, before the flush interval", elapsed)
+	}
+}
+
+func TestIngesterOverflow(t *testing.T) {
+	t.Run("drop", func(t *testing.T) {
+		i := NewIngester(&recordingStore{}, IngestConfig{QueueSize: 2, Writers: 1, BatchSize: 10, FlushInterval: time.Hour, Overflow: OverflowDrop}, testLogger)
+		enqueueN(t, i, 5)
+		if got := ingestMetric(t, i, "telemetryx_server_ingest_samples_dropped_total"); got != 3 {
+			t.Fatalf("dropped = %v, want 3", got)
+		}
+		if got := ingestMetric(t, i, "telemetryx_server_ingest_queue_depth"); got != 2 {
+			t.Fatalf("queue depth = %v, want 2", got)
+		}
+	})
+
+	t.Run("block", func(t *testing.T) {
+		i := NewIngester(&recordingStore{}, IngestConfig{QueueSize: 1, Writers: 1, BatchSize: 10, FlushInterval: time.Hour, Overflow: OverflowBlock}, testLogger)
+		enqueueN(t, i, 1)
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		if err := i.Enqueue(ctx, storage.Record{AgentID: "web-1"}); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("enqueue into a full queue = %v, want it to wait for the stream context", err)
+		}
+		if got := ingestMetric(t, i, "telemetryx_server_ingest_samples_dropped_total"); got != 0 {
+			t.Fatalf("dropped = %v under the block policy", got)
+		}
+
+		runIngester(i)()
+		if err := i.Enqueue(context.Background(), storage.Record{AgentID: "web-1"}); !errors.Is(err, errIngestStopped) {
+			t.Fatalf("enqueue after shutdown = %v, want errIngestStopped", err)
+		}
+	})
+}
+
+func TestIngesterRetriesTransientErrors(t *testing.T) {
+	store := &recordingStore{}
+	failures := 2
+	store.fail = func([]storage.Record) error {
+		if failures > 0 {
+			failures--
+			return &pgconn.PgError{Code: "40001"}
+		}
+		return nil
+	}
+	i := NewIngester(store, IngestConfig{QueueSize: 10, Writers: 1, BatchSize: 4, FlushInterval: time.Hour, Overflow: OverflowBlock}, testLogger)
+	stop := runIngester(i)
+	defer stop()
+
+	enqueueN(t, i, 4)
+	eventually(t, "the retried batch", func() bool {
+		_, saved := store.written()
+		return len(saved) == 4
+	})
+	if got := ingestMetric(t, i, "telemetryx_server_ingest_retries_total"); got != 2 {
+		t.Fatalf("retries = %v, want 2", got)
+	}
+}
+
+func TestIngesterRequeuesOnShutdown(t *testing.T) {
+	store := &recordingStore{}
+	var mu sync.Mutex
+	down := true
+	store.fail = func([]storage.Record) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if down {
+			return &pgconn.PgError{Code: "57P03"}
+		}
+		return nil
+	}
+	i := NewIngester(store, IngestConfig{QueueSize: 10, Writers: 2, BatchSize: 3, FlushInterval: time.Hour, Overflow: OverflowBlock}, testLogger)
+	stop := runIngester(i)
+
+	enqueueN(t, i, 6)
+	eventually(t, "both writers retrying", func() bool {
+		return ingestMetric(t, i, "telemetryx_server_ingest_retries_total") >= 2
+	})
+	// The writers give their batches back on shutdown and the drain writes them once the
+	// database is reachable again.
+	time.AfterFunc(50*time.Millisecond, func() {
+		mu.Lock()
+		down = false
+		mu.Unlock()
+	})
+	stop()
+
+	_, saved := store.written()
+	seen := make(map[float64]int)
+	for _, record := range saved {
+		seen[record.CPUUsage]++
+	}
+	if len(saved) != 6 || len(seen) != 6 {
+		t.Fatalf("drain wrote %d records (%v), want each of the 6 once", len(saved), seen)
+	}
+}
+
+func TestIngesterSavesFailedBatchRecordByRecord(t *testing.T) {
+	store := &recordingStore{}
+	store.fail = func(records []storage.Record) error {
+		if len(records) > 1 {
+			return errors.New("check constraint violated")
+		}
+		if records[0].CPUUsage == 1 {
+			return errors.New("check constraint violated")
+		}
+		return nil
+	}
+	i := NewIngester(store, IngestConfig{QueueSize: 10, Writers: 1, BatchSize: 3, FlushInterval: time.Hour, Overflow: OverflowBlock}, testLogger)
+	stop := runIngester(i)
+	defer stop()
+
+	enqueueN(t, i, 3)
+	eventually(t, "the records written one by one", func() bool {
+		return ingestMetric(t, i, "telemetryx_server_ingest_samples_failed_total") == 1
+	})
+	if got := ingestMetric(t, i, "telemetryx_server_ingest_samples_written_total"); got != 2 {
+		t.Fatalf("written = %v, want 2", got)
+	}
+}
+
+func TestIngesterDrainsOnShutdown(t *testing.T) {
+	store := &recordingStore{}
+	i := NewIngester(store, IngestConfig{QueueSize: 100, Writers: 2, BatchSize: 10, FlushInterval: time.Hour, Overflow: OverflowBlock}, testLogger)
+	stop := runIngester(i)
+
+	enqueueN(t, i, 25)
+	stop()
+	if _, saved := store.written(); len(saved) != 25 {
+		t.Fatalf("wrote %d records by the end of the drain, want 25", len(saved))
+	}
+	if got := ingestMetric(t, i, "telemetryx_server_ingest_queue_depth"); got != 0 {
+		t.Fatalf("queue depth after drain = %v", got)
+	}
+}
+
+func TestIngesterWritesEveryAcceptedRecordDuringShutdown(t *testing.T) {
+	for range 20 {
+		store := &recordingStore{}
+		i := NewIngester(store, IngestConfig{QueueSize: 8, Writers: 2, BatchSize: 4, FlushInterval: time.Millisecond, Overflow: OverflowBlock}, testLogger)
+		stop := runIngester(i)
+
+		var accepted atomic.Int64
+		var wg sync.WaitGroup
+		for range 4 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					if err := i.Enqueue(context.Background(), storage.Record{AgentID: "web-1"}); err != nil {
+						return
+					}
+					accepted.Add(1)
+				}
+			}()
+		}
+		time.Sleep(time.Millisecond)
+		stop()
+		wg.Wait()
+
+		if _, saved := store.written(); int64(len(saved)) != accepted.Load() {
+			t.Fatalf("wrote %d records, but Enqueue accepted %d", len(saved), accepted.Load())
+		}
+	}
+}
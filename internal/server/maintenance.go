@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"telemetry-agent/internal/server/storage"
+)
+
+// MaintenanceConfig schedules the partitioning, rollup and retention job. Stores without
+// partitions or rollups only apply Retention.Raw.
+type MaintenanceConfig struct {
+	// Interval is how often the job runs.
+	Interval time.Duration
+	// PartitionInterval is the span of one raw sample partition, a day or a week;
+	// partitions are created PartitionAhead before they are needed.
+	PartitionInterval time.Duration
+	PartitionAhead    time.Duration
+	// Rollup materialises the storage.Tiers; RollupDelay holds back the newest samples
+	// so most late ones, such as a relay replaying its spool, arrive before their minute
+	// is rolled up. Later ones are merged into the finished buckets afterwards.
+	Rollup      bool
+	RollupDelay time.Duration
+	Retention   storage.Retention
+	// PruneBatch caps the rows deleted by one statement.
+	PruneBatch int
+}
+
+// RunMaintenance prunes expired data every cfg.Interval until ctx is done, first
+// creating upcoming partitions and rolling samples up when store is a
+// storage.Maintainer. Failures are logged and retried on the next run.
+func RunMaintenance(ctx context.Context, store storage.Pruner, cfg MaintenanceConfig, logger *slog.Logger) {
+	maintainer, ok := store.(storage.Maintainer)
+	cfg.Rollup = cfg.Rollup && ok
+	cfg.Retention.AfterRollup = cfg.Rollup
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		now := time.Now()
+		if ok {
+			if err := PreparePartitions(ctx, maintainer, cfg, now, logger); err != nil && ctx.Err() == nil {
+				logger.Error("create partitions", "error", err)
+			}
+		}
+		if cfg.Rollup {
+			if err := maintainer.Rollup(ctx, now.Add(-cfg.RollupDelay)); err != nil && ctx.Err() == nil {
+				logger.Error("roll up samples", "error", err)
+			}
+		}
+		pruned, err := store.Prune(ctx, cfg.Retention, now, cfg.PruneBatch)
+		if err != nil && ctx.Err() == nil {
+			logger.Error("prune expired data", "error", err)
+		}
+		if pruned.Partitions > 0 || pruned.Rows > 0 {
+			logger.Info("pruned expired data", "partitions", pruned.Partitions, "rows", pruned.Rows, "took", time.Since(now))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// PreparePartitions creates the partitions samples collected up to cfg.PartitionAhead
+// after now will need.
+func PreparePartitions(ctx context.Context, store storage.Maintainer, cfg MaintenanceConfig, now time.Time, logger *slog.Logger) error {
+	created, err := store.PreparePartitions(ctx, now.Add(cfg.PartitionAhead), cfg.PartitionInterval)
+	if created > 0 {
+		logger.Info("created partitions", "count", created, "interval", cfg.PartitionInterval)
+	}
+	return err
+}
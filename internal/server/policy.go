@@ -0,0 +1,255 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"telemetry-agent/internal/server/storage"
+	"telemetry-agent/pkg/api"
+)
+
+// agentSession tracks remote configuration state for one connected metrics stream.
+type agentSession struct {
+	out chan *api.AgentConfig
+
+	mu      sync.Mutex
+	agentID string
+	labels  storage.Labels
+	policy  string
+	sent    uint64
+	acked   uint64
+	ackErr  string
+	started bool
+}
+
+func newAgentSession() *agentSession {
+	return &agentSession{out: make(chan *api.AgentConfig, 1)}
+}
+
+func (sess *agentSession) id() string {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.agentID
+}
+
+// offer queues cfg for delivery, replacing any configuration not yet sent.
+func (sess *agentSession) offer(cfg *api.AgentConfig) {
+	for {
+		select {
+		case sess.out <- cfg:
+			return
+		default:
+		}
+		select {
+		case <-sess.out:
+		default:
+		}
+	}
+}
+
+// PolicyStatus describes the remote configuration state of a connected agent.
+type PolicyStatus struct {
+	AgentID        string `json:"agentId"`
+	Policy         string `json:"policy,omitempty"`
+	DesiredVersion uint64 `json:"desiredVersion"`
+	AckedVersion   uint64 `json:"ackedVersion"`
+	Error          string `json:"error,omitempty"`
+	InSync         bool   `json:"inSync"`
+}
+
+// ReloadPolicies reads the policies from storage and pushes any resulting configuration
+// change to the connected agents.
+func (s *TelemetryService) ReloadPolicies(ctx context.Context) error {
+	policies, err := s.store.Policies(ctx)
+	if err != nil {
+		return err
+	}
+
+	s.policyMu.Lock()
+	s.policies = policies
+	s.policyMu.Unlock()
+
+	s.sessionMu.Lock()
+	sessions := make([]*agentSession, 0, len(s.sessions))
+	for sess := range s.sessions {
+		sessions = append(sessions, sess)
+	}
+	s.sessionMu.Unlock()
+
+	for _, sess := range sessions {
+		s.pushPolicy(sess)
+	}
+	return nil
+}
+
+// WatchPolicies reloads policies every period so edits made through another server
+// instance reach the agents connected here. It returns when ctx is cancelled.
+func (s *TelemetryService) WatchPolicies(ctx context.Context, period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.ReloadPolicies(ctx); err != nil && ctx.Err() == nil {
+				s.logger.Warn("reload policies", "error", err)
+			}
+		}
+	}
+}
+
+// PolicyStatuses reports the configuration state of every connected agent.
+func (s *TelemetryService) PolicyStatuses() []PolicyStatus {
+	s.sessionMu.Lock()
+	defer s.sessionMu.Unlock()
+
+	statuses := make([]PolicyStatus, 0, len(s.sessions))
+	for sess := range s.sessions {
+		sess.mu.Lock()
+		if sess.started {
+			statuses = append(statuses, PolicyStatus{
+				AgentID:        sess.agentID,
+				Policy:         sess.policy,
+				DesiredVersion: sess.sent,
+				AckedVersion:   sess.acked,
+				Error:          sess.ackErr,
+				InSync:         sess.sent == sess.acked && sess.ackErr == "",
+			})
+		}
+		sess.mu.Unlock()
+	}
+
+	slices.SortFunc(statuses, func(a, b PolicyStatus) int {
+		return cmp.Compare(a.AgentID, b.AgentID)
+	})
+	return statuses
+}
+
+// observe updates a session from an incoming metric, pushing configuration when the
+// agent first appears or its labels change, and records acknowledgements.
+func (s *TelemetryService) observe(ctx context.Context, sess *agentSession, metric *api.Metric, labels storage.Labels) {
+	sess.mu.Lock()
+	first := !sess.started
+	relabelled := !maps.Equal(sess.labels, labels)
+	acked := metric.GetConfigVersion() != sess.acked || metric.GetConfigError() != sess.ackErr
+	if first {
+		sess.started = true
+		sess.sent = metric.GetConfigVersion()
+	}
+	sess.agentID = metric.GetAgentId()
+	sess.labels = labels
+	sess.acked = metric.GetConfigVersion()
+	sess.ackErr = metric.GetConfigError()
+	sess.mu.Unlock()
+
+	if first || acked {
+		ack := storage.ConfigAck{
+			AgentID: metric.GetAgentId(),
+			Version: metric.GetConfigVersion(),
+			Error:   metric.GetConfigError(),
+			AckedAt: time.Now(),
+		}
+		if !first {
+			if ack.Error != "" {
+				s.logger.Warn("agent rejected configuration", "agent", ack.AgentID, "version", ack.Version, "error", ack.Error)
+			} else {
+				s.logger.Info("agent acknowledged configuration", "agent", ack.AgentID, "version", ack.Version)
+			}
+		}
+		if err := s.store.SaveConfigAck(ctx, ack); err != nil {
+			s.logger.Warn("save config ack", "agent", ack.AgentID, "error", err)
+		}
+	}
+
+	if first || relabelled {
+		s.pushPolicy(sess)
+	}
+}
+
+// pushPolicy resolves the policy for a session and sends it when it differs from what
+// the agent was last given.
+func (s *TelemetryService) pushPolicy(sess *agentSession) {
+	s.policyMu.RLock()
+	policies := s.policies
+	s.policyMu.RUnlock()
+
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if !sess.started {
+		return
+	}
+
+	policy, ok := resolvePolicy(policies, sess.agentID, sess.labels)
+	cfg := policyConfig(policy, ok)
+	sess.policy = policy.Name
+	if cfg.GetVersion() == sess.sent {
+		return
+	}
+
+	sess.sent = cfg.GetVersion()
+	sess.offer(cfg)
+	s.logger.Info("pushing configuration", "agent", sess.agentID, "policy", policy.Name, "version", cfg.GetVersion())
+}
+
+// resolvePolicy picks the policy that applies to an agent: a policy naming the agent
+// wins, then the matching selector policy with the highest priority, then the most
+// specific selector, then the lowest name.
+func resolvePolicy(policies []storage.Policy, agentID string, labels storage.Labels) (storage.Policy, bool) {
+	var best storage.Policy
+	found := false
+
+	for _, p := range policies {
+		if p.AgentID != "" {
+			if p.AgentID != agentID {
+				continue
+			}
+		} else if !labels.Matches(p.Selector) {
+			continue
+		}
+
+		if !found || policyBefore(p, best) {
+			best, found = p, true
+		}
+	}
+
+	return best, found
+}
+
+func policyBefore(a, b storage.Policy) bool {
+	if (a.AgentID != "") != (b.AgentID != "") {
+		return a.AgentID != ""
+	}
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	if len(a.Selector) != len(b.Selector) {
+		return len(a.Selector) > len(b.Selector)
+	}
+	return a.Name < b.Name
+}
+
+// policyConfig converts a policy into the message pushed to agents. Without a policy
+// the agent receives version 0, which withdraws earlier remote configuration.
+func policyConfig(p storage.Policy, ok bool) *api.AgentConfig {
+	if !ok {
+		return &api.AgentConfig{}
+	}
+
+	cfg := &api.AgentConfig{
+		Version:      p.Version,
+		Collectors:   p.Collectors,
+		ProbeTargets: p.ProbeTargets,
+	}
+	if interval, err := time.ParseDuration(p.Interval); err == nil && interval > 0 {
+		cfg.Interval = durationpb.New(interval)
+	}
+	return cfg
+}
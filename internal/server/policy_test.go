@@ -0,0 +1,58 @@
+package server
+
+import (
+	"testing"
+
+	"telemetry-agent/internal/server/storage"
+)
+
+func TestResolvePolicy(t *testing.T) {
+	prod := storage.Policy{Name: "prod", Selector: storage.Labels{"env": "prod"}}
+	prodEU := storage.Policy{Name: "prod-eu", Selector: storage.Labels{"env": "prod", "region": "eu"}}
+	urgent := storage.Policy{Name: "urgent", Selector: storage.Labels{"env": "prod"}, Priority: 10}
+	catchAll := storage.Policy{Name: "all"}
+	web1 := storage.Policy{Name: "web-1", AgentID: "web-1"}
+	web2 := storage.Policy{Name: "web-2", AgentID: "web-2", Priority: 100}
+	alpha := storage.Policy{Name: "alpha", Selector: storage.Labels{"env": "prod"}}
+
+	tests := []struct {
+		name     string
+		policies []storage.Policy
+		agentID  string
+		labels   storage.Labels
+		want     string // empty for no policy
+	}{
+		{"no policies", nil, "web-1", storage.Labels{"env": "prod"}, ""},
+		{"selector matches", []storage.Policy{prod}, "web-1", storage.Labels{"env": "prod", "role": "web"}, "prod"},
+		{"selector value differs", []storage.Policy{prod}, "web-1", storage.Labels{"env": "dev"}, ""},
+		{"selector key missing", []storage.Policy{prodEU}, "web-1", storage.Labels{"env": "prod"}, ""},
+		{"unlabelled agent", []storage.Policy{prod}, "web-1", nil, ""},
+		{"empty selector matches every agent", []storage.Policy{catchAll}, "web-1", nil, "all"},
+		{"agent policy beats selector", []storage.Policy{urgent, web1}, "web-1", storage.Labels{"env": "prod"}, "web-1"},
+		{"agent policy for another agent", []storage.Policy{web2, prod}, "web-1", storage.Labels{"env": "prod"}, "prod"},
+		{"higher priority wins", []storage.Policy{prodEU, urgent}, "web-1", storage.Labels{"env": "prod", "region": "eu"}, "urgent"},
+		{"more specific selector wins", []storage.Policy{catchAll, prod, prodEU}, "web-1", storage.Labels{"env": "prod", "region": "eu"}, "prod-eu"},
+		{"lowest name breaks ties", []storage.Policy{prod, alpha}, "web-1", storage.Labels{"env": "prod"}, "alpha"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := resolvePolicy(tt.policies, tt.agentID, tt.labels)
+			if ok != (tt.want != "") || got.Name != tt.want {
+				t.Fatalf("resolvePolicy = %q (found %t), want %q", got.Name, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicyConfig(t *testing.T) {
+	if cfg := policyConfig(storage.Policy{}, false); cfg.GetVersion() != 0 || cfg.GetInterval() != nil {
+		t.Fatalf("no policy = %v, want an empty version 0 config", cfg)
+	}
+	cfg := policyConfig(storage.Policy{Version: 3, Interval: "15s", Collectors: []string{"cpu"}}, true)
+	if cfg.GetVersion() != 3 || cfg.GetInterval().AsDuration().String() != "15s" || len(cfg.GetCollectors()) != 1 {
+		t.Fatalf("policy config = %v", cfg)
+	}
+	if cfg := policyConfig(storage.Policy{Version: 4}, true); cfg.GetInterval() != nil {
+		t.Fatalf("policy without interval set one: %v", cfg)
+	}
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"context"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"telemetry-agent/internal/server/storage"
+)
+
+// Derived values added to Record.Values. A counter value named "x_total" gets its rate
+// as "x_rate"; GapValue holds the seconds since the previous sample when that exceeds
+// RateConfig.GapIntervals sampling intervals.
+const (
+	counterSuffix = "_total"
+	rateSuffix    = "_rate"
+	GapValue      = "server.gap_seconds"
+)
+
+// RateConfig controls how per-second rates are derived from the counters agents report.
+type RateConfig struct {
+	// GapIntervals flags a sample arriving more than this many sampling intervals after
+	// the previous one of its agent; zero disables gap detection.
+	GapIntervals int
+}
+
+// rateState is what the rates of an agent's next sample are derived from.
+type rateState struct {
+	prev storage.Record
+	// interval is the spacing of the last two samples without a gap, zero until known.
+	interval time.Duration
+}
+
+// rateTracker derives counter rates from consecutive samples of each agent.
+type rateTracker struct {
+	cfg RateConfig
+
+	mu     sync.Mutex
+	agents map[string]rateState
+}
+
+func newRateTracker(cfg RateConfig) *rateTracker {
+	return &rateTracker{cfg: cfg, agents: make(map[string]rateState)}
+}
+
+// seed resumes from the newest stored samples of agentID, given newest first, unless
+// the tracker already holds a newer one. Seeding on every new stream keeps rates
+// continuous across server restarts and agents moving between servers.
+func (t *rateTracker) seed(agentID string, newest []storage.Record) {
+	if len(newest) == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if state, ok := t.agents[agentID]; ok && !newest[0].CollectedAt.After(state.prev.CollectedAt) {
+		return
+	}
+	state := rateState{prev: newest[0]}
+	if len(newest) > 1 {
+		state.interval = newest[0].CollectedAt.Sub(newest[1].CollectedAt)
+	}
+	t.agents[agentID] = state
+}
+
+// apply fills in the rates of record from the previous sample of its agent. A counter
+// lower than before was reset, typically by a host reboot, and is taken to have counted
+// up from zero. Samples older than the previous one, such as a relay replaying its
+// spool, get no rates and do not move the baseline.
+func (t *rateTracker) apply(record *storage.Record) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state, ok := t.agents[record.AgentID]
+	if ok && !record.CollectedAt.After(state.prev.CollectedAt) {
+		return
+	}
+	next := rateState{prev: *record}
+	if ok {
+		prev := state.prev
+		elapsed := record.CollectedAt.Sub(prev.CollectedAt)
+		seconds := elapsed.Seconds()
+		record.NetworkTxRate = counterRate(float64(prev.NetworkTxBytes), float64(record.NetworkTxBytes), seconds)
+		record.NetworkRxRate = counterRate(float64(prev.NetworkRxBytes), float64(record.NetworkRxBytes), seconds)
+		record.DiskReadRate = counterRate(float64(prev.DiskReadBytes), float64(record.DiskReadBytes), seconds)
+		record.DiskWriteRate = counterRate(float64(prev.DiskWriteBytes), float64(record.DiskWriteBytes), seconds)
+		for name, value := range record.Values {
+			old, ok := prev.Values[name]
+			if !ok || !strings.HasSuffix(name, counterSuffix) {
+				continue
+			}
+			record.Values[strings.TrimSuffix(name, counterSuffix)+rateSuffix] = counterRate(old, value, seconds)
+		}
+
+		next.interval = elapsed
+		if t.cfg.GapIntervals > 0 && state.interval > 0 && elapsed > time.Duration(t.cfg.GapIntervals)*state.interval {
+			if record.Values == nil {
+				record.Values = make(map[string]float64)
+			}
+			record.Values[GapValue] = seconds
+			// The gap says nothing about how often the agent samples.
+			next.interval = state.interval
+		}
+	}
+	// The copy kept must not share the map the record is stored with.
+	if record.Values != nil {
+		next.prev.Values = make(map[string]float64, len(record.Values))
+		for name, value := range record.Values {
+			next.prev.Values[name] = value
+		}
+	}
+	t.agents[record.AgentID] = next
+}
+
+// counterRate is the per-second increase of a counter from oldValue to newValue. A
+// decrease means the counter was reset, so newValue counts from zero.
+func counterRate(oldValue, newValue, seconds float64) float64 {
+	if seconds <= 0 {
+		return 0
+	}
+	increase := newValue - oldValue
+	if increase < 0 {
+		increase = newValue
+	}
+	rate := increase / seconds
+	if math.IsNaN(rate) || math.IsInf(rate, 0) {
+		return 0
+	}
+	return rate
+}
+
+// loadRates seeds the rate state of agentID from its newest stored samples. Failures
+// only cost the rates of the next sample, so they are logged rather than returned.
+func (s *TelemetryService) loadRates(ctx context.Context, agentID string) {
+	page, err := s.store.List(ctx, agentID, storage.RecordQuery{Limit: 2})
+	if err != nil {
+		s.logger.Warn("load rate baseline", "agent", agentID, "error", err)
+		return
+	}
+	s.rates.seed(agentID, page.Records)
+}
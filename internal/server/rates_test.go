@@ -0,0 +1,226 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"telemetry-agent/internal/server/storage"
+)
+
+var rateEpoch = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func sampleAt(offset time.Duration, txBytes uint64, values map[string]float64) storage.Record {
+	return storage.Record{AgentID: "a", CollectedAt: rateEpoch.Add(offset), NetworkTxBytes: txBytes, Values: values}
+}
+
+func TestCounterRate(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new float64
+		seconds  float64
+		want     float64
+	}{
+		{"increase", 100, 300, 2, 100},
+		{"unchanged", 100, 100, 2, 0},
+		{"reset counts from zero", 500, 40, 2, 20},
+		{"reset to zero", 500, 0, 2, 0},
+		{"zero elapsed", 100, 300, 0, 0},
+		{"negative elapsed", 100, 300, -1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := counterRate(tt.old, tt.new, tt.seconds); got != tt.want {
+				t.Fatalf("counterRate(%v, %v, %v) = %v, want %v", tt.old, tt.new, tt.seconds, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateTrackerApply(t *testing.T) {
+	type step struct {
+		record  storage.Record
+		wantTx  float64
+		wantGap float64 // zero means no gap flag
+		wantVal map[string]float64
+	}
+	tests := []struct {
+		name  string
+		gap   int
+		steps []step
+	}{
+		{
+			name: "first sample has no rates",
+			steps: []step{
+				{record: sampleAt(0, 1000, nil), wantTx: 0},
+			},
+		},
+		{
+			name: "steady counter",
+			steps: []step{
+				{record: sampleAt(0, 1000, nil)},
+				{record: sampleAt(2*time.Second, 1400, nil), wantTx: 200},
+				{record: sampleAt(4*time.Second, 1600, nil), wantTx: 100},
+			},
+		},
+		{
+			name: "reset counts from zero",
+			steps: []step{
+				{record: sampleAt(0, 1000, nil)},
+				{record: sampleAt(2*time.Second, 60, nil), wantTx: 30},
+			},
+		},
+		{
+			name: "out of order sample is skipped",
+			steps: []step{
+				{record: sampleAt(0, 1000, nil)},
+				{record: sampleAt(4*time.Second, 1800, nil), wantTx: 200},
+				{record: sampleAt(2*time.Second, 1400, nil), wantTx: 0},
+				{record: sampleAt(4*time.Second, 1800, nil), wantTx: 0},
+				// The baseline is still the 4s sample.
+				{record: sampleAt(6*time.Second, 2200, nil), wantTx: 200},
+			},
+		},
+		{
+			name: "value counters",
+			steps: []step{
+				{record: sampleAt(0, 0, map[string]float64{"http.requests_total": 10, "temp": 40})},
+				{
+					record:  sampleAt(2*time.Second, 0, map[string]float64{"http.requests_total": 30, "temp": 42, "new_total": 5}),
+					wantVal: map[string]float64{"http.requests_rate": 10},
+				},
+			},
+		},
+		{
+			name: "gap flagged",
+			gap:  3,
+			steps: []step{
+				{record: sampleAt(0, 0, nil)},
+				{record: sampleAt(time.Second, 0, nil)},
+				{record: sampleAt(3*time.Second, 0, nil)},
+				{record: sampleAt(13*time.Second, 0, nil), wantGap: 10},
+			},
+		},
+		{
+			name: "gap does not move the learned interval",
+			gap:  3,
+			steps: []step{
+				{record: sampleAt(0, 0, nil)},
+				{record: sampleAt(time.Second, 0, nil)},
+				{record: sampleAt(11*time.Second, 0, nil), wantGap: 10},
+				// Still four intervals of 1s, so still a gap.
+				{record: sampleAt(15*time.Second, 0, nil), wantGap: 4},
+				{record: sampleAt(16*time.Second, 0, nil)},
+			},
+		},
+		{
+			name: "gap detection disabled",
+			steps: []step{
+				{record: sampleAt(0, 0, nil)},
+				{record: sampleAt(time.Second, 0, nil)},
+				{record: sampleAt(time.Hour, 0, nil)},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := newRateTracker(RateConfig{GapIntervals: tt.gap})
+			for i, st := range tt.steps {
+				record := st.record
+				tracker.apply(&record)
+				if record.NetworkTxRate != st.wantTx {
+					t.Errorf("step %d: NetworkTxRate = %v, want %v", i, record.NetworkTxRate, st.wantTx)
+				}
+				if gap, ok := record.Values[GapValue]; gap != st.wantGap || ok != (st.wantGap != 0) {
+					t.Errorf("step %d: %s = %v (set %t), want %v", i, GapValue, gap, ok, st.wantGap)
+				}
+				for name, want := range st.wantVal {
+					if got, ok := record.Values[name]; !ok || got != want {
+						t.Errorf("step %d: %s = %v (set %t), want %v", i, name, got, ok, want)
+					}
+				}
+				if _, ok := record.Values["new_rate"]; ok {
+					t.Errorf("step %d: rate derived for a counter without a baseline", i)
+				}
+			}
+		})
+	}
+}
+
+func TestRateTrackerKeepsItsOwnValues(t *testing.T) {
+	tracker := newRateTracker(RateConfig{})
+	first := sampleAt(0, 0, map[string]float64{"jobs_total": 10})
+	tracker.apply(&first)
+	first.Values["jobs_total"] = 1e9
+
+	second := sampleAt(time.Second, 0, map[string]float64{"jobs_total": 12})
+	tracker.apply(&second)
+	if got := second.Values["jobs_rate"]; got != 2 {
+		t.Fatalf("jobs_rate = %v, want 2", got)
+	}
+}
+
+func TestRateTrackerSeed(t *testing.T) {
+	tests := []struct {
+		name    string
+		applied []storage.Record
+		seeded  []storage.Record
+		next    storage.Record
+		wantTx  float64
+		wantGap bool
+	}{
+		{
+			name:   "seed provides the baseline",
+			seeded: []storage.Record{sampleAt(10*time.Second, 2000, nil), sampleAt(8*time.Second, 1000, nil)},
+			next:   sampleAt(12*time.Second, 3000, nil),
+			wantTx: 500,
+		},
+		{
+			name:   "nothing stored",
+			next:   sampleAt(12*time.Second, 3000, nil),
+			wantTx: 0,
+		},
+		{
+			name:    "seed learns the interval",
+			seeded:  []storage.Record{sampleAt(10*time.Second, 0, nil), sampleAt(8*time.Second, 0, nil)},
+			next:    sampleAt(20*time.Second, 0, nil),
+			wantGap: true,
+		},
+		{
+			name:    "single stored sample leaves the interval unknown",
+			seeded:  []storage.Record{sampleAt(10*time.Second, 0, nil)},
+			next:    sampleAt(20*time.Second, 0, nil),
+			wantGap: false,
+		},
+		{
+			name:    "newer live baseline wins",
+			applied: []storage.Record{sampleAt(20*time.Second, 5000, nil)},
+			seeded:  []storage.Record{sampleAt(10*time.Second, 2000, nil), sampleAt(8*time.Second, 1000, nil)},
+			next:    sampleAt(22*time.Second, 6000, nil),
+			wantTx:  500,
+		},
+		{
+			name:    "newer stored baseline wins",
+			applied: []storage.Record{sampleAt(10*time.Second, 2000, nil)},
+			seeded:  []storage.Record{sampleAt(20*time.Second, 5000, nil), sampleAt(18*time.Second, 4000, nil)},
+			next:    sampleAt(22*time.Second, 5500, nil),
+			wantTx:  250,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := newRateTracker(RateConfig{GapIntervals: 3})
+			for _, record := range tt.applied {
+				tracker.apply(&record)
+			}
+			tracker.seed("a", tt.seeded)
+			next := tt.next
+			tracker.apply(&next)
+			if next.NetworkTxRate != tt.wantTx {
+				t.Errorf("NetworkTxRate = %v, want %v", next.NetworkTxRate, tt.wantTx)
+			}
+			if _, gap := next.Values[GapValue]; gap != tt.wantGap {
+				t.Errorf("gap flagged = %t, want %t", gap, tt.wantGap)
+			}
+		})
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
-	"math"
 	"sync"
 	"time"
 
@@ -16,20 +15,59 @@ import (
 type TelemetryService struct {
 	api.UnimplementedTelemetryServer
 
-	store  *storage.PostgresStore
+	store  storage.Store
+	ingest *Ingester
 	logger *slog.Logger
+	auth   AuthConfig
 
-	mu       sync.Mutex
-	previous map[string]storage.Record
+	rates *rateTracker
+
+	policyMu sync.RWMutex
+	policies []storage.Policy
+
+	sessionMu sync.Mutex
+	sessions  map[*agentSession]struct{}
 }
 
 // NewTelemetryService wires the dependencies required by the gRPC server implementation.
-func NewTelemetryService(store *storage.PostgresStore, logger *slog.Logger) *TelemetryService {
-	return &TelemetryService{store: store, logger: logger, previous: make(map[string]storage.Record)}
+// Samples are written through ingest; store serves policies, tokens and the samples
+// counter rates resume from.
+func NewTelemetryService(store storage.Store, ingest *Ingester, logger *slog.Logger, auth AuthConfig, rates RateConfig) *TelemetryService {
+	return &TelemetryService{
+		store:    store,
+		ingest:   ingest,
+		logger:   logger,
+		auth:     auth,
+		rates:    newRateTracker(rates),
+		sessions: make(map[*agentSession]struct{}),
+	}
 }
 
-// StreamMetrics consumes a bi-directional stream of metric data from agents.
+// StreamMetrics consumes a bi-directional stream of metric data from agents and pushes
+// remote configuration back over the same stream. A stream normally carries one agent,
+// but a relay multiplexes many over one stream, so configuration state is kept per agent
+// and every pushed message names the agent it is meant for.
 func (s *TelemetryService) StreamMetrics(stream api.Telemetry_StreamMetricsServer) error {
+	ctx := stream.Context()
+	identities, authenticated := PeerIdentities(ctx)
+	token, hasToken := ctx.Value(tokenContextKey{}).(streamToken)
+	tokenChecked := time.Now()
+
+	agents := make(map[string]*agentSession)
+	var sendMu sync.Mutex
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+
+	defer func() {
+		close(done)
+		wg.Wait()
+		s.sessionMu.Lock()
+		for _, sess := range agents {
+			delete(s.sessions, sess)
+		}
+		s.sessionMu.Unlock()
+	}()
+
 	for {
 		metric, err := stream.Recv()
 		if err != nil {
@@ -45,46 +83,69 @@ func (s *TelemetryService) StreamMetrics(stream api.Telemetry_StreamMetricsServe
 			s.logger.Warn("discarding metric", "error", err)
 			continue
 		}
+		if authenticated {
+			if err := s.authorizeAgent(identities, record.AgentID); err != nil {
+				s.logger.Warn("rejecting metric stream", "agent", record.AgentID, "identities", identities)
+				return err
+			}
+		}
+		if hasToken {
+			if time.Since(tokenChecked) > tokenRecheck {
+				if _, err := s.checkToken(ctx, token.hash); err != nil {
+					s.logger.Warn("closing metric stream", "agent", record.AgentID, "token", token.ID, "error", err)
+					return err
+				}
+				tokenChecked = time.Now()
+			}
+			if err := authorizeToken(token, record.AgentID); err != nil {
+				s.logger.Warn("rejecting metric stream", "agent", record.AgentID, "token", token.ID)
+				return err
+			}
+		}
 
-		s.enrichWithRates(&record)
-
-		if err := s.store.Save(stream.Context(), record); err != nil {
-			s.logger.Error("save metric", "error", err)
-			continue
+		sess, ok := agents[record.AgentID]
+		if !ok {
+			sess = newAgentSession()
+			agents[record.AgentID] = sess
+			s.sessionMu.Lock()
+			s.sessions[sess] = struct{}{}
+			s.sessionMu.Unlock()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.pushConfigs(stream, &sendMu, sess, done)
+			}()
+			s.loadRates(ctx, record.AgentID)
 		}
-	}
-}
 
-func (s *TelemetryService) enrichWithRates(record *storage.Record) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	prev, ok := s.previous[record.AgentID]
-	if ok {
-		elapsed := record.CollectedAt.Sub(prev.CollectedAt).Seconds()
-		if elapsed > 0 {
-			record.NetworkTxRate = ratePerSecond(prev.NetworkTxBytes, record.NetworkTxBytes, elapsed)
-			record.NetworkRxRate = ratePerSecond(prev.NetworkRxBytes, record.NetworkRxBytes, elapsed)
-			record.DiskReadRate = ratePerSecond(prev.DiskReadBytes, record.DiskReadBytes, elapsed)
-			record.DiskWriteRate = ratePerSecond(prev.DiskWriteBytes, record.DiskWriteBytes, elapsed)
+		s.observe(ctx, sess, metric, record.Labels)
+		s.rates.apply(&record)
+
+		// Under the block overflow policy this waits for queue room, holding the stream
+		// so the agent buffers; it only fails once the stream or the server is done.
+		if err := s.ingest.Enqueue(ctx, record); err != nil {
+			return err
 		}
 	}
-
-	s.previous[record.AgentID] = *record
 }
 
-func ratePerSecond(oldValue, newValue uint64, seconds float64) float64 {
-	if seconds <= 0 {
-		return 0
-	}
-	if newValue < oldValue {
-		return 0
-	}
-	rate := float64(newValue-oldValue) / seconds
-	if math.IsNaN(rate) || math.IsInf(rate, 0) {
-		return 0
+// pushConfigs sends the configurations queued for sess until done is closed. The agents
+// of one stream share sendMu because stream.Send must not be called concurrently.
+func (s *TelemetryService) pushConfigs(stream api.Telemetry_StreamMetricsServer, sendMu *sync.Mutex, sess *agentSession, done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case cfg := <-sess.out:
+			sendMu.Lock()
+			err := stream.Send(&api.ServerMessage{Config: cfg, AgentId: sess.id()})
+			sendMu.Unlock()
+			if err != nil {
+				s.logger.Warn("push configuration", "agent", sess.id(), "error", err)
+				return
+			}
+		}
 	}
-	return rate
 }
 
 func convertMetric(metric *api.Metric) (storage.Record, error) {
@@ -111,6 +172,18 @@ func convertMetric(metric *api.Metric) (storage.Record, error) {
 		LoadAvg5:       metric.GetLoadAvg_5(),
 		LoadAvg15:      metric.GetLoadAvg_15(),
 	}
+	if labels := metric.GetLabels(); len(labels) > 0 {
+		record.Labels = make(storage.Labels, len(labels))
+		for key, val := range labels {
+			record.Labels[key] = val
+		}
+	}
+	if values := metric.GetValues(); len(values) > 0 {
+		record.Values = make(map[string]float64, len(values))
+		for key, val := range values {
+			record.Values[key] = val
+		}
+	}
 
 	if record.AgentID == "" {
 		return storage.Record{}, fmt.Errorf("missing agent id")
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"telemetry-agent/internal/server/storage"
+	"telemetry-agent/pkg/api"
+)
+
+var testLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// newTestService returns a service over a fresh MemoryStore with its ingester running.
+// stop drains the ingester so everything streamed so far is in the store.
+func newTestService(t *testing.T, auth AuthConfig) (svc *TelemetryService, store *storage.MemoryStore, stop func()) {
+	t.Helper()
+	store = storage.NewMemoryStore(0)
+	ingest := NewIngester(store, IngestConfig{QueueSize: 100, Writers: 1, BatchSize: 10, FlushInterval: 10 * time.Millisecond, Overflow: OverflowBlock}, testLogger)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ingest.Run(ctx)
+	}()
+	stop = func() {
+		cancel()
+		<-done
+	}
+	t.Cleanup(stop)
+	return NewTelemetryService(store, ingest, testLogger, auth, RateConfig{GapIntervals: 3}), store, stop
+}
+
+// fakeStream feeds StreamMetrics from recv, ending the stream when recv is closed, and
+// collects what the server sends.
+type fakeStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	recv chan *api.Metric
+	sent chan *api.ServerMessage
+}
+
+func newFakeStream(ctx context.Context) *fakeStream {
+	return &fakeStream{ctx: ctx, recv: make(chan *api.Metric, 16), sent: make(chan *api.ServerMessage, 16)}
+}
+
+func (f *fakeStream) Context() context.Context { return f.ctx }
+
+func (f *fakeStream) Recv() (*api.Metric, error) {
+	metric, ok := <-f.recv
+	if !ok {
+		return nil, io.EOF
+	}
+	return metric, nil
+}
+
+func (f *fakeStream) Send(msg *api.ServerMessage) error {
+	f.sent <- msg
+	return nil
+}
+
+func testMetric(agentID string, offset time.Duration, txBytes uint64) *api.Metric {
+	return &api.Metric{
+		AgentId:        agentID,
+		CollectedAt:    timestamppb.New(rateEpoch.Add(offset)),
+		NetworkTxBytes: txBytes,
+		Labels:         map[string]string{"env": "prod"},
+	}
+}
+
+func TestStreamMetricsStoresSamplesWithRates(t *testing.T) {
+	svc, store, stop := newTestService(t, AuthConfig{})
+	stream := newFakeStream(context.Background())
+	stream.recv <- testMetric("a", 0, 1000)
+	stream.recv <- &api.Metric{} // no agent id, discarded
+	stream.recv <- testMetric("a", 2*time.Second, 1400)
+	stream.recv <- testMetric("b", 0, 50)
+	close(stream.recv)
+
+	if err := svc.StreamMetrics(stream); err != nil {
+		t.Fatalf("StreamMetrics: %v", err)
+	}
+	stop()
+
+	page, err := store.List(context.Background(), "a", storage.RecordQuery{Order: storage.OrderAsc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Records) != 2 {
+		t.Fatalf("stored %d records for a, want 2", len(page.Records))
+	}
+	if got := page.Records[1].NetworkTxRate; got != 200 {
+		t.Errorf("second sample tx rate = %v, want 200", got)
+	}
+	if got := page.Records[0].Labels["env"]; got != "prod" {
+		t.Errorf("labels not stored, env = %q", got)
+	}
+	if agents, _ := store.Agents(context.Background(), nil); len(agents) != 2 {
+		t.Errorf("agents = %v, want [a b]", agents)
+	}
+}
+
+func TestStreamMetricsResumesRatesFromStore(t *testing.T) {
+	svc, store, stop := newTestService(t, AuthConfig{})
+	store.Save(context.Background(), storage.Record{AgentID: "a", CollectedAt: rateEpoch, NetworkTxBytes: 1000})
+
+	stream := newFakeStream(context.Background())
+	stream.recv <- testMetric("a", 4*time.Second, 3000)
+	close(stream.recv)
+	if err := svc.StreamMetrics(stream); err != nil {
+		t.Fatalf("StreamMetrics: %v", err)
+	}
+	stop()
+
+	latest, ok, err := store.Latest(context.Background(), "a", nil)
+	if err != nil || !ok {
+		t.Fatalf("latest: %v, %v", ok, err)
+	}
+	if latest.NetworkTxRate != 500 {
+		t.Fatalf("tx rate = %v, want 500 from the stored baseline", latest.NetworkTxRate)
+	}
+}
+
+func TestStreamMetricsEnforcesTokenScope(t *testing.T) {
+	svc, store, _ := newTestService(t, AuthConfig{})
+	ctx := context.WithValue(context.Background(), tokenContextKey{}, streamToken{Token: storage.Token{ID: "t1", Kind: storage.TokenAgent, AgentID: "a"}})
+	stream := newFakeStream(ctx)
+	stream.recv <- testMetric("a", 0, 0)
+	stream.recv <- testMetric("b", 0, 0)
+	close(stream.recv)
+
+	err := svc.StreamMetrics(stream)
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("StreamMetrics = %v, want PermissionDenied", err)
+	}
+	if _, ok, _ := store.Latest(context.Background(), "b", nil); ok {
+		t.Fatal("sample for an agent outside the token scope was stored")
+	}
+}
+
+func TestStreamMetricsPushesPolicy(t *testing.T) {
+	svc, store, _ := newTestService(t, AuthConfig{})
+	ctx := context.Background()
+	if _, err := store.SavePolicy(ctx, storage.Policy{Name: "prod", Selector: storage.Labels{"env": "prod"}, Interval: "5s"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.ReloadPolicies(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	stream := newFakeStream(ctx)
+	errc := make(chan error, 1)
+	go func() { errc <- svc.StreamMetrics(stream) }()
+	stream.recv <- testMetric("a", 0, 0)
+
+	select {
+	case msg := <-stream.sent:
+		if msg.GetAgentId() != "a" || msg.GetConfig().GetInterval().AsDuration() != 5*time.Second {
+			t.Fatalf("pushed %v, want the prod policy for agent a", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no configuration pushed")
+	}
+
+	close(stream.recv)
+	if err := <-errc; err != nil {
+		t.Fatalf("StreamMetrics: %v", err)
+	}
+	if statuses := svc.PolicyStatuses(); len(statuses) != 0 {
+		t.Fatalf("sessions left after the stream ended: %v", statuses)
+	}
+}
@@ -0,0 +1,634 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Bucket layout of BoltStore. Records live in one nested bucket per agent, keyed by the
+// collection time followed by an insertion sequence, so keys sort like the
+// (collected_at, id) order PostgresStore uses.
+var (
+	recordsBucket     = []byte("records")
+	policiesBucket    = []byte("policies")
+	configAcksBucket  = []byte("config_acks")
+	tokensBucket      = []byte("tokens")       // id -> boltToken
+	tokenHashesBucket = []byte("token_hashes") // hash -> id
+)
+
+// BoltStore persists everything in a single bbolt file, for deployments that do not run
+// PostgreSQL. Every write is a transaction fsynced before it returns, so a crash loses
+// nothing that was acknowledged and never leaves a partial write behind.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+var _ Pruner = (*BoltStore)(nil)
+
+type boltToken struct {
+	Token
+	Hash []byte `json:"hash"`
+}
+
+// NewBoltStore opens or creates the database file at path. The file is locked, so a
+// second server pointed at it fails to start instead of corrupting it.
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open bolt database: %w", err)
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{recordsBucket, policiesBucket, configAcksBucket, tokensBucket, tokenHashesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("ensure buckets: %w", err)
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+// Close flushes and closes the database file.
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+// Save writes a telemetry record unless its agent has one collected at the same instant.
+// Concurrent saves are committed together in one transaction to share the cost of
+// syncing the file.
+func (s *BoltStore) Save(ctx context.Context, record Record) error {
+	if record.AgentID == "" {
+		return errMissingAgentID
+	}
+
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("marshal record: %w", err)
+	}
+
+	if err := s.db.Batch(func(tx *bolt.Tx) error {
+		return putRecord(tx, record, payload)
+	}); err != nil {
+		return fmt.Errorf("insert record: %w", err)
+	}
+
+	return nil
+}
+
+// SaveBatch writes records in one transaction, skipping them like Save.
+func (s *BoltStore) SaveBatch(ctx context.Context, records []Record) error {
+	payloads := make([][]byte, len(records))
+	for i, record := range records {
+		if record.AgentID == "" {
+			return errMissingAgentID
+		}
+		payload, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("marshal record: %w", err)
+		}
+		payloads[i] = payload
+	}
+
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		for i, record := range records {
+			if err := putRecord(tx, record, payloads[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("insert records: %w", err)
+	}
+
+	return nil
+}
+
+// List retrieves a page of an agent's historical records selected by query, walking the
+// agent's bucket from whichever end the order starts at.
+func (s *BoltStore) List(ctx context.Context, agentID string, query RecordQuery) (RecordPage, error) {
+	if agentID == "" {
+		return RecordPage{}, errAgentRequired
+	}
+	if err := query.Validate(); err != nil {
+		return RecordPage{}, err
+	}
+
+	// Keys sort like positions, so the range and the cursor become key bounds: lower is
+	// inclusive and upper exclusive.
+	var lower, upper []byte
+	if !query.From.IsZero() {
+		lower = recordKey(query.From, 0)
+	}
+	if !query.To.IsZero() {
+		upper = recordKey(query.To, 0)
+	}
+	if cursor, _ := decodeCursor(query.Cursor); cursor != nil {
+		key := positionKey(*cursor)
+		if query.Order == OrderAsc {
+			// Seeking to the cursor lands on it; it is skipped below.
+			if bytes.Compare(key, lower) > 0 {
+				lower = key
+			}
+		} else if upper == nil || bytes.Compare(key, upper) < 0 {
+			upper = key
+		}
+	}
+
+	var records []Record
+	var positions []recordPosition
+	err := s.db.View(func(tx *bolt.Tx) error {
+		agent := tx.Bucket(recordsBucket).Bucket([]byte(agentID))
+		if agent == nil {
+			return nil
+		}
+		c := agent.Cursor()
+		var k, v []byte
+		var next func() ([]byte, []byte)
+		if query.Order == OrderAsc {
+			k, v = c.Seek(lower)
+			if query.Cursor != "" && bytes.Equal(k, lower) {
+				k, v = c.Next()
+			}
+			next = c.Next
+		} else {
+			if upper == nil {
+				k, v = c.Last()
+			} else if k, _ = c.Seek(upper); k == nil {
+				k, v = c.Last()
+			} else {
+				k, v = c.Prev()
+			}
+			next = c.Prev
+		}
+
+		for ; k != nil && (query.Limit <= 0 || len(records) <= query.Limit); k, v = next() {
+			if query.Order == OrderAsc && upper != nil && bytes.Compare(k, upper) >= 0 ||
+				query.Order == OrderDesc && bytes.Compare(k, lower) < 0 {
+				break
+			}
+			record, err := decodeRecord(v)
+			if err != nil {
+				return err
+			}
+			if record.Labels.Matches(query.Selector) {
+				records = append(records, record)
+				positions = append(positions, keyPosition(k))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return RecordPage{}, fmt.Errorf("query history: %w", err)
+	}
+
+	if records == nil {
+		records = make([]Record, 0)
+	}
+	return query.page(records, positions), nil
+}
+
+// QueryRange resamples one metric of an agent, aggregating the records of the range in
+// process.
+func (s *BoltStore) QueryRange(ctx context.Context, agentID string, query RangeQuery) ([]Point, error) {
+	if err := query.Validate(); err != nil {
+		return nil, err
+	}
+	page, err := s.List(ctx, agentID, RecordQuery{From: query.From, To: query.To, Order: OrderAsc, Selector: query.Selector})
+	if err != nil {
+		return nil, err
+	}
+	return resample(page.Records, query), nil
+}
+
+// Latest returns the newest record for an agent whose labels match selector when available.
+func (s *BoltStore) Latest(ctx context.Context, agentID string, selector Labels) (Record, bool, error) {
+	if agentID == "" {
+		return Record{}, false, errAgentRequired
+	}
+
+	var latest Record
+	var found bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		latest, found, err = newestMatch(tx.Bucket(recordsBucket).Bucket([]byte(agentID)), selector)
+		return err
+	})
+	if err != nil {
+		return Record{}, false, fmt.Errorf("query latest: %w", err)
+	}
+
+	return latest, found, nil
+}
+
+// Agents lists agent identifiers that have persisted data carrying labels that match
+// selector, in order.
+func (s *BoltStore) Agents(ctx context.Context, selector Labels) ([]string, error) {
+	agents := make([]string, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		records := tx.Bucket(recordsBucket)
+		return records.ForEachBucket(func(id []byte) error {
+			if len(selector) > 0 {
+				if _, ok, err := newestMatch(records.Bucket(id), selector); err != nil || !ok {
+					return err
+				}
+			}
+			agents = append(agents, string(id))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("query agents: %w", err)
+	}
+
+	return agents, nil
+}
+
+// Prune deletes records collected more than retention.Raw before now, up to batch
+// records per transaction so saves are not held up for long. Agents left without
+// records are removed. The embedded store keeps no rollups, so tier retention does not
+// apply.
+func (s *BoltStore) Prune(ctx context.Context, retention Retention, now time.Time, batch int) (PruneStats, error) {
+	var stats PruneStats
+	if retention.Raw <= 0 {
+		return stats, nil
+	}
+	cutoff := recordKey(now.Add(-retention.Raw), 0)
+	for {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		deleted := 0
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			records := tx.Bucket(recordsBucket)
+			var emptied [][]byte
+			if err := records.ForEachBucket(func(id []byte) error {
+				c := records.Bucket(id).Cursor()
+				k, _ := c.First()
+				for ; k != nil && bytes.Compare(k, cutoff) < 0 && deleted < batch; k, _ = c.First() {
+					if err := c.Delete(); err != nil {
+						return err
+					}
+					deleted++
+				}
+				if k == nil {
+					emptied = append(emptied, bytes.Clone(id))
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			for _, id := range emptied {
+				if err := records.DeleteBucket(id); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return stats, fmt.Errorf("prune records: %w", err)
+		}
+		stats.Rows += int64(deleted)
+		if deleted < batch {
+			return stats, nil
+		}
+	}
+}
+
+// Policies returns every remote configuration policy ordered by name.
+func (s *BoltStore) Policies(ctx context.Context) ([]Policy, error) {
+	policies := make([]Policy, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(policiesBucket).ForEach(func(_, v []byte) error {
+			var policy Policy
+			if err := json.Unmarshal(v, &policy); err != nil {
+				return fmt.Errorf("decode policy: %w", err)
+			}
+			policies = append(policies, policy)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("query policies: %w", err)
+	}
+
+	return policies, nil
+}
+
+// SavePolicy creates or replaces a policy, assigning it a new version that is greater
+// than any version handed out before.
+func (s *BoltStore) SavePolicy(ctx context.Context, policy Policy) (Policy, error) {
+	if err := policy.Validate(); err != nil {
+		return Policy{}, err
+	}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		policies := tx.Bucket(policiesBucket)
+		version, err := policies.NextSequence()
+		if err != nil {
+			return err
+		}
+		policy.Version = version
+		policy.UpdatedAt = time.Now()
+		spec, err := json.Marshal(policy)
+		if err != nil {
+			return err
+		}
+		return policies.Put([]byte(policy.Name), spec)
+	})
+	if err != nil {
+		return Policy{}, fmt.Errorf("upsert policy: %w", err)
+	}
+
+	return policy, nil
+}
+
+// DeletePolicy removes a policy and reports whether it existed.
+func (s *BoltStore) DeletePolicy(ctx context.Context, name string) (bool, error) {
+	var found bool
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		policies := tx.Bucket(policiesBucket)
+		found = policies.Get([]byte(name)) != nil
+		return policies.Delete([]byte(name))
+	})
+	if err != nil {
+		return false, fmt.Errorf("delete policy: %w", err)
+	}
+	return found, nil
+}
+
+// SaveConfigAck records the configuration version an agent reported.
+func (s *BoltStore) SaveConfigAck(ctx context.Context, ack ConfigAck) error {
+	raw, err := json.Marshal(ack)
+	if err != nil {
+		return fmt.Errorf("marshal config ack: %w", err)
+	}
+	if err := s.db.Batch(func(tx *bolt.Tx) error {
+		return tx.Bucket(configAcksBucket).Put([]byte(ack.AgentID), raw)
+	}); err != nil {
+		return fmt.Errorf("upsert config ack: %w", err)
+	}
+	return nil
+}
+
+// ConfigAcks lists the last acknowledgement of every agent ordered by agent id.
+func (s *BoltStore) ConfigAcks(ctx context.Context) ([]ConfigAck, error) {
+	acks := make([]ConfigAck, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(configAcksBucket).ForEach(func(_, v []byte) error {
+			var ack ConfigAck
+			if err := json.Unmarshal(v, &ack); err != nil {
+				return fmt.Errorf("decode config ack: %w", err)
+			}
+			acks = append(acks, ack)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("query config acks: %w", err)
+	}
+
+	return acks, nil
+}
+
+// CreateToken stores a new token under the hash of its secret.
+func (s *BoltStore) CreateToken(ctx context.Context, token Token, hash []byte) (Token, error) {
+	if err := token.Validate(); err != nil {
+		return Token{}, err
+	}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		token, err = insertBoltToken(tx, token, hash)
+		return err
+	})
+	if err != nil {
+		return Token{}, fmt.Errorf("insert token: %w", err)
+	}
+	return token, nil
+}
+
+// TokenByHash looks up the token whose secret hashes to hash.
+func (s *BoltStore) TokenByHash(ctx context.Context, hash []byte) (Token, bool, error) {
+	var token boltToken
+	var found bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		token, found, err = boltTokenByHash(tx, hash)
+		return err
+	})
+	if err != nil {
+		return Token{}, false, fmt.Errorf("query token: %w", err)
+	}
+	return token.Token, found, nil
+}
+
+// Tokens lists every token, newest first.
+func (s *BoltStore) Tokens(ctx context.Context) ([]Token, error) {
+	tokens := make([]Token, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(tokensBucket).ForEach(func(_, v []byte) error {
+			var token boltToken
+			if err := json.Unmarshal(v, &token); err != nil {
+				return fmt.Errorf("decode token: %w", err)
+			}
+			tokens = append(tokens, token.Token)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("query tokens: %w", err)
+	}
+
+	// ForEach yields tokens by id, which stays the order among equal creation times.
+	slices.SortStableFunc(tokens, func(a, b Token) int { return b.CreatedAt.Compare(a.CreatedAt) })
+	return tokens, nil
+}
+
+// RevokeToken marks a token revoked and reports whether it exists. Revoking twice keeps
+// the original revocation time.
+func (s *BoltStore) RevokeToken(ctx context.Context, id string) (bool, error) {
+	var found bool
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		tokens := tx.Bucket(tokensBucket)
+		raw := tokens.Get([]byte(id))
+		if raw == nil {
+			return nil
+		}
+		found = true
+		var token boltToken
+		if err := json.Unmarshal(raw, &token); err != nil {
+			return fmt.Errorf("decode token: %w", err)
+		}
+		if token.RevokedAt != nil {
+			return nil
+		}
+		now := time.Now()
+		token.RevokedAt = &now
+		return putBoltToken(tx, token)
+	})
+	if err != nil {
+		return false, fmt.Errorf("revoke token: %w", err)
+	}
+	return found, nil
+}
+
+// EnrollAgent consumes the bootstrap token hashing to bootstrapHash and stores credential
+// for agentID in the same transaction, so a bootstrap token is never exchanged twice. It
+// returns ErrTokenRejected when the bootstrap token cannot be used by agentID.
+func (s *BoltStore) EnrollAgent(ctx context.Context, bootstrapHash []byte, agentID string, credential Token, credentialHash []byte) (Token, error) {
+	if err := credential.Validate(); err != nil {
+		return Token{}, err
+	}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bootstrap, ok, err := boltTokenByHash(tx, bootstrapHash)
+		if err != nil {
+			return fmt.Errorf("query bootstrap token: %w", err)
+		}
+		now := time.Now()
+		if !ok || bootstrap.Kind != TokenBootstrap || !bootstrap.Active(now) || !bootstrap.Allows(agentID) {
+			return ErrTokenRejected
+		}
+
+		bootstrap.UsedAt = &now
+		if err := putBoltToken(tx, bootstrap); err != nil {
+			return fmt.Errorf("consume bootstrap token: %w", err)
+		}
+		if credential, err = insertBoltToken(tx, credential, credentialHash); err != nil {
+			return fmt.Errorf("insert agent token: %w", err)
+		}
+		return nil
+	})
+	if errors.Is(err, ErrTokenRejected) {
+		return Token{}, ErrTokenRejected
+	}
+	if err != nil {
+		return Token{}, fmt.Errorf("enroll agent: %w", err)
+	}
+	return credential, nil
+}
+
+func insertBoltToken(tx *bolt.Tx, token Token, hash []byte) (Token, error) {
+	if tx.Bucket(tokensBucket).Get([]byte(token.ID)) != nil {
+		return Token{}, fmt.Errorf("token %q already exists", token.ID)
+	}
+	if tx.Bucket(tokenHashesBucket).Get(hash) != nil {
+		return Token{}, errors.New("token hash already exists")
+	}
+	token.CreatedAt = time.Now()
+	if err := putBoltToken(tx, boltToken{Token: token, Hash: hash}); err != nil {
+		return Token{}, err
+	}
+	if err := tx.Bucket(tokenHashesBucket).Put(hash, []byte(token.ID)); err != nil {
+		return Token{}, err
+	}
+	return token, nil
+}
+
+func putBoltToken(tx *bolt.Tx, token boltToken) error {
+	raw, err := json.Marshal(token)
+	if err != nil {
+		return fmt.Errorf("marshal token: %w", err)
+	}
+	return tx.Bucket(tokensBucket).Put([]byte(token.ID), raw)
+}
+
+func boltTokenByHash(tx *bolt.Tx, hash []byte) (boltToken, bool, error) {
+	id := tx.Bucket(tokenHashesBucket).Get(hash)
+	if id == nil {
+		return boltToken{}, false, nil
+	}
+	raw := tx.Bucket(tokensBucket).Get(id)
+	if raw == nil {
+		return boltToken{}, false, nil
+	}
+	var token boltToken
+	if err := json.Unmarshal(raw, &token); err != nil {
+		return boltToken{}, false, fmt.Errorf("decode token: %w", err)
+	}
+	return token, bytes.Equal(token.Hash, hash), nil
+}
+
+// putRecord stores record under a new key unless its agent already has a record
+// collected at the same instant.
+func putRecord(tx *bolt.Tx, record Record, payload []byte) error {
+	agent, err := tx.Bucket(recordsBucket).CreateBucketIfNotExists([]byte(record.AgentID))
+	if err != nil {
+		return err
+	}
+	// Keys clamp times before the epoch to it, so a matching key only narrows the search.
+	first := recordKey(record.CollectedAt, 0)
+	c := agent.Cursor()
+	for k, v := c.Seek(first); k != nil && bytes.Equal(k[:8], first[:8]); k, v = c.Next() {
+		stored, err := decodeRecord(v)
+		if err != nil {
+			return err
+		}
+		if stored.CollectedAt.Equal(record.CollectedAt) {
+			return nil
+		}
+	}
+	seq, err := agent.NextSequence()
+	if err != nil {
+		return err
+	}
+	return agent.Put(recordKey(record.CollectedAt, seq), payload)
+}
+
+// newestMatch walks an agent's records from the newest and returns the first whose
+// labels match selector. agent may be nil.
+func newestMatch(agent *bolt.Bucket, selector Labels) (Record, bool, error) {
+	if agent == nil {
+		return Record{}, false, nil
+	}
+	c := agent.Cursor()
+	for k, v := c.Last(); k != nil; k, v = c.Prev() {
+		record, err := decodeRecord(v)
+		if err != nil {
+			return Record{}, false, err
+		}
+		if record.Labels.Matches(selector) {
+			return record, true, nil
+		}
+	}
+	return Record{}, false, nil
+}
+
+// recordKey orders records by collection time and then by insertion. Times before the
+// Unix epoch sort first.
+func recordKey(collectedAt time.Time, seq uint64) []byte {
+	return positionKey(recordPosition{at: collectedAt.UnixNano(), seq: seq})
+}
+
+// positionKey and keyPosition convert between record keys and list cursor positions.
+func positionKey(p recordPosition) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key[:8], uint64(max(p.at, 0)))
+	binary.BigEndian.PutUint64(key[8:], p.seq)
+	return key
+}
+
+func keyPosition(key []byte) recordPosition {
+	return recordPosition{at: int64(binary.BigEndian.Uint64(key[:8])), seq: binary.BigEndian.Uint64(key[8:])}
+}
+
+func decodeRecord(raw []byte) (Record, error) {
+	var record Record
+	if err := json.Unmarshal(raw, &record); err != nil {
+		return Record{}, fmt.Errorf("decode payload: %w", err)
+	}
+	return record, nil
+}
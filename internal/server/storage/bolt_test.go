@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestBoltStorePersistsAcrossReopen(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "telemetry.db")
+	store, err := NewBoltStore(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+
+	start := time.Unix(1700000000, 0)
+	// Saved out of order, as a relay replaying its spool may deliver them.
+	for _, i := range []int{2, 0, 1} {
+		record := Record{AgentID: "a", CollectedAt: start.Add(time.Duration(i) * time.Second), CPUUsage: float64(i), Labels: Labels{"env": "prod"}}
+		if err := store.Save(ctx, record); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+	}
+	if err := store.Save(ctx, Record{AgentID: "b", CollectedAt: start, Labels: Labels{"env": "dev"}}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	policy, err := store.SavePolicy(ctx, Policy{Name: "slow", Interval: "30s"})
+	if err != nil {
+		t.Fatalf("save policy: %v", err)
+	}
+	if _, err := NewBoltStore(path); err == nil {
+		t.Fatal("opened a database file that is in use")
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	store, err = NewBoltStore(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer store.Close()
+
+	page, err := store.List(ctx, "a", RecordQuery{Order: OrderAsc})
+	if err != nil || !slices.Equal(cpuValues(page.Records), []float64{0, 1, 2}) {
+		t.Fatalf("list = %v, %v; want [0 1 2]", cpuValues(page.Records), err)
+	}
+	page, err = store.List(ctx, "a", RecordQuery{Limit: 2, Selector: Labels{"env": "prod"}})
+	if err != nil || !slices.Equal(cpuValues(page.Records), []float64{2, 1}) {
+		t.Fatalf("list with limit = %v, %v; want [2 1]", cpuValues(page.Records), err)
+	}
+	latest, ok, err := store.Latest(ctx, "a", nil)
+	if err != nil || !ok || latest.CPUUsage != 2 || !latest.CollectedAt.Equal(start.Add(2*time.Second)) {
+		t.Fatalf("latest = %+v, %v, %v", latest, ok, err)
+	}
+	agents, err := store.Agents(ctx, Labels{"env": "dev"})
+	if err != nil || !slices.Equal(agents, []string{"b"}) {
+		t.Fatalf("dev agents = %v, %v; want [b]", agents, err)
+	}
+
+	replaced, err := store.SavePolicy(ctx, Policy{Name: "slow", Interval: "1m"})
+	if err != nil {
+		t.Fatalf("save policy: %v", err)
+	}
+	if replaced.Version <= policy.Version {
+		t.Fatalf("version %d after reopen not greater than %d", replaced.Version, policy.Version)
+	}
+}
+
+func TestBoltStoreSaveBatchIsAtomic(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewBoltStore(filepath.Join(t.TempDir(), "telemetry.db"))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer store.Close()
+
+	start := time.Unix(1700000000, 0)
+	if err := store.SaveBatch(ctx, []Record{{AgentID: "a", CollectedAt: start}, {CollectedAt: start}}); err == nil {
+		t.Fatal("saved a batch containing a record without agent id")
+	}
+	if agents, _ := store.Agents(ctx, nil); len(agents) != 0 {
+		t.Fatalf("failed batch left records of %v", agents)
+	}
+
+	batch := []Record{
+		{AgentID: "a", CollectedAt: start.Add(time.Second), CPUUsage: 1},
+		{AgentID: "b", CollectedAt: start},
+		{AgentID: "a", CollectedAt: start, CPUUsage: 0},
+	}
+	if err := store.SaveBatch(ctx, batch); err != nil {
+		t.Fatalf("save batch: %v", err)
+	}
+	page, err := store.List(ctx, "a", RecordQuery{Order: OrderAsc})
+	if err != nil || !slices.Equal(cpuValues(page.Records), []float64{0, 1}) {
+		t.Fatalf("list = %v, %v; want [0 1]", cpuValues(page.Records), err)
+	}
+}
+
+func TestBoltStoreEnrollOnce(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewBoltStore(filepath.Join(t.TempDir(), "telemetry.db"))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer store.Close()
+
+	if _, err := store.CreateToken(ctx, Token{ID: "boot", Kind: TokenBootstrap, AgentID: "web-*"}, []byte("boot-hash")); err != nil {
+		t.Fatalf("create token: %v", err)
+	}
+	if _, err := store.CreateToken(ctx, Token{ID: "boot", Kind: TokenAgent, AgentID: "x"}, []byte("other")); err == nil {
+		t.Fatal("created a token with a duplicate id")
+	}
+
+	credential := Token{ID: "web-1-token", Kind: TokenAgent, AgentID: "web-1"}
+	if _, err := store.EnrollAgent(ctx, []byte("boot-hash"), "web-1", credential, []byte("cred-hash")); err != nil {
+		t.Fatalf("enroll: %v", err)
+	}
+	second := Token{ID: "web-2-token", Kind: TokenAgent, AgentID: "web-2"}
+	if _, err := store.EnrollAgent(ctx, []byte("boot-hash"), "web-2", second, []byte("cred-hash-2")); !errors.Is(err, ErrTokenRejected) {
+		t.Fatalf("second enrollment: %v, want ErrTokenRejected", err)
+	}
+
+	tokens, err := store.Tokens(ctx)
+	if err != nil || len(tokens) != 2 {
+		t.Fatalf("tokens = %+v, %v; want 2", tokens, err)
+	}
+	if found, _ := store.RevokeToken(ctx, "web-1-token"); !found {
+		t.Fatal("revoke reported a missing token")
+	}
+	token, ok, err := store.TokenByHash(ctx, []byte("cred-hash"))
+	if err != nil || !ok || token.Active(time.Now()) {
+		t.Fatalf("revoked token = %+v, %v, %v; want inactive", token, ok, err)
+	}
+}
+
+func TestBoltStorePrune(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewBoltStore(filepath.Join(t.TempDir(), "telemetry.db"))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer store.Close()
+
+	now := time.Unix(1700000000, 0)
+	var records []Record
+	for i := 0; i < 7; i++ {
+		records = append(records, Record{AgentID: "a", CollectedAt: now.Add(-time.Duration(i) * time.Hour), CPUUsage: float64(i)})
+	}
+	records = append(records, Record{AgentID: "b", CollectedAt: now.Add(-10 * time.Hour)})
+	if err := store.SaveBatch(ctx, records); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	if stats, err := store.Prune(ctx, Retention{}, now, 2); err != nil || stats.Rows != 0 {
+		t.Fatalf("prune without retention = %+v, %v", stats, err)
+	}
+	// Batches of two cover the five expired records in several transactions.
+	stats, err := store.Prune(ctx, Retention{Raw: 150 * time.Minute, Tiers: map[string]time.Duration{"1m": time.Minute}}, now, 2)
+	if err != nil || stats.Rows != 5 {
+		t.Fatalf("prune = %+v, %v; want 5 rows", stats, err)
+	}
+	page, err := store.List(ctx, "a", RecordQuery{Order: OrderAsc})
+	if err != nil || !slices.Equal(cpuValues(page.Records), []float64{2, 1, 0}) {
+		t.Fatalf("kept = %v, %v; want [2 1 0]", cpuValues(page.Records), err)
+	}
+	agents, err := store.Agents(ctx, nil)
+	if err != nil || !slices.Equal(agents, []string{"a"}) {
+		t.Fatalf("agents = %v, %v; want [a]", agents, err)
+	}
+	if err := store.Save(ctx, Record{AgentID: "b", CollectedAt: now}); err != nil {
+		t.Fatalf("save after prune: %v", err)
+	}
+}
@@ -0,0 +1,15 @@
+package storage
+
+// Labels are the key/value pairs agents attach to every sample (env, region, role, ...).
+type Labels map[string]string
+
+// Matches reports whether every key/value pair in selector is present in l. An empty
+// selector matches everything.
+func (l Labels) Matches(selector Labels) bool {
+	for key, want := range selector {
+		if got, ok := l[key]; !ok || got != want {
+			return false
+		}
+	}
+	return true
+}
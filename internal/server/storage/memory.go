@@ -1,3 +1,396 @@
 package storage
 
-// The in-memory store was removed; relying on PostgreSQL keeps the demo focused and concise.
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMemoryRecords is how many samples MemoryStore keeps per agent by default.
+const DefaultMemoryRecords = 10000
+
+// MemoryStore keeps records, policies and tokens in process. Each agent's records live in
+// a ring buffer holding its newest samples in arrival order, so memory stays bounded
+// however long the server runs. Nothing survives a restart.
+type MemoryStore struct {
+	capacity int
+
+	mu       sync.RWMutex
+	records  map[string]*recordRing
+	policies map[string]Policy
+	version  uint64
+	acks     map[string]ConfigAck
+	tokens   map[string]*memoryToken // by id
+	byHash   map[string]*memoryToken
+}
+
+type memoryToken struct {
+	Token
+	hash string
+}
+
+// NewMemoryStore returns an empty store keeping up to capacity records per agent
+// (DefaultMemoryRecords when capacity is not positive).
+func NewMemoryStore(capacity int) *MemoryStore {
+	if capacity <= 0 {
+		capacity = DefaultMemoryRecords
+	}
+	return &MemoryStore{
+		capacity: capacity,
+		records:  make(map[string]*recordRing),
+		policies: make(map[string]Policy),
+		acks:     make(map[string]ConfigAck),
+		tokens:   make(map[string]*memoryToken),
+		byHash:   make(map[string]*memoryToken),
+	}
+}
+
+// Close is a no-op; the store holds no external resources.
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// Save appends a record to its agent's ring, evicting the oldest when the ring is full.
+// A record collected at the same instant as one the ring holds is skipped.
+func (s *MemoryStore) Save(ctx context.Context, record Record) error {
+	if record.AgentID == "" {
+		return errMissingAgentID
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ringFor(record.AgentID).push(record)
+	return nil
+}
+
+// ringFor returns the ring of agentID, creating it; s.mu must be held for writing.
+func (s *MemoryStore) ringFor(agentID string) *recordRing {
+	ring, ok := s.records[agentID]
+	if !ok {
+		ring = &recordRing{buf: make([]ringEntry, 0, min(s.capacity, 64)), capacity: s.capacity, collected: make(map[int64]struct{})}
+		s.records[agentID] = ring
+	}
+	return ring
+}
+
+// SaveBatch appends records in order under one lock, skipping them like Save.
+func (s *MemoryStore) SaveBatch(ctx context.Context, records []Record) error {
+	for _, record := range records {
+		if record.AgentID == "" {
+			return errMissingAgentID
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, record := range records {
+		s.ringFor(record.AgentID).push(record)
+	}
+	return nil
+}
+
+// List returns a page of an agent's records selected by query. The ring holds records
+// in arrival order, so the matches are sorted by collection time before paging.
+func (s *MemoryStore) List(ctx context.Context, agentID string, query RecordQuery) (RecordPage, error) {
+	if agentID == "" {
+		return RecordPage{}, errAgentRequired
+	}
+	if err := query.Validate(); err != nil {
+		return RecordPage{}, err
+	}
+	cursor, _ := decodeCursor(query.Cursor)
+
+	s.mu.RLock()
+	var matches []ringEntry
+	if ring, ok := s.records[agentID]; ok {
+		for i := 0; i < ring.len(); i++ {
+			entry := ring.entry(i)
+			if query.inRange(entry.CollectedAt) && query.beyond(entry.position(), cursor) && entry.Labels.Matches(query.Selector) {
+				matches = append(matches, entry)
+			}
+		}
+	}
+	s.mu.RUnlock()
+
+	slices.SortFunc(matches, func(a, b ringEntry) int {
+		pa, pb := a.position(), b.position()
+		if query.Order == OrderDesc {
+			pa, pb = pb, pa
+		}
+		switch {
+		case pb.after(pa):
+			return -1
+		case pa.after(pb):
+			return 1
+		}
+		return 0
+	})
+	if query.Limit > 0 && len(matches) > query.Limit+1 {
+		matches = matches[:query.Limit+1]
+	}
+
+	records := make([]Record, len(matches))
+	positions := make([]recordPosition, len(matches))
+	for i, entry := range matches {
+		records[i], positions[i] = entry.Record, entry.position()
+	}
+	return query.page(records, positions), nil
+}
+
+// QueryRange resamples one metric of an agent, aggregating the records of the range in
+// process.
+func (s *MemoryStore) QueryRange(ctx context.Context, agentID string, query RangeQuery) ([]Point, error) {
+	if err := query.Validate(); err != nil {
+		return nil, err
+	}
+	page, err := s.List(ctx, agentID, RecordQuery{From: query.From, To: query.To, Order: OrderAsc, Selector: query.Selector})
+	if err != nil {
+		return nil, err
+	}
+	return resample(page.Records, query), nil
+}
+
+// Latest returns the most recently collected record of an agent whose labels match
+// selector. Replayed samples can arrive after newer ones, so the whole ring is scanned.
+func (s *MemoryStore) Latest(ctx context.Context, agentID string, selector Labels) (Record, bool, error) {
+	if agentID == "" {
+		return Record{}, false, errAgentRequired
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ring, ok := s.records[agentID]
+	if !ok {
+		return Record{}, false, nil
+	}
+	var latest ringEntry
+	found := false
+	for i := 0; i < ring.len(); i++ {
+		entry := ring.entry(i)
+		if entry.Labels.Matches(selector) && (!found || entry.position().after(latest.position())) {
+			latest, found = entry, true
+		}
+	}
+	return latest.Record, found, nil
+}
+
+// Agents lists the agents holding at least one record that matches selector.
+func (s *MemoryStore) Agents(ctx context.Context, selector Labels) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	agents := make([]string, 0, len(s.records))
+	for id, ring := range s.records {
+		for i := 0; i < ring.len(); i++ {
+			if ring.at(i).Labels.Matches(selector) {
+				agents = append(agents, id)
+				break
+			}
+		}
+	}
+	slices.Sort(agents)
+	return agents, nil
+}
+
+// Policies returns every remote configuration policy ordered by name.
+func (s *MemoryStore) Policies(ctx context.Context) ([]Policy, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	policies := make([]Policy, 0, len(s.policies))
+	for _, policy := range s.policies {
+		policies = append(policies, policy)
+	}
+	slices.SortFunc(policies, func(a, b Policy) int { return strings.Compare(a.Name, b.Name) })
+	return policies, nil
+}
+
+// SavePolicy creates or replaces a policy under a new version.
+func (s *MemoryStore) SavePolicy(ctx context.Context, policy Policy) (Policy, error) {
+	if err := policy.Validate(); err != nil {
+		return Policy{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.version++
+	policy.Version = s.version
+	policy.UpdatedAt = time.Now()
+	s.policies[policy.Name] = policy
+	return policy, nil
+}
+
+// DeletePolicy removes a policy and reports whether it existed.
+func (s *MemoryStore) DeletePolicy(ctx context.Context, name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.policies[name]
+	delete(s.policies, name)
+	return ok, nil
+}
+
+// SaveConfigAck records the configuration version an agent reported.
+func (s *MemoryStore) SaveConfigAck(ctx context.Context, ack ConfigAck) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.acks[ack.AgentID] = ack
+	return nil
+}
+
+// ConfigAcks lists the last acknowledgement of every agent ordered by agent id.
+func (s *MemoryStore) ConfigAcks(ctx context.Context) ([]ConfigAck, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	acks := make([]ConfigAck, 0, len(s.acks))
+	for _, ack := range s.acks {
+		acks = append(acks, ack)
+	}
+	slices.SortFunc(acks, func(a, b ConfigAck) int { return strings.Compare(a.AgentID, b.AgentID) })
+	return acks, nil
+}
+
+// CreateToken stores a new token under the hash of its secret.
+func (s *MemoryStore) CreateToken(ctx context.Context, token Token, hash []byte) (Token, error) {
+	if err := token.Validate(); err != nil {
+		return Token{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.insertToken(token, hash)
+}
+
+// TokenByHash looks up the token whose secret hashes to hash.
+func (s *MemoryStore) TokenByHash(ctx context.Context, hash []byte) (Token, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	token, ok := s.byHash[string(hash)]
+	if !ok {
+		return Token{}, false, nil
+	}
+	return token.Token, true, nil
+}
+
+// Tokens lists every token, newest first.
+func (s *MemoryStore) Tokens(ctx context.Context) ([]Token, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	tokens := make([]Token, 0, len(s.tokens))
+	for _, token := range s.tokens {
+		tokens = append(tokens, token.Token)
+	}
+	slices.SortFunc(tokens, func(a, b Token) int {
+		if c := b.CreatedAt.Compare(a.CreatedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	return tokens, nil
+}
+
+// RevokeToken marks a token revoked and reports whether it exists. Revoking twice keeps
+// the original revocation time.
+func (s *MemoryStore) RevokeToken(ctx context.Context, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, ok := s.tokens[id]
+	if !ok {
+		return false, nil
+	}
+	if token.RevokedAt == nil {
+		now := time.Now()
+		token.RevokedAt = &now
+	}
+	return true, nil
+}
+
+// EnrollAgent consumes the bootstrap token hashing to bootstrapHash and stores credential
+// for agentID under the same lock, so a bootstrap token is never exchanged twice.
+func (s *MemoryStore) EnrollAgent(ctx context.Context, bootstrapHash []byte, agentID string, credential Token, credentialHash []byte) (Token, error) {
+	if err := credential.Validate(); err != nil {
+		return Token{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bootstrap, ok := s.byHash[string(bootstrapHash)]
+	now := time.Now()
+	if !ok || bootstrap.Kind != TokenBootstrap || !bootstrap.Active(now) || !bootstrap.Allows(agentID) {
+		return Token{}, ErrTokenRejected
+	}
+
+	issued, err := s.insertToken(credential, credentialHash)
+	if err != nil {
+		return Token{}, err
+	}
+	bootstrap.UsedAt = &now
+	return issued, nil
+}
+
+// insertToken adds token; s.mu must be held for writing.
+func (s *MemoryStore) insertToken(token Token, hash []byte) (Token, error) {
+	if _, ok := s.tokens[token.ID]; ok {
+		return Token{}, fmt.Errorf("insert token: id %q already exists", token.ID)
+	}
+	if _, ok := s.byHash[string(hash)]; ok {
+		return Token{}, fmt.Errorf("insert token: hash already exists")
+	}
+	token.CreatedAt = time.Now()
+	stored := &memoryToken{Token: token, hash: string(hash)}
+	s.tokens[token.ID] = stored
+	s.byHash[stored.hash] = stored
+	return token, nil
+}
+
+// recordRing holds the newest capacity records of one agent in arrival order.
+type recordRing struct {
+	buf       []ringEntry
+	start     int // index of the oldest record once the ring is full
+	capacity  int
+	seq       uint64
+	collected map[int64]struct{} // CollectedAt of every record held, in Unix nanoseconds
+}
+
+// ringEntry is a stored record and its arrival sequence, which orders records collected
+// at the same instant.
+type ringEntry struct {
+	Record
+	seq uint64
+}
+
+func (e ringEntry) position() recordPosition {
+	return recordPosition{at: e.CollectedAt.UnixNano(), seq: e.seq}
+}
+
+// push appends record unless the ring holds one collected at the same instant, which a
+// replayed or retried sample would be.
+func (r *recordRing) push(record Record) {
+	at := record.CollectedAt.UnixNano()
+	if _, ok := r.collected[at]; ok {
+		return
+	}
+	r.collected[at] = struct{}{}
+	r.seq++
+	entry := ringEntry{Record: record, seq: r.seq}
+	if len(r.buf) < r.capacity {
+		r.buf = append(r.buf, entry)
+		return
+	}
+	delete(r.collected, r.buf[r.start].CollectedAt.UnixNano())
+	r.buf[r.start] = entry
+	r.start = (r.start + 1) % r.capacity
+}
+
+func (r *recordRing) len() int {
+	return len(r.buf)
+}
+
+// at returns the i-th oldest record.
+func (r *recordRing) at(i int) Record {
+	return r.entry(i).Record
+}
+
+func (r *recordRing) entry(i int) ringEntry {
+	return r.buf[(r.start+i)%len(r.buf)]
+}
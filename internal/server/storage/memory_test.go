@@ -1,3 +1,216 @@
 package storage
 
-// Legacy in-memory tests were dropped with the store removal to keep the package compiling.
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreKeepsNewestRecords(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore(3)
+	start := time.Unix(1700000000, 0)
+	for i := range 5 {
+		if err := store.Save(ctx, Record{AgentID: "a", CollectedAt: start.Add(time.Duration(i) * time.Second), CPUUsage: float64(i)}); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+	}
+
+	page, err := store.List(ctx, "a", RecordQuery{Order: OrderAsc})
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if got := cpuValues(page.Records); !slices.Equal(got, []float64{2, 3, 4}) {
+		t.Fatalf("list = %v, want [2 3 4]", got)
+	}
+
+	page, err = store.List(ctx, "a", RecordQuery{Limit: 2})
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if got := cpuValues(page.Records); !slices.Equal(got, []float64{4, 3}) {
+		t.Fatalf("list with limit = %v, want the newest [4 3]", got)
+	}
+
+	latest, ok, err := store.Latest(ctx, "a", nil)
+	if err != nil || !ok || latest.CPUUsage != 4 {
+		t.Fatalf("latest = %v, %v, %v; want cpu 4", latest.CPUUsage, ok, err)
+	}
+}
+
+func TestMemoryStoreLatestByCollectionTime(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore(10)
+	start := time.Unix(1700000000, 0)
+	// A replayed spool delivers older samples after newer ones.
+	for _, offset := range []int{5, 6, 1, 2} {
+		record := Record{AgentID: "a", CollectedAt: start.Add(time.Duration(offset) * time.Second), CPUUsage: float64(offset)}
+		if err := store.Save(ctx, record); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+	}
+
+	latest, ok, err := store.Latest(ctx, "a", nil)
+	if err != nil || !ok || !latest.CollectedAt.Equal(start.Add(6*time.Second)) {
+		t.Fatalf("latest = %v, %v, %v; want the sample collected at +6s", latest.CollectedAt, ok, err)
+	}
+	if latest.CPUUsage != 6 {
+		t.Fatalf("latest cpu = %v, want 6", latest.CPUUsage)
+	}
+}
+
+func TestMemoryStoreSelectors(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore(10)
+	start := time.Unix(1700000000, 0)
+	saves := []Record{
+		{AgentID: "b", CollectedAt: start, CPUUsage: 1, Labels: Labels{"env": "prod"}},
+		{AgentID: "a", CollectedAt: start, CPUUsage: 2, Labels: Labels{"env": "dev"}},
+		{AgentID: "b", CollectedAt: start.Add(time.Second), CPUUsage: 3, Labels: Labels{"env": "dev"}},
+	}
+	for _, record := range saves {
+		if err := store.Save(ctx, record); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+	}
+
+	agents, err := store.Agents(ctx, nil)
+	if err != nil || !slices.Equal(agents, []string{"a", "b"}) {
+		t.Fatalf("agents = %v, %v; want [a b]", agents, err)
+	}
+	agents, err = store.Agents(ctx, Labels{"env": "prod"})
+	if err != nil || !slices.Equal(agents, []string{"b"}) {
+		t.Fatalf("prod agents = %v, %v; want [b]", agents, err)
+	}
+
+	latest, ok, err := store.Latest(ctx, "b", Labels{"env": "prod"})
+	if err != nil || !ok || latest.CPUUsage != 1 {
+		t.Fatalf("latest prod = %v, %v, %v; want cpu 1", latest.CPUUsage, ok, err)
+	}
+	if _, ok, _ := store.Latest(ctx, "a", Labels{"env": "prod"}); ok {
+		t.Fatal("latest matched a record with other labels")
+	}
+
+	page, err := store.List(ctx, "b", RecordQuery{Selector: Labels{"env": "dev"}})
+	if err != nil || !slices.Equal(cpuValues(page.Records), []float64{3}) {
+		t.Fatalf("list dev = %v, %v; want [3]", cpuValues(page.Records), err)
+	}
+}
+
+func TestMemoryStoreRejectsMissingAgent(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore(10)
+	if err := store.Save(ctx, Record{}); err == nil {
+		t.Fatal("save without agent id succeeded")
+	}
+	if _, err := store.List(ctx, "", RecordQuery{}); err == nil {
+		t.Fatal("list without agent id succeeded")
+	}
+}
+
+func TestMemoryStoreConcurrentSaves(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore(100)
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range 200 {
+				record := Record{AgentID: fmt.Sprintf("agent-%d", i%2), CollectedAt: time.Unix(0, int64(i*200+n))}
+				if err := store.Save(ctx, record); err != nil {
+					t.Errorf("save: %v", err)
+				}
+				store.Latest(ctx, "agent-0", nil)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, id := range []string{"agent-0", "agent-1"} {
+		page, err := store.List(ctx, id, RecordQuery{})
+		if err != nil || len(page.Records) != 100 {
+			t.Fatalf("%s kept %d records (%v), want 100", id, len(page.Records), err)
+		}
+	}
+}
+
+func TestMemoryStorePolicyVersions(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore(10)
+
+	first, err := store.SavePolicy(ctx, Policy{Name: "slow", Interval: "30s"})
+	if err != nil {
+		t.Fatalf("save policy: %v", err)
+	}
+	second, err := store.SavePolicy(ctx, Policy{Name: "slow", Interval: "1m"})
+	if err != nil {
+		t.Fatalf("save policy: %v", err)
+	}
+	if second.Version <= first.Version {
+		t.Fatalf("replaced policy version %d not greater than %d", second.Version, first.Version)
+	}
+	if _, err := store.SavePolicy(ctx, Policy{}); err == nil {
+		t.Fatal("saved a policy without a name")
+	}
+
+	policies, err := store.Policies(ctx)
+	if err != nil || len(policies) != 1 || policies[0].Interval != "1m" {
+		t.Fatalf("policies = %+v, %v; want the replaced policy", policies, err)
+	}
+	if found, _ := store.DeletePolicy(ctx, "slow"); !found {
+		t.Fatal("delete reported a missing policy")
+	}
+	if found, _ := store.DeletePolicy(ctx, "slow"); found {
+		t.Fatal("deleted a policy twice")
+	}
+}
+
+func TestMemoryStoreEnrollOnce(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore(10)
+	if _, err := store.CreateToken(ctx, Token{ID: "boot", Kind: TokenBootstrap, AgentID: "web-*"}, []byte("boot-hash")); err != nil {
+		t.Fatalf("create token: %v", err)
+	}
+
+	credential := Token{ID: "web-1-token", Kind: TokenAgent, AgentID: "web-1"}
+	if _, err := store.EnrollAgent(ctx, []byte("boot-hash"), "db-1", credential, []byte("cred-hash")); !errors.Is(err, ErrTokenRejected) {
+		t.Fatalf("enroll outside the token scope: %v, want ErrTokenRejected", err)
+	}
+	issued, err := store.EnrollAgent(ctx, []byte("boot-hash"), "web-1", credential, []byte("cred-hash"))
+	if err != nil {
+		t.Fatalf("enroll: %v", err)
+	}
+	if issued.CreatedAt.IsZero() {
+		t.Fatal("issued token has no creation time")
+	}
+
+	second := Token{ID: "web-1-token-2", Kind: TokenAgent, AgentID: "web-1"}
+	if _, err := store.EnrollAgent(ctx, []byte("boot-hash"), "web-1", second, []byte("cred-hash-2")); !errors.Is(err, ErrTokenRejected) {
+		t.Fatalf("second enrollment: %v, want ErrTokenRejected", err)
+	}
+
+	token, ok, err := store.TokenByHash(ctx, []byte("cred-hash"))
+	if err != nil || !ok || token.ID != "web-1-token" {
+		t.Fatalf("token by hash = %+v, %v, %v", token, ok, err)
+	}
+	if found, _ := store.RevokeToken(ctx, token.ID); !found {
+		t.Fatal("revoke reported a missing token")
+	}
+	token, _, _ = store.TokenByHash(ctx, []byte("cred-hash"))
+	if token.Active(time.Now()) {
+		t.Fatal("revoked token still active")
+	}
+}
+
+func cpuValues(records []Record) []float64 {
+	values := make([]float64, 0, len(records))
+	for _, record := range records {
+		values = append(values, record.CPUUsage)
+	}
+	return values
+}
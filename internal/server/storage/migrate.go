@@ -0,0 +1,426 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID is the key of the session advisory lock held while migrating, so
+// servers starting together and deploy pipelines never apply migrations concurrently.
+const migrationLockID = 0x74656c656d657472 // "telemetr"
+
+var migrationName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration is a numbered schema change of PostgresStore, embedded in the binary from
+// migrations/NNNN_name.up.sql and its matching .down.sql.
+type Migration struct {
+	Version int
+	Name    string
+	up      string
+	down    string
+	// finish, when set, completes the up script outside its transaction, for data
+	// changes too large for one.
+	finish func(ctx context.Context, db execQuerier) error
+	// resumed, when set, reports whether the up script already committed and an
+	// interrupted finish step is all that is left, for scripts that cannot run twice.
+	resumed func(ctx context.Context, db execQuerier) (bool, error)
+}
+
+// migrationStep completes a migration whose data changes run outside its script.
+type migrationStep struct {
+	finish  func(ctx context.Context, db execQuerier) error
+	resumed func(ctx context.Context, db execQuerier) (bool, error)
+}
+
+// migrationSteps are the finish steps of migrations by version.
+var migrationSteps = map[int]migrationStep{
+	2: {finish: backfillPayload},
+	4: {finish: moveLegacySamples, resumed: legacySamplesPending},
+}
+
+// MigrationState reports a migration and when it was applied, nil while it is pending.
+// Unknown is set for versions recorded in the database that this binary does not know,
+// which happens after rolling back to an older server.
+type MigrationState struct {
+	Migration
+	AppliedAt *time.Time
+	Unknown   bool
+}
+
+// Migrations returns the embedded migrations ordered by version.
+func Migrations() ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, fmt.Errorf("read migrations: %w", err)
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		match := migrationName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("migration %s: name must be NNNN_name.up.sql or NNNN_name.down.sql", entry.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+		raw, err := fs.ReadFile(migrationFiles, "migrations/"+entry.Name())
+		if err != nil {
+			return nil, fmt.Errorf("read migration %s: %w", entry.Name(), err)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d is named both %q and %q", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.up = string(raw)
+		} else {
+			m.down = string(raw)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration %04d_%s needs both an up and a down file", m.Version, m.Name)
+		}
+		step := migrationSteps[m.Version]
+		m.finish, m.resumed = step.finish, step.resumed
+		migrations = append(migrations, *m)
+	}
+	slices.SortFunc(migrations, func(a, b Migration) int { return a.Version - b.Version })
+	return migrations, nil
+}
+
+// LatestSchemaVersion returns the version the embedded migrations bring the schema to.
+func LatestSchemaVersion() (int, error) {
+	migrations, err := Migrations()
+	if err != nil || len(migrations) == 0 {
+		return 0, err
+	}
+	return migrations[len(migrations)-1].Version, nil
+}
+
+// MigrationStatus lists every known migration and every version recorded in the
+// database, ordered by version.
+func (s *PostgresStore) MigrationStatus(ctx context.Context) ([]MigrationState, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	if err := ensureMigrationsTable(ctx, s.db); err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(ctx, s.db)
+	if err != nil {
+		return nil, err
+	}
+
+	states := make([]MigrationState, 0, len(migrations))
+	for _, m := range migrations {
+		state := MigrationState{Migration: m}
+		if at, ok := applied[m.Version]; ok {
+			state.AppliedAt = &at
+			delete(applied, m.Version)
+		}
+		states = append(states, state)
+	}
+	for version, at := range applied {
+		states = append(states, MigrationState{Migration: Migration{Version: version}, AppliedAt: &at, Unknown: true})
+	}
+	slices.SortFunc(states, func(a, b MigrationState) int { return a.Version - b.Version })
+	return states, nil
+}
+
+// Migrate brings the schema to target: pending migrations up to target are applied in
+// ascending order, applied ones above it are reverted in descending order. Each
+// migration runs in its own transaction together with its schema_migrations entry, and
+// the whole run holds an advisory lock. A migration with a finish step is recorded only
+// once the step completes. It returns the migrations it ran, in order.
+func (s *PostgresStore) Migrate(ctx context.Context, target int) ([]Migration, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("acquire connection: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, int64(migrationLockID)); err != nil {
+		return nil, fmt.Errorf("acquire migration lock: %w", err)
+	}
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, int64(migrationLockID))
+
+	if err := ensureMigrationsTable(ctx, conn); err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	for version := range applied {
+		if version > target && !slices.ContainsFunc(migrations, func(m Migration) bool { return m.Version == version }) {
+			return nil, fmt.Errorf("cannot revert migration %d: it is unknown to this version of the server", version)
+		}
+	}
+
+	var ran []Migration
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; ok || m.Version > target {
+			continue
+		}
+		if err := applyMigration(ctx, conn, m); err != nil {
+			return ran, fmt.Errorf("apply migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+		ran = append(ran, m)
+	}
+	for _, m := range slices.Backward(migrations) {
+		if _, ok := applied[m.Version]; !ok || m.Version <= target {
+			continue
+		}
+		if err := runMigration(ctx, conn, m.down, `DELETE FROM schema_migrations WHERE version = $1 AND name = $2`, m); err != nil {
+			return ran, fmt.Errorf("revert migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+		ran = append(ran, m)
+	}
+	return ran, nil
+}
+
+// CheckSchema returns an error unless every embedded migration is applied and the
+// database knows no newer ones.
+func (s *PostgresStore) CheckSchema(ctx context.Context) error {
+	states, err := s.MigrationStatus(ctx)
+	if err != nil {
+		return err
+	}
+	for _, state := range states {
+		switch {
+		case state.Unknown:
+			return fmt.Errorf("database schema has migration %d, which this version of the server does not know", state.Version)
+		case state.AppliedAt == nil:
+			return fmt.Errorf("database schema is missing migration %04d_%s; run \"server migrate up\"", state.Version, state.Name)
+		}
+	}
+	return nil
+}
+
+// applyMigration runs the up script of m and records it. With a finish step the script
+// commits on its own and the step runs before the migration is recorded, so an
+// interrupted step runs again on the next migrate and picks up where it stopped; the
+// script is skipped then if m reports it resumed.
+func applyMigration(ctx context.Context, conn *sql.Conn, m Migration) error {
+	const record = `INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, now())`
+	if m.finish == nil {
+		return runMigration(ctx, conn, m.up, record, m)
+	}
+	resumed := false
+	if m.resumed != nil {
+		var err error
+		if resumed, err = m.resumed(ctx, conn); err != nil {
+			return err
+		}
+	}
+	if !resumed {
+		if err := runMigration(ctx, conn, m.up, "", m); err != nil {
+			return err
+		}
+	}
+	if err := m.finish(ctx, conn); err != nil {
+		return err
+	}
+	return runMigration(ctx, conn, "", record, m)
+}
+
+// runMigration runs script and the statement recording m in one transaction; either
+// may be empty.
+func runMigration(ctx context.Context, conn *sql.Conn, script, record string, m Migration) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if script != "" {
+		if _, err := tx.ExecContext(ctx, script); err != nil {
+			return err
+		}
+	}
+	if record != "" {
+		if _, err := tx.ExecContext(ctx, record, m.Version, m.Name); err != nil {
+			return fmt.Errorf("record version: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// payloadBackfillBatch is how many records backfillPayload converts per transaction.
+const payloadBackfillBatch = 5000
+
+// backfillPayload finishes 0002_typed_columns: it moves records written by earlier
+// versions, which kept every sample in a JSONB payload column, into the typed columns
+// and telemetry_values, then drops the column. Each batch commits on its own, so an
+// interrupted back-fill resumes where it stopped.
+func backfillPayload(ctx context.Context, db execQuerier) error {
+	for {
+		res, err := db.ExecContext(ctx, `
+			WITH batch AS (
+				SELECT id, payload FROM telemetry_records
+				WHERE payload IS NOT NULL
+				ORDER BY id
+				LIMIT $1
+				FOR UPDATE
+			), named AS (
+				INSERT INTO telemetry_values (record_id, name, value)
+				SELECT batch.id, v.key, v.value::double precision
+				FROM batch, jsonb_each_text(COALESCE(batch.payload->'values', '{}'::jsonb)) AS v
+				ON CONFLICT DO NOTHING
+			)
+			UPDATE telemetry_records r SET
+				cpu_usage = COALESCE((b.payload->>'cpuUsage')::double precision, 0),
+				memory_usage_bytes = COALESCE((b.payload->>'memoryUsageBytes')::numeric::bigint, 0),
+				memory_percent = COALESCE((b.payload->>'memoryPercent')::double precision, 0),
+				network_tx_bytes = COALESCE((b.payload->>'networkTxBytes')::numeric::bigint, 0),
+				network_rx_bytes = COALESCE((b.payload->>'networkRxBytes')::numeric::bigint, 0),
+				network_tx_rate = COALESCE((b.payload->>'networkTxRate')::double precision, 0),
+				network_rx_rate = COALESCE((b.payload->>'networkRxRate')::double precision, 0),
+				disk_read_bytes = COALESCE((b.payload->>'diskReadBytes')::numeric::bigint, 0),
+				disk_write_bytes = COALESCE((b.payload->>'diskWriteBytes')::numeric::bigint, 0),
+				disk_read_rate = COALESCE((b.payload->>'diskReadRate')::double precision, 0),
+				disk_write_rate = COALESCE((b.payload->>'diskWriteRate')::double precision, 0),
+				load_avg_1 = COALESCE((b.payload->>'loadAvg1')::double precision, 0),
+				load_avg_5 = COALESCE((b.payload->>'loadAvg5')::double precision, 0),
+				load_avg_15 = COALESCE((b.payload->>'loadAvg15')::double precision, 0),
+				payload = NULL
+			FROM batch b
+			WHERE r.id = b.id
+		`, payloadBackfillBatch)
+		if err != nil {
+			return fmt.Errorf("back-fill typed columns: %w", err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("back-fill typed columns: %w", err)
+		}
+		if n == 0 {
+			break
+		}
+	}
+
+	if _, err := db.ExecContext(ctx, `ALTER TABLE telemetry_records DROP COLUMN payload`); err != nil {
+		return fmt.Errorf("drop payload column: %w", err)
+	}
+	return nil
+}
+
+// legacyMoveBatch is how many records moveLegacySamples moves per transaction.
+const legacyMoveBatch = 5000
+
+// moveLegacySamples finishes 0004_partitioned_records: it moves the samples of the old
+// unpartitioned tables into the partitioned ones, deleting them as it goes, then drops
+// the old tables. Each batch commits on its own, so an interrupted move resumes where it
+// stopped.
+func moveLegacySamples(ctx context.Context, db execQuerier) error {
+	pending, err := legacySamplesPending(ctx, db)
+	if err != nil || !pending {
+		return err
+	}
+
+	for {
+		// Deleting a record cascades to its old values only once the statement ends, so
+		// the values are still there to be copied.
+		res, err := db.ExecContext(ctx, `
+			WITH batch AS (
+				DELETE FROM telemetry_records_unpartitioned
+				WHERE id IN (SELECT id FROM telemetry_records_unpartitioned ORDER BY id LIMIT $1)
+				RETURNING *
+			), named AS (
+				INSERT INTO telemetry_values (record_id, collected_at, name, value)
+				SELECT v.record_id, batch.collected_at, v.name, v.value
+				FROM telemetry_values_unpartitioned v JOIN batch ON batch.id = v.record_id
+			)
+			INSERT INTO telemetry_records (id, `+recordInsertColumns+`)
+			SELECT id, `+recordInsertColumns+` FROM batch
+		`, legacyMoveBatch)
+		if err != nil {
+			return fmt.Errorf("move samples: %w", err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("move samples: %w", err)
+		}
+		if n == 0 {
+			break
+		}
+	}
+
+	if _, err := db.ExecContext(ctx, `DROP TABLE telemetry_values_unpartitioned, telemetry_records_unpartitioned`); err != nil {
+		return fmt.Errorf("drop unpartitioned tables: %w", err)
+	}
+	return nil
+}
+
+// legacySamplesPending reports whether the unpartitioned tables 0004_partitioned_records
+// renamed are still there, that is whether its script ran but moveLegacySamples has not
+// finished.
+func legacySamplesPending(ctx context.Context, db execQuerier) (bool, error) {
+	var pending bool
+	if err := db.QueryRowContext(ctx, `SELECT to_regclass('telemetry_records_unpartitioned') IS NOT NULL`).Scan(&pending); err != nil {
+		return false, fmt.Errorf("find unpartitioned samples: %w", err)
+	}
+	return pending, nil
+}
+
+type execQuerier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func ensureMigrationsTable(ctx context.Context, db execQuerier) error {
+	if _, err := db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version BIGINT PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL
+		)
+	`); err != nil {
+		return fmt.Errorf("ensure schema_migrations table: %w", err)
+	}
+	return nil
+}
+
+func appliedMigrations(ctx context.Context, db execQuerier) (map[int]time.Time, error) {
+	rows, err := db.QueryContext(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("query schema_migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, fmt.Errorf("scan schema_migrations: %w", err)
+		}
+		applied[version] = at
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate schema_migrations: %w", err)
+	}
+	return applied, nil
+}
@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEmbeddedMigrations(t *testing.T) {
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatalf("load migrations: %v", err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("no migrations embedded")
+	}
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("migration %d has version %d; versions must be contiguous from 1", i, m.Version)
+		}
+		if strings.TrimSpace(m.up) == "" || strings.TrimSpace(m.down) == "" {
+			t.Errorf("migration %04d_%s has an empty up or down script", m.Version, m.Name)
+		}
+	}
+
+	for version := range migrationSteps {
+		if version < 1 || version > len(migrations) || migrations[version-1].finish == nil {
+			t.Errorf("finish step for migration %d is not attached to an embedded migration", version)
+		}
+	}
+
+	latest, err := LatestSchemaVersion()
+	if err != nil || latest != migrations[len(migrations)-1].Version {
+		t.Fatalf("latest version = %d, %v", latest, err)
+	}
+}
+
+// interruptedExec fails every statement after the first n, as if the server stopped.
+type interruptedExec struct {
+	execQuerier
+	n int
+}
+
+var errInterrupted = errors.New("interrupted")
+
+func (e *interruptedExec) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	if e.n == 0 {
+		return nil, errInterrupted
+	}
+	e.n--
+	return e.execQuerier.ExecContext(ctx, query, args...)
+}
+
+func TestPostgresPartitionMigrationResumes(t *testing.T) {
+	store := openEmptyTestPostgres(t)
+	ctx := context.Background()
+	if _, err := store.Migrate(ctx, 3); err != nil {
+		t.Fatalf("migrate to 3: %v", err)
+	}
+	// More than one batch, so the interruption leaves samples behind.
+	samples := legacyMoveBatch + 100
+	if _, err := store.db.ExecContext(ctx, `
+		INSERT INTO telemetry_records (agent_id, collected_at, cpu_usage)
+		SELECT 'a', now() - n * interval '1 second', n FROM generate_series(1, $1) n
+	`, samples); err != nil {
+		t.Fatalf("insert samples: %v", err)
+	}
+	if _, err := store.db.ExecContext(ctx, `INSERT INTO telemetry_values (record_id, name, value) SELECT id, 'queue_depth', cpu_usage FROM telemetry_records`); err != nil {
+		t.Fatalf("insert values: %v", err)
+	}
+
+	step := migrationSteps[4]
+	t.Cleanup(func() { migrationSteps[4] = step })
+	migrationSteps[4] = migrationStep{
+		finish: func(ctx context.Context, db execQuerier) error {
+			return step.finish(ctx, &interruptedExec{execQuerier: db, n: 1})
+		},
+		resumed: step.resumed,
+	}
+	if _, err := store.Migrate(ctx, 4); !errors.Is(err, errInterrupted) {
+		t.Fatalf("interrupted migrate = %v, want errInterrupted", err)
+	}
+	var left int
+	if err := store.db.QueryRowContext(ctx, `SELECT count(*) FROM telemetry_records_unpartitioned`).Scan(&left); err != nil {
+		t.Fatal(err)
+	}
+	if left != samples-legacyMoveBatch {
+		t.Fatalf("%d samples left unmoved, want %d", left, samples-legacyMoveBatch)
+	}
+
+	migrationSteps[4] = step
+	latest, err := LatestSchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Migrate(ctx, latest); err != nil {
+		t.Fatalf("resume migrate: %v", err)
+	}
+	var records, values int
+	if err := store.db.QueryRowContext(ctx, `SELECT (SELECT count(*) FROM telemetry_records), (SELECT count(*) FROM telemetry_values)`).Scan(&records, &values); err != nil {
+		t.Fatal(err)
+	}
+	if records != samples || values != samples {
+		t.Fatalf("%d records and %d values after the resumed move, want %d of each", records, values, samples)
+	}
+	if pending, err := legacySamplesPending(ctx, store.db); err != nil || pending {
+		t.Fatalf("unpartitioned tables still there: %v, %v", pending, err)
+	}
+}
+
+func TestPostgresBackfillPayload(t *testing.T) {
+	store := openEmptyTestPostgres(t)
+	ctx := context.Background()
+	if _, err := store.Migrate(ctx, 1); err != nil {
+		t.Fatalf("migrate to 1: %v", err)
+	}
+
+	at := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	full := Record{
+		AgentID: "a", CollectedAt: at, CPUUsage: 0.5, MemoryUsage: 17179869184, MemoryPercent: 40,
+		NetworkTxBytes: 1 << 40, NetworkRxRate: 12.5, DiskWriteBytes: 4096, LoadAvg15: 1.25,
+		Values: map[string]float64{"queue_depth": 3, "process.threads": 12},
+	}
+	payload, err := json.Marshal(full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.db.ExecContext(ctx, `INSERT INTO telemetry_records (agent_id, collected_at, payload, labels) VALUES ('a', $1, $2, '{"env":"prod"}')`, at, payload); err != nil {
+		t.Fatal(err)
+	}
+	// Older agents sent fewer fields; the missing ones become zero.
+	if _, err := store.db.ExecContext(ctx, `INSERT INTO telemetry_records (agent_id, collected_at, payload) VALUES ('a', $1, '{"cpuUsage": 0.75}')`, at.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	// Enough filler for a second batch, so the interruption leaves work behind.
+	if _, err := store.db.ExecContext(ctx, `
+		INSERT INTO telemetry_records (agent_id, collected_at, payload)
+		SELECT 'b', $1::timestamptz + n * interval '1 second', jsonb_build_object('cpuUsage', n) FROM generate_series(1, $2) n
+	`, at, payloadBackfillBatch); err != nil {
+		t.Fatal(err)
+	}
+
+	step := migrationSteps[2]
+	t.Cleanup(func() { migrationSteps[2] = step })
+	migrationSteps[2] = migrationStep{finish: func(ctx context.Context, db execQuerier) error {
+		return step.finish(ctx, &interruptedExec{execQuerier: db, n: 1})
+	}}
+	if _, err := store.Migrate(ctx, 2); !errors.Is(err, errInterrupted) {
+		t.Fatalf("interrupted migrate = %v, want errInterrupted", err)
+	}
+	var pending int
+	if err := store.db.QueryRowContext(ctx, `SELECT count(*) FROM telemetry_records WHERE payload IS NOT NULL`).Scan(&pending); err != nil {
+		t.Fatal(err)
+	}
+	if pending != 2 {
+		t.Fatalf("%d records left to back-fill after one batch, want 2", pending)
+	}
+
+	migrationSteps[2] = step
+	latest, err := LatestSchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Migrate(ctx, latest); err != nil {
+		t.Fatalf("resume migrate: %v", err)
+	}
+
+	page, err := store.List(ctx, "a", RecordQuery{Order: OrderAsc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Records) != 2 {
+		t.Fatalf("%d records of a after the back-fill, want 2", len(page.Records))
+	}
+	got := page.Records[0]
+	want := full
+	want.CollectedAt = got.CollectedAt
+	want.Labels = Labels{"env": "prod"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("back-filled record = %+v, want %+v", got, want)
+	}
+	if sparse := page.Records[1]; sparse.CPUUsage != 0.75 || sparse.MemoryUsage != 0 || len(sparse.Values) != 0 {
+		t.Fatalf("sparse record = %+v, want cpu 0.75 and zero elsewhere", sparse)
+	}
+	if page, err := store.List(ctx, "b", RecordQuery{Limit: payloadBackfillBatch}); err != nil || len(page.Records) != payloadBackfillBatch {
+		t.Fatalf("%d records of b after the back-fill (%v), want %d", len(page.Records), err, payloadBackfillBatch)
+	}
+}
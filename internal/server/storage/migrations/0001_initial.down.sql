@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS agent_tokens;
+DROP TABLE IF EXISTS agent_config_acks;
+DROP TABLE IF EXISTS agent_policies;
+DROP SEQUENCE IF EXISTS agent_policy_version_seq;
+DROP TABLE IF EXISTS telemetry_records;
@@ -0,0 +1,45 @@
+-- Schema created by ensureSchema before migrations existed. Every statement tolerates
+-- existing objects so databases from those versions adopt the migration history.
+CREATE TABLE IF NOT EXISTS telemetry_records (
+	id BIGSERIAL PRIMARY KEY,
+	agent_id TEXT NOT NULL,
+	collected_at TIMESTAMPTZ NOT NULL,
+	payload JSONB NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS telemetry_records_agent_collected_at_idx
+ON telemetry_records (agent_id, collected_at DESC, id DESC);
+
+ALTER TABLE telemetry_records
+ADD COLUMN IF NOT EXISTS labels JSONB NOT NULL DEFAULT '{}'::jsonb;
+
+CREATE INDEX IF NOT EXISTS telemetry_records_labels_idx
+ON telemetry_records USING GIN (labels jsonb_path_ops);
+
+CREATE SEQUENCE IF NOT EXISTS agent_policy_version_seq;
+
+CREATE TABLE IF NOT EXISTS agent_policies (
+	name TEXT PRIMARY KEY,
+	spec JSONB NOT NULL,
+	version BIGINT NOT NULL,
+	updated_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS agent_config_acks (
+	agent_id TEXT PRIMARY KEY,
+	version BIGINT NOT NULL,
+	error TEXT NOT NULL DEFAULT '',
+	acked_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS agent_tokens (
+	id TEXT PRIMARY KEY,
+	token_hash BYTEA NOT NULL UNIQUE,
+	kind TEXT NOT NULL,
+	agent_id TEXT NOT NULL,
+	description TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMPTZ NOT NULL,
+	expires_at TIMESTAMPTZ,
+	revoked_at TIMESTAMPTZ,
+	used_at TIMESTAMPTZ
+);
@@ -0,0 +1,43 @@
+-- Rebuild the JSONB payload from the typed columns and named values.
+ALTER TABLE telemetry_records ADD COLUMN payload JSONB;
+
+UPDATE telemetry_records r SET payload = jsonb_strip_nulls(jsonb_build_object(
+	'agentId', r.agent_id,
+	'collectedAt', r.collected_at,
+	'cpuUsage', r.cpu_usage,
+	'memoryUsageBytes', r.memory_usage_bytes,
+	'memoryPercent', r.memory_percent,
+	'networkTxBytes', r.network_tx_bytes,
+	'networkRxBytes', r.network_rx_bytes,
+	'networkTxRate', r.network_tx_rate,
+	'networkRxRate', r.network_rx_rate,
+	'diskReadBytes', r.disk_read_bytes,
+	'diskWriteBytes', r.disk_write_bytes,
+	'diskReadRate', r.disk_read_rate,
+	'diskWriteRate', r.disk_write_rate,
+	'loadAvg1', r.load_avg_1,
+	'loadAvg5', r.load_avg_5,
+	'loadAvg15', r.load_avg_15,
+	'labels', NULLIF(r.labels, '{}'::jsonb),
+	'values', (SELECT jsonb_object_agg(v.name, v.value) FROM telemetry_values v WHERE v.record_id = r.id)
+));
+
+ALTER TABLE telemetry_records ALTER COLUMN payload SET NOT NULL;
+
+DROP TABLE telemetry_values;
+
+ALTER TABLE telemetry_records
+DROP COLUMN cpu_usage,
+DROP COLUMN memory_usage_bytes,
+DROP COLUMN memory_percent,
+DROP COLUMN network_tx_bytes,
+DROP COLUMN network_rx_bytes,
+DROP COLUMN network_tx_rate,
+DROP COLUMN network_rx_rate,
+DROP COLUMN disk_read_bytes,
+DROP COLUMN disk_write_bytes,
+DROP COLUMN disk_read_rate,
+DROP COLUMN disk_write_rate,
+DROP COLUMN load_avg_1,
+DROP COLUMN load_avg_5,
+DROP COLUMN load_avg_15;
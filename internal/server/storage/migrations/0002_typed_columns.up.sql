@@ -0,0 +1,29 @@
+-- Add typed columns and a narrow name/value table for samples kept in the JSONB
+-- payload. Databases whose payload was already converted get an empty column back, so
+-- the back-fill step that follows this script (backfillPayload) applies to both; it
+-- moves the samples over in batches and drops the column.
+ALTER TABLE telemetry_records ADD COLUMN IF NOT EXISTS payload JSONB;
+ALTER TABLE telemetry_records ALTER COLUMN payload DROP NOT NULL;
+
+ALTER TABLE telemetry_records
+ADD COLUMN IF NOT EXISTS cpu_usage DOUBLE PRECISION NOT NULL DEFAULT 0,
+ADD COLUMN IF NOT EXISTS memory_usage_bytes BIGINT NOT NULL DEFAULT 0,
+ADD COLUMN IF NOT EXISTS memory_percent DOUBLE PRECISION NOT NULL DEFAULT 0,
+ADD COLUMN IF NOT EXISTS network_tx_bytes BIGINT NOT NULL DEFAULT 0,
+ADD COLUMN IF NOT EXISTS network_rx_bytes BIGINT NOT NULL DEFAULT 0,
+ADD COLUMN IF NOT EXISTS network_tx_rate DOUBLE PRECISION NOT NULL DEFAULT 0,
+ADD COLUMN IF NOT EXISTS network_rx_rate DOUBLE PRECISION NOT NULL DEFAULT 0,
+ADD COLUMN IF NOT EXISTS disk_read_bytes BIGINT NOT NULL DEFAULT 0,
+ADD COLUMN IF NOT EXISTS disk_write_bytes BIGINT NOT NULL DEFAULT 0,
+ADD COLUMN IF NOT EXISTS disk_read_rate DOUBLE PRECISION NOT NULL DEFAULT 0,
+ADD COLUMN IF NOT EXISTS disk_write_rate DOUBLE PRECISION NOT NULL DEFAULT 0,
+ADD COLUMN IF NOT EXISTS load_avg_1 DOUBLE PRECISION NOT NULL DEFAULT 0,
+ADD COLUMN IF NOT EXISTS load_avg_5 DOUBLE PRECISION NOT NULL DEFAULT 0,
+ADD COLUMN IF NOT EXISTS load_avg_15 DOUBLE PRECISION NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS telemetry_values (
+	record_id BIGINT NOT NULL REFERENCES telemetry_records (id) ON DELETE CASCADE,
+	name TEXT NOT NULL,
+	value DOUBLE PRECISION NOT NULL,
+	PRIMARY KEY (record_id, name)
+);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS telemetry_records_collected_at_idx;
+DROP TABLE IF EXISTS telemetry_rollup_state;
+DROP TABLE IF EXISTS telemetry_rollups;
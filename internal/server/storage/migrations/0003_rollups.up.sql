@@ -0,0 +1,31 @@
+-- Aggregates of every sample field and free-form value at coarser resolutions ("tiers"),
+-- kept by the server's rollup job. count/sum/min/max/last combine exactly, so each tier
+-- is built from the one below it and range queries merge rollups with raw samples.
+CREATE TABLE telemetry_rollups (
+	tier TEXT NOT NULL,
+	agent_id TEXT NOT NULL,
+	name TEXT NOT NULL,
+	bucket TIMESTAMPTZ NOT NULL,
+	labels JSONB NOT NULL,
+	sample_count BIGINT NOT NULL,
+	value_sum DOUBLE PRECISION NOT NULL,
+	value_min DOUBLE PRECISION NOT NULL,
+	value_max DOUBLE PRECISION NOT NULL,
+	value_last DOUBLE PRECISION NOT NULL,
+	last_at TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (tier, agent_id, name, bucket, labels)
+);
+
+CREATE INDEX telemetry_rollups_tier_bucket_idx ON telemetry_rollups (tier, bucket);
+
+-- Every bucket of a tier before its watermark has been rolled up; NULL until the first
+-- run finds data.
+CREATE TABLE telemetry_rollup_state (
+	tier TEXT PRIMARY KEY,
+	watermark TIMESTAMPTZ
+);
+
+INSERT INTO telemetry_rollup_state (tier) VALUES ('1m'), ('1h'), ('1d');
+
+-- Rollups and pruning scan raw samples by time across all agents.
+CREATE INDEX telemetry_records_collected_at_idx ON telemetry_records (collected_at);
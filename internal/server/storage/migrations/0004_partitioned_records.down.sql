@@ -0,0 +1,68 @@
+-- Copy samples back into plain tables linked by a foreign key.
+ALTER SEQUENCE telemetry_records_id_seq OWNED BY NONE;
+
+ALTER TABLE telemetry_records RENAME TO telemetry_records_partitioned;
+ALTER TABLE telemetry_records_partitioned RENAME CONSTRAINT telemetry_records_pkey TO telemetry_records_partitioned_pkey;
+ALTER TABLE telemetry_values RENAME TO telemetry_values_partitioned;
+ALTER TABLE telemetry_values_partitioned RENAME CONSTRAINT telemetry_values_pkey TO telemetry_values_partitioned_pkey;
+DROP INDEX telemetry_records_agent_collected_at_idx;
+DROP INDEX telemetry_records_labels_idx;
+DROP INDEX telemetry_records_collected_at_idx;
+
+CREATE TABLE telemetry_records (
+	id BIGINT PRIMARY KEY DEFAULT nextval('telemetry_records_id_seq'),
+	agent_id TEXT NOT NULL,
+	collected_at TIMESTAMPTZ NOT NULL,
+	labels JSONB NOT NULL DEFAULT '{}'::jsonb,
+	cpu_usage DOUBLE PRECISION NOT NULL DEFAULT 0,
+	memory_usage_bytes BIGINT NOT NULL DEFAULT 0,
+	memory_percent DOUBLE PRECISION NOT NULL DEFAULT 0,
+	network_tx_bytes BIGINT NOT NULL DEFAULT 0,
+	network_rx_bytes BIGINT NOT NULL DEFAULT 0,
+	network_tx_rate DOUBLE PRECISION NOT NULL DEFAULT 0,
+	network_rx_rate DOUBLE PRECISION NOT NULL DEFAULT 0,
+	disk_read_bytes BIGINT NOT NULL DEFAULT 0,
+	disk_write_bytes BIGINT NOT NULL DEFAULT 0,
+	disk_read_rate DOUBLE PRECISION NOT NULL DEFAULT 0,
+	disk_write_rate DOUBLE PRECISION NOT NULL DEFAULT 0,
+	load_avg_1 DOUBLE PRECISION NOT NULL DEFAULT 0,
+	load_avg_5 DOUBLE PRECISION NOT NULL DEFAULT 0,
+	load_avg_15 DOUBLE PRECISION NOT NULL DEFAULT 0
+);
+
+CREATE TABLE telemetry_values (
+	record_id BIGINT NOT NULL REFERENCES telemetry_records (id) ON DELETE CASCADE,
+	name TEXT NOT NULL,
+	value DOUBLE PRECISION NOT NULL,
+	PRIMARY KEY (record_id, name)
+);
+
+INSERT INTO telemetry_records (
+	id, agent_id, collected_at, labels, cpu_usage, memory_usage_bytes, memory_percent,
+	network_tx_bytes, network_rx_bytes, network_tx_rate, network_rx_rate,
+	disk_read_bytes, disk_write_bytes, disk_read_rate, disk_write_rate,
+	load_avg_1, load_avg_5, load_avg_15
+)
+SELECT
+	id, agent_id, collected_at, labels, cpu_usage, memory_usage_bytes, memory_percent,
+	network_tx_bytes, network_rx_bytes, network_tx_rate, network_rx_rate,
+	disk_read_bytes, disk_write_bytes, disk_read_rate, disk_write_rate,
+	load_avg_1, load_avg_5, load_avg_15
+FROM telemetry_records_partitioned;
+
+INSERT INTO telemetry_values (record_id, name, value)
+SELECT record_id, name, value FROM telemetry_values_partitioned;
+
+DROP TABLE telemetry_values_partitioned;
+DROP TABLE telemetry_records_partitioned;
+DROP TABLE telemetry_partitions;
+ALTER SEQUENCE telemetry_records_id_seq OWNED BY telemetry_records.id;
+
+CREATE INDEX telemetry_records_agent_collected_at_idx
+ON telemetry_records (agent_id, collected_at DESC, id DESC);
+
+CREATE INDEX telemetry_records_labels_idx
+ON telemetry_records USING GIN (labels jsonb_path_ops);
+
+CREATE INDEX telemetry_records_collected_at_idx
+ON telemetry_records (collected_at);
@@ -0,0 +1,97 @@
+-- Rebuild telemetry_records and telemetry_values partitioned by collected_at, so expired
+-- samples are dropped a partition at a time instead of deleted row by row. Existing
+-- samples go into one "legacy" partition ending after the newest of them; the server
+-- creates day or week partitions past it ahead of time and records every partition in
+-- telemetry_partitions. Samples outside every partition land in a default partition
+-- until theirs is created. When the timescaledb extension is installed both tables
+-- become hypertables chunked by day instead, and retention drops chunks.
+--
+-- This script only renames the old tables; the server's finish step moves their samples
+-- over in batches and drops them.
+--
+-- A foreign key into a partitioned table must include its partition key, so
+-- telemetry_values carries collected_at and is partitioned alongside telemetry_records
+-- without one: values are written in the same transaction as their record and dropped
+-- with the same partition.
+ALTER SEQUENCE telemetry_records_id_seq OWNED BY NONE;
+
+ALTER TABLE telemetry_records RENAME TO telemetry_records_unpartitioned;
+ALTER TABLE telemetry_records_unpartitioned RENAME CONSTRAINT telemetry_records_pkey TO telemetry_records_unpartitioned_pkey;
+ALTER TABLE telemetry_values RENAME TO telemetry_values_unpartitioned;
+ALTER TABLE telemetry_values_unpartitioned RENAME CONSTRAINT telemetry_values_pkey TO telemetry_values_unpartitioned_pkey;
+ALTER INDEX telemetry_records_agent_collected_at_idx RENAME TO telemetry_records_unpartitioned_agent_collected_at_idx;
+ALTER INDEX telemetry_records_labels_idx RENAME TO telemetry_records_unpartitioned_labels_idx;
+ALTER INDEX telemetry_records_collected_at_idx RENAME TO telemetry_records_unpartitioned_collected_at_idx;
+
+CREATE TABLE telemetry_partitions (
+	suffix TEXT PRIMARY KEY,
+	range_start TIMESTAMPTZ NOT NULL,
+	range_end TIMESTAMPTZ NOT NULL
+);
+
+DO $$
+DECLARE
+	timescale BOOLEAN := EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'timescaledb');
+	partitioning TEXT := CASE WHEN timescale THEN '' ELSE 'PARTITION BY RANGE (collected_at)' END;
+	legacy_end TIMESTAMPTZ;
+BEGIN
+	EXECUTE format($sql$
+		CREATE TABLE telemetry_records (
+			id BIGINT NOT NULL DEFAULT nextval('telemetry_records_id_seq'),
+			agent_id TEXT NOT NULL,
+			collected_at TIMESTAMPTZ NOT NULL,
+			labels JSONB NOT NULL DEFAULT '{}'::jsonb,
+			cpu_usage DOUBLE PRECISION NOT NULL DEFAULT 0,
+			memory_usage_bytes BIGINT NOT NULL DEFAULT 0,
+			memory_percent DOUBLE PRECISION NOT NULL DEFAULT 0,
+			network_tx_bytes BIGINT NOT NULL DEFAULT 0,
+			network_rx_bytes BIGINT NOT NULL DEFAULT 0,
+			network_tx_rate DOUBLE PRECISION NOT NULL DEFAULT 0,
+			network_rx_rate DOUBLE PRECISION NOT NULL DEFAULT 0,
+			disk_read_bytes BIGINT NOT NULL DEFAULT 0,
+			disk_write_bytes BIGINT NOT NULL DEFAULT 0,
+			disk_read_rate DOUBLE PRECISION NOT NULL DEFAULT 0,
+			disk_write_rate DOUBLE PRECISION NOT NULL DEFAULT 0,
+			load_avg_1 DOUBLE PRECISION NOT NULL DEFAULT 0,
+			load_avg_5 DOUBLE PRECISION NOT NULL DEFAULT 0,
+			load_avg_15 DOUBLE PRECISION NOT NULL DEFAULT 0,
+			PRIMARY KEY (id, collected_at)
+		) %s
+	$sql$, partitioning);
+	EXECUTE format($sql$
+		CREATE TABLE telemetry_values (
+			record_id BIGINT NOT NULL,
+			collected_at TIMESTAMPTZ NOT NULL,
+			name TEXT NOT NULL,
+			value DOUBLE PRECISION NOT NULL,
+			PRIMARY KEY (record_id, collected_at, name)
+		) %s
+	$sql$, partitioning);
+
+	IF timescale THEN
+		PERFORM create_hypertable('telemetry_records', 'collected_at', chunk_time_interval => interval '1 day');
+		PERFORM create_hypertable('telemetry_values', 'collected_at', chunk_time_interval => interval '1 day');
+		RETURN;
+	END IF;
+
+	SELECT greatest(date_trunc('day', now(), 'UTC'), date_trunc('day', max(collected_at), 'UTC')) + interval '1 day'
+	INTO legacy_end FROM telemetry_records_unpartitioned;
+	EXECUTE format('CREATE TABLE telemetry_records_legacy PARTITION OF telemetry_records FOR VALUES FROM (MINVALUE) TO (%L)', legacy_end);
+	EXECUTE format('CREATE TABLE telemetry_values_legacy PARTITION OF telemetry_values FOR VALUES FROM (MINVALUE) TO (%L)', legacy_end);
+	INSERT INTO telemetry_partitions (suffix, range_start, range_end) VALUES ('legacy', '-infinity', legacy_end);
+	-- Not listed in telemetry_partitions: it is never dropped, only pruned row by row.
+	CREATE TABLE telemetry_records_default PARTITION OF telemetry_records DEFAULT;
+	CREATE TABLE telemetry_values_default PARTITION OF telemetry_values DEFAULT;
+END
+$$;
+
+ALTER SEQUENCE telemetry_records_id_seq OWNED BY telemetry_records.id;
+
+CREATE INDEX telemetry_records_agent_collected_at_idx
+ON telemetry_records (agent_id, collected_at DESC, id DESC);
+
+CREATE INDEX telemetry_records_labels_idx
+ON telemetry_records USING GIN (labels jsonb_path_ops);
+
+CREATE INDEX telemetry_records_collected_at_idx
+ON telemetry_records (collected_at);
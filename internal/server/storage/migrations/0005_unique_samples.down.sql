@@ -0,0 +1,2 @@
+-- Allow an agent to store several samples collected at the same time again.
+DROP INDEX telemetry_records_agent_collected_at_key;
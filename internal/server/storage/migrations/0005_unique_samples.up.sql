@@ -0,0 +1,14 @@
+-- Identify a sample by its agent and collection time, so a batch written again because
+-- its commit was not acknowledged, or samples a relay replays, are stored once. Samples
+-- stored twice before are removed first, keeping the one written first.
+DELETE FROM telemetry_values v
+USING telemetry_records r, telemetry_records d
+WHERE v.record_id = r.id AND v.collected_at = r.collected_at
+	AND d.agent_id = r.agent_id AND d.collected_at = r.collected_at AND d.id < r.id;
+
+DELETE FROM telemetry_records r
+USING telemetry_records d
+WHERE d.agent_id = r.agent_id AND d.collected_at = r.collected_at AND d.id < r.id;
+
+CREATE UNIQUE INDEX telemetry_records_agent_collected_at_key
+ON telemetry_records (agent_id, collected_at);
@@ -0,0 +1,8 @@
+-- Samples stored after the 1-minute tier had rolled up their bucket, queued by the write
+-- that stored them. The rollup job merges them into every tier already past them and
+-- removes them from the queue in the same transaction.
+CREATE TABLE telemetry_rollup_late (
+	record_id BIGINT NOT NULL,
+	collected_at TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (record_id, collected_at)
+);
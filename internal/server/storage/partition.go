@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// PartitionIntervals lists the supported lengths of the raw sample partitions: a day or
+// a week. Partitions are aligned to UTC midnight and, for weeks, to Mondays.
+var PartitionIntervals = []time.Duration{24 * time.Hour, 7 * 24 * time.Hour}
+
+// partitionedTables are partitioned together by collected_at, the values of a record
+// always landing in the partition of the same range.
+var partitionedTables = []string{"telemetry_values", "telemetry_records"}
+
+// partitioned reports whether telemetry_records is natively partitioned; without it the
+// table is a TimescaleDB hypertable.
+func partitioned(ctx context.Context, q interface {
+	QueryRowContext(context.Context, string, ...any) *sql.Row
+}) (bool, error) {
+	var native bool
+	if err := q.QueryRowContext(ctx, `SELECT relkind = 'p' FROM pg_class WHERE oid = 'telemetry_records'::regclass`).Scan(&native); err != nil {
+		return false, fmt.Errorf("inspect telemetry_records: %w", err)
+	}
+	return native, nil
+}
+
+// partitionSpan is the range of one raw sample partition and the suffix naming its
+// tables.
+type partitionSpan struct {
+	suffix     string
+	start, end time.Time
+}
+
+// planPartitions returns the partitions, interval long, that follow one ending at from,
+// up to until. The first may be short to get back onto interval boundaries.
+func planPartitions(from, until time.Time, interval time.Duration) []partitionSpan {
+	var spans []partitionSpan
+	for start := from.UTC(); start.Before(until); {
+		end := start.Truncate(interval).Add(interval)
+		spans = append(spans, partitionSpan{suffix: "p" + start.Format("20060102"), start: start, end: end})
+		start = end
+	}
+	return spans
+}
+
+// expiredPartitions returns the suffixes of the partitions ending at or before before,
+// oldest first. A partition straddling before is kept whole until it expires entirely.
+func expiredPartitions(spans []partitionSpan, before time.Time) []string {
+	spans = slices.Clone(spans)
+	slices.SortFunc(spans, func(a, b partitionSpan) int { return a.end.Compare(b.end) })
+	var suffixes []string
+	for _, span := range spans {
+		if span.end.After(before) {
+			break
+		}
+		suffixes = append(suffixes, span.suffix)
+	}
+	return suffixes
+}
+
+// PreparePartitions creates the partitions, interval long, that raw samples collected
+// up to until will land in, and returns how many it created. Samples past the last
+// partition wait in the default partition and are moved into theirs once it is
+// created. Hypertables need no preparation: TimescaleDB creates chunks as samples
+// arrive.
+func (s *PostgresStore) PreparePartitions(ctx context.Context, until time.Time, interval time.Duration) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if native, err := partitioned(ctx, tx); err != nil || !native {
+		return 0, err
+	}
+	// Servers starting together would otherwise race to create the same partitions.
+	if _, err := tx.ExecContext(ctx, `LOCK TABLE telemetry_partitions IN EXCLUSIVE MODE`); err != nil {
+		return 0, fmt.Errorf("lock partitions: %w", err)
+	}
+	var last sql.NullTime
+	if err := tx.QueryRowContext(ctx, `SELECT max(range_end) FROM telemetry_partitions`).Scan(&last); err != nil {
+		return 0, fmt.Errorf("query partitions: %w", err)
+	}
+	start := time.Now().UTC().Truncate(interval)
+	if last.Valid {
+		start = last.Time.UTC()
+	}
+
+	spans := planPartitions(start, until, interval)
+	for _, span := range spans {
+		for _, table := range partitionedTables {
+			// A range can only be attached once the default partition holds none of it,
+			// so samples that arrived early move over first.
+			stmt := fmt.Sprintf(`
+				CREATE TABLE %[1]s (LIKE %[2]s INCLUDING DEFAULTS);
+				WITH moved AS (
+					DELETE FROM %[2]s_default WHERE collected_at >= '%[3]s' AND collected_at < '%[4]s' RETURNING *
+				)
+				INSERT INTO %[1]s SELECT * FROM moved;
+				ALTER TABLE %[2]s ATTACH PARTITION %[1]s FOR VALUES FROM ('%[3]s') TO ('%[4]s')`,
+				pgx.Identifier{table + "_" + span.suffix}.Sanitize(), table, span.start.Format(time.RFC3339), span.end.Format(time.RFC3339))
+			if _, err := tx.ExecContext(ctx, stmt); err != nil {
+				return 0, fmt.Errorf("create partition %s_%s: %w", table, span.suffix, err)
+			}
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO telemetry_partitions (suffix, range_start, range_end) VALUES ($1, $2, $3)`, span.suffix, span.start, span.end); err != nil {
+			return 0, fmt.Errorf("record partition %s: %w", span.suffix, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(spans), nil
+}
+
+// dropPartitions drops the raw sample partitions, or hypertable chunks, ending at or
+// before before, and deletes the expired samples of the default partitions in batches
+// of up to batch rows. A partition straddling before is kept whole until it expires
+// entirely.
+func (s *PostgresStore) dropPartitions(ctx context.Context, before time.Time, batch int) (PruneStats, error) {
+	native, err := partitioned(ctx, s.db)
+	if err != nil {
+		return PruneStats{}, err
+	}
+	var stats PruneStats
+	if !native {
+		for _, table := range partitionedTables {
+			var n int
+			if err := s.db.QueryRowContext(ctx, `SELECT count(*) FROM drop_chunks($1, older_than => $2::timestamptz)`, table, before).Scan(&n); err != nil {
+				return stats, fmt.Errorf("drop %s chunks: %w", table, err)
+			}
+			stats.Partitions += n
+		}
+		return stats, nil
+	}
+
+	if stats.Partitions, err = s.dropExpiredPartitions(ctx, before); err != nil {
+		return stats, err
+	}
+	for _, table := range partitionedTables {
+		n, err := s.deleteBatches(ctx, batch, `DELETE FROM `+table+`_default WHERE ctid IN (SELECT ctid FROM `+table+`_default WHERE collected_at < $1 LIMIT $2)`, before)
+		stats.Rows += n
+		if err != nil {
+			return stats, fmt.Errorf("prune %s_default: %w", table, err)
+		}
+	}
+	return stats, nil
+}
+
+// dropExpiredPartitions drops the native partitions ending at or before before and
+// returns how many it dropped.
+func (s *PostgresStore) dropExpiredPartitions(ctx context.Context, before time.Time) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `LOCK TABLE telemetry_partitions IN EXCLUSIVE MODE`); err != nil {
+		return 0, fmt.Errorf("lock partitions: %w", err)
+	}
+	// range_start is left out: the legacy partition starts at -infinity.
+	rows, err := tx.QueryContext(ctx, `SELECT suffix, range_end FROM telemetry_partitions`)
+	if err != nil {
+		return 0, fmt.Errorf("query partitions: %w", err)
+	}
+	var spans []partitionSpan
+	for rows.Next() {
+		var span partitionSpan
+		if err := rows.Scan(&span.suffix, &span.end); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("scan partition: %w", err)
+		}
+		spans = append(spans, span)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("iterate partitions: %w", err)
+	}
+
+	suffixes := expiredPartitions(spans, before)
+	for _, suffix := range suffixes {
+		for _, table := range partitionedTables {
+			if _, err := tx.ExecContext(ctx, `DROP TABLE IF EXISTS `+pgx.Identifier{table + "_" + suffix}.Sanitize()); err != nil {
+				return 0, fmt.Errorf("drop partition %s_%s: %w", table, suffix, err)
+			}
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM telemetry_partitions WHERE suffix = $1`, suffix); err != nil {
+			return 0, fmt.Errorf("forget partition %s: %w", suffix, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(suffixes), nil
+}
@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestPlanPartitions(t *testing.T) {
+	day, week := 24*time.Hour, 7*24*time.Hour
+	at := func(month time.Month, d, hour int) time.Time {
+		return time.Date(2024, month, d, hour, 0, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name        string
+		from, until time.Time
+		interval    time.Duration
+		want        []partitionSpan
+	}{
+		{
+			name: "daily up to a boundary", from: at(1, 1, 0), until: at(1, 3, 0), interval: day,
+			want: []partitionSpan{{"p20240101", at(1, 1, 0), at(1, 2, 0)}, {"p20240102", at(1, 2, 0), at(1, 3, 0)}},
+		},
+		{
+			name: "daily past a boundary", from: at(1, 1, 0), until: at(1, 2, 12), interval: day,
+			want: []partitionSpan{{"p20240101", at(1, 1, 0), at(1, 2, 0)}, {"p20240102", at(1, 2, 0), at(1, 3, 0)}},
+		},
+		{
+			// 2024-01-01 is a Monday.
+			name: "weekly from a Wednesday", from: at(1, 3, 0), until: at(1, 9, 0), interval: week,
+			want: []partitionSpan{{"p20240103", at(1, 3, 0), at(1, 8, 0)}, {"p20240108", at(1, 8, 0), at(1, 15, 0)}},
+		},
+		{
+			name: "named in UTC", from: time.Date(2024, 1, 2, 1, 0, 0, 0, time.FixedZone("CEST", 2*60*60)), until: at(1, 2, 0), interval: day,
+			want: []partitionSpan{{"p20240101", at(1, 1, 23), at(1, 2, 0)}},
+		},
+		{name: "nothing ahead", from: at(1, 3, 0), until: at(1, 2, 0), interval: day},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := planPartitions(tt.from, tt.until, tt.interval)
+			if !slices.EqualFunc(got, tt.want, func(a, b partitionSpan) bool {
+				return a.suffix == b.suffix && a.start.Equal(b.start) && a.end.Equal(b.end)
+			}) {
+				t.Fatalf("planPartitions = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpiredPartitions(t *testing.T) {
+	at := func(d int) time.Time { return time.Date(2024, 1, d, 0, 0, 0, 0, time.UTC) }
+	spans := []partitionSpan{
+		{suffix: "p20240102", end: at(3)},
+		{suffix: "legacy", end: at(1)},
+		{suffix: "p20240101", end: at(2)},
+	}
+	tests := []struct {
+		before time.Time
+		want   []string
+	}{
+		{at(1).Add(-time.Second), nil},
+		{at(2).Add(12 * time.Hour), []string{"legacy", "p20240101"}},
+		{at(3), []string{"legacy", "p20240101", "p20240102"}},
+	}
+	for _, tt := range tests {
+		if got := expiredPartitions(spans, tt.before); !slices.Equal(got, tt.want) {
+			t.Errorf("expiredPartitions(%s) = %v, want %v", tt.before.Format(time.DateTime), got, tt.want)
+		}
+	}
+}
+
+func TestPostgresDefaultPartition(t *testing.T) {
+	store := openTestPostgres(t)
+	ctx := context.Background()
+
+	// Collected past the prepared partitions, as by an agent whose clock runs ahead.
+	at := time.Now().UTC().Add(10 * 24 * time.Hour)
+	record := Record{AgentID: "a", CollectedAt: at, CPUUsage: 1, Values: map[string]float64{"queue_depth": 2}}
+	if err := store.SaveBatch(ctx, []Record{record}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if _, err := store.PreparePartitions(ctx, at.Add(24*time.Hour), 24*time.Hour); err != nil {
+		t.Fatalf("prepare partitions: %v", err)
+	}
+
+	suffix := "p" + at.Truncate(24*time.Hour).Format("20060102")
+	for _, table := range partitionedTables {
+		var partition string
+		if err := store.db.QueryRowContext(ctx, `SELECT tableoid::regclass::text FROM `+table).Scan(&partition); err != nil {
+			t.Fatalf("find %s: %v", table, err)
+		}
+		if partition != table+"_"+suffix {
+			t.Fatalf("%s row is in %s, want %s_%s", table, partition, table, suffix)
+		}
+	}
+}
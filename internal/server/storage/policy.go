@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Policy is remote agent configuration pushed by the server. It targets either a single
+// agent (AgentID) or every agent whose labels match Selector; unset fields leave the
+// agent's local settings alone.
+type Policy struct {
+	Name         string    `json:"name"`
+	AgentID      string    `json:"agentId,omitempty"`
+	Selector     Labels    `json:"selector,omitempty"`
+	Priority     int       `json:"priority"`
+	Interval     string    `json:"interval,omitempty"`
+	Collectors   []string  `json:"collectors,omitempty"`
+	ProbeTargets []string  `json:"probeTargets,omitempty"`
+	Version      uint64    `json:"version"`
+	UpdatedAt    time.Time `json:"updatedAt"`
+}
+
+// Validate checks the fields an operator can set.
+func (p Policy) Validate() error {
+	var errs []error
+	if p.Name == "" {
+		errs = append(errs, errors.New("name must be provided"))
+	}
+	if p.AgentID != "" && len(p.Selector) > 0 {
+		errs = append(errs, errors.New("agentId and selector are mutually exclusive"))
+	}
+	if p.Interval != "" {
+		if interval, err := time.ParseDuration(p.Interval); err != nil {
+			errs = append(errs, fmt.Errorf("interval: %w", err))
+		} else if interval <= 0 {
+			errs = append(errs, fmt.Errorf("interval must be positive, got %s", interval))
+		}
+	}
+	for _, target := range p.ProbeTargets {
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			errs = append(errs, fmt.Errorf("probe target %q: %w", target, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ConfigAck records the remote configuration version an agent last reported.
+type ConfigAck struct {
+	AgentID string    `json:"agentId"`
+	Version uint64    `json:"version"`
+	Error   string    `json:"error,omitempty"`
+	AckedAt time.Time `json:"ackedAt"`
+}
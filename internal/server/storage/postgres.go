@@ -3,19 +3,27 @@ package storage
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"strings"
+	"time"
 
-	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/stdlib"
 )
 
-// PostgresStore offers a tiny JSONB-backed persistence layer for telemetry records.
+// PostgresStore persists telemetry records in typed columns, with the free-form values of
+// each sample in a narrow name/value table, so aggregates can be computed in the database.
 type PostgresStore struct {
 	db *sql.DB
 }
 
-// NewPostgresStore opens the database connection, ensures the schema, and returns a store.
+// NewPostgresStore opens the database connection and returns a store. The schema is
+// managed by migrations: call Migrate or CheckSchema before using the store.
 func NewPostgresStore(ctx context.Context, dsn string) (*PostgresStore, error) {
 	db, err := sql.Open("pgx", dsn)
 	if err != nil {
@@ -27,13 +35,7 @@ func NewPostgresStore(ctx context.Context, dsn string) (*PostgresStore, error) {
 		return nil, fmt.Errorf("ping postgres: %w", err)
 	}
 
-	store := &PostgresStore{db: db}
-	if err := store.ensureSchema(ctx); err != nil {
-		db.Close()
-		return nil, err
-	}
-
-	return store, nil
+	return &PostgresStore{db: db}, nil
 }
 
 // Close releases the underlying connection pool.
@@ -41,100 +43,362 @@ func (s *PostgresStore) Close() error {
 	return s.db.Close()
 }
 
-// Save writes a telemetry record to the database.
+// Save writes a telemetry record and its named values to the database, unless the agent
+// already has a record collected at the same time. A record collected before the
+// rollup watermark is queued for the rollup job to merge in.
 func (s *PostgresStore) Save(ctx context.Context, record Record) error {
 	if record.AgentID == "" {
-		return errors.New("record missing agent id")
+		return errMissingAgentID
 	}
 
-	payload, err := json.Marshal(record)
+	labels, err := encodeLabels(record.Labels)
 	if err != nil {
-		return fmt.Errorf("marshal record: %w", err)
+		return err
 	}
 
-	if _, err := s.db.ExecContext(ctx,
-		`INSERT INTO telemetry_records (agent_id, collected_at, payload) VALUES ($1, $2, $3)`,
-		record.AgentID, record.CollectedAt, payload,
+	names := make([]string, 0, len(record.Values))
+	values := make([]float64, 0, len(record.Values))
+	for name, value := range record.Values {
+		names = append(names, name)
+		values = append(values, value)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin record: %w", err)
+	}
+	defer tx.Rollback()
+
+	var watermark sql.NullTime
+	if err := tx.QueryRowContext(ctx, lockRollupWatermark, Tiers[0].Name).Scan(&watermark); err != nil {
+		return fmt.Errorf("read rollup watermark: %w", err)
+	}
+	// Data-modifying CTEs always run to completion, so the record is inserted even when
+	// it carries no named values.
+	if _, err := tx.ExecContext(ctx, `
+		WITH record AS (
+			INSERT INTO telemetry_records (`+recordInsertColumns+`)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
+			ON CONFLICT (agent_id, collected_at) DO NOTHING
+			RETURNING id
+		), late AS (
+			INSERT INTO telemetry_rollup_late (record_id, collected_at)
+			SELECT record.id, $2 FROM record WHERE $2 < $20::timestamptz
+		)
+		INSERT INTO telemetry_values (record_id, collected_at, name, value)
+		SELECT record.id, $2, v.name, v.value FROM record, unnest($18::text[], $19::double precision[]) AS v(name, value)
+	`,
+		record.AgentID, record.CollectedAt, record.CPUUsage, int64(record.MemoryUsage), record.MemoryPercent,
+		int64(record.NetworkTxBytes), int64(record.NetworkRxBytes), record.NetworkTxRate, record.NetworkRxRate,
+		int64(record.DiskReadBytes), int64(record.DiskWriteBytes), record.DiskReadRate, record.DiskWriteRate,
+		record.LoadAvg1, record.LoadAvg5, record.LoadAvg15, labels,
+		names, values, watermark,
 	); err != nil {
 		return fmt.Errorf("insert record: %w", err)
 	}
-
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit record: %w", err)
+	}
 	return nil
 }
 
-// List retrieves historical records for a given agent ordered oldest to newest.
-func (s *PostgresStore) List(ctx context.Context, agentID string, limit int) ([]Record, error) {
-	if agentID == "" {
-		return nil, errors.New("agent id must be provided")
+// lockRollupWatermark reads the watermark of the tier named $1 and keeps the rollup job
+// from advancing it until the writing transaction ends. Either the job's next chunk sees
+// the records written, or the write sees the advanced watermark and queues the ones
+// collected before it in telemetry_rollup_late.
+const lockRollupWatermark = `SELECT watermark FROM telemetry_rollup_state WHERE tier = $1 FOR SHARE`
+
+// SaveBatch writes records and their named values in one transaction. They are copied
+// into staging tables first and moved over with ON CONFLICT DO NOTHING, so records the
+// database already holds, such as those of a batch retried after its commit was lost,
+// are skipped along with their values. Record ids are drawn from the table's sequence
+// up front so the values can reference them. Like Save, it queues records collected
+// before the rollup watermark for the rollup job.
+func (s *PostgresStore) SaveBatch(ctx context.Context, records []Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+	rows := make([][]any, len(records))
+	for i, record := range records {
+		if record.AgentID == "" {
+			return errMissingAgentID
+		}
+		labels, err := encodeLabels(record.Labels)
+		if err != nil {
+			return err
+		}
+		rows[i] = []any{
+			nil, record.AgentID, record.CollectedAt, record.CPUUsage, int64(record.MemoryUsage), record.MemoryPercent,
+			int64(record.NetworkTxBytes), int64(record.NetworkRxBytes), record.NetworkTxRate, record.NetworkRxRate,
+			int64(record.DiskReadBytes), int64(record.DiskWriteBytes), record.DiskReadRate, record.DiskWriteRate,
+			record.LoadAvg1, record.LoadAvg5, record.LoadAvg15, labels,
+		}
 	}
 
-	query := `SELECT payload FROM telemetry_records WHERE agent_id = $1 ORDER BY collected_at ASC, id ASC`
-	var rows *sql.Rows
-	var err error
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("acquire connection: %w", err)
+	}
+	defer conn.Close()
 
-	if limit > 0 {
-		query += " LIMIT $2"
-		rows, err = s.db.QueryContext(ctx, query, agentID, limit)
-	} else {
-		rows, err = s.db.QueryContext(ctx, query, agentID)
+	return conn.Raw(func(driverConn any) error {
+		tx, err := driverConn.(*stdlib.Conn).Conn().Begin(ctx)
+		if err != nil {
+			return fmt.Errorf("begin batch: %w", err)
+		}
+		defer tx.Rollback(ctx)
+
+		var watermark *time.Time
+		if err := tx.QueryRow(ctx, lockRollupWatermark, Tiers[0].Name).Scan(&watermark); err != nil {
+			return fmt.Errorf("read rollup watermark: %w", err)
+		}
+		ids, err := tx.Query(ctx, `SELECT nextval(pg_get_serial_sequence('telemetry_records', 'id')) FROM generate_series(1, $1)`, len(records))
+		if err != nil {
+			return fmt.Errorf("allocate record ids: %w", err)
+		}
+		var values [][]any
+		for i := 0; ids.Next(); i++ {
+			var id int64
+			if err := ids.Scan(&id); err != nil {
+				return fmt.Errorf("allocate record ids: %w", err)
+			}
+			rows[i][0] = id
+			for name, value := range records[i].Values {
+				values = append(values, []any{id, records[i].CollectedAt, name, value})
+			}
+		}
+		if err := ids.Err(); err != nil {
+			return fmt.Errorf("allocate record ids: %w", err)
+		}
+
+		// The staging tables live as long as the connection and are emptied on commit.
+		if _, err := tx.Exec(ctx, `
+			CREATE TEMPORARY TABLE IF NOT EXISTS telemetry_records_staging
+			(LIKE telemetry_records INCLUDING DEFAULTS) ON COMMIT DELETE ROWS;
+			CREATE TEMPORARY TABLE IF NOT EXISTS telemetry_values_staging
+			(LIKE telemetry_values) ON COMMIT DELETE ROWS
+		`); err != nil {
+			return fmt.Errorf("create staging tables: %w", err)
+		}
+		columns := append([]string{"id"}, recordColumns...)
+		if _, err := tx.CopyFrom(ctx, pgx.Identifier{"telemetry_records_staging"}, columns, pgx.CopyFromRows(rows)); err != nil {
+			return fmt.Errorf("copy records: %w", err)
+		}
+		if _, err := tx.CopyFrom(ctx, pgx.Identifier{"telemetry_values_staging"}, []string{"record_id", "collected_at", "name", "value"}, pgx.CopyFromRows(values)); err != nil {
+			return fmt.Errorf("copy values: %w", err)
+		}
+		if _, err := tx.Exec(ctx, `
+			WITH inserted AS (
+				INSERT INTO telemetry_records (id, `+recordInsertColumns+`)
+				SELECT id, `+recordInsertColumns+` FROM telemetry_records_staging ORDER BY id
+				ON CONFLICT (agent_id, collected_at) DO NOTHING
+				RETURNING id, collected_at
+			), late AS (
+				INSERT INTO telemetry_rollup_late (record_id, collected_at)
+				SELECT id, collected_at FROM inserted WHERE collected_at < $1::timestamptz
+			)
+			INSERT INTO telemetry_values (record_id, collected_at, name, value)
+			SELECT v.record_id, v.collected_at, v.name, v.value
+			FROM telemetry_values_staging v JOIN inserted ON inserted.id = v.record_id
+		`, watermark); err != nil {
+			return fmt.Errorf("insert records: %w", err)
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return fmt.Errorf("commit batch: %w", err)
+		}
+		return nil
+	})
+}
+
+// List retrieves a page of an agent's historical records selected by query.
+func (s *PostgresStore) List(ctx context.Context, agentID string, query RecordQuery) (RecordPage, error) {
+	if agentID == "" {
+		return RecordPage{}, errAgentRequired
+	}
+	if err := query.Validate(); err != nil {
+		return RecordPage{}, err
 	}
+
+	args := []any{agentID}
+	stmt := `SELECT ` + recordSelectColumns + `, r.id FROM telemetry_records r WHERE agent_id = $1`
+	if len(query.Selector) > 0 {
+		filter, err := encodeLabels(query.Selector)
+		if err != nil {
+			return RecordPage{}, err
+		}
+		args = append(args, filter)
+		stmt += fmt.Sprintf(" AND labels @> $%d", len(args))
+	}
+	if !query.From.IsZero() {
+		args = append(args, query.From)
+		stmt += fmt.Sprintf(" AND collected_at >= $%d", len(args))
+	}
+	if !query.To.IsZero() {
+		args = append(args, query.To)
+		stmt += fmt.Sprintf(" AND collected_at < $%d", len(args))
+	}
+	direction, compare := "DESC", "<"
+	if query.Order == OrderAsc {
+		direction, compare = "ASC", ">"
+	}
+	if cursor, _ := decodeCursor(query.Cursor); cursor != nil {
+		args = append(args, time.Unix(0, cursor.at), int64(cursor.seq))
+		stmt += fmt.Sprintf(" AND (collected_at, id) %s ($%d, $%d)", compare, len(args)-1, len(args))
+	}
+	stmt += fmt.Sprintf(" ORDER BY collected_at %s, id %s", direction, direction)
+	if query.Limit > 0 {
+		// One extra row tells whether there is a next page.
+		args = append(args, query.Limit+1)
+		stmt += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+
+	rows, err := s.db.QueryContext(ctx, stmt, args...)
 	if err != nil {
-		return nil, fmt.Errorf("query history: %w", err)
+		return RecordPage{}, fmt.Errorf("query history: %w", err)
 	}
 	defer rows.Close()
 
 	records := make([]Record, 0)
+	var positions []recordPosition
 	for rows.Next() {
-		var raw []byte
-		if err := rows.Scan(&raw); err != nil {
-			return nil, fmt.Errorf("scan payload: %w", err)
+		var id int64
+		record, err := scanRecord(rows, &id)
+		if err != nil {
+			return RecordPage{}, err
+		}
+		records = append(records, record)
+		positions = append(positions, recordPosition{at: record.CollectedAt.UnixNano(), seq: uint64(id)})
+	}
+	if err := rows.Err(); err != nil {
+		return RecordPage{}, fmt.Errorf("iterate history: %w", err)
+	}
+
+	return query.page(records, positions), nil
+}
+
+// QueryRange resamples one metric of an agent in SQL, binning samples into steps with
+// date_bin so only the aggregates leave the database. Queries a rollup tier can answer
+// read it instead of the raw samples.
+func (s *PostgresStore) QueryRange(ctx context.Context, agentID string, query RangeQuery) ([]Point, error) {
+	if agentID == "" {
+		return nil, errAgentRequired
+	}
+	if err := query.Validate(); err != nil {
+		return nil, err
+	}
+	if tier, ok := rollupTier(query); ok {
+		return s.queryRollups(ctx, agentID, query, tier)
+	}
+
+	args := []any{agentID, query.Step.Microseconds(), query.From, query.To}
+	value, from := "v.value", "telemetry_records r"
+	if column, ok := metricColumns[query.Metric]; ok {
+		value = "r." + column
+	} else {
+		args = append(args, query.Metric)
+		from += fmt.Sprintf(" JOIN telemetry_values v ON v.record_id = r.id AND v.collected_at = r.collected_at AND v.name = $%d", len(args))
+	}
+	stmt := fmt.Sprintf(`SELECT date_bin($2::double precision * interval '1 microsecond', r.collected_at, $3) AS bucket, %s
+		FROM %s WHERE r.agent_id = $1 AND r.collected_at >= $3 AND r.collected_at < $4`,
+		aggregateSQL(query.Agg, value+"::double precision"), from)
+	if len(query.Selector) > 0 {
+		filter, err := encodeLabels(query.Selector)
+		if err != nil {
+			return nil, err
 		}
+		args = append(args, filter)
+		stmt += fmt.Sprintf(" AND r.labels @> $%d", len(args))
+	}
+	stmt += " GROUP BY bucket ORDER BY bucket"
+
+	return s.queryPoints(ctx, stmt, args...)
+}
+
+// queryPoints runs a range query returning (bucket, value) rows.
+func (s *PostgresStore) queryPoints(ctx context.Context, stmt string, args ...any) ([]Point, error) {
+	rows, err := s.db.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query range: %w", err)
+	}
+	defer rows.Close()
 
-		var record Record
-		if err := json.Unmarshal(raw, &record); err != nil {
-			return nil, fmt.Errorf("decode payload: %w", err)
+	points := make([]Point, 0)
+	for rows.Next() {
+		var point Point
+		if err := rows.Scan(&point.Time, &point.Value); err != nil {
+			return nil, fmt.Errorf("scan range: %w", err)
 		}
-		records = append(records, record)
+		points = append(points, point)
 	}
 	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("iterate history: %w", err)
+		return nil, fmt.Errorf("iterate range: %w", err)
 	}
+	return points, nil
+}
 
-	return records, nil
+// aggregateSQL returns the SQL aggregate computing agg over value, as double precision.
+func aggregateSQL(agg Aggregation, value string) string {
+	switch agg {
+	case AggMin, AggMax, AggSum, AggAvg:
+		return fmt.Sprintf("%s(%s)", agg, value)
+	case AggCount:
+		return fmt.Sprintf("count(%s)::double precision", value)
+	case AggLast:
+		return fmt.Sprintf("(array_agg(%s ORDER BY r.collected_at DESC, r.id DESC))[1]", value)
+	case AggP50:
+		return fmt.Sprintf("percentile_cont(0.5) WITHIN GROUP (ORDER BY %s)", value)
+	case AggP95:
+		return fmt.Sprintf("percentile_cont(0.95) WITHIN GROUP (ORDER BY %s)", value)
+	default: // AggP99
+		return fmt.Sprintf("percentile_cont(0.99) WITHIN GROUP (ORDER BY %s)", value)
+	}
 }
 
-// Latest returns the newest record for an agent when available.
-func (s *PostgresStore) Latest(ctx context.Context, agentID string) (Record, bool, error) {
+// Latest returns the newest record for an agent whose labels match selector when available.
+func (s *PostgresStore) Latest(ctx context.Context, agentID string, selector Labels) (Record, bool, error) {
 	if agentID == "" {
-		return Record{}, false, errors.New("agent id must be provided")
+		return Record{}, false, errAgentRequired
 	}
 
-	var raw []byte
-	if err := s.db.QueryRowContext(ctx,
-		`SELECT payload FROM telemetry_records WHERE agent_id = $1 ORDER BY collected_at DESC, id DESC LIMIT 1`,
-		agentID,
-	).Scan(&raw); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return Record{}, false, nil
+	args := []any{agentID}
+	query := `SELECT ` + recordSelectColumns + ` FROM telemetry_records r WHERE agent_id = $1`
+	if len(selector) > 0 {
+		filter, err := encodeLabels(selector)
+		if err != nil {
+			return Record{}, false, err
 		}
-		return Record{}, false, fmt.Errorf("query latest: %w", err)
+		args = append(args, filter)
+		query += " AND labels @> $2"
 	}
+	query += " ORDER BY collected_at DESC, id DESC LIMIT 1"
 
-	var record Record
-	if err := json.Unmarshal(raw, &record); err != nil {
-		return Record{}, false, fmt.Errorf("decode payload: %w", err)
+	record, err := scanRecord(s.db.QueryRowContext(ctx, query, args...))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Record{}, false, nil
+	}
+	if err != nil {
+		return Record{}, false, fmt.Errorf("query latest: %w", err)
 	}
 
 	return record, true, nil
 }
 
-// Agents lists distinct agent identifiers that have persisted data.
-func (s *PostgresStore) Agents(ctx context.Context) ([]string, error) {
-	rows, err := s.db.QueryContext(ctx, `
-		SELECT DISTINCT agent_id
-		FROM telemetry_records
-		ORDER BY agent_id ASC
-	`)
+// Agents lists distinct agent identifiers that have persisted data carrying labels that
+// match selector.
+func (s *PostgresStore) Agents(ctx context.Context, selector Labels) ([]string, error) {
+	var args []any
+	query := `SELECT DISTINCT agent_id FROM telemetry_records`
+	if len(selector) > 0 {
+		filter, err := encodeLabels(selector)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, filter)
+		query += " WHERE labels @> $1"
+	}
+	query += " ORDER BY agent_id ASC"
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("query agents: %w", err)
 	}
@@ -155,24 +419,321 @@ func (s *PostgresStore) Agents(ctx context.Context) ([]string, error) {
 	return agents, nil
 }
 
-func (s *PostgresStore) ensureSchema(ctx context.Context) error {
-	if _, err := s.db.ExecContext(ctx, `
-		CREATE TABLE IF NOT EXISTS telemetry_records (
-			id BIGSERIAL PRIMARY KEY,
-			agent_id TEXT NOT NULL,
-			collected_at TIMESTAMPTZ NOT NULL,
-			payload JSONB NOT NULL
-		)
-	`); err != nil {
-		return fmt.Errorf("ensure schema: %w", err)
+// Policies returns every remote configuration policy ordered by name.
+func (s *PostgresStore) Policies(ctx context.Context) ([]Policy, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT spec, version, updated_at FROM agent_policies ORDER BY name ASC`)
+	if err != nil {
+		return nil, fmt.Errorf("query policies: %w", err)
 	}
+	defer rows.Close()
 
-	if _, err := s.db.ExecContext(ctx, `
-		CREATE INDEX IF NOT EXISTS telemetry_records_agent_collected_at_idx
-		ON telemetry_records (agent_id, collected_at DESC, id DESC)
-	`); err != nil {
-		return fmt.Errorf("ensure index: %w", err)
+	policies := make([]Policy, 0)
+	for rows.Next() {
+		var raw []byte
+		var policy Policy
+		var version int64
+		if err := rows.Scan(&raw, &version, &policy.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("scan policy: %w", err)
+		}
+		if err := json.Unmarshal(raw, &policy); err != nil {
+			return nil, fmt.Errorf("decode policy: %w", err)
+		}
+		policy.Version = uint64(version)
+		policies = append(policies, policy)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate policies: %w", err)
 	}
 
+	return policies, nil
+}
+
+// SavePolicy creates or replaces a policy, assigning it a new version that is greater
+// than any version handed out before.
+func (s *PostgresStore) SavePolicy(ctx context.Context, policy Policy) (Policy, error) {
+	if err := policy.Validate(); err != nil {
+		return Policy{}, err
+	}
+
+	spec, err := json.Marshal(policy)
+	if err != nil {
+		return Policy{}, fmt.Errorf("marshal policy: %w", err)
+	}
+
+	var version int64
+	if err := s.db.QueryRowContext(ctx, `
+		INSERT INTO agent_policies (name, spec, version, updated_at)
+		VALUES ($1, $2, nextval('agent_policy_version_seq'), now())
+		ON CONFLICT (name) DO UPDATE
+		SET spec = EXCLUDED.spec, version = EXCLUDED.version, updated_at = EXCLUDED.updated_at
+		RETURNING version, updated_at
+	`, policy.Name, spec).Scan(&version, &policy.UpdatedAt); err != nil {
+		return Policy{}, fmt.Errorf("upsert policy: %w", err)
+	}
+	policy.Version = uint64(version)
+
+	return policy, nil
+}
+
+// DeletePolicy removes a policy and reports whether it existed.
+func (s *PostgresStore) DeletePolicy(ctx context.Context, name string) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM agent_policies WHERE name = $1`, name)
+	if err != nil {
+		return false, fmt.Errorf("delete policy: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("delete policy: %w", err)
+	}
+	return n > 0, nil
+}
+
+// SaveConfigAck records the configuration version an agent reported.
+func (s *PostgresStore) SaveConfigAck(ctx context.Context, ack ConfigAck) error {
+	if _, err := s.db.ExecContext(ctx, `
+		INSERT INTO agent_config_acks (agent_id, version, error, acked_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (agent_id) DO UPDATE
+		SET version = EXCLUDED.version, error = EXCLUDED.error, acked_at = EXCLUDED.acked_at
+	`, ack.AgentID, int64(ack.Version), ack.Error, ack.AckedAt); err != nil {
+		return fmt.Errorf("upsert config ack: %w", err)
+	}
 	return nil
 }
+
+// ConfigAcks lists the last acknowledgement of every agent ordered by agent id.
+func (s *PostgresStore) ConfigAcks(ctx context.Context) ([]ConfigAck, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT agent_id, version, error, acked_at FROM agent_config_acks ORDER BY agent_id ASC`)
+	if err != nil {
+		return nil, fmt.Errorf("query config acks: %w", err)
+	}
+	defer rows.Close()
+
+	acks := make([]ConfigAck, 0)
+	for rows.Next() {
+		var ack ConfigAck
+		var version int64
+		if err := rows.Scan(&ack.AgentID, &version, &ack.Error, &ack.AckedAt); err != nil {
+			return nil, fmt.Errorf("scan config ack: %w", err)
+		}
+		ack.Version = uint64(version)
+		acks = append(acks, ack)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate config acks: %w", err)
+	}
+
+	return acks, nil
+}
+
+const tokenColumns = `id, kind, agent_id, description, created_at, expires_at, revoked_at, used_at`
+
+// CreateToken stores a new token under the hash of its secret.
+func (s *PostgresStore) CreateToken(ctx context.Context, token Token, hash []byte) (Token, error) {
+	if err := token.Validate(); err != nil {
+		return Token{}, err
+	}
+
+	if err := s.db.QueryRowContext(ctx, `
+		INSERT INTO agent_tokens (id, token_hash, kind, agent_id, description, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, now(), $6)
+		RETURNING created_at
+	`, token.ID, hash, token.Kind, token.AgentID, token.Description, token.ExpiresAt).Scan(&token.CreatedAt); err != nil {
+		return Token{}, fmt.Errorf("insert token: %w", err)
+	}
+	return token, nil
+}
+
+// TokenByHash looks up the token whose secret hashes to hash.
+func (s *PostgresStore) TokenByHash(ctx context.Context, hash []byte) (Token, bool, error) {
+	token, err := scanToken(s.db.QueryRowContext(ctx, `SELECT `+tokenColumns+` FROM agent_tokens WHERE token_hash = $1`, hash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Token{}, false, nil
+	}
+	if err != nil {
+		return Token{}, false, fmt.Errorf("query token: %w", err)
+	}
+	return token, true, nil
+}
+
+// Tokens lists every token, newest first.
+func (s *PostgresStore) Tokens(ctx context.Context) ([]Token, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+tokenColumns+` FROM agent_tokens ORDER BY created_at DESC, id ASC`)
+	if err != nil {
+		return nil, fmt.Errorf("query tokens: %w", err)
+	}
+	defer rows.Close()
+
+	tokens := make([]Token, 0)
+	for rows.Next() {
+		token, err := scanToken(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan token: %w", err)
+		}
+		tokens = append(tokens, token)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate tokens: %w", err)
+	}
+
+	return tokens, nil
+}
+
+// RevokeToken marks a token revoked and reports whether it exists. Revoking twice keeps
+// the original revocation time.
+func (s *PostgresStore) RevokeToken(ctx context.Context, id string) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `UPDATE agent_tokens SET revoked_at = COALESCE(revoked_at, now()) WHERE id = $1`, id)
+	if err != nil {
+		return false, fmt.Errorf("revoke token: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("revoke token: %w", err)
+	}
+	return n > 0, nil
+}
+
+// EnrollAgent consumes the bootstrap token hashing to bootstrapHash and stores credential
+// for agentID in the same transaction, so a bootstrap token is never exchanged twice. It
+// returns ErrTokenRejected when the bootstrap token cannot be used by agentID.
+func (s *PostgresStore) EnrollAgent(ctx context.Context, bootstrapHash []byte, agentID string, credential Token, credentialHash []byte) (Token, error) {
+	if err := credential.Validate(); err != nil {
+		return Token{}, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Token{}, fmt.Errorf("begin enrollment: %w", err)
+	}
+	defer tx.Rollback()
+
+	bootstrap, err := scanToken(tx.QueryRowContext(ctx, `SELECT `+tokenColumns+` FROM agent_tokens WHERE token_hash = $1 FOR UPDATE`, bootstrapHash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Token{}, ErrTokenRejected
+	}
+	if err != nil {
+		return Token{}, fmt.Errorf("query bootstrap token: %w", err)
+	}
+	if bootstrap.Kind != TokenBootstrap || !bootstrap.Active(time.Now()) || !bootstrap.Allows(agentID) {
+		return Token{}, ErrTokenRejected
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE agent_tokens SET used_at = now() WHERE id = $1`, bootstrap.ID); err != nil {
+		return Token{}, fmt.Errorf("consume bootstrap token: %w", err)
+	}
+	if err := tx.QueryRowContext(ctx, `
+		INSERT INTO agent_tokens (id, token_hash, kind, agent_id, description, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, now(), $6)
+		RETURNING created_at
+	`, credential.ID, credentialHash, credential.Kind, credential.AgentID, credential.Description, credential.ExpiresAt).Scan(&credential.CreatedAt); err != nil {
+		return Token{}, fmt.Errorf("insert agent token: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Token{}, fmt.Errorf("commit enrollment: %w", err)
+	}
+	return credential, nil
+}
+
+// Columns of telemetry_records written by Save and SaveBatch and read back by
+// scanRecord. Named values are folded into a JSON object by a correlated subquery on
+// telemetry_values.
+var (
+	recordColumns = []string{
+		"agent_id", "collected_at", "cpu_usage", "memory_usage_bytes", "memory_percent",
+		"network_tx_bytes", "network_rx_bytes", "network_tx_rate", "network_rx_rate",
+		"disk_read_bytes", "disk_write_bytes", "disk_read_rate", "disk_write_rate",
+		"load_avg_1", "load_avg_5", "load_avg_15", "labels",
+	}
+	recordInsertColumns = strings.Join(recordColumns, ", ")
+	recordSelectColumns = recordInsertColumns +
+		", (SELECT jsonb_object_agg(v.name, v.value) FROM telemetry_values v WHERE v.record_id = r.id AND v.collected_at = r.collected_at)"
+)
+
+// scanRecord scans the recordSelectColumns of a row, followed by any extra columns.
+func scanRecord(row interface{ Scan(...any) error }, extra ...any) (Record, error) {
+	var record Record
+	var memory, tx, rx, read, write int64
+	var labels, values []byte
+	dest := []any{
+		&record.AgentID, &record.CollectedAt, &record.CPUUsage, &memory, &record.MemoryPercent,
+		&tx, &rx, &record.NetworkTxRate, &record.NetworkRxRate,
+		&read, &write, &record.DiskReadRate, &record.DiskWriteRate,
+		&record.LoadAvg1, &record.LoadAvg5, &record.LoadAvg15, &labels, &values,
+	}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return Record{}, fmt.Errorf("scan record: %w", err)
+	}
+	record.MemoryUsage = uint64(memory)
+	record.NetworkTxBytes, record.NetworkRxBytes = uint64(tx), uint64(rx)
+	record.DiskReadBytes, record.DiskWriteBytes = uint64(read), uint64(write)
+
+	if err := json.Unmarshal(labels, &record.Labels); err != nil {
+		return Record{}, fmt.Errorf("decode labels: %w", err)
+	}
+	if len(record.Labels) == 0 {
+		record.Labels = nil
+	}
+	if values != nil {
+		if err := json.Unmarshal(values, &record.Values); err != nil {
+			return Record{}, fmt.Errorf("decode values: %w", err)
+		}
+	}
+	return record, nil
+}
+
+func scanToken(row interface{ Scan(...any) error }) (Token, error) {
+	var token Token
+	var expires, revoked, used sql.NullTime
+	if err := row.Scan(&token.ID, &token.Kind, &token.AgentID, &token.Description, &token.CreatedAt, &expires, &revoked, &used); err != nil {
+		return Token{}, err
+	}
+	token.ExpiresAt = nullTime(expires)
+	token.RevokedAt = nullTime(revoked)
+	token.UsedAt = nullTime(used)
+	return token, nil
+}
+
+func nullTime(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// Transient reports whether err is a failure worth retrying unchanged: the connection
+// broke or could not be made, the server is restarting or overloaded, or the transaction
+// lost a serialization conflict or deadlock.
+func Transient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch {
+		case strings.HasPrefix(pgErr.Code, "08"), // connection exception
+			strings.HasPrefix(pgErr.Code, "53"), // insufficient resources
+			pgErr.Code == "40001",               // serialization failure
+			pgErr.Code == "40P01",               // deadlock detected
+			pgErr.Code == "57P01",               // admin shutdown
+			pgErr.Code == "57P02",               // crash shutdown
+			pgErr.Code == "57P03":               // cannot connect now
+			return true
+		}
+		return false
+	}
+	var connectErr *pgconn.ConnectError
+	return errors.As(err, &connectErr) || pgconn.Timeout(err) || pgconn.SafeToRetry(err) ||
+		errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, context.DeadlineExceeded)
+}
+
+func encodeLabels(labels Labels) ([]byte, error) {
+	if labels == nil {
+		labels = Labels{}
+	}
+	raw, err := json.Marshal(labels)
+	if err != nil {
+		return nil, fmt.Errorf("marshal labels: %w", err)
+	}
+	return raw, nil
+}
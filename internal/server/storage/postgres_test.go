@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+// openTestPostgres returns a store migrated to the latest schema in a schema of its own,
+// dropped when the test ends. Tests using it are skipped unless
+// TELEMETRY_TEST_POSTGRES_DSN holds a postgres:// URL of a database they may write to.
+func openTestPostgres(t *testing.T) *PostgresStore {
+	t.Helper()
+	store := openEmptyTestPostgres(t)
+	ctx := context.Background()
+	latest, err := LatestSchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Migrate(ctx, latest); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if _, err := store.PreparePartitions(ctx, time.Now().Add(48*time.Hour), 24*time.Hour); err != nil {
+		t.Fatalf("prepare partitions: %v", err)
+	}
+	return store
+}
+
+// openEmptyTestPostgres is openTestPostgres without any migration applied.
+func openEmptyTestPostgres(t *testing.T) *PostgresStore {
+	t.Helper()
+	raw := os.Getenv("TELEMETRY_TEST_POSTGRES_DSN")
+	if raw == "" {
+		t.Skip("TELEMETRY_TEST_POSTGRES_DSN not set")
+	}
+	ctx := context.Background()
+
+	admin, err := NewPostgresStore(ctx, raw)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	schema := fmt.Sprintf("telemetry_test_%d", time.Now().UnixNano())
+	if _, err := admin.db.ExecContext(ctx, `CREATE SCHEMA `+schema); err != nil {
+		admin.Close()
+		t.Fatalf("create schema: %v", err)
+	}
+	t.Cleanup(func() {
+		admin.db.ExecContext(context.Background(), `DROP SCHEMA `+schema+` CASCADE`)
+		admin.Close()
+	})
+
+	dsn, err := url.Parse(raw)
+	if err != nil {
+		t.Fatalf("TELEMETRY_TEST_POSTGRES_DSN must be a URL: %v", err)
+	}
+	query := dsn.Query()
+	query.Set("search_path", schema)
+	dsn.RawQuery = query.Encode()
+	store, err := NewPostgresStore(ctx, dsn.String())
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestPostgresSaveBatchIsIdempotent(t *testing.T) {
+	store := openTestPostgres(t)
+	ctx := context.Background()
+
+	at := time.Now().UTC().Truncate(time.Second)
+	batch := []Record{
+		{AgentID: "a", CollectedAt: at, CPUUsage: 1, Values: map[string]float64{"queue_depth": 1}},
+		{AgentID: "a", CollectedAt: at.Add(time.Second), CPUUsage: 2, Values: map[string]float64{"queue_depth": 2}},
+		{AgentID: "b", CollectedAt: at, CPUUsage: 3},
+	}
+	if err := store.SaveBatch(ctx, batch); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	// A retry of the same batch, with a new sample, as after a lost commit acknowledgement.
+	retry := append(batch, Record{AgentID: "a", CollectedAt: at.Add(2 * time.Second), CPUUsage: 4})
+	if err := store.SaveBatch(ctx, retry); err != nil {
+		t.Fatalf("save again: %v", err)
+	}
+	if err := store.Save(ctx, batch[0]); err != nil {
+		t.Fatalf("save single duplicate: %v", err)
+	}
+
+	page, err := store.List(ctx, "a", RecordQuery{Order: OrderAsc})
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if got := cpuValues(page.Records); len(got) != 3 || got[0] != 1 || got[1] != 2 || got[2] != 4 {
+		t.Fatalf("records of a = %v, want [1 2 4]", got)
+	}
+	var values int
+	if err := store.db.QueryRowContext(ctx, `SELECT count(*) FROM telemetry_values`).Scan(&values); err != nil {
+		t.Fatal(err)
+	}
+	if values != 2 {
+		t.Fatalf("%d named values stored, want 2", values)
+	}
+}
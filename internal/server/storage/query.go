@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Order is the direction List walks an agent's history in.
+type Order string
+
+const (
+	// OrderDesc returns the newest records first, so an unbounded query with a limit
+	// yields the most recent window.
+	OrderDesc Order = "desc"
+	// OrderAsc returns the oldest records first.
+	OrderAsc Order = "asc"
+)
+
+// ErrInvalidCursor is returned by List for a cursor it did not issue.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// RecordQuery selects a page of one agent's records, ordered by collection time and then
+// by arrival.
+type RecordQuery struct {
+	// From and To bound CollectedAt to [From, To); a zero time leaves that end open.
+	From, To time.Time
+	// Order defaults to OrderDesc.
+	Order Order
+	// Limit caps the page; zero or negative returns every match.
+	Limit int
+	// Cursor continues after the last record of a previous page, from RecordPage.Next. It
+	// is only meaningful with the query that produced it.
+	Cursor string
+	// Selector keeps only samples carrying these labels.
+	Selector Labels
+}
+
+// RecordPage is one page of List results.
+type RecordPage struct {
+	Records []Record
+	// Next is the cursor of the following page, empty when there are no more records.
+	Next string
+}
+
+// Validate normalises the order and checks the query is well formed.
+func (q *RecordQuery) Validate() error {
+	switch q.Order {
+	case "":
+		q.Order = OrderDesc
+	case OrderAsc, OrderDesc:
+	default:
+		return fmt.Errorf("order must be %q or %q, got %q", OrderAsc, OrderDesc, q.Order)
+	}
+	if !q.From.IsZero() && !q.To.IsZero() && !q.From.Before(q.To) {
+		return fmt.Errorf("from must be before to")
+	}
+	if _, err := decodeCursor(q.Cursor); err != nil {
+		return err
+	}
+	return nil
+}
+
+// recordPosition identifies a record within its agent's history: the collection time
+// and a tiebreaker increasing with arrival (the row id, or a per-agent sequence).
+type recordPosition struct {
+	at  int64 // UnixNano
+	seq uint64
+}
+
+// after reports whether p comes after o in ascending order.
+func (p recordPosition) after(o recordPosition) bool {
+	return p.at > o.at || p.at == o.at && p.seq > o.seq
+}
+
+// inRange reports whether t lies within [q.From, q.To).
+func (q RecordQuery) inRange(t time.Time) bool {
+	return (q.From.IsZero() || !t.Before(q.From)) && (q.To.IsZero() || t.Before(q.To))
+}
+
+// beyond reports whether p lies past the cursor position c in the direction of q.
+func (q RecordQuery) beyond(p recordPosition, c *recordPosition) bool {
+	if c == nil {
+		return true
+	}
+	if q.Order == OrderAsc {
+		return p.after(*c)
+	}
+	return c.after(p)
+}
+
+// page trims records, fetched in query order with up to one more than the limit, to the
+// limit and issues the cursor of the next page. positions parallels records.
+func (q RecordQuery) page(records []Record, positions []recordPosition) RecordPage {
+	if q.Limit <= 0 || len(records) <= q.Limit {
+		return RecordPage{Records: records}
+	}
+	return RecordPage{Records: records[:q.Limit], Next: encodeCursor(positions[q.Limit-1])}
+}
+
+func encodeCursor(p recordPosition) string {
+	raw := make([]byte, 16)
+	binary.BigEndian.PutUint64(raw[:8], uint64(p.at))
+	binary.BigEndian.PutUint64(raw[8:], p.seq)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// decodeCursor returns the position of a cursor, nil for an empty one.
+func decodeCursor(cursor string) (*recordPosition, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(raw) != 16 {
+		return nil, ErrInvalidCursor
+	}
+	return &recordPosition{at: int64(binary.BigEndian.Uint64(raw[:8])), seq: binary.BigEndian.Uint64(raw[8:])}, nil
+}
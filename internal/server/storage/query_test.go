@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSaveSkipsStoredSamples(t *testing.T) {
+	bolt, err := NewBoltStore(filepath.Join(t.TempDir(), "telemetry.db"))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer bolt.Close()
+
+	stores := map[string]func(t *testing.T) RecordStore{
+		"memory":   func(*testing.T) RecordStore { return NewMemoryStore(100) },
+		"bolt":     func(*testing.T) RecordStore { return bolt },
+		"postgres": func(t *testing.T) RecordStore { return openTestPostgres(t) },
+	}
+	for name, open := range stores {
+		t.Run(name, func(t *testing.T) {
+			store := open(t)
+			ctx := context.Background()
+			at := time.Now().UTC().Truncate(time.Second)
+			batch := []Record{
+				{AgentID: "a", CollectedAt: at, CPUUsage: 1},
+				{AgentID: "a", CollectedAt: at.Add(time.Second), CPUUsage: 2},
+				{AgentID: "b", CollectedAt: at, CPUUsage: 3},
+			}
+			if err := store.SaveBatch(ctx, batch); err != nil {
+				t.Fatalf("save: %v", err)
+			}
+			// The same batch again, as after a lost commit acknowledgement.
+			if err := store.SaveBatch(ctx, batch); err != nil {
+				t.Fatalf("save again: %v", err)
+			}
+			if err := store.Save(ctx, Record{AgentID: "a", CollectedAt: at, CPUUsage: 9}); err != nil {
+				t.Fatalf("save single duplicate: %v", err)
+			}
+
+			for agent, want := range map[string][]float64{"a": {1, 2}, "b": {3}} {
+				page, err := store.List(ctx, agent, RecordQuery{Order: OrderAsc})
+				if err != nil {
+					t.Fatalf("list %s: %v", agent, err)
+				}
+				if got := cpuValues(page.Records); !slices.Equal(got, want) {
+					t.Fatalf("records of %s = %v, want %v", agent, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestListPagesThroughRange(t *testing.T) {
+	bolt, err := NewBoltStore(filepath.Join(t.TempDir(), "telemetry.db"))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer bolt.Close()
+
+	for name, store := range map[string]RecordStore{"memory": NewMemoryStore(100), "bolt": bolt} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			start := time.Unix(1700000000, 0)
+			// Second 3 arrives twice, as a replayed sample would; it is stored once.
+			for _, i := range []int{5, 0, 3, 1, 4, 2, 3} {
+				record := Record{AgentID: "a", CollectedAt: start.Add(time.Duration(i) * time.Second), CPUUsage: float64(i)}
+				if err := store.Save(ctx, record); err != nil {
+					t.Fatalf("save: %v", err)
+				}
+			}
+
+			collect := func(query RecordQuery) [][]float64 {
+				var pages [][]float64
+				for {
+					page, err := store.List(ctx, "a", query)
+					if err != nil {
+						t.Fatalf("list %+v: %v", query, err)
+					}
+					pages = append(pages, cpuValues(page.Records))
+					if page.Next == "" {
+						return pages
+					}
+					query.Cursor = page.Next
+				}
+			}
+
+			from, to := start.Add(time.Second), start.Add(5*time.Second)
+			if got := collect(RecordQuery{From: from, To: to, Limit: 2}); !slices.EqualFunc(got, [][]float64{{4, 3}, {2, 1}}, slices.Equal) {
+				t.Fatalf("descending pages = %v", got)
+			}
+			if got := collect(RecordQuery{From: from, To: to, Limit: 2, Order: OrderAsc}); !slices.EqualFunc(got, [][]float64{{1, 2}, {3, 4}}, slices.Equal) {
+				t.Fatalf("ascending pages = %v", got)
+			}
+			if got := collect(RecordQuery{Limit: 3}); !slices.EqualFunc(got, [][]float64{{5, 4, 3}, {2, 1, 0}}, slices.Equal) {
+				t.Fatalf("unbounded pages = %v", got)
+			}
+
+			if _, err := store.List(ctx, "a", RecordQuery{Cursor: "bogus"}); !errors.Is(err, ErrInvalidCursor) {
+				t.Fatalf("bogus cursor: %v, want ErrInvalidCursor", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"time"
+)
+
+// Aggregation reduces the samples falling into one step of a range query.
+type Aggregation string
+
+// Aggregations supported by range queries. Percentiles interpolate between the closest
+// samples, like PostgreSQL's percentile_cont.
+const (
+	AggAvg   Aggregation = "avg"
+	AggMin   Aggregation = "min"
+	AggMax   Aggregation = "max"
+	AggSum   Aggregation = "sum"
+	AggLast  Aggregation = "last"
+	AggCount Aggregation = "count"
+	AggP50   Aggregation = "p50"
+	AggP95   Aggregation = "p95"
+	AggP99   Aggregation = "p99"
+)
+
+// Aggregations lists the supported aggregations.
+var Aggregations = []Aggregation{AggAvg, AggMin, AggMax, AggSum, AggLast, AggCount, AggP50, AggP95, AggP99}
+
+// MaxRangePoints caps the steps a range query may span.
+const MaxRangePoints = 11000
+
+// metricColumns maps the metric names of Record, as serialised to JSON, to the
+// PostgreSQL columns holding them. Any other metric name refers to a key of
+// Record.Values.
+var metricColumns = map[string]string{
+	"cpuUsage":         "cpu_usage",
+	"memoryUsageBytes": "memory_usage_bytes",
+	"memoryPercent":    "memory_percent",
+	"networkTxBytes":   "network_tx_bytes",
+	"networkRxBytes":   "network_rx_bytes",
+	"networkTxRate":    "network_tx_rate",
+	"networkRxRate":    "network_rx_rate",
+	"diskReadBytes":    "disk_read_bytes",
+	"diskWriteBytes":   "disk_write_bytes",
+	"diskReadRate":     "disk_read_rate",
+	"diskWriteRate":    "disk_write_rate",
+	"loadAvg1":         "load_avg_1",
+	"loadAvg5":         "load_avg_5",
+	"loadAvg15":        "load_avg_15",
+}
+
+// RangeQuery resamples one metric of an agent over [From, To) into steps of Step, the
+// first starting at From.
+type RangeQuery struct {
+	// Metric is a Record field by its JSON name, such as cpuUsage, or a key of Values.
+	Metric   string
+	From, To time.Time
+	Step     time.Duration
+	Agg      Aggregation
+	Selector Labels
+}
+
+// Point is the aggregate of one step. Steps without samples are omitted.
+type Point struct {
+	Time  time.Time `json:"t"`
+	Value float64   `json:"v"`
+}
+
+// Validate checks the query is well formed and bounded.
+func (q RangeQuery) Validate() error {
+	switch {
+	case q.Metric == "":
+		return fmt.Errorf("metric must be provided")
+	case q.From.IsZero() || q.To.IsZero():
+		return fmt.Errorf("from and to must be provided")
+	case !q.From.Before(q.To):
+		return fmt.Errorf("from must be before to")
+	case q.Step < time.Second:
+		return fmt.Errorf("step must be at least 1s")
+	case q.To.Sub(q.From)/q.Step >= MaxRangePoints:
+		return fmt.Errorf("range spans more than %d steps; use a larger step", MaxRangePoints)
+	case !slices.Contains(Aggregations, q.Agg):
+		return fmt.Errorf("unknown aggregation %q", q.Agg)
+	}
+	return nil
+}
+
+// metricValue returns the value of metric in record, false when the record lacks it.
+func metricValue(record Record, metric string) (float64, bool) {
+	switch metric {
+	case "cpuUsage":
+		return record.CPUUsage, true
+	case "memoryUsageBytes":
+		return float64(record.MemoryUsage), true
+	case "memoryPercent":
+		return record.MemoryPercent, true
+	case "networkTxBytes":
+		return float64(record.NetworkTxBytes), true
+	case "networkRxBytes":
+		return float64(record.NetworkRxBytes), true
+	case "networkTxRate":
+		return record.NetworkTxRate, true
+	case "networkRxRate":
+		return record.NetworkRxRate, true
+	case "diskReadBytes":
+		return float64(record.DiskReadBytes), true
+	case "diskWriteBytes":
+		return float64(record.DiskWriteBytes), true
+	case "diskReadRate":
+		return record.DiskReadRate, true
+	case "diskWriteRate":
+		return record.DiskWriteRate, true
+	case "loadAvg1":
+		return record.LoadAvg1, true
+	case "loadAvg5":
+		return record.LoadAvg5, true
+	case "loadAvg15":
+		return record.LoadAvg15, true
+	}
+	value, ok := record.Values[metric]
+	return value, ok
+}
+
+// resample aggregates records, ordered oldest to newest and already within the range,
+// into the steps of q. It backs the stores that cannot aggregate natively.
+func resample(records []Record, q RangeQuery) []Point {
+	points := make([]Point, 0)
+	var bucket time.Time
+	var samples []float64
+	emit := func() {
+		if len(samples) > 0 {
+			points = append(points, Point{Time: bucket, Value: aggregate(samples, q.Agg)})
+		}
+		samples = samples[:0]
+	}
+
+	for _, record := range records {
+		value, ok := metricValue(record, q.Metric)
+		if !ok {
+			continue
+		}
+		start := q.From.Add(record.CollectedAt.Sub(q.From) / q.Step * q.Step)
+		if !start.Equal(bucket) {
+			emit()
+			bucket = start
+		}
+		samples = append(samples, value)
+	}
+	emit()
+	return points
+}
+
+// aggregate reduces the samples of one step, given in collection order.
+func aggregate(samples []float64, agg Aggregation) float64 {
+	switch agg {
+	case AggMin:
+		return slices.Min(samples)
+	case AggMax:
+		return slices.Max(samples)
+	case AggLast:
+		return samples[len(samples)-1]
+	case AggCount:
+		return float64(len(samples))
+	case AggP50:
+		return percentile(samples, 0.5)
+	case AggP95:
+		return percentile(samples, 0.95)
+	case AggP99:
+		return percentile(samples, 0.99)
+	}
+
+	var sum float64
+	for _, value := range samples {
+		sum += value
+	}
+	if agg == AggSum {
+		return sum
+	}
+	return sum / float64(len(samples))
+}
+
+// percentile interpolates linearly between the closest ranks.
+func percentile(samples []float64, p float64) float64 {
+	sorted := slices.Clone(samples)
+	slices.Sort(sorted)
+	rank := p * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	if lower+1 >= len(sorted) {
+		return sorted[lower]
+	}
+	return sorted[lower] + (rank-float64(lower))*(sorted[lower+1]-sorted[lower])
+}
@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestQueryRangeResamples(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore(100)
+	start := time.Unix(1700000000, 0)
+	// Ten samples a second apart: steps of 4s hold 0-3, 4-7 and 8-9. Second 6 is missing.
+	for i := range 10 {
+		if i == 6 {
+			continue
+		}
+		record := Record{AgentID: "a", CollectedAt: start.Add(time.Duration(i) * time.Second), CPUUsage: float64(i), Values: map[string]float64{"temp": float64(10 * i)}}
+		if err := store.Save(ctx, record); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+	}
+
+	tests := []struct {
+		metric string
+		agg    Aggregation
+		want   []float64
+	}{
+		{"cpuUsage", AggAvg, []float64{1.5, 5.333333333333333, 8.5}},
+		{"cpuUsage", AggMin, []float64{0, 4, 8}},
+		{"cpuUsage", AggMax, []float64{3, 7, 9}},
+		{"cpuUsage", AggSum, []float64{6, 16, 17}},
+		{"cpuUsage", AggLast, []float64{3, 7, 9}},
+		{"cpuUsage", AggCount, []float64{4, 3, 2}},
+		{"cpuUsage", AggP50, []float64{1.5, 5, 8.5}},
+		{"cpuUsage", AggP95, []float64{2.85, 6.8, 8.95}},
+		{"temp", AggMax, []float64{30, 70, 90}},
+	}
+	for _, tt := range tests {
+		points, err := store.QueryRange(ctx, "a", RangeQuery{Metric: tt.metric, From: start, To: start.Add(12 * time.Second), Step: 4 * time.Second, Agg: tt.agg})
+		if err != nil {
+			t.Fatalf("%s %s: %v", tt.metric, tt.agg, err)
+		}
+		got := make([]float64, len(points))
+		for i, point := range points {
+			got[i] = point.Value
+			if want := start.Add(time.Duration(4*i) * time.Second); !point.Time.Equal(want) {
+				t.Fatalf("%s %s: step %d starts at %v, want %v", tt.metric, tt.agg, i, point.Time, want)
+			}
+		}
+		if !slices.EqualFunc(got, tt.want, func(a, b float64) bool { return a-b < 1e-9 && b-a < 1e-9 }) {
+			t.Fatalf("%s %s = %v, want %v", tt.metric, tt.agg, got, tt.want)
+		}
+	}
+
+	if _, err := store.QueryRange(ctx, "a", RangeQuery{Metric: "cpuUsage", From: start, To: start.Add(time.Hour), Step: 100 * time.Millisecond, Agg: AggAvg}); err == nil {
+		t.Fatal("accepted a step below one second")
+	}
+}
+
+func TestRollupTierChoice(t *testing.T) {
+	hour := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		from time.Time
+		step time.Duration
+		agg  Aggregation
+		want string
+	}{
+		{hour, time.Minute, AggAvg, "1m"},
+		{hour, 15 * time.Minute, AggMax, "1m"},
+		{hour, 2 * time.Hour, AggLast, "1h"},
+		{hour.Truncate(24 * time.Hour), 24 * time.Hour, AggCount, "1d"},
+		{hour, 24 * time.Hour, AggSum, "1h"}, // from is not on a day boundary
+		{hour.Add(30 * time.Second), time.Minute, AggAvg, ""},
+		{hour, 90 * time.Second, AggAvg, ""},
+		{hour, time.Hour, AggP95, ""}, // percentiles need raw samples
+	}
+	for _, tt := range tests {
+		tier, ok := rollupTier(RangeQuery{From: tt.from, Step: tt.step, Agg: tt.agg})
+		if tier.Name != tt.want || ok != (tt.want != "") {
+			t.Errorf("rollupTier(from %s, step %s, %s) = %q, want %q", tt.from.Format(time.TimeOnly), tt.step, tt.agg, tier.Name, tt.want)
+		}
+	}
+}
@@ -0,0 +1,467 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Tier is a rollup resolution. Each tier is built from the one before it, the first
+// from raw samples.
+type Tier struct {
+	Name       string
+	Resolution time.Duration
+	// chunk bounds the span rolled up in one transaction.
+	chunk time.Duration
+}
+
+// Tiers lists the rollup tiers from the finest to the coarsest.
+var Tiers = []Tier{
+	{Name: "1m", Resolution: time.Minute, chunk: time.Hour},
+	{Name: "1h", Resolution: time.Hour, chunk: 24 * time.Hour},
+	{Name: "1d", Resolution: 24 * time.Hour, chunk: 30 * 24 * time.Hour},
+}
+
+// Retention is how long raw samples and the buckets of each tier, by name, are kept;
+// zero keeps them forever.
+type Retention struct {
+	Raw   time.Duration
+	Tiers map[string]time.Duration
+	// AfterRollup keeps raw samples and buckets until the next tier has rolled them up,
+	// so expiring data never leaves a gap in the coarser tiers.
+	AfterRollup bool
+}
+
+// Pruner is implemented by stores that expire old data.
+type Pruner interface {
+	// Prune deletes raw samples and buckets past their retention in batches of up to
+	// batch rows.
+	Prune(ctx context.Context, retention Retention, now time.Time, batch int) (PruneStats, error)
+}
+
+// Maintainer is implemented by stores that partition raw samples and materialise
+// rollups as well as expire old data.
+type Maintainer interface {
+	Pruner
+	// PreparePartitions creates the raw sample partitions, interval long, up to until.
+	PreparePartitions(ctx context.Context, until time.Time, interval time.Duration) (int, error)
+	// Rollup aggregates every complete bucket before until into its tiers.
+	Rollup(ctx context.Context, until time.Time) error
+}
+
+// PruneStats reports what Prune removed.
+type PruneStats struct {
+	Partitions int
+	Rows       int64
+}
+
+var _ Maintainer = (*PostgresStore)(nil)
+
+// rollupAggregations can be answered from rollups: they combine exactly across buckets.
+var rollupAggregations = []Aggregation{AggAvg, AggMin, AggMax, AggSum, AggLast, AggCount}
+
+// rollupFields unpivots the typed columns of telemetry_records r into (name, value) rows.
+var rollupFields = func() string {
+	names := make([]string, 0, len(metricColumns))
+	for name := range metricColumns {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	rows := make([]string, len(names))
+	for i, name := range names {
+		rows[i] = fmt.Sprintf("('%s', r.%s::double precision)", name, metricColumns[name])
+	}
+	return "VALUES " + strings.Join(rows, ", ")
+}()
+
+const rollupColumns = `tier, agent_id, name, bucket, labels, sample_count, value_sum, value_min, value_max, value_last, last_at`
+
+// rollupRawSelect aggregates the raw samples r that from joins and where selects into
+// buckets of $3 seconds of the tier named $4.
+func rollupRawSelect(from, where string) string {
+	return `SELECT $4, r.agent_id, m.name, date_bin(make_interval(secs => $3), r.collected_at, TIMESTAMPTZ 'epoch'), r.labels,
+			count(*), sum(m.value), min(m.value), max(m.value),
+			(array_agg(m.value ORDER BY r.collected_at DESC, r.id DESC))[1], max(r.collected_at)
+		FROM ` + from + `
+		CROSS JOIN LATERAL (
+			` + rollupFields + `
+			UNION ALL
+			SELECT v.name, v.value FROM telemetry_values v WHERE v.record_id = r.id AND v.collected_at = r.collected_at
+		) AS m (name, value)
+		WHERE ` + where + `
+		GROUP BY 2, 3, 4, 5`
+}
+
+// lateBatch caps the late samples merged into the rollups by one transaction.
+const lateBatch = 5000
+
+// Rollup merges the samples stored late into the buckets already rolled up, then
+// advances every tier to the last bucket completed before until, one chunk per
+// transaction. The tier's state row is locked while it is rolled up, so servers running
+// the job concurrently take turns instead of aggregating a chunk twice.
+func (s *PostgresStore) Rollup(ctx context.Context, until time.Time) error {
+	for {
+		done, err := s.mergeLate(ctx)
+		if err != nil {
+			return fmt.Errorf("merge late samples: %w", err)
+		}
+		if done {
+			break
+		}
+	}
+	for i, tier := range Tiers {
+		for {
+			done, err := s.rollupChunk(ctx, i, until)
+			if err != nil {
+				return fmt.Errorf("roll up %s: %w", tier.Name, err)
+			}
+			if done {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// rollupChunk rolls up the next chunk of Tiers[i] and reports whether the tier is done.
+func (s *PostgresStore) rollupChunk(ctx context.Context, i int, until time.Time) (bool, error) {
+	tier := Tiers[i]
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var watermark sql.NullTime
+	if err := tx.QueryRowContext(ctx, `SELECT watermark FROM telemetry_rollup_state WHERE tier = $1 FOR UPDATE`, tier.Name).Scan(&watermark); err != nil {
+		return false, fmt.Errorf("lock state: %w", err)
+	}
+
+	// The tier can reach the end of its source: until for raw samples, the watermark of
+	// the previous tier otherwise.
+	end := until
+	var first sql.NullTime
+	if i == 0 {
+		err = tx.QueryRowContext(ctx, `SELECT min(collected_at) FROM telemetry_records`).Scan(&first)
+	} else {
+		var source sql.NullTime
+		if err := tx.QueryRowContext(ctx, `SELECT watermark FROM telemetry_rollup_state WHERE tier = $1`, Tiers[i-1].Name).Scan(&source); err != nil {
+			return false, fmt.Errorf("read %s state: %w", Tiers[i-1].Name, err)
+		}
+		if !source.Valid {
+			return true, nil
+		}
+		end = source.Time
+		err = tx.QueryRowContext(ctx, `SELECT min(bucket) FROM telemetry_rollups WHERE tier = $1`, Tiers[i-1].Name).Scan(&first)
+	}
+	if err != nil {
+		return false, fmt.Errorf("find first sample: %w", err)
+	}
+
+	if !first.Valid {
+		return true, nil
+	}
+	// Start after the watermark, skipping any stretch without data.
+	start := first.Time.Truncate(tier.Resolution)
+	if watermark.Valid && watermark.Time.After(start) {
+		start = watermark.Time
+	}
+	end = end.Truncate(tier.Resolution)
+	if !end.After(start) {
+		return true, nil
+	}
+	stop := start.Add(tier.chunk)
+	if stop.After(end) {
+		stop = end
+	}
+
+	args := []any{start, stop, tier.Resolution.Seconds(), tier.Name}
+	var stmt string
+	if i == 0 {
+		stmt = `INSERT INTO telemetry_rollups (` + rollupColumns + `)
+			` + rollupRawSelect(`telemetry_records r`, `r.collected_at >= $1 AND r.collected_at < $2`) + `
+			ON CONFLICT DO NOTHING`
+	} else {
+		args = append(args, Tiers[i-1].Name)
+		stmt = `INSERT INTO telemetry_rollups (` + rollupColumns + `)
+			SELECT $4, agent_id, name, date_bin(make_interval(secs => $3), bucket, TIMESTAMPTZ 'epoch'), labels,
+				sum(sample_count), sum(value_sum), min(value_min), max(value_max),
+				(array_agg(value_last ORDER BY last_at DESC))[1], max(last_at)
+			FROM telemetry_rollups
+			WHERE tier = $5 AND bucket >= $1 AND bucket < $2
+			GROUP BY 2, 3, 4, 5
+			ON CONFLICT DO NOTHING`
+	}
+	if _, err := tx.ExecContext(ctx, stmt, args...); err != nil {
+		return false, fmt.Errorf("aggregate %s to %s: %w", start.Format(time.RFC3339), stop.Format(time.RFC3339), err)
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE telemetry_rollup_state SET watermark = $2 WHERE tier = $1`, tier.Name, stop); err != nil {
+		return false, fmt.Errorf("advance watermark: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return !stop.Before(end), nil
+}
+
+// mergeLate merges the next batch of queued late samples into every tier whose
+// watermark has passed them, and reports whether the queue is empty. A tier not yet
+// past a sample picks it up from the tier below as usual. The counts, sums, extremes
+// and newest values combine exactly, so the samples rolled up before are not needed.
+func (s *PostgresStore) mergeLate(ctx context.Context) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// Every tier is locked, so none rolls up a chunk from buckets being merged into.
+	watermarks := make(map[string]sql.NullTime)
+	rows, err := tx.QueryContext(ctx, `SELECT tier, watermark FROM telemetry_rollup_state ORDER BY tier FOR UPDATE`)
+	if err != nil {
+		return false, fmt.Errorf("lock state: %w", err)
+	}
+	for rows.Next() {
+		var tier string
+		var watermark sql.NullTime
+		if err := rows.Scan(&tier, &watermark); err != nil {
+			rows.Close()
+			return false, fmt.Errorf("scan state: %w", err)
+		}
+		watermarks[tier] = watermark
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, fmt.Errorf("iterate state: %w", err)
+	}
+
+	var ids []int64
+	var collected []time.Time
+	rows, err = tx.QueryContext(ctx, `
+		DELETE FROM telemetry_rollup_late WHERE ctid IN (SELECT ctid FROM telemetry_rollup_late LIMIT $1)
+		RETURNING record_id, collected_at`, lateBatch)
+	if err != nil {
+		return false, fmt.Errorf("dequeue: %w", err)
+	}
+	for rows.Next() {
+		var id int64
+		var at time.Time
+		if err := rows.Scan(&id, &at); err != nil {
+			rows.Close()
+			return false, fmt.Errorf("scan late sample: %w", err)
+		}
+		ids = append(ids, id)
+		collected = append(collected, at)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, fmt.Errorf("iterate late samples: %w", err)
+	}
+	if len(ids) == 0 {
+		return true, nil
+	}
+
+	stmt := `INSERT INTO telemetry_rollups AS o (` + rollupColumns + `)
+		` + rollupRawSelect(`unnest($1::bigint[], $2::timestamptz[]) AS l (record_id, collected_at)
+			JOIN telemetry_records r ON r.id = l.record_id AND r.collected_at = l.collected_at`, `r.collected_at < $5`) + `
+		ON CONFLICT (tier, agent_id, name, bucket, labels) DO UPDATE SET
+			sample_count = o.sample_count + EXCLUDED.sample_count,
+			value_sum = o.value_sum + EXCLUDED.value_sum,
+			value_min = LEAST(o.value_min, EXCLUDED.value_min),
+			value_max = GREATEST(o.value_max, EXCLUDED.value_max),
+			value_last = CASE WHEN EXCLUDED.last_at >= o.last_at THEN EXCLUDED.value_last ELSE o.value_last END,
+			last_at = GREATEST(o.last_at, EXCLUDED.last_at)`
+	for _, tier := range Tiers {
+		watermark := watermarks[tier.Name]
+		if !watermark.Valid {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, stmt, ids, collected, tier.Resolution.Seconds(), tier.Name, watermark.Time); err != nil {
+			return false, fmt.Errorf("merge into %s: %w", tier.Name, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return len(ids) < lateBatch, nil
+}
+
+// Prune drops raw sample partitions and deletes rollup buckets older than their
+// retention. Each batch of buckets is its own statement, so pruning a large backlog
+// never holds locks for long.
+func (s *PostgresStore) Prune(ctx context.Context, retention Retention, now time.Time, batch int) (PruneStats, error) {
+	watermarks := make(map[string]sql.NullTime)
+	rows, err := s.db.QueryContext(ctx, `SELECT tier, watermark FROM telemetry_rollup_state`)
+	if err != nil {
+		return PruneStats{}, fmt.Errorf("query rollup state: %w", err)
+	}
+	for rows.Next() {
+		var tier string
+		var watermark sql.NullTime
+		if err := rows.Scan(&tier, &watermark); err != nil {
+			rows.Close()
+			return PruneStats{}, fmt.Errorf("scan rollup state: %w", err)
+		}
+		watermarks[tier] = watermark
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return PruneStats{}, fmt.Errorf("iterate rollup state: %w", err)
+	}
+
+	// cutoff returns the time data kept for keep is deleted before, false to keep it
+	// all. next is the tier rolled up from this data, empty for the coarsest.
+	cutoff := func(keep time.Duration, next string) (time.Time, bool) {
+		if keep <= 0 {
+			return time.Time{}, false
+		}
+		at := now.Add(-keep)
+		if retention.AfterRollup && next != "" {
+			watermark := watermarks[next]
+			if !watermark.Valid {
+				return time.Time{}, false
+			}
+			if watermark.Time.Before(at) {
+				at = watermark.Time
+			}
+		}
+		return at, true
+	}
+
+	var stats PruneStats
+	if at, ok := cutoff(retention.Raw, Tiers[0].Name); ok {
+		dropped, err := s.dropPartitions(ctx, at, batch)
+		stats = dropped
+		if err != nil {
+			return stats, fmt.Errorf("prune samples: %w", err)
+		}
+	}
+	for i, tier := range Tiers {
+		var next string
+		if i+1 < len(Tiers) {
+			next = Tiers[i+1].Name
+		}
+		at, ok := cutoff(retention.Tiers[tier.Name], next)
+		if !ok {
+			continue
+		}
+		n, err := s.deleteBatches(ctx, batch, `DELETE FROM telemetry_rollups WHERE ctid IN (SELECT ctid FROM telemetry_rollups WHERE tier = $3 AND bucket < $1 LIMIT $2)`, at, tier.Name)
+		stats.Rows += n
+		if err != nil {
+			return stats, fmt.Errorf("prune %s rollups: %w", tier.Name, err)
+		}
+	}
+	return stats, nil
+}
+
+// deleteBatches runs stmt, which deletes up to $2 rows older than $1, until a batch
+// comes back short.
+func (s *PostgresStore) deleteBatches(ctx context.Context, batch int, stmt string, before time.Time, args ...any) (int64, error) {
+	var deleted int64
+	for {
+		result, err := s.db.ExecContext(ctx, stmt, append([]any{before, batch}, args...)...)
+		if err != nil {
+			return deleted, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return deleted, err
+		}
+		deleted += n
+		if n < int64(batch) {
+			return deleted, nil
+		}
+	}
+}
+
+// rollupTier returns the coarsest tier able to answer query: its resolution divides the
+// step and from is aligned to it, so every bucket falls within a single step.
+func rollupTier(query RangeQuery) (Tier, bool) {
+	if !slices.Contains(rollupAggregations, query.Agg) {
+		return Tier{}, false
+	}
+	for _, tier := range slices.Backward(Tiers) {
+		if query.Step%tier.Resolution == 0 && query.From.Truncate(tier.Resolution).Equal(query.From) {
+			return tier, true
+		}
+	}
+	return Tier{}, false
+}
+
+// queryRollups answers query from tier up to the tier's watermark, then from each finer
+// tier in turn up to its own watermark, and from raw samples after the finest, combining
+// all of them as rollup-shaped rows. A coarse tier lags its source by up to a bucket, so
+// the finer tiers answer that span even once its raw samples have expired. Buckets ending
+// after query.To are left to the finer tiers and the raw samples, so the range is
+// honoured exactly.
+func (s *PostgresStore) queryRollups(ctx context.Context, agentID string, query RangeQuery, tier Tier) ([]Point, error) {
+	args := []any{agentID, query.Step.Microseconds(), query.From, query.To, query.Metric}
+	value, from := "v.value", "telemetry_records r"
+	if column, ok := metricColumns[query.Metric]; ok {
+		value = "r." + column
+	} else {
+		from += " JOIN telemetry_values v ON v.record_id = r.id AND v.collected_at = r.collected_at AND v.name = $5"
+	}
+	var rollupFilter, rawFilter string
+	if len(query.Selector) > 0 {
+		filter, err := encodeLabels(query.Selector)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, filter)
+		rollupFilter = fmt.Sprintf(" AND o.labels @> $%d", len(args))
+		rawFilter = fmt.Sprintf(" AND r.labels @> $%d", len(args))
+	}
+
+	// Each tier, from the coarsest, covers from where the one before it stopped up to its
+	// own watermark; splitN is where the tier N steps finer than the coarsest stops.
+	var splits, parts []string
+	previous := "$3::timestamptz"
+	for _, part := range slices.Backward(Tiers[:slices.Index(Tiers, tier)+1]) {
+		n := len(splits)
+		args = append(args, part.Name, query.To.Truncate(part.Resolution))
+		name, at := fmt.Sprintf("$%d", len(args)-1), fmt.Sprintf("$%d", len(args))
+		splits = append(splits, fmt.Sprintf(`split%d AS (
+			SELECT GREATEST(%s, LEAST(
+				COALESCE((SELECT watermark FROM telemetry_rollup_state WHERE tier = %s), '-infinity'),
+				%s::timestamptz)) AS at
+		)`, n, previous, name, at))
+		parts = append(parts, fmt.Sprintf(`
+			SELECT o.bucket AS at, o.sample_count, o.value_sum, o.value_min, o.value_max, o.value_last, o.last_at
+			FROM telemetry_rollups o
+			WHERE o.tier = %s AND o.agent_id = $1 AND o.name = $5 AND o.bucket >= %s AND o.bucket < (SELECT at FROM split%d)`, name, previous, n)+rollupFilter)
+		previous = fmt.Sprintf("(SELECT at FROM split%d)", n)
+	}
+	parts = append(parts, `
+			SELECT r.collected_at, 1, x, x, x, x, r.collected_at
+			FROM `+from+`, LATERAL (SELECT `+value+`::double precision AS x) AS s
+			WHERE r.agent_id = $1 AND r.collected_at >= `+previous+` AND r.collected_at < $4`+rawFilter)
+
+	stmt := `WITH ` + strings.Join(splits, ", ") + `, parts AS (` + strings.Join(parts, `
+			UNION ALL`) + `
+		)
+		SELECT date_bin($2::double precision * interval '1 microsecond', at, $3) AS bucket, ` + combineSQL(query.Agg) + `
+		FROM parts GROUP BY bucket ORDER BY bucket`
+	return s.queryPoints(ctx, stmt, args...)
+}
+
+// combineSQL returns the SQL aggregate computing agg over rollup-shaped rows.
+func combineSQL(agg Aggregation) string {
+	switch agg {
+	case AggMin:
+		return "min(value_min)"
+	case AggMax:
+		return "max(value_max)"
+	case AggSum:
+		return "sum(value_sum)"
+	case AggCount:
+		return "sum(sample_count)::double precision"
+	case AggLast:
+		return "(array_agg(value_last ORDER BY last_at DESC))[1]"
+	default: // AggAvg
+		return "sum(value_sum) / sum(sample_count)"
+	}
+}
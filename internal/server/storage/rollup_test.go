@@ -0,0 +1,288 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+)
+
+var rollupEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// bucket is the cpuUsage aggregate of one rollup bucket.
+type bucket struct {
+	count               int64
+	sum, min, max, last float64
+}
+
+func readBucket(t *testing.T, store *PostgresStore, tier string, at time.Time) (bucket, bool) {
+	t.Helper()
+	var b bucket
+	err := store.db.QueryRowContext(context.Background(), `
+		SELECT sample_count, value_sum, value_min, value_max, value_last FROM telemetry_rollups
+		WHERE tier = $1 AND agent_id = 'a' AND name = 'cpuUsage' AND bucket = $2`, tier, at,
+	).Scan(&b.count, &b.sum, &b.min, &b.max, &b.last)
+	if errors.Is(err, sql.ErrNoRows) {
+		return bucket{}, false
+	}
+	if err != nil {
+		t.Fatalf("read %s bucket %s: %v", tier, at.Format(time.TimeOnly), err)
+	}
+	return b, true
+}
+
+func readWatermark(t *testing.T, store *PostgresStore, tier string) sql.NullTime {
+	t.Helper()
+	var watermark sql.NullTime
+	if err := store.db.QueryRowContext(context.Background(), `SELECT watermark FROM telemetry_rollup_state WHERE tier = $1`, tier).Scan(&watermark); err != nil {
+		t.Fatal(err)
+	}
+	return watermark
+}
+
+func saveCPU(t *testing.T, store *PostgresStore, offset time.Duration, cpu float64) {
+	t.Helper()
+	record := Record{AgentID: "a", CollectedAt: rollupEpoch.Add(offset), CPUUsage: cpu}
+	if err := store.SaveBatch(context.Background(), []Record{record}); err != nil {
+		t.Fatalf("save sample at %s: %v", offset, err)
+	}
+}
+
+func TestPostgresRollupChunk(t *testing.T) {
+	store := openTestPostgres(t)
+	ctx := context.Background()
+
+	saveCPU(t, store, 10*time.Second, 1)
+	saveCPU(t, store, 50*time.Second, 3)
+	saveCPU(t, store, 70*time.Second, 5)
+	saveCPU(t, store, 90*time.Minute, 7)
+
+	// The 1-minute tier advances an hour per chunk, up to the last complete minute.
+	until := rollupEpoch.Add(100*time.Minute + 30*time.Second)
+	for n, wantDone := range []bool{false, true} {
+		done, err := store.rollupChunk(ctx, 0, until)
+		if err != nil {
+			t.Fatalf("chunk %d: %v", n, err)
+		}
+		if done != wantDone {
+			t.Fatalf("chunk %d done = %t, want %t", n, done, wantDone)
+		}
+	}
+	if watermark := readWatermark(t, store, "1m"); !watermark.Time.Equal(rollupEpoch.Add(100 * time.Minute)) {
+		t.Fatalf("1m watermark = %v, want 01:40", watermark)
+	}
+	for _, tt := range []struct {
+		at   time.Duration
+		want bucket
+	}{
+		{0, bucket{2, 4, 1, 3, 3}},
+		{time.Minute, bucket{1, 5, 5, 5, 5}},
+		{90 * time.Minute, bucket{1, 7, 7, 7, 7}},
+	} {
+		if got, _ := readBucket(t, store, "1m", rollupEpoch.Add(tt.at)); got != tt.want {
+			t.Fatalf("1m bucket at %s = %+v, want %+v", tt.at, got, tt.want)
+		}
+	}
+
+	// The 1-hour tier only reaches the last hour the 1-minute tier has completed.
+	if done, err := store.rollupChunk(ctx, 1, until); err != nil || !done {
+		t.Fatalf("1h chunk = %t, %v", done, err)
+	}
+	if got, _ := readBucket(t, store, "1h", rollupEpoch); got != (bucket{3, 9, 1, 5, 5}) {
+		t.Fatalf("1h bucket = %+v", got)
+	}
+	if _, ok := readBucket(t, store, "1h", rollupEpoch.Add(time.Hour)); ok {
+		t.Fatal("1h bucket of the incomplete hour rolled up")
+	}
+	if done, err := store.rollupChunk(ctx, 2, until); err != nil || !done {
+		t.Fatalf("1d chunk = %t, %v", done, err)
+	}
+	if watermark := readWatermark(t, store, "1d"); watermark.Valid {
+		t.Fatalf("1d watermark = %v before a day is complete", watermark.Time)
+	}
+}
+
+func TestPostgresRollupMergesLateSamples(t *testing.T) {
+	store := openTestPostgres(t)
+	ctx := context.Background()
+
+	saveCPU(t, store, 10*time.Second, 1)
+	saveCPU(t, store, 50*time.Second, 3)
+	saveCPU(t, store, 70*time.Minute, 5)
+	until := rollupEpoch.Add(2 * time.Hour)
+	if err := store.Rollup(ctx, until); err != nil {
+		t.Fatal(err)
+	}
+
+	// Late samples in minutes and hours already rolled up, one stored by Save.
+	saveCPU(t, store, 20*time.Second, 9)
+	if err := store.Save(ctx, Record{AgentID: "a", CollectedAt: rollupEpoch.Add(70*time.Minute + 30*time.Second), CPUUsage: 2}); err != nil {
+		t.Fatal(err)
+	}
+	// A duplicate of a stored sample is neither stored nor queued.
+	saveCPU(t, store, 50*time.Second, 3)
+	if err := store.Rollup(ctx, until); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		tier string
+		at   time.Duration
+		want bucket
+	}{
+		// The newest sample of the minute stays the last value.
+		{"1m", 0, bucket{3, 13, 1, 9, 3}},
+		{"1m", 70 * time.Minute, bucket{2, 7, 2, 5, 2}},
+		{"1h", 0, bucket{3, 13, 1, 9, 3}},
+		{"1h", time.Hour, bucket{2, 7, 2, 5, 2}},
+	} {
+		if got, _ := readBucket(t, store, tt.tier, rollupEpoch.Add(tt.at)); got != tt.want {
+			t.Fatalf("%s bucket at %s = %+v, want %+v", tt.tier, tt.at, got, tt.want)
+		}
+	}
+	var queued int
+	if err := store.db.QueryRowContext(ctx, `SELECT count(*) FROM telemetry_rollup_late`).Scan(&queued); err != nil {
+		t.Fatal(err)
+	}
+	if queued != 0 {
+		t.Fatalf("%d late samples still queued", queued)
+	}
+}
+
+func TestPostgresPrune(t *testing.T) {
+	store := openTestPostgres(t)
+	ctx := context.Background()
+
+	saveCPU(t, store, 10*time.Second, 1)
+	saveCPU(t, store, 70*time.Second, 2)
+	saveCPU(t, store, 130*time.Second, 3)
+	if err := store.Rollup(ctx, rollupEpoch.Add(3*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	retention := Retention{Tiers: map[string]time.Duration{"1m": time.Minute}}
+	now := rollupEpoch.Add(2*time.Minute + 30*time.Second)
+
+	// Nothing the 1-hour tier has not rolled up yet is deleted.
+	retention.AfterRollup = true
+	stats, err := store.Prune(ctx, retention, now, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Rows != 0 {
+		t.Fatalf("pruned %d rows before the next tier rolled them up", stats.Rows)
+	}
+
+	retention.AfterRollup = false
+	stats, err = store.Prune(ctx, retention, now, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Rows == 0 {
+		t.Fatal("pruned no expired buckets")
+	}
+	for _, tt := range []struct {
+		at   time.Duration
+		kept bool
+	}{{0, false}, {time.Minute, false}, {2 * time.Minute, true}} {
+		if _, ok := readBucket(t, store, "1m", rollupEpoch.Add(tt.at)); ok != tt.kept {
+			t.Fatalf("1m bucket at %s kept = %t, want %t", tt.at, ok, tt.kept)
+		}
+	}
+
+	// Raw samples go a whole partition at a time, once all of it has expired.
+	stats, err = store.Prune(ctx, Retention{Raw: time.Hour}, time.Now(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Partitions != 0 {
+		t.Fatalf("dropped %d partitions still holding unexpired samples", stats.Partitions)
+	}
+	stats, err = store.Prune(ctx, Retention{Raw: time.Hour}, time.Now().Add(30*24*time.Hour), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Partitions == 0 {
+		t.Fatal("dropped no expired partitions")
+	}
+	page, err := store.List(ctx, "a", RecordQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Records) != 0 {
+		t.Fatalf("%d expired samples left", len(page.Records))
+	}
+}
+
+func TestPostgresQueryRollups(t *testing.T) {
+	store := openTestPostgres(t)
+	ctx := context.Background()
+
+	for i, cpu := range []float64{1, 2, 3, 4, 5, 6} {
+		saveCPU(t, store, time.Duration(i)*30*time.Second, cpu)
+	}
+	if err := store.Rollup(ctx, rollupEpoch.Add(2*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	// Mark the rolled-up minutes, so the result shows which side answered each step.
+	if _, err := store.db.ExecContext(ctx, `UPDATE telemetry_rollups SET value_sum = value_sum + 100 WHERE tier = '1m' AND name = 'cpuUsage'`); err != nil {
+		t.Fatal(err)
+	}
+
+	query := RangeQuery{Metric: "cpuUsage", From: rollupEpoch, To: rollupEpoch.Add(3 * time.Minute), Step: time.Minute, Agg: AggSum}
+	points, err := store.queryRollups(ctx, "a", query, Tiers[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []float64{103, 107, 11}
+	if len(points) != len(want) {
+		t.Fatalf("points = %+v, want sums %v", points, want)
+	}
+	for i, w := range want {
+		if !points[i].Time.Equal(rollupEpoch.Add(time.Duration(i)*time.Minute)) || points[i].Value != w {
+			t.Fatalf("points = %+v, want sums %v a minute apart", points, want)
+		}
+	}
+
+	// A range ending mid-bucket reads that bucket from raw samples.
+	query.To = rollupEpoch.Add(90 * time.Second)
+	if points, err = store.queryRollups(ctx, "a", query, Tiers[0]); err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 2 || points[0].Value != 103 || points[1].Value != 3 {
+		t.Fatalf("points = %+v, want sums [103 3]", points)
+	}
+}
+
+func TestPostgresQueryRollupsFallsBackTierByTier(t *testing.T) {
+	store := openTestPostgres(t)
+	ctx := context.Background()
+
+	day := 24 * time.Hour
+	saveCPU(t, store, time.Hour, 1)
+	saveCPU(t, store, day+time.Hour, 10)
+	saveCPU(t, store, day+2*time.Hour+30*time.Minute, 100)
+	saveCPU(t, store, day+2*time.Hour+50*time.Minute, 1000)
+	if err := store.Rollup(ctx, rollupEpoch.Add(day+2*time.Hour+45*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	// The day tier only has the first day, the hour tier runs two hours past it and the
+	// minute tier 45 minutes further.
+	for tier, want := range map[string]time.Duration{"1d": day, "1h": day + 2*time.Hour, "1m": day + 2*time.Hour + 45*time.Minute} {
+		if watermark := readWatermark(t, store, tier); !watermark.Valid || !watermark.Time.Equal(rollupEpoch.Add(want)) {
+			t.Fatalf("%s watermark = %v, want %s", tier, watermark, rollupEpoch.Add(want))
+		}
+	}
+	// Expire every raw sample the minute tier holds.
+	if _, err := store.db.ExecContext(ctx, `DELETE FROM telemetry_records WHERE collected_at < $1`, rollupEpoch.Add(day+2*time.Hour+45*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	points, err := store.QueryRange(ctx, "a", RangeQuery{Metric: "cpuUsage", From: rollupEpoch, To: rollupEpoch.Add(2 * day), Step: day, Agg: AggSum})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 2 || points[0].Value != 1 || points[1].Value != 1110 {
+		t.Fatalf("points = %+v, want sums [1 1110] from the day, hour and minute tiers and raw samples", points)
+	}
+}
@@ -1,3 +1,69 @@
 package storage
 
-// The generic Store interface was removed during simplification; only PostgresStore remains.
+import (
+	"context"
+	"errors"
+)
+
+// Store is the persistence contract the server is built on. PostgresStore and the
+// embedded BoltStore are durable; MemoryStore keeps everything in process for demos and
+// tests.
+type Store interface {
+	RecordStore
+	PolicyStore
+	TokenStore
+
+	// Close releases the resources held by the store.
+	Close() error
+}
+
+// RecordStore persists telemetry samples.
+type RecordStore interface {
+	// Save stores a record; records without an agent id are rejected. A record is
+	// skipped when its agent already has one collected at the same instant.
+	Save(ctx context.Context, record Record) error
+	// SaveBatch stores records atomically: all of them or, on error, none. Like Save it
+	// skips records already stored, so retrying a batch after an error never stores a
+	// record twice, even when the error hid a successful commit.
+	SaveBatch(ctx context.Context, records []Record) error
+	// List returns a page of an agent's records selected by query.
+	List(ctx context.Context, agentID string, query RecordQuery) (RecordPage, error)
+	// QueryRange resamples one metric of an agent into fixed steps.
+	QueryRange(ctx context.Context, agentID string, query RangeQuery) ([]Point, error)
+	// Latest returns the newest record of an agent whose labels match selector.
+	Latest(ctx context.Context, agentID string, selector Labels) (Record, bool, error)
+	// Agents lists, in order, the agents with stored records matching selector.
+	Agents(ctx context.Context, selector Labels) ([]string, error)
+}
+
+// PolicyStore persists remote configuration policies and the versions agents acknowledged.
+type PolicyStore interface {
+	Policies(ctx context.Context) ([]Policy, error)
+	// SavePolicy creates or replaces a policy under a version greater than any before.
+	SavePolicy(ctx context.Context, policy Policy) (Policy, error)
+	DeletePolicy(ctx context.Context, name string) (bool, error)
+	SaveConfigAck(ctx context.Context, ack ConfigAck) error
+	ConfigAcks(ctx context.Context) ([]ConfigAck, error)
+}
+
+// TokenStore persists agent credentials by the hash of their secret.
+type TokenStore interface {
+	CreateToken(ctx context.Context, token Token, hash []byte) (Token, error)
+	TokenByHash(ctx context.Context, hash []byte) (Token, bool, error)
+	Tokens(ctx context.Context) ([]Token, error)
+	RevokeToken(ctx context.Context, id string) (bool, error)
+	// EnrollAgent atomically consumes a bootstrap token and stores the agent credential
+	// issued in exchange, returning ErrTokenRejected when the bootstrap token is unusable.
+	EnrollAgent(ctx context.Context, bootstrapHash []byte, agentID string, credential Token, credentialHash []byte) (Token, error)
+}
+
+var (
+	_ Store = (*PostgresStore)(nil)
+	_ Store = (*MemoryStore)(nil)
+	_ Store = (*BoltStore)(nil)
+)
+
+var (
+	errMissingAgentID = errors.New("record missing agent id")
+	errAgentRequired  = errors.New("agent id must be provided")
+)
@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"time"
+)
+
+// Token kinds. Agent tokens authenticate metric streams; bootstrap tokens can only be
+// exchanged, once, for an agent token.
+const (
+	TokenAgent     = "agent"
+	TokenBootstrap = "bootstrap"
+)
+
+// ErrTokenRejected is returned when a bootstrap token is unknown, used, revoked, expired
+// or not valid for the enrolling agent.
+var ErrTokenRejected = errors.New("token rejected")
+
+// Token is an agent credential. Only a hash of the secret is stored, so the secret is
+// shown once when the token is issued.
+type Token struct {
+	ID   string `json:"id"`
+	Kind string `json:"kind"`
+	// AgentID is the agent the token is scoped to, or a path.Match pattern of agent IDs.
+	AgentID     string     `json:"agentId"`
+	Description string     `json:"description,omitempty"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	ExpiresAt   *time.Time `json:"expiresAt,omitempty"`
+	RevokedAt   *time.Time `json:"revokedAt,omitempty"`
+	UsedAt      *time.Time `json:"usedAt,omitempty"`
+}
+
+// Validate checks the fields an operator can set.
+func (t Token) Validate() error {
+	var errs []error
+	if t.Kind != TokenAgent && t.Kind != TokenBootstrap {
+		errs = append(errs, fmt.Errorf("kind must be %q or %q, got %q", TokenAgent, TokenBootstrap, t.Kind))
+	}
+	if t.AgentID == "" {
+		errs = append(errs, errors.New("agentId must be provided"))
+	} else if _, err := path.Match(t.AgentID, ""); err != nil {
+		errs = append(errs, fmt.Errorf("agentId pattern %q: %w", t.AgentID, err))
+	}
+	return errors.Join(errs...)
+}
+
+// Active reports whether the token is accepted at now.
+func (t Token) Active(now time.Time) bool {
+	if t.RevokedAt != nil || (t.ExpiresAt != nil && !now.Before(*t.ExpiresAt)) {
+		return false
+	}
+	return t.Kind != TokenBootstrap || t.UsedAt == nil
+}
+
+// Allows reports whether the token may act as agentID.
+func (t Token) Allows(agentID string) bool {
+	ok, _ := path.Match(t.AgentID, agentID)
+	return ok
+}
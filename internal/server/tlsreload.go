@@ -0,0 +1,117 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"telemetry-agent/internal/filewatch"
+)
+
+// CertReloader serves the server certificate and, with mutual TLS, the client CA bundle
+// from disk and swaps them in place when the files change, so certificates can be
+// rotated without dropping agent streams.
+type CertReloader struct {
+	certPath, keyPath, caPath string
+	logger                    *slog.Logger
+
+	cert    atomic.Pointer[tls.Certificate]
+	mtlsCfg atomic.Pointer[tls.Config]
+}
+
+// NewCertReloader loads the certificate, key and client CA configured in cfg. Unlike
+// later reloads, a failure here is returned.
+func NewCertReloader(cfg Config, logger *slog.Logger) (*CertReloader, error) {
+	c := &CertReloader{
+		certPath: cfg.TLSCertPath,
+		keyPath:  cfg.TLSKeyPath,
+		caPath:   cfg.ClientCAPath,
+		logger:   logger,
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// TLSConfig returns a server configuration that always presents the current certificate
+// and, with mutual TLS, verifies clients against the current CA bundle.
+func (c *CertReloader) TLSConfig() *tls.Config {
+	cfg := &tls.Config{GetCertificate: c.getCertificate}
+	if c.caPath != "" {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return c.mtlsCfg.Load(), nil
+		}
+	}
+	return cfg
+}
+
+// AdminTLSConfig returns a server configuration that presents the current certificate
+// without asking for a client certificate, for listeners that authenticate callers by
+// other means.
+func (c *CertReloader) AdminTLSConfig() *tls.Config {
+	return &tls.Config{GetCertificate: c.getCertificate}
+}
+
+// Watch polls the files every period and reloads them after a change until ctx is
+// cancelled. Invalid material is logged and the current certificates stay in use.
+func (c *CertReloader) Watch(ctx context.Context, period time.Duration) {
+	filewatch.Watch(ctx, period, func() {
+		if err := c.load(); err != nil {
+			c.logger.Error("tls reload rejected, keeping current certificates", "error", err)
+		}
+	}, c.certPath, c.keyPath, c.caPath)
+}
+
+func (c *CertReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.cert.Load(), nil
+}
+
+// load validates the files and installs them only if all of them are usable.
+func (c *CertReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(c.certPath, c.keyPath)
+	if err != nil {
+		return fmt.Errorf("load server certificate: %w", err)
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return fmt.Errorf("parse server certificate: %w", err)
+		}
+	}
+	if time.Now().After(leaf.NotAfter) {
+		return fmt.Errorf("server certificate %s expired at %s", c.certPath, leaf.NotAfter.Format(time.RFC3339))
+	}
+
+	var mtlsCfg *tls.Config
+	if c.caPath != "" {
+		pem, err := os.ReadFile(c.caPath)
+		if err != nil {
+			return fmt.Errorf("read client ca: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("append client ca: not a valid PEM block")
+		}
+		mtlsCfg = &tls.Config{
+			GetCertificate: c.getCertificate,
+			ClientAuth:     tls.RequireAndVerifyClientCert,
+			ClientCAs:      pool,
+			// Per-connection configs bypass grpc's defaults, so ALPN must be set here.
+			NextProtos: []string{"h2"},
+		}
+	}
+
+	c.cert.Store(&cert)
+	if mtlsCfg != nil {
+		c.mtlsCfg.Store(mtlsCfg)
+	}
+	c.logger.Info("tls certificates loaded", "subject", leaf.Subject.String(), "not_after", leaf.NotAfter, "client_ca", c.caPath)
+	return nil
+}
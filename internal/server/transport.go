@@ -0,0 +1,32 @@
+package server
+
+import (
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+
+	_ "telemetry-agent/internal/transport" // registers the gzip and zstd compressors
+)
+
+// GRPCOptions translates the transport settings of cfg into gRPC server options. Agents
+// choose their compression; every compressor they may use is registered.
+func (c Config) GRPCOptions() []grpc.ServerOption {
+	opts := []grpc.ServerOption{
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:    c.KeepaliveTime,
+			Timeout: c.KeepaliveTimeout,
+		}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             c.KeepaliveMinTime,
+			PermitWithoutStream: true,
+		}),
+		grpc.MaxRecvMsgSize(c.MaxMessageBytes),
+		grpc.MaxSendMsgSize(c.MaxMessageBytes),
+	}
+	if c.InitialWindowSize > 0 {
+		opts = append(opts, grpc.InitialWindowSize(int32(c.InitialWindowSize)))
+	}
+	if c.InitialConnWindowSize > 0 {
+		opts = append(opts, grpc.InitialConnWindowSize(int32(c.InitialConnWindowSize)))
+	}
+	return opts
+}
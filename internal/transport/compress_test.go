@@ -0,0 +1,188 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/test/bufconn"
+
+	"telemetry-agent/pkg/api"
+)
+
+func compress(t *testing.T, c encoding.Compressor, payload []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := c.Compress(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// A second Close must not hand the encoder to the pool twice.
+	if err := w.Close(); err != nil {
+		t.Fatalf("second close: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func decompress(t *testing.T, c encoding.Compressor, compressed []byte) []byte {
+	t.Helper()
+	r, err := c.Decompress(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Reading past the end after the decoder went back to the pool stays at EOF.
+	if n, err := r.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Fatalf("read after EOF = %d, %v", n, err)
+	}
+	return out
+}
+
+func TestCompressorsRoundTrip(t *testing.T) {
+	payload := []byte(strings.Repeat(`{"agent":"web-1","cpu":0.25}`, 200))
+	for _, name := range Compressions {
+		if name == CompressionNone {
+			continue
+		}
+		t.Run(name, func(t *testing.T) {
+			c := encoding.GetCompressor(name)
+			if c == nil {
+				t.Fatalf("compressor %q is not registered", name)
+			}
+			compressed := compress(t, c, payload)
+			if len(compressed) >= len(payload)/4 {
+				t.Errorf("compressed %d bytes to %d", len(payload), len(compressed))
+			}
+			if got := decompress(t, c, compressed); !bytes.Equal(got, payload) {
+				t.Fatalf("round trip returned %d bytes, want the %d sent", len(got), len(payload))
+			}
+		})
+	}
+}
+
+func TestZstdReusesCodersAcrossMessages(t *testing.T) {
+	c := encoding.GetCompressor(CompressionZstd)
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 50 {
+				payload := bytes.Repeat([]byte{byte(i), byte(j)}, 100+j)
+				if got := decompress(t, c, compress(t, c, payload)); !bytes.Equal(got, payload) {
+					t.Errorf("message %d/%d corrupted by a shared coder", i, j)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// recordingServer counts the samples received over StreamMetrics.
+type recordingServer struct {
+	api.UnimplementedTelemetryServer
+	received atomic.Int64
+}
+
+func (s *recordingServer) StreamMetrics(stream grpc.BidiStreamingServer[api.Metric, api.ServerMessage]) error {
+	for {
+		if _, err := stream.Recv(); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		s.received.Add(1)
+	}
+}
+
+// countingConn counts the bytes written through it.
+type countingConn struct {
+	net.Conn
+	written *atomic.Int64
+}
+
+func (c countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+// streamBytes streams samples to a server over an in-memory connection compressed with
+// name and returns how many bytes the client wrote.
+func streamBytes(t *testing.T, name string, samples int) int64 {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	recorder := &recordingServer{}
+	api.RegisterTelemetryServer(srv, recorder)
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	var written atomic.Int64
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			c, err := lis.DialContext(ctx)
+			return countingConn{Conn: c, written: &written}, err
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var opts []grpc.CallOption
+	if name != CompressionNone {
+		opts = append(opts, grpc.UseCompressor(name))
+	}
+	stream, err := api.NewTelemetryClient(conn).StreamMetrics(context.Background(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]float64)
+	for i := range 50 {
+		values["collector.process."+strings.Repeat("x", i)] = float64(i)
+	}
+	for range samples {
+		if err := stream.Send(&api.Metric{AgentId: "web-1", Values: values}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Fatalf("stream ended with %v", err)
+	}
+	if got := recorder.received.Load(); got != int64(samples) {
+		t.Fatalf("server received %d samples over %s, want %d", got, name, samples)
+	}
+	return written.Load()
+}
+
+func TestStreamCompression(t *testing.T) {
+	plain := streamBytes(t, CompressionNone, 20)
+	for _, name := range []string{CompressionGzip, CompressionZstd} {
+		if compressed := streamBytes(t, name, 20); compressed >= plain/2 {
+			t.Errorf("%s stream wrote %d bytes, want well under the %d of an uncompressed one", name, compressed, plain)
+		}
+	}
+}
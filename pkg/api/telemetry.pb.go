@@ -9,6 +9,7 @@ package api
 import (
 	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
 	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	durationpb "google.golang.org/protobuf/types/known/durationpb"
 	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
 	reflect "reflect"
 	sync "sync"
@@ -36,8 +37,15 @@ type Metric struct {
 	LoadAvg_15     float64                `protobuf:"fixed64,10,opt,name=load_avg_15,json=loadAvg15,proto3" json:"load_avg_15,omitempty"`
 	DiskReadBytes  uint64                 `protobuf:"varint,11,opt,name=disk_read_bytes,json=diskReadBytes,proto3" json:"disk_read_bytes,omitempty"`
 	DiskWriteBytes uint64                 `protobuf:"varint,12,opt,name=disk_write_bytes,json=diskWriteBytes,proto3" json:"disk_write_bytes,omitempty"`
-	unknownFields  protoimpl.UnknownFields
-	sizeCache      protoimpl.SizeCache
+	Labels         map[string]string      `protobuf:"bytes,13,rep,name=labels,proto3" json:"labels,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	// Version of the last remote configuration the agent received (0 when none).
+	ConfigVersion uint64 `protobuf:"varint,14,opt,name=config_version,json=configVersion,proto3" json:"config_version,omitempty"`
+	// Why the agent rejected the configuration at config_version; empty when applied.
+	ConfigError string `protobuf:"bytes,15,opt,name=config_error,json=configError,proto3" json:"config_error,omitempty"`
+	// Additional named values such as probe results.
+	Values        map[string]float64 `protobuf:"bytes,16,rep,name=values,proto3" json:"values,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"fixed64,2,opt,name=value"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
 }
 
 func (x *Metric) Reset() {
@@ -154,11 +162,271 @@ func (x *Metric) GetDiskWriteBytes() uint64 {
 	return 0
 }
 
+func (x *Metric) GetLabels() map[string]string {
+	if x != nil {
+		return x.Labels
+	}
+	return nil
+}
+
+func (x *Metric) GetConfigVersion() uint64 {
+	if x != nil {
+		return x.ConfigVersion
+	}
+	return 0
+}
+
+func (x *Metric) GetConfigError() string {
+	if x != nil {
+		return x.ConfigError
+	}
+	return ""
+}
+
+func (x *Metric) GetValues() map[string]float64 {
+	if x != nil {
+		return x.Values
+	}
+	return nil
+}
+
+// AgentConfig is remote configuration pushed by the server. Unset fields leave the
+// agent's local setting in place; version 0 withdraws any earlier remote configuration.
+type AgentConfig struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Version       uint64                 `protobuf:"varint,1,opt,name=version,proto3" json:"version,omitempty"`
+	Interval      *durationpb.Duration   `protobuf:"bytes,2,opt,name=interval,proto3" json:"interval,omitempty"`
+	Collectors    []string               `protobuf:"bytes,3,rep,name=collectors,proto3" json:"collectors,omitempty"`
+	ProbeTargets  []string               `protobuf:"bytes,4,rep,name=probe_targets,json=probeTargets,proto3" json:"probe_targets,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AgentConfig) Reset() {
+	*x = AgentConfig{}
+	mi := &file_pkg_api_telemetry_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AgentConfig) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AgentConfig) ProtoMessage() {}
+
+func (x *AgentConfig) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_api_telemetry_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AgentConfig.ProtoReflect.Descriptor instead.
+func (*AgentConfig) Descriptor() ([]byte, []int) {
+	return file_pkg_api_telemetry_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *AgentConfig) GetVersion() uint64 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *AgentConfig) GetInterval() *durationpb.Duration {
+	if x != nil {
+		return x.Interval
+	}
+	return nil
+}
+
+func (x *AgentConfig) GetCollectors() []string {
+	if x != nil {
+		return x.Collectors
+	}
+	return nil
+}
+
+func (x *AgentConfig) GetProbeTargets() []string {
+	if x != nil {
+		return x.ProbeTargets
+	}
+	return nil
+}
+
+// ServerMessage is sent from the server to an agent over the metrics stream.
+type ServerMessage struct {
+	state  protoimpl.MessageState `protogen:"open.v1"`
+	Config *AgentConfig           `protobuf:"bytes,1,opt,name=config,proto3" json:"config,omitempty"`
+	// Agent the message is meant for. Streams carrying samples of several agents, such as
+	// those from a relay, route messages by it.
+	AgentId       string `protobuf:"bytes,2,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ServerMessage) Reset() {
+	*x = ServerMessage{}
+	mi := &file_pkg_api_telemetry_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ServerMessage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ServerMessage) ProtoMessage() {}
+
+func (x *ServerMessage) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_api_telemetry_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ServerMessage.ProtoReflect.Descriptor instead.
+func (*ServerMessage) Descriptor() ([]byte, []int) {
+	return file_pkg_api_telemetry_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *ServerMessage) GetConfig() *AgentConfig {
+	if x != nil {
+		return x.Config
+	}
+	return nil
+}
+
+func (x *ServerMessage) GetAgentId() string {
+	if x != nil {
+		return x.AgentId
+	}
+	return ""
+}
+
+// EnrollRequest exchanges a one-time bootstrap token for a per-agent credential.
+type EnrollRequest struct {
+	state          protoimpl.MessageState `protogen:"open.v1"`
+	AgentId        string                 `protobuf:"bytes,1,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
+	BootstrapToken string                 `protobuf:"bytes,2,opt,name=bootstrap_token,json=bootstrapToken,proto3" json:"bootstrap_token,omitempty"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
+}
+
+func (x *EnrollRequest) Reset() {
+	*x = EnrollRequest{}
+	mi := &file_pkg_api_telemetry_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *EnrollRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*EnrollRequest) ProtoMessage() {}
+
+func (x *EnrollRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_api_telemetry_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use EnrollRequest.ProtoReflect.Descriptor instead.
+func (*EnrollRequest) Descriptor() ([]byte, []int) {
+	return file_pkg_api_telemetry_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *EnrollRequest) GetAgentId() string {
+	if x != nil {
+		return x.AgentId
+	}
+	return ""
+}
+
+func (x *EnrollRequest) GetBootstrapToken() string {
+	if x != nil {
+		return x.BootstrapToken
+	}
+	return ""
+}
+
+type EnrollResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Bearer token the agent presents on StreamMetrics from now on.
+	Token string `protobuf:"bytes,1,opt,name=token,proto3" json:"token,omitempty"`
+	// When the token stops being accepted; unset when it does not expire.
+	ExpiresAt     *timestamppb.Timestamp `protobuf:"bytes,2,opt,name=expires_at,json=expiresAt,proto3" json:"expires_at,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *EnrollResponse) Reset() {
+	*x = EnrollResponse{}
+	mi := &file_pkg_api_telemetry_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *EnrollResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*EnrollResponse) ProtoMessage() {}
+
+func (x *EnrollResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_api_telemetry_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use EnrollResponse.ProtoReflect.Descriptor instead.
+func (*EnrollResponse) Descriptor() ([]byte, []int) {
+	return file_pkg_api_telemetry_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *EnrollResponse) GetToken() string {
+	if x != nil {
+		return x.Token
+	}
+	return ""
+}
+
+func (x *EnrollResponse) GetExpiresAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.ExpiresAt
+	}
+	return nil
+}
+
 var File_pkg_api_telemetry_proto protoreflect.FileDescriptor
 
 const file_pkg_api_telemetry_proto_rawDesc = "" +
 	"\n" +
-	"\x17pkg/api/telemetry.proto\x12\x03api\x1a\x1fgoogle/protobuf/timestamp.proto\"\xcb\x03\n" +
+	"\x17pkg/api/telemetry.proto\x12\x03api\x1a\x1egoogle/protobuf/duration.proto\x1a\x1fgoogle/protobuf/timestamp.proto\"\xed\x05\n" +
 	"\x06Metric\x12\x1b\n" +
 	"\tcpu_usage\x18\x01 \x01(\x01R\bcpuUsage\x12!\n" +
 	"\fmemory_usage\x18\x02 \x01(\x04R\vmemoryUsage\x12(\n" +
@@ -174,9 +442,37 @@ const file_pkg_api_telemetry_proto_rawDesc = "" +
 	"\vload_avg_15\x18\n" +
 	" \x01(\x01R\tloadAvg15\x12&\n" +
 	"\x0fdisk_read_bytes\x18\v \x01(\x04R\rdiskReadBytes\x12(\n" +
-	"\x10disk_write_bytes\x18\f \x01(\x04R\x0ediskWriteBytes2<\n" +
-	"\tTelemetry\x12/\n" +
-	"\rStreamMetrics\x12\v.api.Metric\x1a\v.api.Metric\"\x00(\x010\x01B\tZ\apkg/apib\x06proto3"
+	"\x10disk_write_bytes\x18\f \x01(\x04R\x0ediskWriteBytes\x12/\n" +
+	"\x06labels\x18\r \x03(\v2\x17.api.Metric.LabelsEntryR\x06labels\x12%\n" +
+	"\x0econfig_version\x18\x0e \x01(\x04R\rconfigVersion\x12!\n" +
+	"\fconfig_error\x18\x0f \x01(\tR\vconfigError\x12/\n" +
+	"\x06values\x18\x10 \x03(\v2\x17.api.Metric.ValuesEntryR\x06values\x1a9\n" +
+	"\vLabelsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\x1a9\n" +
+	"\vValuesEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\x01R\x05value:\x028\x01\"\xa3\x01\n" +
+	"\vAgentConfig\x12\x18\n" +
+	"\aversion\x18\x01 \x01(\x04R\aversion\x125\n" +
+	"\binterval\x18\x02 \x01(\v2\x19.google.protobuf.DurationR\binterval\x12\x1e\n" +
+	"\n" +
+	"collectors\x18\x03 \x03(\tR\n" +
+	"collectors\x12#\n" +
+	"\rprobe_targets\x18\x04 \x03(\tR\fprobeTargets\"T\n" +
+	"\rServerMessage\x12(\n" +
+	"\x06config\x18\x01 \x01(\v2\x10.api.AgentConfigR\x06config\x12\x19\n" +
+	"\bagent_id\x18\x02 \x01(\tR\aagentId\"S\n" +
+	"\rEnrollRequest\x12\x19\n" +
+	"\bagent_id\x18\x01 \x01(\tR\aagentId\x12'\n" +
+	"\x0fbootstrap_token\x18\x02 \x01(\tR\x0ebootstrapToken\"a\n" +
+	"\x0eEnrollResponse\x12\x14\n" +
+	"\x05token\x18\x01 \x01(\tR\x05token\x129\n" +
+	"\n" +
+	"expires_at\x18\x02 \x01(\v2\x1a.google.protobuf.TimestampR\texpiresAt2x\n" +
+	"\tTelemetry\x126\n" +
+	"\rStreamMetrics\x12\v.api.Metric\x1a\x12.api.ServerMessage\"\x00(\x010\x01\x123\n" +
+	"\x06Enroll\x12\x12.api.EnrollRequest\x1a\x13.api.EnrollResponse\"\x00B\tZ\apkg/apib\x06proto3"
 
 var (
 	file_pkg_api_telemetry_proto_rawDescOnce sync.Once
@@ -190,20 +486,34 @@ func file_pkg_api_telemetry_proto_rawDescGZIP() []byte {
 	return file_pkg_api_telemetry_proto_rawDescData
 }
 
-var file_pkg_api_telemetry_proto_msgTypes = make([]protoimpl.MessageInfo, 1)
+var file_pkg_api_telemetry_proto_msgTypes = make([]protoimpl.MessageInfo, 7)
 var file_pkg_api_telemetry_proto_goTypes = []any{
 	(*Metric)(nil),                // 0: api.Metric
-	(*timestamppb.Timestamp)(nil), // 1: google.protobuf.Timestamp
+	(*AgentConfig)(nil),           // 1: api.AgentConfig
+	(*ServerMessage)(nil),         // 2: api.ServerMessage
+	(*EnrollRequest)(nil),         // 3: api.EnrollRequest
+	(*EnrollResponse)(nil),        // 4: api.EnrollResponse
+	nil,                           // 5: api.Metric.LabelsEntry
+	nil,                           // 6: api.Metric.ValuesEntry
+	(*timestamppb.Timestamp)(nil), // 7: google.protobuf.Timestamp
+	(*durationpb.Duration)(nil),   // 8: google.protobuf.Duration
 }
 var file_pkg_api_telemetry_proto_depIdxs = []int32{
-	1, // 0: api.Metric.collected_at:type_name -> google.protobuf.Timestamp
-	0, // 1: api.Telemetry.StreamMetrics:input_type -> api.Metric
-	0, // 2: api.Telemetry.StreamMetrics:output_type -> api.Metric
-	2, // [2:3] is the sub-list for method output_type
-	1, // [1:2] is the sub-list for method input_type
-	1, // [1:1] is the sub-list for extension type_name
-	1, // [1:1] is the sub-list for extension extendee
-	0, // [0:1] is the sub-list for field type_name
+	7, // 0: api.Metric.collected_at:type_name -> google.protobuf.Timestamp
+	5, // 1: api.Metric.labels:type_name -> api.Metric.LabelsEntry
+	6, // 2: api.Metric.values:type_name -> api.Metric.ValuesEntry
+	8, // 3: api.AgentConfig.interval:type_name -> google.protobuf.Duration
+	1, // 4: api.ServerMessage.config:type_name -> api.AgentConfig
+	7, // 5: api.EnrollResponse.expires_at:type_name -> google.protobuf.Timestamp
+	0, // 6: api.Telemetry.StreamMetrics:input_type -> api.Metric
+	3, // 7: api.Telemetry.Enroll:input_type -> api.EnrollRequest
+	2, // 8: api.Telemetry.StreamMetrics:output_type -> api.ServerMessage
+	4, // 9: api.Telemetry.Enroll:output_type -> api.EnrollResponse
+	8, // [8:10] is the sub-list for method output_type
+	6, // [6:8] is the sub-list for method input_type
+	6, // [6:6] is the sub-list for extension type_name
+	6, // [6:6] is the sub-list for extension extendee
+	0, // [0:6] is the sub-list for field type_name
 }
 
 func init() { file_pkg_api_telemetry_proto_init() }
@@ -217,7 +527,7 @@ func file_pkg_api_telemetry_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_pkg_api_telemetry_proto_rawDesc), len(file_pkg_api_telemetry_proto_rawDesc)),
 			NumEnums:      0,
-			NumMessages:   1,
+			NumMessages:   7,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
@@ -20,13 +20,15 @@ const _ = grpc.SupportPackageIsVersion9
 
 const (
 	Telemetry_StreamMetrics_FullMethodName = "/api.Telemetry/StreamMetrics"
+	Telemetry_Enroll_FullMethodName        = "/api.Telemetry/Enroll"
 )
 
 // TelemetryClient is the client API for Telemetry service.
 //
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type TelemetryClient interface {
-	StreamMetrics(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[Metric, Metric], error)
+	StreamMetrics(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[Metric, ServerMessage], error)
+	Enroll(ctx context.Context, in *EnrollRequest, opts ...grpc.CallOption) (*EnrollResponse, error)
 }
 
 type telemetryClient struct {
@@ -37,24 +39,35 @@ func NewTelemetryClient(cc grpc.ClientConnInterface) TelemetryClient {
 	return &telemetryClient{cc}
 }
 
-func (c *telemetryClient) StreamMetrics(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[Metric, Metric], error) {
+func (c *telemetryClient) StreamMetrics(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[Metric, ServerMessage], error) {
 	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
 	stream, err := c.cc.NewStream(ctx, &Telemetry_ServiceDesc.Streams[0], Telemetry_StreamMetrics_FullMethodName, cOpts...)
 	if err != nil {
 		return nil, err
 	}
-	x := &grpc.GenericClientStream[Metric, Metric]{ClientStream: stream}
+	x := &grpc.GenericClientStream[Metric, ServerMessage]{ClientStream: stream}
 	return x, nil
 }
 
 // This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
-type Telemetry_StreamMetricsClient = grpc.BidiStreamingClient[Metric, Metric]
+type Telemetry_StreamMetricsClient = grpc.BidiStreamingClient[Metric, ServerMessage]
+
+func (c *telemetryClient) Enroll(ctx context.Context, in *EnrollRequest, opts ...grpc.CallOption) (*EnrollResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(EnrollResponse)
+	err := c.cc.Invoke(ctx, Telemetry_Enroll_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
 
 // TelemetryServer is the server API for Telemetry service.
 // All implementations must embed UnimplementedTelemetryServer
 // for forward compatibility.
 type TelemetryServer interface {
-	StreamMetrics(grpc.BidiStreamingServer[Metric, Metric]) error
+	StreamMetrics(grpc.BidiStreamingServer[Metric, ServerMessage]) error
+	Enroll(context.Context, *EnrollRequest) (*EnrollResponse, error)
 	mustEmbedUnimplementedTelemetryServer()
 }
 
@@ -65,9 +78,12 @@ type TelemetryServer interface {
 // pointer dereference when methods are called.
 type UnimplementedTelemetryServer struct{}
 
-func (UnimplementedTelemetryServer) StreamMetrics(grpc.BidiStreamingServer[Metric, Metric]) error {
+func (UnimplementedTelemetryServer) StreamMetrics(grpc.BidiStreamingServer[Metric, ServerMessage]) error {
 	return status.Errorf(codes.Unimplemented, "method StreamMetrics not implemented")
 }
+func (UnimplementedTelemetryServer) Enroll(context.Context, *EnrollRequest) (*EnrollResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Enroll not implemented")
+}
 func (UnimplementedTelemetryServer) mustEmbedUnimplementedTelemetryServer() {}
 func (UnimplementedTelemetryServer) testEmbeddedByValue()                   {}
 
@@ -90,11 +106,29 @@ func RegisterTelemetryServer(s grpc.ServiceRegistrar, srv TelemetryServer) {
 }
 
 func _Telemetry_StreamMetrics_Handler(srv interface{}, stream grpc.ServerStream) error {
-	return srv.(TelemetryServer).StreamMetrics(&grpc.GenericServerStream[Metric, Metric]{ServerStream: stream})
+	return srv.(TelemetryServer).StreamMetrics(&grpc.GenericServerStream[Metric, ServerMessage]{ServerStream: stream})
 }
 
 // This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
-type Telemetry_StreamMetricsServer = grpc.BidiStreamingServer[Metric, Metric]
+type Telemetry_StreamMetricsServer = grpc.BidiStreamingServer[Metric, ServerMessage]
+
+func _Telemetry_Enroll_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(EnrollRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TelemetryServer).Enroll(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Telemetry_Enroll_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TelemetryServer).Enroll(ctx, req.(*EnrollRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
 
 // Telemetry_ServiceDesc is the grpc.ServiceDesc for Telemetry service.
 // It's only intended for direct use with grpc.RegisterService,
@@ -102,7 +136,12 @@ type Telemetry_StreamMetricsServer = grpc.BidiStreamingServer[Metric, Metric]
 var Telemetry_ServiceDesc = grpc.ServiceDesc{
 	ServiceName: "api.Telemetry",
 	HandlerType: (*TelemetryServer)(nil),
-	Methods:     []grpc.MethodDesc{},
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Enroll",
+			Handler:    _Telemetry_Enroll_Handler,
+		},
+	},
 	Streams: []grpc.StreamDesc{
 		{
 			StreamName:    "StreamMetrics",
@@ -15,6 +15,8 @@ export interface TelemetryRecord {
   loadAvg1: number;
   loadAvg5: number;
   loadAvg15: number;
+  labels?: Record<string, string>;
+  values?: Record<string, number>;
 }
 
 export interface AgentSummary {